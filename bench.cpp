@@ -0,0 +1,307 @@
+/*
+    netcode.io reference implementation
+
+    Copyright © 2017, The Network Protocol Company, Inc.
+
+    Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+        1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+        2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer 
+           in the documentation and/or other materials provided with the distribution.
+
+        3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived 
+           from this software without specific prior written permission.
+
+    THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, 
+    INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE 
+    DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, 
+    SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR 
+    SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, 
+    WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+    USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+
+// benchmarks pull in netcode.c directly, like test.cpp, so they can time the internal packet and token functions on the server receive path
+
+#include "netcode.h"
+#include "netcode.c"
+#include <stdio.h>
+#include <stdlib.h>
+#include <assert.h>
+
+#define BENCH_PROTOCOL_ID 0x1122334455667788ULL
+#define BENCH_ITERATIONS 100000
+
+static uint8_t bench_private_key[NETCODE_KEY_BYTES];
+
+static void bench_report( NETCODE_CONST char * name, int iterations, double start_time, int bytes )
+{
+    double elapsed = netcode_time() - start_time;
+    double nanoseconds = elapsed * 1000000000.0 / iterations;
+    printf( "%-32s %10d iterations %10.1f ns/op", name, iterations, nanoseconds );
+    if ( bytes > 0 )
+    {
+        printf( " %8.1f MB/s", ( (double) bytes ) * iterations / elapsed / ( 1024.0 * 1024.0 ) );
+    }
+    printf( "\n" );
+}
+
+static void bench_write_payload_packet( int payload_bytes )
+{
+    struct netcode_connection_payload_packet_t * packet = netcode_create_payload_packet( payload_bytes, NULL, NULL );
+    memset( packet->payload_data, 0x42, payload_bytes );
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( packet_key );
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    double start_time = netcode_time();
+
+    int i;
+    for ( i = 0; i < BENCH_ITERATIONS; ++i )
+    {
+        int bytes_written = netcode_write_packet( packet, buffer, sizeof( buffer ), i, packet_key, NETCODE_VERSION_INFO, BENCH_PROTOCOL_ID );
+        assert( bytes_written > 0 );
+        (void) bytes_written;
+    }
+
+    char name[64];
+    snprintf( name, sizeof( name ), "write payload packet (%d)", payload_bytes );
+    bench_report( name, BENCH_ITERATIONS, start_time, payload_bytes );
+
+    free( packet );
+}
+
+static void bench_read_payload_packet( int payload_bytes )
+{
+    struct netcode_connection_payload_packet_t * packet = netcode_create_payload_packet( payload_bytes, NULL, NULL );
+    memset( packet->payload_data, 0x42, payload_bytes );
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( packet_key );
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    int packet_bytes = netcode_write_packet( packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, BENCH_PROTOCOL_ID );
+    assert( packet_bytes > 0 );
+
+    free( packet );
+
+    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packets, 1, sizeof( allowed_packets ) );
+
+    uint64_t current_timestamp = netcode_timestamp();
+
+    // reads decrypt in place, so each iteration reads a fresh copy
+
+    uint8_t packet_copy[NETCODE_MAX_PACKET_BYTES];
+
+    double start_time = netcode_time();
+
+    int i;
+    for ( i = 0; i < BENCH_ITERATIONS; ++i )
+    {
+        memcpy( packet_copy, buffer, packet_bytes );
+        uint64_t sequence;
+        void * output_packet = netcode_read_packet( packet_copy, packet_bytes, &sequence, packet_key, NETCODE_VERSION_INFO, BENCH_PROTOCOL_ID, current_timestamp, NULL, allowed_packets, NULL, NULL, NULL );
+        assert( output_packet );
+        free( output_packet );
+    }
+
+    char name[64];
+    snprintf( name, sizeof( name ), "read payload packet (%d)", payload_bytes );
+    bench_report( name, BENCH_ITERATIONS, start_time, payload_bytes );
+}
+
+static void bench_decrypt_connect_token_private()
+{
+    NETCODE_CONST char * server_address = "127.0.0.1:40000";
+
+    struct netcode_address_t address;
+    netcode_parse_address( server_address, &address );
+
+    struct netcode_connect_token_private_t connect_token_private;
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    memset( user_data, 0, sizeof( user_data ) );
+    netcode_generate_connect_token_private( &connect_token_private, 1, 5, 1, &address, user_data );
+
+    uint8_t buffer[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    netcode_write_connect_token_private( &connect_token_private, buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    uint64_t expire_timestamp = netcode_timestamp() + 30;
+    uint8_t nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    netcode_random_bytes( nonce, sizeof( nonce ) );
+
+    int result = netcode_encrypt_connect_token_private( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, NETCODE_VERSION_INFO, BENCH_PROTOCOL_ID, expire_timestamp, nonce, bench_private_key );
+    assert( result == NETCODE_OK );
+    (void) result;
+
+    uint8_t buffer_copy[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+
+    double start_time = netcode_time();
+
+    int i;
+    for ( i = 0; i < BENCH_ITERATIONS; ++i )
+    {
+        memcpy( buffer_copy, buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+        result = netcode_decrypt_connect_token_private( buffer_copy, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, NETCODE_VERSION_INFO, BENCH_PROTOCOL_ID, expire_timestamp, nonce, bench_private_key );
+        assert( result == NETCODE_OK );
+        struct netcode_connect_token_private_t output;
+        result = netcode_read_connect_token_private( buffer_copy, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &output );
+        assert( result == NETCODE_OK );
+    }
+
+    bench_report( "decrypt connect token private", BENCH_ITERATIONS, start_time, 0 );
+}
+
+static void bench_server_process_payload_packet( int payload_bytes, int num_clients )
+{
+    // connect clients through the network simulator, then feed payload packets sealed with the last client's keys straight into the server
+
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = BENCH_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, bench_private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+    assert( server );
+
+    netcode_server_start( server, num_clients );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client[NETCODE_MAX_CLIENTS];
+
+    int i;
+    for ( i = 0; i < num_clients; ++i )
+    {
+        char client_address[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+        snprintf( client_address, sizeof( client_address ), "[::]:%d", 50000 + i );
+        client[i] = netcode_client_create( client_address, &client_config, time );
+        assert( client[i] );
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+        int result = netcode_generate_connect_token( 1, &server_address, &server_address, 30, 5, 1000 + i, BENCH_PROTOCOL_ID, bench_private_key, NULL, connect_token );
+        assert( result == NETCODE_OK );
+        (void) result;
+
+        netcode_client_connect( client[i], connect_token );
+    }
+
+    int iteration;
+    for ( iteration = 0; iteration < 100; ++iteration )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        for ( i = 0; i < num_clients; ++i )
+        {
+            netcode_client_update( client[i], time );
+        }
+
+        netcode_server_update( server, time );
+
+        if ( netcode_server_num_connected_clients( server ) == num_clients )
+            break;
+
+        time += 0.1;
+    }
+
+    assert( netcode_server_num_connected_clients( server ) == num_clients );
+
+    struct netcode_client_t * sender = client[num_clients-1];
+
+    struct netcode_connection_payload_packet_t * packet = netcode_create_payload_packet( payload_bytes, NULL, NULL );
+    memset( packet->payload_data, 0x42, payload_bytes );
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    // sequence numbers must move forward for replay protection, so packets are sealed ahead of time
+
+    const int num_packets = 10000;
+
+    uint8_t * packet_data = (uint8_t*) malloc( num_packets * NETCODE_MAX_PACKET_BYTES );
+    int * packet_bytes = (int*) malloc( num_packets * sizeof( int ) );
+
+    for ( i = 0; i < num_packets; ++i )
+    {
+        packet_bytes[i] = netcode_write_packet( packet, buffer, sizeof( buffer ), sender->sequence++, sender->context.write_packet_key, NETCODE_VERSION_INFO, BENCH_PROTOCOL_ID );
+        assert( packet_bytes[i] > 0 );
+        memcpy( packet_data + i * NETCODE_MAX_PACKET_BYTES, buffer, packet_bytes[i] );
+    }
+
+    free( packet );
+
+    double start_time = netcode_time();
+
+    for ( i = 0; i < num_packets; ++i )
+    {
+        netcode_server_process_packet( server, &sender->address, packet_data + i * NETCODE_MAX_PACKET_BYTES, packet_bytes[i] );
+
+        int received_bytes;
+        uint64_t packet_sequence;
+        void * received_packet = netcode_server_receive_packet( server, num_clients - 1, &received_bytes, &packet_sequence );
+        assert( received_packet );
+        netcode_server_free_packet( server, received_packet );
+    }
+
+    char name[64];
+    snprintf( name, sizeof( name ), "server payload (%d, %d clients)", payload_bytes, num_clients );
+    bench_report( name, num_packets, start_time, payload_bytes );
+
+    free( packet_data );
+    free( packet_bytes );
+
+    netcode_server_destroy( server );
+
+    for ( i = 0; i < num_clients; ++i )
+    {
+        netcode_client_destroy( client[i] );
+    }
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+int main( int argc, char ** argv )
+{
+    (void) argc;
+    (void) argv;
+
+    printf( "\n" );
+
+    if ( netcode_init() != NETCODE_OK )
+    {
+        printf( "error: failed to initialize netcode.io\n" );
+        return 1;
+    }
+
+    netcode_log_level( NETCODE_LOG_LEVEL_NONE );
+
+    netcode_generate_key( bench_private_key );
+
+    bench_write_payload_packet( 100 );
+    bench_write_payload_packet( NETCODE_MAX_PACKET_SIZE );
+    bench_read_payload_packet( 100 );
+    bench_read_payload_packet( NETCODE_MAX_PACKET_SIZE );
+    bench_decrypt_connect_token_private();
+    bench_server_process_payload_packet( 100, 1 );
+    bench_server_process_payload_packet( 100, 64 );
+    bench_server_process_payload_packet( NETCODE_MAX_PACKET_SIZE, 64 );
+
+    netcode_term();
+
+    printf( "\n" );
+
+    return 0;
+}
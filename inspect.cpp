@@ -0,0 +1,294 @@
+
+/*
+    netcode.io reference implementation
+
+    Copyright © 2017, The Network Protocol Company, Inc.
+
+    Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+        1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+        2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer 
+           in the documentation and/or other materials provided with the distribution.
+
+        3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived 
+           from this software without specific prior written permission.
+
+    THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, 
+    INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE 
+    DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, 
+    SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR 
+    SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, 
+    WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+    USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// inspect pulls in netcode.c directly, like test.cpp, so it can decrypt the private part of connect tokens with the same code the server uses
+
+#include "netcode.h"
+#include "netcode.c"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <inttypes.h>
+
+// the same key as the client and server examples
+
+static uint8_t private_key[NETCODE_KEY_BYTES] = { 0x60, 0x6a, 0xbe, 0x6e, 0xc9, 0x19, 0x10, 0xea, 
+                                                  0x9a, 0x65, 0x62, 0xf6, 0x6f, 0x2b, 0x30, 0xe4, 
+                                                  0x43, 0x71, 0xd6, 0x2c, 0xd1, 0x99, 0x27, 0x26,
+                                                  0x6b, 0x3c, 0x60, 0xf4, 0xb7, 0x15, 0xab, 0xa1 };
+
+#define MAX_INPUT_BYTES 4096
+
+static void usage()
+{
+    printf( "usage: inspect [options] [base64]\n\n" );
+    printf( "decodes a base64 connect token, or a captured connection request packet, and prints what is inside.\n" );
+    printf( "reads the base64 from stdin when it isn't given on the command line\n\n" );
+    printf( "    -key-file <path>       private key, as %d raw bytes or base64 (default: the example key)\n", NETCODE_KEY_BYTES );
+}
+
+static int read_key_file( NETCODE_CONST char * path, uint8_t * key )
+{
+    FILE * file = fopen( path, "rb" );
+    if ( !file )
+        return 0;
+
+    char buffer[256];
+    int bytes_read = (int) fread( buffer, 1, sizeof( buffer ) - 1, file );
+    fclose( file );
+
+    if ( bytes_read == NETCODE_KEY_BYTES )
+    {
+        memcpy( key, buffer, NETCODE_KEY_BYTES );
+        return 1;
+    }
+
+    while ( bytes_read > 0 && ( buffer[bytes_read-1] == '\n' || buffer[bytes_read-1] == '\r' || buffer[bytes_read-1] == ' ' ) )
+        bytes_read--;
+
+    buffer[bytes_read] = '\0';
+
+    uint8_t decoded[NETCODE_KEY_BYTES+2];
+
+    if ( netcode_base64_decode_data( buffer, decoded, sizeof( decoded ) ) != NETCODE_KEY_BYTES )
+        return 0;
+
+    memcpy( key, decoded, NETCODE_KEY_BYTES );
+
+    return 1;
+}
+
+static void print_hex( NETCODE_CONST char * name, NETCODE_CONST uint8_t * data, int bytes )
+{
+    printf( "    %-24s", name );
+    int i;
+    for ( i = 0; i < bytes; ++i )
+    {
+        if ( i > 0 && i % 32 == 0 )
+            printf( "\n    %-24s", "" );
+        printf( "%02x", data[i] );
+    }
+    printf( "\n" );
+}
+
+static void print_timestamp( NETCODE_CONST char * name, uint64_t timestamp, uint64_t now )
+{
+    time_t t = (time_t) timestamp;
+    struct tm * tm = gmtime( &t );
+    char string[64];
+    if ( !tm || strftime( string, sizeof( string ), "%Y-%m-%d %H:%M:%S UTC", tm ) == 0 )
+        snprintf( string, sizeof( string ), "?" );
+
+    if ( timestamp >= now )
+        printf( "    %-24s%" PRIu64 " (%s, %" PRIu64 " seconds from now)\n", name, timestamp, string, timestamp - now );
+    else
+        printf( "    %-24s%" PRIu64 " (%s, %" PRIu64 " seconds ago)\n", name, timestamp, string, now - timestamp );
+}
+
+static void print_addresses( NETCODE_CONST char * name, struct netcode_address_t * addresses, int num_addresses )
+{
+    int i;
+    for ( i = 0; i < num_addresses; ++i )
+    {
+        char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+        printf( "    %-24s%s\n", i == 0 ? name : "", netcode_address_to_string( &addresses[i], address_string ) );
+    }
+}
+
+static void print_private_data( uint8_t * private_data, uint8_t * version_info, uint64_t protocol_id, uint64_t expire_timestamp, uint8_t * nonce, uint64_t sequence, int version_1_01 )
+{
+    // decryption is done in place, so work on a copy
+
+    uint8_t buffer[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    memcpy( buffer, private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    int result = version_1_01 ? 
+        netcode_decrypt_connect_token_private_1_01( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, version_info, protocol_id, expire_timestamp, sequence, private_key ) : 
+        netcode_decrypt_connect_token_private( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, version_info, protocol_id, expire_timestamp, nonce, private_key );
+
+    printf( "\nprivate data\n" );
+
+    if ( result != NETCODE_OK )
+    {
+        printf( "    failed to decrypt. the private key is wrong, or the protocol id or expire timestamp was tampered with\n" );
+        return;
+    }
+
+    struct netcode_connect_token_private_t connect_token_private;
+    if ( netcode_read_connect_token_private( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &connect_token_private ) != NETCODE_OK )
+    {
+        printf( "    decrypted, but failed to read. the token was minted with a bad server address list\n" );
+        return;
+    }
+
+    printf( "    %-24s0x%.16" PRIx64 "\n", "client id", connect_token_private.client_id );
+    printf( "    %-24s%d\n", "timeout seconds", connect_token_private.timeout_seconds );
+    print_addresses( "server addresses", connect_token_private.server_addresses, connect_token_private.num_server_addresses );
+    print_hex( "client to server key", connect_token_private.client_to_server_key, NETCODE_KEY_BYTES );
+    print_hex( "server to client key", connect_token_private.server_to_client_key, NETCODE_KEY_BYTES );
+    print_hex( "user data", connect_token_private.user_data, NETCODE_USER_DATA_BYTES );
+}
+
+static int inspect_connect_token( uint8_t * data, int bytes )
+{
+    struct netcode_connect_token_t connect_token;
+    if ( netcode_read_connect_token( data, bytes, &connect_token ) != NETCODE_OK )
+    {
+        fprintf( stderr, "error: failed to read connect token\n" );
+        return 0;
+    }
+
+    uint64_t now = netcode_timestamp();
+
+    printf( "connect token\n" );
+    printf( "    %-24s%s\n", "version info", (char*) connect_token.version_info );
+    printf( "    %-24s0x%.16" PRIx64 "\n", "protocol id", connect_token.protocol_id );
+    print_timestamp( "create timestamp", connect_token.create_timestamp, now );
+    print_timestamp( "expire timestamp", connect_token.expire_timestamp, now );
+    printf( "    %-24s%d\n", "timeout seconds", connect_token.timeout_seconds );
+    print_addresses( "server addresses", connect_token.server_addresses, connect_token.num_server_addresses );
+    print_hex( "nonce", connect_token.nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    print_hex( "client to server key", connect_token.client_to_server_key, NETCODE_KEY_BYTES );
+    print_hex( "server to client key", connect_token.server_to_client_key, NETCODE_KEY_BYTES );
+
+    print_private_data( connect_token.private_data, connect_token.version_info, connect_token.protocol_id, connect_token.expire_timestamp, connect_token.nonce, 0, 0 );
+
+    return 1;
+}
+
+static int inspect_connection_request_packet( uint8_t * data, int bytes )
+{
+    if ( bytes < 1 + NETCODE_VERSION_INFO_BYTES || data[0] != NETCODE_CONNECTION_REQUEST_PACKET )
+    {
+        fprintf( stderr, "error: input is neither a connect token nor a connection request packet\n" );
+        return 0;
+    }
+
+    uint8_t * p = data + 1;
+
+    uint8_t version_info[NETCODE_VERSION_INFO_BYTES];
+    netcode_read_bytes( &p, version_info, NETCODE_VERSION_INFO_BYTES );
+
+    if ( version_info[NETCODE_VERSION_INFO_BYTES-1] != '\0' || bytes != netcode_connection_request_packet_bytes( version_info ) )
+    {
+        fprintf( stderr, "error: connection request packet has bad version info or length (%d bytes)\n", bytes );
+        return 0;
+    }
+
+    int version_1_01 = memcmp( version_info, NETCODE_VERSION_INFO_1_01, NETCODE_VERSION_INFO_BYTES ) == 0;
+
+    uint64_t protocol_id = netcode_read_uint64( &p );
+    uint64_t expire_timestamp = netcode_read_uint64( &p );
+
+    uint64_t sequence = 0;
+    uint8_t nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    memset( nonce, 0, sizeof( nonce ) );
+
+    if ( version_1_01 )
+        sequence = netcode_read_uint64( &p );
+    else
+        netcode_read_bytes( &p, nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+
+    printf( "connection request packet\n" );
+    printf( "    %-24s%s\n", "version info", (char*) version_info );
+    printf( "    %-24s0x%.16" PRIx64 "\n", "protocol id", protocol_id );
+    print_timestamp( "expire timestamp", expire_timestamp, netcode_timestamp() );
+    if ( version_1_01 )
+        printf( "    %-24s%" PRIu64 "\n", "sequence", sequence );
+    else
+        print_hex( "nonce", nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+
+    print_private_data( p, version_info, protocol_id, expire_timestamp, nonce, sequence, version_1_01 );
+
+    return 1;
+}
+
+int main( int argc, char ** argv )
+{
+    NETCODE_CONST char * input = NULL;
+
+    int i;
+    for ( i = 1; i < argc; ++i )
+    {
+        if ( strcmp( argv[i], "-h" ) == 0 || strcmp( argv[i], "-help" ) == 0 )
+        {
+            usage();
+            return 0;
+        }
+        else if ( strcmp( argv[i], "-key-file" ) == 0 && i + 1 < argc )
+        {
+            if ( !read_key_file( argv[++i], private_key ) )
+            {
+                fprintf( stderr, "error: could not read a %d byte private key from '%s'\n", NETCODE_KEY_BYTES, argv[i] );
+                return 1;
+            }
+        }
+        else if ( argv[i][0] != '-' && !input )
+        {
+            input = argv[i];
+        }
+        else
+        {
+            fprintf( stderr, "error: unknown option %s\n\n", argv[i] );
+            usage();
+            return 1;
+        }
+    }
+
+    static char input_buffer[MAX_INPUT_BYTES*2];
+
+    if ( !input )
+    {
+        int input_bytes = (int) fread( input_buffer, 1, sizeof( input_buffer ) - 1, stdin );
+        while ( input_bytes > 0 && ( input_buffer[input_bytes-1] == '\n' || input_buffer[input_bytes-1] == '\r' || input_buffer[input_bytes-1] == ' ' ) )
+            input_bytes--;
+        input_buffer[input_bytes] = '\0';
+        input = input_buffer;
+    }
+
+    static uint8_t data[MAX_INPUT_BYTES];
+
+    int data_bytes = netcode_base64_decode_data( input, data, sizeof( data ) );
+    if ( data_bytes <= 0 )
+    {
+        fprintf( stderr, "error: input is not valid base64\n" );
+        return 1;
+    }
+
+    if ( netcode_init() != NETCODE_OK )
+    {
+        fprintf( stderr, "error: failed to initialize netcode.io\n" );
+        return 1;
+    }
+
+    netcode_log_level( NETCODE_LOG_LEVEL_NONE );
+
+    int result = ( data_bytes == NETCODE_CONNECT_TOKEN_BYTES ) ? inspect_connect_token( data, data_bytes ) : inspect_connection_request_packet( data, data_bytes );
+
+    netcode_term();
+
+    return result ? 0 : 1;
+}
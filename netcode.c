@@ -41,14 +41,7 @@
 #define NETCODE_SOCKET_IPV6         1
 #define NETCODE_SOCKET_IPV4         2
 
-#define NETCODE_CONNECT_TOKEN_PRIVATE_BYTES 1024
-#define NETCODE_CHALLENGE_TOKEN_BYTES 300
-#define NETCODE_VERSION_INFO_BYTES 13
-#define NETCODE_USER_DATA_BYTES 256
-#define NETCODE_MAX_PACKET_BYTES 1200
-#define NETCODE_MAX_PAYLOAD_BYTES 1100
 #define NETCODE_MAX_ADDRESS_STRING_LENGTH 256
-#define NETCODE_PACKET_QUEUE_SIZE 256
 #define NETCODE_REPLAY_PROTECTION_BUFFER_SIZE 256
 #define NETCODE_CLIENT_MAX_RECEIVE_PACKETS 64
 #define NETCODE_SERVER_MAX_RECEIVE_PACKETS ( 64 * NETCODE_MAX_CLIENTS )
@@ -56,11 +49,32 @@
 #define NETCODE_CLIENT_SOCKET_RCVBUF_SIZE ( 256 * 1024 )
 #define NETCODE_SERVER_SOCKET_SNDBUF_SIZE ( 4 * 1024 * 1024 )
 #define NETCODE_SERVER_SOCKET_RCVBUF_SIZE ( 4 * 1024 * 1024 )
+#define NETCODE_SERVER_ADMIN_SOCKET_BUFFER_SIZE ( 64 * 1024 )
 
-#define NETCODE_VERSION_INFO ( (uint8_t*) "NETCODE 1.01" )
 #define NETCODE_PACKET_SEND_RATE 10.0
+
+#define NETCODE_KEEP_ALIVE_JITTER 0.25
+
+#define NETCODE_MAX_MIGRATION_ATTEMPTS_PER_SECOND 64
+#define NETCODE_MAX_MIGRATION_ATTEMPTS_PER_ADDRESS_PER_SECOND 4
+#define NETCODE_TIME_SYNC_SEND_RATE 1.0
+#define NETCODE_TIME_SYNC_SMOOTHING 0.1
 #define NETCODE_NUM_DISCONNECT_PACKETS 10
 
+#define NETCODE_MAX_DISCONNECT_PACKETS 64
+
+// global packets are sent with sequence numbers from the top half of the range, so they never share a nonce with connection
+// packets sent under the same key. connections are closed, and the global and challenge sequences stop or rekey, a margin
+// short of the end of their range, leaving room for the disconnect packets and whatever else goes out before that happens
+
+#define NETCODE_GLOBAL_SEQUENCE_START ( 1ULL << 63 )
+#define NETCODE_SEQUENCE_MARGIN ( 1ULL << 32 )
+#define NETCODE_CONNECTION_SEQUENCE_LIMIT ( NETCODE_GLOBAL_SEQUENCE_START - NETCODE_SEQUENCE_MARGIN )
+#define NETCODE_GLOBAL_SEQUENCE_LIMIT ( 0xFFFFFFFFFFFFFFFFULL - NETCODE_SEQUENCE_MARGIN )
+#define NETCODE_BANDWIDTH_LIMIT_BURST_SECONDS 0.1
+#define NETCODE_HANDSHAKE_SWEEP_INTERVAL 1.0
+#define NETCODE_WAIT_LIST_TIMEOUT 5.0
+
 #ifndef NETCODE_ENABLE_TESTS
 #define NETCODE_ENABLE_TESTS 0
 #endif // #ifndef NETCODE_ENABLE_TESTS
@@ -102,6 +116,23 @@ void netcode_set_assert_function( void (*function)( NETCODE_CONST char *, NETCOD
     netcode_assert_function = function;
 }
 
+static uint64_t netcode_default_timestamp_function()
+{
+    return (uint64_t) time( NULL );
+}
+
+static uint64_t (*timestamp_function)() = netcode_default_timestamp_function;
+
+void netcode_set_timestamp_function( uint64_t (*function)() )
+{
+    timestamp_function = function ? function : netcode_default_timestamp_function;
+}
+
+uint64_t netcode_timestamp()
+{
+    return timestamp_function();
+}
+
 #if NETCODE_ENABLE_LOGGING
 
 void netcode_printf( int level, NETCODE_CONST char * format, ... ) 
@@ -321,11 +352,51 @@ char * netcode_address_to_string( struct netcode_address_t * address, char * buf
     }
 }
 
+void netcode_address_unmap_ipv4( struct netcode_address_t * address, struct netcode_address_t * result )
+{
+    netcode_assert( address );
+    netcode_assert( result );
+
+    *result = *address;
+
+    // ::ffff:a.b.c.d is the ipv4 address a.b.c.d seen through an ipv6 socket
+
+    if ( address->type != NETCODE_ADDRESS_IPV6 )
+        return;
+
+    int i;
+    for ( i = 0; i < 5; ++i )
+    {
+        if ( address->data.ipv6[i] != 0 )
+            return;
+    }
+
+    if ( address->data.ipv6[5] != 0xFFFF )
+        return;
+
+    memset( result, 0, sizeof( struct netcode_address_t ) );
+    result->type = NETCODE_ADDRESS_IPV4;
+    result->port = address->port;
+    result->data.ipv4[0] = (uint8_t) ( address->data.ipv6[6] >> 8 );
+    result->data.ipv4[1] = (uint8_t) ( address->data.ipv6[6] & 0xFF );
+    result->data.ipv4[2] = (uint8_t) ( address->data.ipv6[7] >> 8 );
+    result->data.ipv4[3] = (uint8_t) ( address->data.ipv6[7] & 0xFF );
+}
+
 int netcode_address_equal( struct netcode_address_t * a, struct netcode_address_t * b )
 {
     netcode_assert( a );
     netcode_assert( b );
 
+    struct netcode_address_t unmapped_a;
+    struct netcode_address_t unmapped_b;
+
+    netcode_address_unmap_ipv4( a, &unmapped_a );
+    netcode_address_unmap_ipv4( b, &unmapped_b );
+
+    a = &unmapped_a;
+    b = &unmapped_b;
+
     if ( a->type != b->type )
         return 0;
 
@@ -358,6 +429,30 @@ int netcode_address_equal( struct netcode_address_t * a, struct netcode_address_
     return 1;
 }
 
+int netcode_address_is_loopback( struct netcode_address_t * address )
+{
+    netcode_assert( address );
+
+    struct netcode_address_t unmapped;
+    netcode_address_unmap_ipv4( address, &unmapped );
+
+    if ( unmapped.type == NETCODE_ADDRESS_IPV4 )
+        return unmapped.data.ipv4[0] == 127;
+
+    if ( unmapped.type == NETCODE_ADDRESS_IPV6 )
+    {
+        int i;
+        for ( i = 0; i < 7; ++i )
+        {
+            if ( unmapped.data.ipv6[i] != 0 )
+                return 0;
+        }
+        return unmapped.data.ipv6[7] == 1;
+    }
+
+    return 0;
+}
+
 // ----------------------------------------------------------------
 
 struct netcode_t
@@ -427,6 +522,9 @@ struct netcode_socket_holder_t
 #define NETCODE_SOCKET_ERROR_BIND_IPV6_FAILED                   7
 #define NETCODE_SOCKET_ERROR_GET_SOCKNAME_IPV4_FAILED           8
 #define NETCODE_SOCKET_ERROR_GET_SOCKNAME_IPV6_FAILED           7
+#define NETCODE_SOCKET_ERROR_SOCKOPT_TOS_FAILED                 9
+#define NETCODE_SOCKET_ERROR_SOCKOPT_DONT_FRAGMENT_FAILED       10
+#define NETCODE_SOCKET_ERROR_SOCKOPT_REUSE_PORT_FAILED          11
 
 void netcode_socket_destroy( struct netcode_socket_t * socket )
 {
@@ -446,7 +544,7 @@ void netcode_socket_destroy( struct netcode_socket_t * socket )
     }
 }
 
-int netcode_socket_create( struct netcode_socket_t * s, struct netcode_address_t * address, int send_buffer_size, int receive_buffer_size )
+int netcode_socket_create( struct netcode_socket_t * s, struct netcode_address_t * address, int send_buffer_size, int receive_buffer_size, int tos, int dont_fragment, int reuse_port )
 {
     netcode_assert( s );
     netcode_assert( address );
@@ -499,6 +597,85 @@ int netcode_socket_create( struct netcode_socket_t * s, struct netcode_address_t
         return NETCODE_SOCKET_ERROR_SOCKOPT_RCVBUF_FAILED;
     }
 
+    // set type of service (DSCP/ECN) if requested
+
+    if ( tos != 0 )
+    {
+        int result = -1;
+        if ( address->type == NETCODE_ADDRESS_IPV6 )
+        {
+#ifdef IPV6_TCLASS
+            result = setsockopt( s->handle, IPPROTO_IPV6, IPV6_TCLASS, (char*)&tos, sizeof(int) );
+#endif // #ifdef IPV6_TCLASS
+        }
+        else
+        {
+            result = setsockopt( s->handle, IPPROTO_IP, IP_TOS, (char*)&tos, sizeof(int) );
+        }
+
+        if ( result != 0 )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to set socket type of service\n" );
+            netcode_socket_destroy( s );
+            return NETCODE_SOCKET_ERROR_SOCKOPT_TOS_FAILED;
+        }
+    }
+
+    // set the don't fragment bit if requested, so oversized packets are dropped instead of fragmented
+
+    if ( dont_fragment )
+    {
+        int result = -1;
+        if ( address->type == NETCODE_ADDRESS_IPV6 )
+        {
+#if defined( IPV6_MTU_DISCOVER ) && defined( IPV6_PMTUDISC_DO )
+            int value = IPV6_PMTUDISC_DO;
+            result = setsockopt( s->handle, IPPROTO_IPV6, IPV6_MTU_DISCOVER, (char*)&value, sizeof(int) );
+#elif defined( IPV6_DONTFRAG )
+            int value = 1;
+            result = setsockopt( s->handle, IPPROTO_IPV6, IPV6_DONTFRAG, (char*)&value, sizeof(int) );
+#endif
+        }
+        else
+        {
+#if defined( IP_MTU_DISCOVER ) && defined( IP_PMTUDISC_DO )
+            int value = IP_PMTUDISC_DO;
+            result = setsockopt( s->handle, IPPROTO_IP, IP_MTU_DISCOVER, (char*)&value, sizeof(int) );
+#elif defined( IP_DONTFRAGMENT )
+            int value = 1;
+            result = setsockopt( s->handle, IPPROTO_IP, IP_DONTFRAGMENT, (char*)&value, sizeof(int) );
+#elif defined( IP_DONTFRAG )
+            int value = 1;
+            result = setsockopt( s->handle, IPPROTO_IP, IP_DONTFRAG, (char*)&value, sizeof(int) );
+#endif
+        }
+
+        if ( result != 0 )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to set socket don't fragment\n" );
+            netcode_socket_destroy( s );
+            return NETCODE_SOCKET_ERROR_SOCKOPT_DONT_FRAGMENT_FAILED;
+        }
+    }
+
+    // let another process bind the same port, so a new server process can take over the socket before the old one exits
+
+    if ( reuse_port )
+    {
+        int result = -1;
+#ifdef SO_REUSEPORT
+        int yes = 1;
+        result = setsockopt( s->handle, SOL_SOCKET, SO_REUSEPORT, (char*)&yes, sizeof(int) );
+#endif // #ifdef SO_REUSEPORT
+
+        if ( result != 0 )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to set socket reuse port\n" );
+            netcode_socket_destroy( s );
+            return NETCODE_SOCKET_ERROR_SOCKOPT_REUSE_PORT_FAILED;
+        }
+    }
+
     // bind to port
 
     if ( address->type == NETCODE_ADDRESS_IPV6 )
@@ -814,23 +991,35 @@ void netcode_read_bytes( uint8_t ** p, uint8_t * byte_array, int num_bytes )
 #define SODIUM_SUPPORTS_OVERLAPPING_BUFFERS 1
 #endif
 
+static void netcode_default_random_bytes_function( uint8_t * data, int bytes )
+{
+    randombytes_buf( data, bytes );
+}
+
+static void (*random_bytes_function)( uint8_t *, int ) = netcode_default_random_bytes_function;
+
+void netcode_set_random_bytes_function( void (*function)( uint8_t *, int ) )
+{
+    random_bytes_function = function ? function : netcode_default_random_bytes_function;
+}
+
 void netcode_generate_key( uint8_t * key )
 {
     netcode_assert( key );
-    randombytes_buf( key, NETCODE_KEY_BYTES );
+    random_bytes_function( key, NETCODE_KEY_BYTES );
 }
 
 void netcode_random_bytes( uint8_t * data, int bytes )
 {
     netcode_assert( data );
     netcode_assert( bytes > 0 );
-    randombytes_buf( data, bytes );
+    random_bytes_function( data, bytes );
 }
 
-int netcode_encrypt_aead( uint8_t * message, uint64_t message_length, 
-                          uint8_t * additional, uint64_t additional_length,
-                          uint8_t * nonce,
-                          NETCODE_CONST uint8_t * key )
+int netcode_encrypt_aead_chacha20poly1305( uint8_t * message, uint64_t message_length, 
+                                           uint8_t * additional, uint64_t additional_length,
+                                           uint8_t * nonce,
+                                           NETCODE_CONST uint8_t * key )
 {
     unsigned long long encrypted_length;
 
@@ -865,10 +1054,10 @@ int netcode_encrypt_aead( uint8_t * message, uint64_t message_length,
     return NETCODE_OK;
 }
 
-int netcode_decrypt_aead( uint8_t * message, uint64_t message_length, 
-                          uint8_t * additional, uint64_t additional_length,
-                          uint8_t * nonce,
-                          uint8_t * key )
+int netcode_decrypt_aead_chacha20poly1305( uint8_t * message, uint64_t message_length, 
+                                           uint8_t * additional, uint64_t additional_length,
+                                           uint8_t * nonce,
+                                           NETCODE_CONST uint8_t * key )
 {
     unsigned long long decrypted_length;
 
@@ -905,6 +1094,135 @@ int netcode_decrypt_aead( uint8_t * message, uint64_t message_length,
     return NETCODE_OK;
 }
 
+int netcode_aes256gcm_available()
+{
+    return crypto_aead_aes256gcm_is_available();
+}
+
+int netcode_encrypt_aead_aes256gcm( uint8_t * message, uint64_t message_length, 
+                                    uint8_t * additional, uint64_t additional_length,
+                                    uint8_t * nonce,
+                                    NETCODE_CONST uint8_t * key )
+{
+    netcode_assert( crypto_aead_aes256gcm_is_available() );
+
+    unsigned long long encrypted_length;
+
+    uint8_t * temp = (uint8_t*) alloca( message_length + NETCODE_MAC_BYTES );
+
+    int result = crypto_aead_aes256gcm_encrypt( temp, &encrypted_length,
+                                                message, (unsigned long long) message_length,
+                                                additional, (unsigned long long) additional_length,
+                                                NULL, nonce, key );
+    
+    if ( result != 0 )
+        return NETCODE_ERROR;
+
+    netcode_assert( encrypted_length == message_length + NETCODE_MAC_BYTES );
+
+    memcpy( message, temp, message_length + NETCODE_MAC_BYTES );
+
+    return NETCODE_OK;
+}
+
+int netcode_decrypt_aead_aes256gcm( uint8_t * message, uint64_t message_length, 
+                                    uint8_t * additional, uint64_t additional_length,
+                                    uint8_t * nonce,
+                                    NETCODE_CONST uint8_t * key )
+{
+    netcode_assert( crypto_aead_aes256gcm_is_available() );
+
+    if ( message_length < NETCODE_MAC_BYTES )
+        return NETCODE_ERROR;
+
+    unsigned long long decrypted_length;
+
+    uint8_t * temp = (uint8_t*) alloca( message_length );
+
+    int result = crypto_aead_aes256gcm_decrypt( temp, &decrypted_length,
+                                                NULL,
+                                                message, (unsigned long long) message_length,
+                                                additional, (unsigned long long) additional_length,
+                                                nonce, key );
+    
+    if ( result != 0 )
+        return NETCODE_ERROR;
+
+    netcode_assert( decrypted_length == message_length - NETCODE_MAC_BYTES );
+
+    memcpy( message, temp, decrypted_length );
+
+    return NETCODE_OK;
+}
+
+static int (*encrypt_aead_function)( uint8_t *, uint64_t, uint8_t *, uint64_t, uint8_t *, NETCODE_CONST uint8_t * ) = netcode_encrypt_aead_chacha20poly1305;
+static int (*decrypt_aead_function)( uint8_t *, uint64_t, uint8_t *, uint64_t, uint8_t *, NETCODE_CONST uint8_t * ) = netcode_decrypt_aead_chacha20poly1305;
+
+void netcode_set_aead_functions( int (*encrypt_function)( uint8_t *, uint64_t, uint8_t *, uint64_t, uint8_t *, NETCODE_CONST uint8_t * ), 
+                                 int (*decrypt_function)( uint8_t *, uint64_t, uint8_t *, uint64_t, uint8_t *, NETCODE_CONST uint8_t * ) )
+{
+    netcode_assert( ( encrypt_function == NULL ) == ( decrypt_function == NULL ) );
+    encrypt_aead_function = encrypt_function ? encrypt_function : netcode_encrypt_aead_chacha20poly1305;
+    decrypt_aead_function = decrypt_function ? decrypt_function : netcode_decrypt_aead_chacha20poly1305;
+}
+
+int netcode_encrypt_aead( uint8_t * message, uint64_t message_length, 
+                          uint8_t * additional, uint64_t additional_length,
+                          uint8_t * nonce,
+                          NETCODE_CONST uint8_t * key )
+{
+    return encrypt_aead_function( message, message_length, additional, additional_length, nonce, key );
+}
+
+int netcode_decrypt_aead( uint8_t * message, uint64_t message_length, 
+                          uint8_t * additional, uint64_t additional_length,
+                          uint8_t * nonce,
+                          NETCODE_CONST uint8_t * key )
+{
+    return decrypt_aead_function( message, message_length, additional, additional_length, nonce, key );
+}
+
+int netcode_encrypt_aead_bignonce( uint8_t * message, uint64_t message_length, 
+                                   uint8_t * additional, uint64_t additional_length,
+                                   NETCODE_CONST uint8_t * nonce,
+                                   NETCODE_CONST uint8_t * key )
+{
+    // XChaCha20-Poly1305: HChaCha20 derives a subkey from the first 16 bytes of the nonce, 
+    // then the remaining 8 bytes are the nonce for ChaCha20-Poly1305 IETF under that subkey
+
+    uint8_t subkey[NETCODE_KEY_BYTES];
+    crypto_core_hchacha20( subkey, nonce, key, NULL );
+
+    uint8_t subnonce[12];
+    memset( subnonce, 0, 4 );
+    memcpy( subnonce + 4, nonce + 16, 8 );
+
+    int result = netcode_encrypt_aead( message, message_length, additional, additional_length, subnonce, subkey );
+
+    sodium_memzero( subkey, sizeof( subkey ) );
+
+    return result;
+}
+
+int netcode_decrypt_aead_bignonce( uint8_t * message, uint64_t message_length, 
+                                   uint8_t * additional, uint64_t additional_length,
+                                   NETCODE_CONST uint8_t * nonce,
+                                   NETCODE_CONST uint8_t * key )
+{
+    uint8_t subkey[NETCODE_KEY_BYTES];
+    crypto_core_hchacha20( subkey, nonce, key, NULL );
+
+    uint8_t subnonce[12];
+    memset( subnonce, 0, 4 );
+    memcpy( subnonce + 4, nonce + 16, 8 );
+
+    int result = netcode_decrypt_aead( message, message_length, additional, additional_length, subnonce, subkey );
+
+    sodium_memzero( subkey, sizeof( subkey ) );
+
+    return result;
+}
+
 // ----------------------------------------------------------------
 
 struct netcode_connect_token_private_t
@@ -1019,8 +1337,60 @@ int netcode_encrypt_connect_token_private( uint8_t * buffer,
                                            uint8_t * version_info, 
                                            uint64_t protocol_id, 
                                            uint64_t expire_timestamp, 
-                                           uint64_t sequence, 
+                                           NETCODE_CONST uint8_t * nonce, 
+                                           NETCODE_CONST uint8_t * key )
+{
+    netcode_assert( buffer );
+    netcode_assert( buffer_length == NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+    netcode_assert( nonce );
+    netcode_assert( key );
+
+    (void) buffer_length;
+
+    uint8_t additional_data[NETCODE_VERSION_INFO_BYTES+8+8];
+    {
+        uint8_t * p = additional_data;
+        netcode_write_bytes( &p, version_info, NETCODE_VERSION_INFO_BYTES );
+        netcode_write_uint64( &p, protocol_id );
+        netcode_write_uint64( &p, expire_timestamp );
+    }
+
+    return netcode_encrypt_aead_bignonce( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES - NETCODE_MAC_BYTES, additional_data, sizeof( additional_data ), nonce, key );
+}
+
+int netcode_decrypt_connect_token_private( uint8_t * buffer, 
+                                           int buffer_length, 
+                                           uint8_t * version_info, 
+                                           uint64_t protocol_id, 
+                                           uint64_t expire_timestamp, 
+                                           NETCODE_CONST uint8_t * nonce, 
                                            NETCODE_CONST uint8_t * key )
+{
+    netcode_assert( buffer );
+    netcode_assert( buffer_length == NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+    netcode_assert( nonce );
+    netcode_assert( key );
+
+    (void) buffer_length;
+
+    uint8_t additional_data[NETCODE_VERSION_INFO_BYTES+8+8];
+    {
+        uint8_t * p = additional_data;
+        netcode_write_bytes( &p, version_info, NETCODE_VERSION_INFO_BYTES );
+        netcode_write_uint64( &p, protocol_id );
+        netcode_write_uint64( &p, expire_timestamp );
+    }
+
+    return netcode_decrypt_aead_bignonce( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, additional_data, sizeof( additional_data ), nonce, key );
+}
+
+int netcode_encrypt_connect_token_private_1_01( uint8_t * buffer, 
+                                                int buffer_length, 
+                                                uint8_t * version_info, 
+                                                uint64_t protocol_id, 
+                                                uint64_t expire_timestamp, 
+                                                uint64_t sequence, 
+                                                NETCODE_CONST uint8_t * key )
 {
     netcode_assert( buffer );
     netcode_assert( buffer_length == NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
@@ -1046,13 +1416,13 @@ int netcode_encrypt_connect_token_private( uint8_t * buffer,
     return netcode_encrypt_aead( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES - NETCODE_MAC_BYTES, additional_data, sizeof( additional_data ), nonce, key );
 }
 
-int netcode_decrypt_connect_token_private( uint8_t * buffer, 
-                                           int buffer_length, 
-                                           uint8_t * version_info, 
-                                           uint64_t protocol_id, 
-                                           uint64_t expire_timestamp, 
-                                           uint64_t sequence, 
-                                           uint8_t * key )
+int netcode_decrypt_connect_token_private_1_01( uint8_t * buffer, 
+                                                int buffer_length, 
+                                                uint8_t * version_info, 
+                                                uint64_t protocol_id, 
+                                                uint64_t expire_timestamp, 
+                                                uint64_t sequence, 
+                                                NETCODE_CONST uint8_t * key )
 {
     netcode_assert( buffer );
     netcode_assert( buffer_length == NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
@@ -1165,10 +1535,46 @@ void netcode_write_challenge_token( struct netcode_challenge_token_t * challenge
     netcode_assert( buffer - start <= NETCODE_CHALLENGE_TOKEN_BYTES - NETCODE_MAC_BYTES );
 }
 
-int netcode_encrypt_challenge_token( uint8_t * buffer, int buffer_length, uint64_t sequence, uint8_t * key )
+#define NETCODE_CHALLENGE_TOKEN_ADDITIONAL_BYTES ( 1 + 16 + 2 )
+
+int netcode_write_challenge_token_additional_data( struct netcode_address_t * address, uint8_t * additional )
+{
+    netcode_assert( address );
+    netcode_assert( additional );
+
+    // the client address goes into the additional data, so a challenge token only decrypts in a response from the address it was sent to
+
+    struct netcode_address_t unmapped;
+    netcode_address_unmap_ipv4( address, &unmapped );
+
+    uint8_t * start = additional;
+
+    netcode_write_uint8( &additional, unmapped.type );
+
+    int i;
+    if ( unmapped.type == NETCODE_ADDRESS_IPV4 )
+    {
+        for ( i = 0; i < 4; ++i )
+            netcode_write_uint8( &additional, unmapped.data.ipv4[i] );
+    }
+    else if ( unmapped.type == NETCODE_ADDRESS_IPV6 )
+    {
+        for ( i = 0; i < 8; ++i )
+            netcode_write_uint16( &additional, unmapped.data.ipv6[i] );
+    }
+
+    netcode_write_uint16( &additional, unmapped.port );
+
+    netcode_assert( additional - start <= NETCODE_CHALLENGE_TOKEN_ADDITIONAL_BYTES );
+
+    return (int) ( additional - start );
+}
+
+int netcode_encrypt_challenge_token( uint8_t * buffer, int buffer_length, uint64_t sequence, struct netcode_address_t * address, uint8_t * key )
 {
     netcode_assert( buffer );
     netcode_assert( buffer_length >= NETCODE_CHALLENGE_TOKEN_BYTES );
+    netcode_assert( address );
     netcode_assert( key );
 
     (void) buffer_length;
@@ -1180,13 +1586,17 @@ int netcode_encrypt_challenge_token( uint8_t * buffer, int buffer_length, uint64
         netcode_write_uint64( &p, sequence );
     }
 
-    return netcode_encrypt_aead( buffer, NETCODE_CHALLENGE_TOKEN_BYTES - NETCODE_MAC_BYTES, NULL, 0, nonce, key );
+    uint8_t additional[NETCODE_CHALLENGE_TOKEN_ADDITIONAL_BYTES];
+    int additional_bytes = netcode_write_challenge_token_additional_data( address, additional );
+
+    return netcode_encrypt_aead( buffer, NETCODE_CHALLENGE_TOKEN_BYTES - NETCODE_MAC_BYTES, additional, additional_bytes, nonce, key );
 }
 
-int netcode_decrypt_challenge_token( uint8_t * buffer, int buffer_length, uint64_t sequence, uint8_t * key )
+int netcode_decrypt_challenge_token( uint8_t * buffer, int buffer_length, uint64_t sequence, struct netcode_address_t * address, uint8_t * key )
 {
     netcode_assert( buffer );
     netcode_assert( buffer_length >= NETCODE_CHALLENGE_TOKEN_BYTES );
+    netcode_assert( address );
     netcode_assert( key );
 
     (void) buffer_length;
@@ -1198,7 +1608,10 @@ int netcode_decrypt_challenge_token( uint8_t * buffer, int buffer_length, uint64
         netcode_write_uint64( &p, sequence );
     }
 
-    return netcode_decrypt_aead( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, NULL, 0, nonce, key );
+    uint8_t additional[NETCODE_CHALLENGE_TOKEN_ADDITIONAL_BYTES];
+    int additional_bytes = netcode_write_challenge_token_additional_data( address, additional );
+
+    return netcode_decrypt_aead( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, additional, additional_bytes, nonce, key );
 }
 
 int netcode_read_challenge_token( uint8_t * buffer, int buffer_length, struct netcode_challenge_token_t * challenge_token )
@@ -1224,25 +1637,24 @@ int netcode_read_challenge_token( uint8_t * buffer, int buffer_length, struct ne
 
 // ----------------------------------------------------------------
 
-#define NETCODE_CONNECTION_REQUEST_PACKET           0
-#define NETCODE_CONNECTION_DENIED_PACKET            1
-#define NETCODE_CONNECTION_CHALLENGE_PACKET         2
-#define NETCODE_CONNECTION_RESPONSE_PACKET          3
-#define NETCODE_CONNECTION_KEEP_ALIVE_PACKET        4
-#define NETCODE_CONNECTION_PAYLOAD_PACKET           5
-#define NETCODE_CONNECTION_DISCONNECT_PACKET        6
-#define NETCODE_CONNECTION_NUM_PACKETS              7
-
 struct netcode_connection_request_packet_t
 {
     uint8_t packet_type;
     uint8_t version_info[NETCODE_VERSION_INFO_BYTES];
     uint64_t protocol_id;
     uint64_t connect_token_expire_timestamp;
+    uint8_t connect_token_nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
     uint64_t connect_token_sequence;
     uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
 };
 
+int netcode_connection_request_packet_bytes( uint8_t * version_info )
+{
+    if ( memcmp( version_info, NETCODE_VERSION_INFO_1_01, NETCODE_VERSION_INFO_BYTES ) == 0 )
+        return 1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + 8 + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES;
+    return 1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + NETCODE_CONNECT_TOKEN_NONCE_BYTES + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES;
+}
+
 struct netcode_connection_denied_packet_t
 {
     uint8_t packet_type;
@@ -1279,6 +1691,14 @@ struct netcode_connection_payload_packet_t
 struct netcode_connection_disconnect_packet_t
 {
     uint8_t packet_type;
+    uint8_t reason;
+};
+
+struct netcode_connection_time_sync_packet_t
+{
+    uint8_t packet_type;
+    double client_time;
+    double server_time;
 };
 
 struct netcode_connection_payload_packet_t * netcode_create_payload_packet( int payload_bytes, void * allocator_context, void* (*allocate_function)(void*,uint64_t) )
@@ -1322,7 +1742,7 @@ int netcode_sequence_number_bytes_required( uint64_t sequence )
     return 8 - i;
 }
 
-int netcode_write_packet( void * packet, uint8_t * buffer, int buffer_length, uint64_t sequence, uint8_t * write_packet_key, uint64_t protocol_id )
+int netcode_write_packet( void * packet, uint8_t * buffer, int buffer_length, uint64_t sequence, uint8_t * write_packet_key, uint8_t * version_info, uint64_t protocol_id )
 {
     netcode_assert( packet );
     netcode_assert( buffer );
@@ -1336,20 +1756,27 @@ int netcode_write_packet( void * packet, uint8_t * buffer, int buffer_length, ui
     {
         // connection request packet: first byte is zero
 
-        netcode_assert( buffer_length >= 1 + 13 + 8 + 8 + 8 + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
-
         struct netcode_connection_request_packet_t * p = (struct netcode_connection_request_packet_t*) packet;
 
+        netcode_assert( buffer_length >= netcode_connection_request_packet_bytes( p->version_info ) );
+
         uint8_t * start = buffer;
 
         netcode_write_uint8( &buffer, NETCODE_CONNECTION_REQUEST_PACKET );
         netcode_write_bytes( &buffer, p->version_info, NETCODE_VERSION_INFO_BYTES );
         netcode_write_uint64( &buffer, p->protocol_id );
         netcode_write_uint64( &buffer, p->connect_token_expire_timestamp );
-        netcode_write_uint64( &buffer, p->connect_token_sequence );
-        netcode_write_bytes( &buffer, p->connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
-
-        netcode_assert( buffer - start == 1 + 13 + 8 + 8 + 8 + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+        if ( memcmp( p->version_info, NETCODE_VERSION_INFO_1_01, NETCODE_VERSION_INFO_BYTES ) == 0 )
+        {
+            netcode_write_uint64( &buffer, p->connect_token_sequence );
+        }
+        else
+        {
+            netcode_write_bytes( &buffer, p->connect_token_nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+        }
+        netcode_write_bytes( &buffer, p->connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+        netcode_assert( buffer - start == netcode_connection_request_packet_bytes( p->version_info ) );
 
         return (int) ( buffer - start );
     }
@@ -1431,7 +1858,26 @@ int netcode_write_packet( void * packet, uint8_t * buffer, int buffer_length, ui
 
             case NETCODE_CONNECTION_DISCONNECT_PACKET:
             {
-                // ...
+                // the reason byte is an optional extension. a disconnect packet without a reason is empty
+
+                struct netcode_connection_disconnect_packet_t * p = (struct netcode_connection_disconnect_packet_t*) packet;
+
+                if ( p->reason != NETCODE_DISCONNECT_REASON_NONE )
+                {
+                    netcode_write_uint8( &buffer, p->reason );
+                }
+            }
+            break;
+
+            case NETCODE_CONNECTION_TIME_SYNC_PACKET:
+            {
+                struct netcode_connection_time_sync_packet_t * p = (struct netcode_connection_time_sync_packet_t*) packet;
+                uint64_t client_time;
+                uint64_t server_time;
+                memcpy( &client_time, &p->client_time, 8 );
+                memcpy( &server_time, &p->server_time, 8 );
+                netcode_write_uint64( &buffer, client_time );
+                netcode_write_uint64( &buffer, server_time );
             }
             break;
 
@@ -1448,7 +1894,7 @@ int netcode_write_packet( void * packet, uint8_t * buffer, int buffer_length, ui
         uint8_t additional_data[NETCODE_VERSION_INFO_BYTES+8+1];
         {
             uint8_t * p = additional_data;
-            netcode_write_bytes( &p, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+            netcode_write_bytes( &p, version_info, NETCODE_VERSION_INFO_BYTES );
             netcode_write_uint64( &p, protocol_id );
             netcode_write_uint8( &p, prefix_byte );
         }
@@ -1480,6 +1926,7 @@ struct netcode_replay_protection_t
 {
     uint64_t most_recent_sequence;
     uint64_t received_packet[NETCODE_REPLAY_PROTECTION_BUFFER_SIZE];
+    uint64_t num_replayed_packets;          // not cleared on reset, so it counts over the lifetime of the client or server
 };
 
 void netcode_replay_protection_reset( struct netcode_replay_protection_t * replay_protection )
@@ -1496,29 +1943,34 @@ int netcode_replay_protection_packet_already_received( struct netcode_replay_pro
     if ( sequence + NETCODE_REPLAY_PROTECTION_BUFFER_SIZE <= replay_protection->most_recent_sequence )
         return 1;
     
-    if ( sequence > replay_protection->most_recent_sequence )
-        replay_protection->most_recent_sequence = sequence;
-
     int index = (int) ( sequence % NETCODE_REPLAY_PROTECTION_BUFFER_SIZE );
 
     if ( replay_protection->received_packet[index] == 0xFFFFFFFFFFFFFFFFLL )
-    {
-        replay_protection->received_packet[index] = sequence;
         return 0;
-    }
 
     if ( replay_protection->received_packet[index] >= sequence )
         return 1;
     
-    replay_protection->received_packet[index] = sequence;
-
     return 0;
 }
 
+void netcode_replay_protection_advance_sequence( struct netcode_replay_protection_t * replay_protection, uint64_t sequence )
+{
+    netcode_assert( replay_protection );
+
+    if ( sequence > replay_protection->most_recent_sequence )
+        replay_protection->most_recent_sequence = sequence;
+
+    int index = (int) ( sequence % NETCODE_REPLAY_PROTECTION_BUFFER_SIZE );
+
+    replay_protection->received_packet[index] = sequence;
+}
+
 void * netcode_read_packet( uint8_t * buffer, 
                             int buffer_length, 
                             uint64_t * sequence, 
                             uint8_t * read_packet_key, 
+                            uint8_t * version_info, 
                             uint64_t protocol_id, 
                             uint64_t current_timestamp, 
                             uint8_t * private_key, 
@@ -1558,9 +2010,15 @@ void * netcode_read_packet( uint8_t * buffer,
             return NULL;
         }
 
-        if ( buffer_length != 1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + 8 + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES )
+        // 1.01 requests carry a 64 bit connect token sequence where 1.02 requests carry a 24 byte nonce
+
+        int version_1_01 = memcmp( version_info, NETCODE_VERSION_INFO_1_01, NETCODE_VERSION_INFO_BYTES ) == 0;
+
+        int expected_packet_bytes = netcode_connection_request_packet_bytes( version_info );
+
+        if ( buffer_length != expected_packet_bytes )
         {
-            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "ignored connection request packet. bad packet length (expected %d, got %d)\n", 1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + 8 + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, buffer_length );
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "ignored connection request packet. bad packet length (expected %d, got %d)\n", expected_packet_bytes, buffer_length );
             return NULL;
         }
 
@@ -1570,21 +2028,9 @@ void * netcode_read_packet( uint8_t * buffer,
             return NULL;
         }
 
-        uint8_t version_info[NETCODE_VERSION_INFO_BYTES];
-        netcode_read_bytes( &buffer, version_info, NETCODE_VERSION_INFO_BYTES );
-        if ( version_info[0]  != 'N' || 
-             version_info[1]  != 'E' || 
-             version_info[2]  != 'T' || 
-             version_info[3]  != 'C' || 
-             version_info[4]  != 'O' ||
-             version_info[5]  != 'D' ||
-             version_info[6]  != 'E' ||
-             version_info[7]  != ' ' || 
-             version_info[8]  != '1' ||
-             version_info[9]  != '.' ||
-             version_info[10] != '0' ||
-             version_info[11] != '1' ||
-             version_info[12] != '\0' )
+        uint8_t packet_version_info[NETCODE_VERSION_INFO_BYTES];
+        netcode_read_bytes( &buffer, packet_version_info, NETCODE_VERSION_INFO_BYTES );
+        if ( memcmp( packet_version_info, version_info, NETCODE_VERSION_INFO_BYTES ) != 0 )
         {
             netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "ignored connection request packet. bad version info\n" );
             return NULL;
@@ -1605,17 +2051,40 @@ void * netcode_read_packet( uint8_t * buffer,
             return NULL;
         }
 
-        uint64_t packet_connect_token_sequence = netcode_read_uint64( &buffer );
+        uint8_t packet_connect_token_nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+        memset( packet_connect_token_nonce, 0, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+        uint64_t packet_connect_token_sequence = 0;
+
+        int result;
+
+        if ( version_1_01 )
+        {
+            packet_connect_token_sequence = netcode_read_uint64( &buffer );
+
+            result = netcode_decrypt_connect_token_private_1_01( buffer, 
+                                                                 NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                                 version_info, 
+                                                                 protocol_id, 
+                                                                 packet_connect_token_expire_timestamp, 
+                                                                 packet_connect_token_sequence, 
+                                                                 private_key );
+        }
+        else
+        {
+            netcode_read_bytes( &buffer, packet_connect_token_nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+
+            result = netcode_decrypt_connect_token_private( buffer, 
+                                                            NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                            version_info, 
+                                                            protocol_id, 
+                                                            packet_connect_token_expire_timestamp, 
+                                                            packet_connect_token_nonce, 
+                                                            private_key );
+        }
 
-        netcode_assert( buffer - start == 1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + 8 );
+        netcode_assert( buffer - start == expected_packet_bytes - NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
 
-        if ( netcode_decrypt_connect_token_private( buffer, 
-                                                    NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
-                                                    version_info, 
-                                                    protocol_id, 
-                                                    packet_connect_token_expire_timestamp, 
-                                                    packet_connect_token_sequence, 
-                                                    private_key ) != NETCODE_OK )
+        if ( result != NETCODE_OK )
         {
             netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "ignored connection request packet. connect token failed to decrypt\n" );
             return NULL;
@@ -1634,10 +2103,11 @@ void * netcode_read_packet( uint8_t * buffer,
         memcpy( packet->version_info, version_info, NETCODE_VERSION_INFO_BYTES );
         packet->protocol_id = packet_protocol_id;
         packet->connect_token_expire_timestamp = packet_connect_token_expire_timestamp;
+        memcpy( packet->connect_token_nonce, packet_connect_token_nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
         packet->connect_token_sequence = packet_connect_token_sequence;
         netcode_read_bytes( &buffer, packet->connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
 
-        netcode_assert( buffer - start == 1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + 8 + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+        netcode_assert( buffer - start == expected_packet_bytes );
 
         return packet;
     }
@@ -1703,6 +2173,7 @@ void * netcode_read_packet( uint8_t * buffer,
             if ( netcode_replay_protection_packet_already_received( replay_protection, *sequence ) )
             {
                 netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "ignored connection payload packet. sequence %.16" PRIx64 " already received (replay protection)\n", *sequence );
+                replay_protection->num_replayed_packets++;
                 return NULL;
             }
         }
@@ -1712,7 +2183,7 @@ void * netcode_read_packet( uint8_t * buffer,
         uint8_t additional_data[NETCODE_VERSION_INFO_BYTES+8+1];
         {
             uint8_t * p = additional_data;
-            netcode_write_bytes( &p, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+            netcode_write_bytes( &p, version_info, NETCODE_VERSION_INFO_BYTES );
             netcode_write_uint64( &p, protocol_id );
             netcode_write_uint8( &p, prefix_byte );
         }
@@ -1738,6 +2209,14 @@ void * netcode_read_packet( uint8_t * buffer,
             return NULL;
         }
 
+        // only mark the sequence as received once the packet is known to be authentic, 
+        // otherwise forged packets could push the replay window forward and get real packets dropped
+
+        if ( replay_protection && packet_type >= NETCODE_CONNECTION_KEEP_ALIVE_PACKET )
+        {
+            netcode_replay_protection_advance_sequence( replay_protection, *sequence );
+        }
+
         int decrypted_bytes = encrypted_bytes - NETCODE_MAC_BYTES;
 
         // process the per-packet type data that was just decrypted
@@ -1872,7 +2351,7 @@ void * netcode_read_packet( uint8_t * buffer,
 
             case NETCODE_CONNECTION_DISCONNECT_PACKET:
             {
-                if ( decrypted_bytes != 0 )
+                if ( decrypted_bytes != 0 && decrypted_bytes != 1 )
                 {
                     netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "ignored connection disconnect packet. decrypted packet data is wrong size\n" );
                     return NULL;
@@ -1888,11 +2367,40 @@ void * netcode_read_packet( uint8_t * buffer,
                 }
                 
                 packet->packet_type = NETCODE_CONNECTION_DISCONNECT_PACKET;
+                packet->reason = ( decrypted_bytes == 1 ) ? netcode_read_uint8( &buffer ) : NETCODE_DISCONNECT_REASON_NONE;
                 
                 return packet;
             }
             break;
 
+            case NETCODE_CONNECTION_TIME_SYNC_PACKET:
+            {
+                if ( decrypted_bytes != 16 )
+                {
+                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "ignored connection time sync packet. decrypted packet data is wrong size\n" );
+                    return NULL;
+                }
+
+                struct netcode_connection_time_sync_packet_t * packet = (struct netcode_connection_time_sync_packet_t*) 
+                    allocate_function( allocator_context, sizeof( struct netcode_connection_time_sync_packet_t ) );
+
+                if ( !packet )
+                {
+                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "ignored connection time sync packet. could not allocate packet struct\n" );
+                    return NULL;
+                }
+
+                uint64_t client_time = netcode_read_uint64( &buffer );
+                uint64_t server_time = netcode_read_uint64( &buffer );
+
+                packet->packet_type = NETCODE_CONNECTION_TIME_SYNC_PACKET;
+                memcpy( &packet->client_time, &client_time, 8 );
+                memcpy( &packet->server_time, &server_time, 8 );
+
+                return packet;
+            }
+            break;
+
             default:
                 return NULL;
         }
@@ -1901,21 +2409,6 @@ void * netcode_read_packet( uint8_t * buffer,
 
 // ----------------------------------------------------------------
 
-struct netcode_connect_token_t
-{
-    uint8_t version_info[NETCODE_VERSION_INFO_BYTES];
-    uint64_t protocol_id;
-    uint64_t create_timestamp;
-    uint64_t expire_timestamp;
-    uint64_t sequence;
-    uint8_t private_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
-    int timeout_seconds;
-    int num_server_addresses;
-    struct netcode_address_t server_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
-    uint8_t client_to_server_key[NETCODE_KEY_BYTES];
-    uint8_t server_to_client_key[NETCODE_KEY_BYTES];
-};
-
 void netcode_write_connect_token( struct netcode_connect_token_t * connect_token, uint8_t * buffer, int buffer_length )
 {
     netcode_assert( connect_token );
@@ -1935,7 +2428,7 @@ void netcode_write_connect_token( struct netcode_connect_token_t * connect_token
 
     netcode_write_uint64( &buffer, connect_token->expire_timestamp );
 
-    netcode_write_uint64( &buffer, connect_token->sequence );
+    netcode_write_bytes( &buffer, connect_token->nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
 
     netcode_write_bytes( &buffer, connect_token->private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
 
@@ -1993,19 +2486,7 @@ int netcode_read_connect_token( uint8_t * buffer, int buffer_length, struct netc
     }
 
     netcode_read_bytes( &buffer, connect_token->version_info, NETCODE_VERSION_INFO_BYTES );
-    if ( connect_token->version_info[0]  != 'N' || 
-         connect_token->version_info[1]  != 'E' || 
-         connect_token->version_info[2]  != 'T' || 
-         connect_token->version_info[3]  != 'C' || 
-         connect_token->version_info[4]  != 'O' ||
-         connect_token->version_info[5]  != 'D' ||
-         connect_token->version_info[6]  != 'E' ||
-         connect_token->version_info[7]  != ' ' || 
-         connect_token->version_info[8]  != '1' ||
-         connect_token->version_info[9]  != '.' ||
-         connect_token->version_info[10] != '0' ||
-         connect_token->version_info[11] != '1' ||
-         connect_token->version_info[12] != '\0' )
+    if ( memcmp( connect_token->version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES ) != 0 )
     {
         connect_token->version_info[12] = '\0';
         netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: read connect data has bad version info (got %s, expected %s)\n", connect_token->version_info, NETCODE_VERSION_INFO );
@@ -2021,7 +2502,7 @@ int netcode_read_connect_token( uint8_t * buffer, int buffer_length, struct netc
     if ( connect_token->create_timestamp > connect_token->expire_timestamp )
         return NETCODE_ERROR;
     
-    connect_token->sequence = netcode_read_uint64( &buffer );
+    netcode_read_bytes( &buffer, connect_token->nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
 
     netcode_read_bytes( &buffer, connect_token->private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
 
@@ -2072,6 +2553,49 @@ int netcode_read_connect_token( uint8_t * buffer, int buffer_length, struct netc
     return NETCODE_OK;
 }
 
+void netcode_generate_signing_keys( uint8_t * signing_public_key, uint8_t * signing_private_key )
+{
+    netcode_assert( signing_public_key );
+    netcode_assert( signing_private_key );
+
+    // seed from the random bytes function, so tests that replace it get repeatable keys
+
+    uint8_t seed[crypto_sign_SEEDBYTES];
+    random_bytes_function( seed, crypto_sign_SEEDBYTES );
+    crypto_sign_seed_keypair( signing_public_key, signing_private_key, seed );
+    sodium_memzero( seed, sizeof( seed ) );
+}
+
+void netcode_sign_connect_token( uint8_t * connect_token, NETCODE_CONST uint8_t * signing_private_key )
+{
+    netcode_assert( connect_token );
+    netcode_assert( signing_private_key );
+
+    // the signature covers everything before it, including the encrypted private data, and lives at the end of the zero pad
+
+    crypto_sign_detached( connect_token + NETCODE_CONNECT_TOKEN_BYTES - NETCODE_CONNECT_TOKEN_SIGNATURE_BYTES, 
+                          NULL, 
+                          connect_token, 
+                          NETCODE_CONNECT_TOKEN_BYTES - NETCODE_CONNECT_TOKEN_SIGNATURE_BYTES, 
+                          signing_private_key );
+}
+
+int netcode_verify_connect_token( NETCODE_CONST uint8_t * connect_token, NETCODE_CONST uint8_t * signing_public_key )
+{
+    netcode_assert( connect_token );
+    netcode_assert( signing_public_key );
+
+    if ( crypto_sign_verify_detached( connect_token + NETCODE_CONNECT_TOKEN_BYTES - NETCODE_CONNECT_TOKEN_SIGNATURE_BYTES, 
+                                      connect_token, 
+                                      NETCODE_CONNECT_TOKEN_BYTES - NETCODE_CONNECT_TOKEN_SIGNATURE_BYTES, 
+                                      signing_public_key ) != 0 )
+    {
+        return NETCODE_ERROR;
+    }
+
+    return NETCODE_OK;
+}
+
 // ----------------------------------------------------------------
 
 struct netcode_packet_queue_t
@@ -2079,6 +2603,8 @@ struct netcode_packet_queue_t
     void * allocator_context;
     void * (*allocate_function)(void*,uint64_t);
     void (*free_function)(void*,void*);
+    int capacity;
+    int overflow_policy;
     int num_packets;
     int start_index;
     void * packet_data[NETCODE_PACKET_QUEUE_SIZE];
@@ -2088,7 +2614,9 @@ struct netcode_packet_queue_t
 void netcode_packet_queue_init( struct netcode_packet_queue_t * queue, 
                                 void * allocator_context, 
                                 void * (*allocate_function)(void*,uint64_t), 
-                                void (*free_function)(void*,void*) )
+                                void (*free_function)(void*,void*), 
+                                int capacity, 
+                                int overflow_policy )
 {
     if ( allocate_function == NULL )
     {
@@ -2101,10 +2629,15 @@ void netcode_packet_queue_init( struct netcode_packet_queue_t * queue,
     }
 
     netcode_assert( queue );
+    netcode_assert( capacity > 0 );
+    netcode_assert( capacity <= NETCODE_PACKET_QUEUE_SIZE );
+    netcode_assert( overflow_policy == NETCODE_PACKET_QUEUE_DROP_NEWEST || overflow_policy == NETCODE_PACKET_QUEUE_DROP_OLDEST );
 
     queue->allocator_context = allocator_context;
     queue->allocate_function = allocate_function;
     queue->free_function = free_function;
+    queue->capacity = capacity;
+    queue->overflow_policy = overflow_policy;
     queue->num_packets = 0;
     queue->start_index = 0;
     memset( queue->packet_data, 0, sizeof( queue->packet_data ) );
@@ -2116,7 +2649,7 @@ void netcode_packet_queue_clear( struct netcode_packet_queue_t * queue )
     int i;
     for ( i = 0; i < queue->num_packets; ++i )
     {
-        queue->free_function( queue->allocator_context, queue->packet_data[i] );
+        queue->free_function( queue->allocator_context, queue->packet_data[( queue->start_index + i ) % NETCODE_PACKET_QUEUE_SIZE] );
     }
     queue->num_packets = 0;
     queue->start_index = 0;
@@ -2128,16 +2661,25 @@ int netcode_packet_queue_push( struct netcode_packet_queue_t * queue, void * pac
 {
     netcode_assert( queue );
     netcode_assert( packet_data );
-    if ( queue->num_packets == NETCODE_PACKET_QUEUE_SIZE )
+    int result = 1;
+    if ( queue->num_packets == queue->capacity )
     {
-        queue->free_function( queue->allocator_context, packet_data );
-        return 0;
+        if ( queue->overflow_policy == NETCODE_PACKET_QUEUE_DROP_NEWEST )
+        {
+            queue->free_function( queue->allocator_context, packet_data );
+            return 0;
+        }
+        queue->free_function( queue->allocator_context, queue->packet_data[queue->start_index] );
+        queue->packet_data[queue->start_index] = NULL;
+        queue->start_index = ( queue->start_index + 1 ) % NETCODE_PACKET_QUEUE_SIZE;
+        queue->num_packets--;
+        result = 0;
     }
     int index = ( queue->start_index + queue->num_packets ) % NETCODE_PACKET_QUEUE_SIZE;
     queue->packet_data[index] = packet_data;
     queue->packet_sequence[index] = packet_sequence;
     queue->num_packets++;
-    return 1;
+    return result;
 }
 
 void * netcode_packet_queue_pop( struct netcode_packet_queue_t * queue, uint64_t * packet_sequence )
@@ -2145,6 +2687,7 @@ void * netcode_packet_queue_pop( struct netcode_packet_queue_t * queue, uint64_t
     if ( queue->num_packets == 0 )
         return NULL;
     void * packet = queue->packet_data[queue->start_index];
+    queue->packet_data[queue->start_index] = NULL;
     if ( packet_sequence )
         *packet_sequence = queue->packet_sequence[queue->start_index];
     queue->start_index = ( queue->start_index + 1 ) % NETCODE_PACKET_QUEUE_SIZE;
@@ -2156,6 +2699,7 @@ void * netcode_packet_queue_pop( struct netcode_packet_queue_t * queue, uint64_t
 
 #define NETCODE_NETWORK_SIMULATOR_NUM_PACKET_ENTRIES ( NETCODE_MAX_CLIENTS * 256 )
 #define NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS ( NETCODE_MAX_CLIENTS * 64 )
+#define NETCODE_NETWORK_SIMULATOR_BANDWIDTH_QUEUE_SECONDS 0.25
 
 struct netcode_network_simulator_packet_entry_t
 {
@@ -2175,6 +2719,10 @@ struct netcode_network_simulator_t
     float jitter_milliseconds;
     float packet_loss_percent;
     float duplicate_packet_percent;
+    float corrupt_packet_percent;
+    int drop_next_packets;
+    float bandwidth_kbps;
+    double bandwidth_free_time;
     double time;
     int current_index;
     int num_pending_receive_packets;
@@ -2231,6 +2779,7 @@ void netcode_network_simulator_reset( struct netcode_network_simulator_t * netwo
 
     network_simulator->current_index = 0;
     network_simulator->num_pending_receive_packets = 0;
+    network_simulator->bandwidth_free_time = 0.0;
 }
 
 void netcode_network_simulator_destroy( struct netcode_network_simulator_t * network_simulator )
@@ -2282,16 +2831,49 @@ void netcode_network_simulator_send_packet( struct netcode_network_simulator_t *
     netcode_assert( packet_bytes > 0 );
     netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_BYTES );
 
+    // tests drop an exact number of packets to hit a specific point in the protocol, on top of any random loss
+
+    if ( network_simulator->drop_next_packets > 0 )
+    {
+        network_simulator->drop_next_packets--;
+        return;
+    }
+
     if ( netcode_random_float( 0.0f, 100.0f ) <= network_simulator->packet_loss_percent )
         return;
 
+    uint8_t corrupt_packet_data[NETCODE_MAX_PACKET_BYTES];
+
+    if ( network_simulator->corrupt_packet_percent > 0.0f && netcode_random_float( 0.0f, 100.0f ) <= network_simulator->corrupt_packet_percent )
+    {
+        memcpy( corrupt_packet_data, packet_data, packet_bytes );
+        corrupt_packet_data[rand() % packet_bytes] ^= (uint8_t) ( 1 + rand() % 255 );
+        packet_data = corrupt_packet_data;
+    }
+
+    // with a bandwidth cap, every packet in the simulator shares one bottleneck link. packets wait their turn to go out on it, and are dropped once the link's buffer is full
+
+    float queue_delay = 0.0f;
+
+    if ( network_simulator->bandwidth_kbps > 0.0f )
+    {
+        double start_time = network_simulator->bandwidth_free_time > network_simulator->time ? network_simulator->bandwidth_free_time : network_simulator->time;
+
+        if ( start_time - network_simulator->time > NETCODE_NETWORK_SIMULATOR_BANDWIDTH_QUEUE_SECONDS )
+            return;
+
+        network_simulator->bandwidth_free_time = start_time + ( packet_bytes * 8.0 ) / ( network_simulator->bandwidth_kbps * 1000.0 );
+
+        queue_delay = (float) ( network_simulator->bandwidth_free_time - network_simulator->time );
+    }
+
     if ( network_simulator->packet_entries[network_simulator->current_index].packet_data )
     {
         network_simulator->free_function( network_simulator->allocator_context, network_simulator->packet_entries[network_simulator->current_index].packet_data );
         network_simulator->packet_entries[network_simulator->current_index].packet_data = NULL;
     }
 
-    float delay = network_simulator->latency_milliseconds / 1000.0f;
+    float delay = queue_delay + network_simulator->latency_milliseconds / 1000.0f;
 
     if ( network_simulator->jitter_milliseconds > 0.0 )
         delay += netcode_random_float( -network_simulator->jitter_milliseconds, +network_simulator->jitter_milliseconds ) / 1000.0f;
@@ -2420,6 +3002,19 @@ void netcode_default_client_config( struct netcode_client_config_t * config )
     config->override_send_and_receive = 0;
     config->send_packet_override = NULL;
     config->receive_packet_override = NULL;
+    config->packet_send_rate = NETCODE_PACKET_SEND_RATE;
+    config->packet_queue_size = NETCODE_PACKET_QUEUE_SIZE;
+    config->packet_queue_overflow_policy = NETCODE_PACKET_QUEUE_DROP_NEWEST;
+    config->socket_send_buffer_size = NETCODE_CLIENT_SOCKET_SNDBUF_SIZE;
+    config->socket_receive_buffer_size = NETCODE_CLIENT_SOCKET_RCVBUF_SIZE;
+    config->socket_tos = 0;
+    config->socket_dont_fragment = 0;
+    config->time_sync = 0;
+    config->max_packet_size = NETCODE_MAX_PACKET_SIZE;
+    config->connection_request_send_rate = NETCODE_PACKET_SEND_RATE;
+    config->connection_response_send_rate = NETCODE_PACKET_SEND_RATE;
+    config->connect_timeout = 0.0;
+    config->num_disconnect_packets = NETCODE_NUM_DISCONNECT_PACKETS;
 };
 
 struct netcode_client_t
@@ -2432,6 +3027,8 @@ struct netcode_client_t
     double last_packet_receive_time;
     int should_disconnect;
     int should_disconnect_state;
+    int should_disconnect_reason;
+    int disconnect_reason;
     uint64_t sequence;
     int client_index;
     int max_clients;
@@ -2449,12 +3046,16 @@ struct netcode_client_t
     int receive_packet_bytes[NETCODE_CLIENT_MAX_RECEIVE_PACKETS];
     struct netcode_address_t receive_from[NETCODE_CLIENT_MAX_RECEIVE_PACKETS];
     int loopback;
+    uint64_t counters[NETCODE_CLIENT_NUM_COUNTERS];
+    double last_time_sync_send_time;
+    int server_time_synced;
+    double server_time_offset;
+    int migration_challenge_pending;
+    uint64_t migration_challenge;
 };
 
 int netcode_client_socket_create( struct netcode_socket_t * socket,
                                   struct netcode_address_t * address,
-                                  int send_buffer_size,
-                                  int receive_buffer_size,
                                   NETCODE_CONST struct netcode_client_config_t * config )
 {
     netcode_assert( socket );
@@ -2465,7 +3066,7 @@ int netcode_client_socket_create( struct netcode_socket_t * socket,
     {
         if ( !config->override_send_and_receive )
         {
-            if ( netcode_socket_create( socket, address, send_buffer_size, receive_buffer_size ) != NETCODE_SOCKET_ERROR_NONE )
+            if ( netcode_socket_create( socket, address, config->socket_send_buffer_size, config->socket_receive_buffer_size, config->socket_tos, config->socket_dont_fragment, 0 ) != NETCODE_SOCKET_ERROR_NONE )
             {
                 return 0;
             }
@@ -2489,6 +3090,7 @@ struct netcode_client_t * netcode_client_create_overload( NETCODE_CONST char * a
                                                           double time )
 {
     netcode_assert( config );
+    netcode_assert( config->packet_send_rate > 0.0 );
     netcode_assert( netcode.initialized );
 
     struct netcode_address_t address1;
@@ -2509,6 +3111,41 @@ struct netcode_client_t * netcode_client_create_overload( NETCODE_CONST char * a
         return NULL;
     }
 
+    if ( config->max_packet_size <= 0 || config->max_packet_size > NETCODE_MAX_PAYLOAD_BYTES )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: client max packet size must be in [1,%d]\n", NETCODE_MAX_PAYLOAD_BYTES );
+        return NULL;
+    }
+
+    if ( config->connection_request_send_rate <= 0.0 || config->connection_response_send_rate <= 0.0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: client connection request and response send rates must be positive\n" );
+        return NULL;
+    }
+
+    if ( config->connect_timeout < 0.0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: client connect timeout must not be negative\n" );
+        return NULL;
+    }
+
+    if ( config->num_disconnect_packets <= 0 || config->num_disconnect_packets > NETCODE_MAX_DISCONNECT_PACKETS )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: client num disconnect packets must be in [1,%d]\n", NETCODE_MAX_DISCONNECT_PACKETS );
+        return NULL;
+    }
+
+    if ( config->packet_queue_size <= 0 || config->packet_queue_size > NETCODE_PACKET_QUEUE_SIZE )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: client packet queue size must be in [1,%d]\n", NETCODE_PACKET_QUEUE_SIZE );
+        return NULL;
+    }
+
+    if ( config->packet_queue_overflow_policy != NETCODE_PACKET_QUEUE_DROP_NEWEST && config->packet_queue_overflow_policy != NETCODE_PACKET_QUEUE_DROP_OLDEST )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: client packet queue overflow policy is not valid\n" );
+        return NULL;
+    }
 
     struct netcode_socket_t socket_ipv4;
     struct netcode_socket_t socket_ipv6;
@@ -2518,7 +3155,7 @@ struct netcode_client_t * netcode_client_create_overload( NETCODE_CONST char * a
 
     if ( address1.type == NETCODE_ADDRESS_IPV4 || address2.type == NETCODE_ADDRESS_IPV4 )
     {
-        if ( !netcode_client_socket_create( &socket_ipv4, address1.type == NETCODE_ADDRESS_IPV4 ? &address1 : &address2, NETCODE_CLIENT_SOCKET_SNDBUF_SIZE, NETCODE_CLIENT_SOCKET_RCVBUF_SIZE, config ) )
+        if ( !netcode_client_socket_create( &socket_ipv4, address1.type == NETCODE_ADDRESS_IPV4 ? &address1 : &address2, config ) )
         {
             return NULL;
         }
@@ -2526,7 +3163,7 @@ struct netcode_client_t * netcode_client_create_overload( NETCODE_CONST char * a
 
     if ( address1.type == NETCODE_ADDRESS_IPV6 || address2.type == NETCODE_ADDRESS_IPV6 )
     {
-        if ( !netcode_client_socket_create( &socket_ipv6, address1.type == NETCODE_ADDRESS_IPV6 ? &address1 : &address2, NETCODE_CLIENT_SOCKET_SNDBUF_SIZE, NETCODE_CLIENT_SOCKET_RCVBUF_SIZE, config ) )
+        if ( !netcode_client_socket_create( &socket_ipv6, address1.type == NETCODE_ADDRESS_IPV6 ? &address1 : &address2, config ) )
         {
             return NULL;
         }
@@ -2562,6 +3199,8 @@ struct netcode_client_t * netcode_client_create_overload( NETCODE_CONST char * a
     client->last_packet_send_time = -1000.0;
     client->last_packet_receive_time = -1000.0;
     client->should_disconnect = 0;
+    client->should_disconnect_reason = NETCODE_DISCONNECT_REASON_NONE;
+    client->disconnect_reason = NETCODE_DISCONNECT_REASON_NONE;
     client->should_disconnect_state = NETCODE_CLIENT_STATE_DISCONNECTED;
     client->sequence = 0;
     client->client_index = 0;
@@ -2569,15 +3208,23 @@ struct netcode_client_t * netcode_client_create_overload( NETCODE_CONST char * a
     client->server_address_index = 0;
     client->challenge_token_sequence = 0;
     client->loopback = 0;
+    client->last_time_sync_send_time = -1000.0;
+    client->server_time_synced = 0;
+    client->server_time_offset = 0.0;
+    client->migration_challenge_pending = 0;
+    client->migration_challenge = 0;
     memset( &client->server_address, 0, sizeof( struct netcode_address_t ) );
     memset( &client->connect_token, 0, sizeof( struct netcode_connect_token_t ) );
     memset( &client->context, 0, sizeof( struct netcode_context_t ) );
     memset( client->challenge_token_data, 0, NETCODE_CHALLENGE_TOKEN_BYTES );
+    memset( client->counters, 0, sizeof( client->counters ) );
 
-    netcode_packet_queue_init( &client->packet_receive_queue, config->allocator_context, config->allocate_function, config->free_function );
+    netcode_packet_queue_init( &client->packet_receive_queue, config->allocator_context, config->allocate_function, config->free_function, config->packet_queue_size, config->packet_queue_overflow_policy );
 
     netcode_replay_protection_reset( &client->replay_protection );
 
+    client->replay_protection.num_replayed_packets = 0;
+
     return client;
 }
 
@@ -2621,7 +3268,13 @@ void netcode_client_reset_before_next_connect( struct netcode_client_t * client
     client->last_packet_receive_time = client->time;
     client->should_disconnect = 0;
     client->should_disconnect_state = NETCODE_CLIENT_STATE_DISCONNECTED;
+    client->should_disconnect_reason = NETCODE_DISCONNECT_REASON_NONE;
     client->challenge_token_sequence = 0;
+    client->last_time_sync_send_time = -1000.0;
+    client->server_time_synced = 0;
+    client->server_time_offset = 0.0;
+    client->migration_challenge_pending = 0;
+    client->migration_challenge = 0;
 
     memset( client->challenge_token_data, 0, NETCODE_CHALLENGE_TOKEN_BYTES );
 
@@ -2657,7 +3310,7 @@ void netcode_client_reset_connection_data( struct netcode_client_t * client, int
     netcode_packet_queue_clear( &client->packet_receive_queue );
 }
 
-void netcode_client_disconnect_internal( struct netcode_client_t * client, int destination_state, int send_disconnect_packets );
+void netcode_client_disconnect_internal( struct netcode_client_t * client, int destination_state, int disconnect_reason, int send_disconnect_packets );
 
 void netcode_client_connect( struct netcode_client_t * client, uint8_t * connect_token )
 {
@@ -2666,6 +3319,8 @@ void netcode_client_connect( struct netcode_client_t * client, uint8_t * connect
 
     netcode_client_disconnect( client );
 
+    client->disconnect_reason = NETCODE_DISCONNECT_REASON_NONE;
+
     if ( netcode_read_connect_token( connect_token, NETCODE_CONNECT_TOKEN_BYTES, &client->connect_token ) != NETCODE_OK )
     {
         netcode_client_set_state( client, NETCODE_CLIENT_STATE_INVALID_CONNECT_TOKEN );
@@ -2738,6 +3393,15 @@ void netcode_client_process_packet_internal( struct netcode_client_t * client, s
                     netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client received connection keep alive packet from server\n" );
 
                     client->last_packet_receive_time = client->time;
+
+                    // a keep-alive that doesn't carry our slot is the server checking a new address of ours. it carries a challenge in
+                    // place of the slot, which goes straight back in a keep-alive from this address
+
+                    if ( p->client_index != client->client_index || p->max_clients != client->max_clients )
+                    {
+                        client->migration_challenge = ( (uint64_t) (uint32_t) p->client_index ) | ( ( (uint64_t) (uint32_t) p->max_clients ) << 32 );
+                        client->migration_challenge_pending = 1;
+                    }
                 }
                 else if ( client->state == NETCODE_CLIENT_STATE_SENDING_CONNECTION_RESPONSE )
                 {
@@ -2761,7 +3425,16 @@ void netcode_client_process_packet_internal( struct netcode_client_t * client, s
             {
                 netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client received connection payload packet from server\n" );
 
-                netcode_packet_queue_push( &client->packet_receive_queue, packet, sequence );
+                if ( (int) ( (struct netcode_connection_payload_packet_t*) packet )->payload_bytes > client->config.max_packet_size )
+                {
+                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client ignored connection payload packet. payload is larger than max packet size\n" );
+                    break;
+                }
+
+                if ( !netcode_packet_queue_push( &client->packet_receive_queue, packet, sequence ) )
+                {
+                    client->counters[NETCODE_CLIENT_COUNTER_PAYLOAD_PACKETS_DROPPED]++;
+                }
 
                 client->last_packet_receive_time = client->time;
 
@@ -2776,8 +3449,50 @@ void netcode_client_process_packet_internal( struct netcode_client_t * client, s
             {
                 netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client received disconnect packet from server\n" );
 
+                struct netcode_connection_disconnect_packet_t * p = (struct netcode_connection_disconnect_packet_t*) packet;
+
                 client->should_disconnect = 1;
                 client->should_disconnect_state = NETCODE_CLIENT_STATE_DISCONNECTED;
+                if ( p->reason != NETCODE_DISCONNECT_REASON_NONE )
+                {
+                    client->should_disconnect_reason = p->reason;
+                }
+                else if ( client->should_disconnect_reason == NETCODE_DISCONNECT_REASON_NONE )
+                {
+                    client->should_disconnect_reason = NETCODE_DISCONNECT_REASON_SERVER_DISCONNECTED;
+                }
+                client->last_packet_receive_time = client->time;
+            }
+        }
+        break;
+
+        case NETCODE_CONNECTION_TIME_SYNC_PACKET:
+        {
+            if ( client->state == NETCODE_CLIENT_STATE_CONNECTED && netcode_address_equal( from, &client->server_address ) )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client received connection time sync packet from server\n" );
+
+                struct netcode_connection_time_sync_packet_t * p = (struct netcode_connection_time_sync_packet_t*) packet;
+
+                // assume the reply spent half the round trip in flight. smooth the offset so one late reply doesn't jerk the clock around
+
+                double round_trip_time = client->time - p->client_time;
+
+                if ( round_trip_time >= 0.0 )
+                {
+                    double offset = p->server_time + round_trip_time * 0.5 - client->time;
+
+                    if ( !client->server_time_synced )
+                    {
+                        client->server_time_offset = offset;
+                        client->server_time_synced = 1;
+                    }
+                    else
+                    {
+                        client->server_time_offset += ( offset - client->server_time_offset ) * NETCODE_TIME_SYNC_SMOOTHING;
+                    }
+                }
+
                 client->last_packet_receive_time = client->time;
             }
         }
@@ -2804,8 +3519,9 @@ void netcode_client_process_packet( struct netcode_client_t * client, struct net
     allowed_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET] = 1;
     allowed_packets[NETCODE_CONNECTION_PAYLOAD_PACKET] = 1;
     allowed_packets[NETCODE_CONNECTION_DISCONNECT_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_TIME_SYNC_PACKET] = client->config.time_sync ? 1 : 0;
 
-    uint64_t current_timestamp = (uint64_t) time( NULL );
+    uint64_t current_timestamp = netcode_timestamp();
 
     uint64_t sequence;
 
@@ -2813,6 +3529,7 @@ void netcode_client_process_packet( struct netcode_client_t * client, struct net
                                          packet_bytes, 
                                          &sequence, 
                                          client->context.read_packet_key, 
+                                         client->connect_token.version_info, 
                                          client->connect_token.protocol_id, 
                                          current_timestamp, 
                                          NULL, 
@@ -2839,8 +3556,9 @@ void netcode_client_receive_packets( struct netcode_client_t * client )
     allowed_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET] = 1;
     allowed_packets[NETCODE_CONNECTION_PAYLOAD_PACKET] = 1;
     allowed_packets[NETCODE_CONNECTION_DISCONNECT_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_TIME_SYNC_PACKET] = client->config.time_sync ? 1 : 0;
 
-    uint64_t current_timestamp = (uint64_t) time( NULL );
+    uint64_t current_timestamp = netcode_timestamp();
 
     if ( !client->config.network_simulator )
     {
@@ -2873,6 +3591,7 @@ void netcode_client_receive_packets( struct netcode_client_t * client )
                                                  packet_bytes, 
                                                  &sequence, 
                                                  client->context.read_packet_key, 
+                                                 client->connect_token.version_info, 
                                                  client->connect_token.protocol_id, 
                                                  current_timestamp, 
                                                  NULL, 
@@ -2907,6 +3626,7 @@ void netcode_client_receive_packets( struct netcode_client_t * client )
                                                  client->receive_packet_bytes[i], 
                                                  &sequence, 
                                                  client->context.read_packet_key, 
+                                                 client->connect_token.version_info, 
                                                  client->connect_token.protocol_id, 
                                                  current_timestamp, 
                                                  NULL, 
@@ -2937,6 +3657,7 @@ void netcode_client_send_packet_to_server_internal( struct netcode_client_t * cl
                                              NETCODE_MAX_PACKET_BYTES, 
                                              client->sequence++, 
                                              client->context.write_packet_key, 
+                                             client->connect_token.version_info, 
                                              client->connect_token.protocol_id );
 
     netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_BYTES );
@@ -2973,17 +3694,17 @@ void netcode_client_send_packets( struct netcode_client_t * client )
     {
         case NETCODE_CLIENT_STATE_SENDING_CONNECTION_REQUEST:
         {
-            if ( client->last_packet_send_time + ( 1.0 / NETCODE_PACKET_SEND_RATE ) >= client->time )
+            if ( client->last_packet_send_time + ( 1.0 / client->config.connection_request_send_rate ) >= client->time )
                 return;
 
             netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client sent connection request packet to server\n" );
 
             struct netcode_connection_request_packet_t packet;
             packet.packet_type = NETCODE_CONNECTION_REQUEST_PACKET;
-            memcpy( packet.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+            memcpy( packet.version_info, client->connect_token.version_info, NETCODE_VERSION_INFO_BYTES );
             packet.protocol_id = client->connect_token.protocol_id;
             packet.connect_token_expire_timestamp = client->connect_token.expire_timestamp;
-            packet.connect_token_sequence = client->connect_token.sequence;
+            memcpy( packet.connect_token_nonce, client->connect_token.nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
             memcpy( packet.connect_token_data, client->connect_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
 
             netcode_client_send_packet_to_server_internal( client, &packet );
@@ -2992,7 +3713,7 @@ void netcode_client_send_packets( struct netcode_client_t * client )
 
         case NETCODE_CLIENT_STATE_SENDING_CONNECTION_RESPONSE:
         {
-            if ( client->last_packet_send_time + ( 1.0 / NETCODE_PACKET_SEND_RATE ) >= client->time )
+            if ( client->last_packet_send_time + ( 1.0 / client->config.connection_response_send_rate ) >= client->time )
                 return;
 
             netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client sent connection response packet to server\n" );
@@ -3008,7 +3729,37 @@ void netcode_client_send_packets( struct netcode_client_t * client )
 
         case NETCODE_CLIENT_STATE_CONNECTED:
         {
-            if ( client->last_packet_send_time + ( 1.0 / NETCODE_PACKET_SEND_RATE ) >= client->time )
+            if ( client->config.time_sync && client->last_time_sync_send_time + ( 1.0 / NETCODE_TIME_SYNC_SEND_RATE ) <= client->time )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client sent connection time sync packet to server\n" );
+
+                struct netcode_connection_time_sync_packet_t packet;
+                packet.packet_type = NETCODE_CONNECTION_TIME_SYNC_PACKET;
+                packet.client_time = client->time;
+                packet.server_time = 0.0;
+
+                netcode_client_send_packet_to_server_internal( client, &packet );
+
+                client->last_time_sync_send_time = client->time;
+            }
+
+            if ( client->migration_challenge_pending )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client sent migration challenge back to server\n" );
+
+                struct netcode_connection_keep_alive_packet_t packet;
+                packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+                packet.client_index = (int) (uint32_t) client->migration_challenge;
+                packet.max_clients = (int) (uint32_t) ( client->migration_challenge >> 32 );
+
+                netcode_client_send_packet_to_server_internal( client, &packet );
+
+                client->migration_challenge_pending = 0;
+
+                return;
+            }
+
+            if ( client->last_packet_send_time + ( 1.0 / client->config.packet_send_rate ) >= client->time )
                 return;
 
             netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client sent connection keep-alive packet to server\n" );
@@ -3054,6 +3805,16 @@ int netcode_client_connect_to_next_server( struct netcode_client_t * client )
     return 1;
 }
 
+double netcode_client_connect_timeout( struct netcode_client_t * client )
+{
+    netcode_assert( client );
+
+    if ( client->config.connect_timeout > 0.0 )
+        return client->config.connect_timeout;
+
+    return (double) client->connect_token.timeout_seconds;
+}
+
 void netcode_client_update( struct netcode_client_t * client, double time )
 {
     netcode_assert( client );
@@ -3073,7 +3834,7 @@ void netcode_client_update( struct netcode_client_t * client, double time )
         if ( client->time - client->connect_start_time >= connect_token_expire_seconds )
         {
             netcode_printf( NETCODE_LOG_LEVEL_INFO, "client connect failed. connect token expired\n" );
-            netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_CONNECT_TOKEN_EXPIRED, 0 );
+            netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_CONNECT_TOKEN_EXPIRED, NETCODE_DISCONNECT_REASON_NONE, 0 );
             return;
         }
     }
@@ -3083,7 +3844,7 @@ void netcode_client_update( struct netcode_client_t * client, double time )
         netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client should disconnect -> %s\n", netcode_client_state_name( client->should_disconnect_state ) );
         if ( netcode_client_connect_to_next_server( client ) )
             return;
-        netcode_client_disconnect_internal( client, client->should_disconnect_state, 0 );
+        netcode_client_disconnect_internal( client, client->should_disconnect_state, client->should_disconnect_reason, 0 );
         return;
     }
 
@@ -3091,12 +3852,13 @@ void netcode_client_update( struct netcode_client_t * client, double time )
     {
         case NETCODE_CLIENT_STATE_SENDING_CONNECTION_REQUEST:
         {
-            if ( client->connect_token.timeout_seconds > 0 && client->last_packet_receive_time + client->connect_token.timeout_seconds < time )
+            double connect_timeout = netcode_client_connect_timeout( client );
+            if ( connect_timeout > 0.0 && client->last_packet_receive_time + connect_timeout < time )
             {
                 netcode_printf( NETCODE_LOG_LEVEL_INFO, "client connect failed. connection request timed out\n" );
                 if ( netcode_client_connect_to_next_server( client ) )
                     return;
-                netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_CONNECTION_REQUEST_TIMED_OUT, 0 );
+                netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_CONNECTION_REQUEST_TIMED_OUT, NETCODE_DISCONNECT_REASON_TIMED_OUT, 0 );
                 return;
             }
         }
@@ -3104,12 +3866,13 @@ void netcode_client_update( struct netcode_client_t * client, double time )
 
         case NETCODE_CLIENT_STATE_SENDING_CONNECTION_RESPONSE:
         {
-            if ( client->connect_token.timeout_seconds > 0 && client->last_packet_receive_time + client->connect_token.timeout_seconds < time )
+            double connect_timeout = netcode_client_connect_timeout( client );
+            if ( connect_timeout > 0.0 && client->last_packet_receive_time + connect_timeout < time )
             {
                 netcode_printf( NETCODE_LOG_LEVEL_INFO, "client connect failed. connection response timed out\n" );
                 if ( netcode_client_connect_to_next_server( client ) )
                     return;
-                netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_CONNECTION_RESPONSE_TIMED_OUT, 0 );
+                netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_CONNECTION_RESPONSE_TIMED_OUT, NETCODE_DISCONNECT_REASON_TIMED_OUT, 0 );
                 return;
             }
         }
@@ -3120,7 +3883,14 @@ void netcode_client_update( struct netcode_client_t * client, double time )
             if ( client->connect_token.timeout_seconds > 0 && client->last_packet_receive_time + client->connect_token.timeout_seconds < time )
             {
                 netcode_printf( NETCODE_LOG_LEVEL_INFO, "client connection timed out\n" );
-                netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_CONNECTION_TIMED_OUT, 0 );
+                netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_CONNECTION_TIMED_OUT, NETCODE_DISCONNECT_REASON_TIMED_OUT, 0 );
+                return;
+            }
+
+            if ( client->sequence >= NETCODE_CONNECTION_SEQUENCE_LIMIT )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_INFO, "client disconnected. sequence exhausted\n" );
+                netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_DISCONNECTED, NETCODE_DISCONNECT_REASON_SEQUENCE_EXHAUSTED, 1 );
                 return;
             }
         }
@@ -3142,7 +3912,7 @@ void netcode_client_send_packet( struct netcode_client_t * client, NETCODE_CONST
     netcode_assert( client );
     netcode_assert( packet_data );
     netcode_assert( packet_bytes >= 0 );
-    netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_SIZE );
+    netcode_assert( packet_bytes <= client->config.max_packet_size );
 
     if ( client->state != NETCODE_CLIENT_STATE_CONNECTED )
         return;
@@ -3204,10 +3974,10 @@ void netcode_client_disconnect( struct netcode_client_t * client )
 {
     netcode_assert( client );
     netcode_assert( !client->loopback );
-    netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_DISCONNECTED, 1 );
+    netcode_client_disconnect_internal( client, NETCODE_CLIENT_STATE_DISCONNECTED, NETCODE_DISCONNECT_REASON_CLIENT_DISCONNECTED, 1 );
 }
 
-void netcode_client_disconnect_internal( struct netcode_client_t * client, int destination_state, int send_disconnect_packets )
+void netcode_client_disconnect_internal( struct netcode_client_t * client, int destination_state, int disconnect_reason, int send_disconnect_packets )
 {
     netcode_assert( !client->loopback );
     netcode_assert( destination_state <= NETCODE_CLIENT_STATE_DISCONNECTED );
@@ -3222,17 +3992,20 @@ void netcode_client_disconnect_internal( struct netcode_client_t * client, int d
         netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client sent disconnect packets to server\n" );
 
         int i;
-        for ( i = 0; i < NETCODE_NUM_DISCONNECT_PACKETS; ++i )
+        for ( i = 0; i < client->config.num_disconnect_packets; ++i )
         {
             netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client sent disconnect packet %d\n", i );
 
             struct netcode_connection_disconnect_packet_t packet;
             packet.packet_type = NETCODE_CONNECTION_DISCONNECT_PACKET;
+            packet.reason = NETCODE_DISCONNECT_REASON_NONE;
 
             netcode_client_send_packet_to_server_internal( client, &packet );
         }
     }
 
+    client->disconnect_reason = disconnect_reason;
+
     netcode_client_reset_connection_data( client, destination_state );
 }
 
@@ -3242,6 +4015,12 @@ int netcode_client_state( struct netcode_client_t * client )
     return client->state;
 }
 
+int netcode_client_disconnect_reason( struct netcode_client_t * client )
+{
+    netcode_assert( client );
+    return client->disconnect_reason;
+}
+
 int netcode_client_index( struct netcode_client_t * client )
 {
     netcode_assert( client );
@@ -3254,6 +4033,15 @@ int netcode_client_max_clients( struct netcode_client_t * client )
     return client->max_clients;
 }
 
+double netcode_client_server_time( struct netcode_client_t * client )
+{
+    netcode_assert( client );
+
+    // until the first time sync reply arrives this is just the client time
+
+    return client->time + client->server_time_offset;
+}
+
 void netcode_client_connect_loopback( struct netcode_client_t * client, int client_index, int max_clients )
 {
     netcode_assert( client );
@@ -3269,6 +4057,7 @@ void netcode_client_disconnect_loopback( struct netcode_client_t * client )
 {
     netcode_assert( client );
     netcode_assert( client->loopback );
+    client->disconnect_reason = NETCODE_DISCONNECT_REASON_CLIENT_DISCONNECTED;
     netcode_client_reset_connection_data( client, NETCODE_CLIENT_STATE_DISCONNECTED );
 }
 
@@ -3287,7 +4076,10 @@ void netcode_client_process_loopback_packet( struct netcode_client_t * client, N
         return;
     memcpy( packet->payload_data, packet_data, packet_bytes );
     netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "client processing loopback packet from server\n" );
-    netcode_packet_queue_push( &client->packet_receive_queue, packet, packet_sequence );
+    if ( !netcode_packet_queue_push( &client->packet_receive_queue, packet, packet_sequence ) )
+    {
+        client->counters[NETCODE_CLIENT_COUNTER_PAYLOAD_PACKETS_DROPPED]++;
+    }
 }
 
 uint16_t netcode_client_get_port( struct netcode_client_t * client )
@@ -3302,6 +4094,13 @@ struct netcode_address_t * netcode_client_server_address( struct netcode_client_
     return &client->server_address;
 }
 
+NETCODE_CONST uint64_t * netcode_client_counters( struct netcode_client_t * client )
+{
+    netcode_assert( client );
+    client->counters[NETCODE_CLIENT_COUNTER_REPLAYED_PACKETS_DROPPED] = client->replay_protection.num_replayed_packets;
+    return client->counters;
+}
+
 // ----------------------------------------------------------------
 
 #define NETCODE_MAX_ENCRYPTION_MAPPINGS ( NETCODE_MAX_CLIENTS * 4 )
@@ -3310,11 +4109,18 @@ struct netcode_encryption_manager_t
 {
     int num_encryption_mappings;
     int timeout[NETCODE_MAX_ENCRYPTION_MAPPINGS];
+    int version_index[NETCODE_MAX_ENCRYPTION_MAPPINGS];
+    int protocol_index[NETCODE_MAX_ENCRYPTION_MAPPINGS];
     double expire_time[NETCODE_MAX_ENCRYPTION_MAPPINGS];
     double last_access_time[NETCODE_MAX_ENCRYPTION_MAPPINGS];
+    int established[NETCODE_MAX_ENCRYPTION_MAPPINGS];
     struct netcode_address_t address[NETCODE_MAX_ENCRYPTION_MAPPINGS];
     uint8_t send_key[NETCODE_KEY_BYTES*NETCODE_MAX_ENCRYPTION_MAPPINGS];
     uint8_t receive_key[NETCODE_KEY_BYTES*NETCODE_MAX_ENCRYPTION_MAPPINGS];
+    int challenge_cached[NETCODE_MAX_ENCRYPTION_MAPPINGS];
+    uint64_t challenge_sequence[NETCODE_MAX_ENCRYPTION_MAPPINGS];
+    uint8_t challenge_connect_token_mac[NETCODE_MAC_BYTES*NETCODE_MAX_ENCRYPTION_MAPPINGS];
+    uint8_t challenge_token_data[NETCODE_CHALLENGE_TOKEN_BYTES*NETCODE_MAX_ENCRYPTION_MAPPINGS];
 };
 
 void netcode_encryption_manager_reset( struct netcode_encryption_manager_t * encryption_manager )
@@ -3334,8 +4140,15 @@ void netcode_encryption_manager_reset( struct netcode_encryption_manager_t * enc
     }
 
     memset( encryption_manager->timeout, 0, sizeof( encryption_manager->timeout ) );    
+    memset( encryption_manager->version_index, 0, sizeof( encryption_manager->version_index ) );
+    memset( encryption_manager->protocol_index, 0, sizeof( encryption_manager->protocol_index ) );
+    memset( encryption_manager->established, 0, sizeof( encryption_manager->established ) );
     memset( encryption_manager->send_key, 0, sizeof( encryption_manager->send_key ) );
     memset( encryption_manager->receive_key, 0, sizeof( encryption_manager->receive_key ) );
+    memset( encryption_manager->challenge_cached, 0, sizeof( encryption_manager->challenge_cached ) );
+    memset( encryption_manager->challenge_sequence, 0, sizeof( encryption_manager->challenge_sequence ) );
+    memset( encryption_manager->challenge_connect_token_mac, 0, sizeof( encryption_manager->challenge_connect_token_mac ) );
+    memset( encryption_manager->challenge_token_data, 0, sizeof( encryption_manager->challenge_token_data ) );
 }
 
 int netcode_encryption_manager_entry_expired( struct netcode_encryption_manager_t * encryption_manager, int index, double time )
@@ -3350,7 +4163,8 @@ int netcode_encryption_manager_add_encryption_mapping( struct netcode_encryption
                                                        uint8_t * receive_key, 
                                                        double time, 
                                                        double expire_time,
-                                                       int timeout )
+                                                       int timeout, 
+                                                       int version_index )
 {
     int i;
     for ( i = 0; i < encryption_manager->num_encryption_mappings; ++i )
@@ -3358,8 +4172,12 @@ int netcode_encryption_manager_add_encryption_mapping( struct netcode_encryption
         if ( netcode_address_equal( &encryption_manager->address[i], address ) && !netcode_encryption_manager_entry_expired( encryption_manager, i, time ) )
         {
             encryption_manager->timeout[i] = timeout;
+            encryption_manager->version_index[i] = version_index;
+            encryption_manager->protocol_index[i] = 0;
             encryption_manager->expire_time[i] = expire_time;
             encryption_manager->last_access_time[i] = time;
+            encryption_manager->established[i] = 0;
+            encryption_manager->challenge_cached[i] = 0;
             memcpy( encryption_manager->send_key + i * NETCODE_KEY_BYTES, send_key, NETCODE_KEY_BYTES );
             memcpy( encryption_manager->receive_key + i * NETCODE_KEY_BYTES, receive_key, NETCODE_KEY_BYTES );
             return 1;
@@ -3371,9 +4189,13 @@ int netcode_encryption_manager_add_encryption_mapping( struct netcode_encryption
         if ( encryption_manager->address[i].type == NETCODE_ADDRESS_NONE || netcode_encryption_manager_entry_expired( encryption_manager, i, time ) )
         {
             encryption_manager->timeout[i] = timeout;
+            encryption_manager->version_index[i] = version_index;
+            encryption_manager->protocol_index[i] = 0;
             encryption_manager->address[i] = *address;
             encryption_manager->expire_time[i] = expire_time;
             encryption_manager->last_access_time[i] = time;
+            encryption_manager->established[i] = 0;
+            encryption_manager->challenge_cached[i] = 0;
             memcpy( encryption_manager->send_key + i * NETCODE_KEY_BYTES, send_key, NETCODE_KEY_BYTES );
             memcpy( encryption_manager->receive_key + i * NETCODE_KEY_BYTES, receive_key, NETCODE_KEY_BYTES );
             if ( i + 1 > encryption_manager->num_encryption_mappings )
@@ -3398,8 +4220,10 @@ int netcode_encryption_manager_remove_encryption_mapping( struct netcode_encrypt
             encryption_manager->expire_time[i] = -1.0;
             encryption_manager->last_access_time[i] = -1000.0;
             memset( &encryption_manager->address[i], 0, sizeof( struct netcode_address_t ) );
+            encryption_manager->established[i] = 0;
             memset( encryption_manager->send_key + i * NETCODE_KEY_BYTES, 0, NETCODE_KEY_BYTES );
             memset( encryption_manager->receive_key + i * NETCODE_KEY_BYTES, 0, NETCODE_KEY_BYTES );
+            encryption_manager->challenge_cached[i] = 0;
 
             if ( i + 1 == encryption_manager->num_encryption_mappings )
             {
@@ -3410,6 +4234,11 @@ int netcode_encryption_manager_remove_encryption_mapping( struct netcode_encrypt
                     {
                         break;
                     }
+                    if ( encryption_manager->address[index].type != NETCODE_ADDRESS_NONE && !encryption_manager->established[index] )
+                    {
+                        // leave abandoned handshakes for netcode_encryption_manager_remove_abandoned, so the server hears about them
+                        break;
+                    }
                     encryption_manager->address[index].type = NETCODE_ADDRESS_NONE;
                     index--;
                 }
@@ -3423,6 +4252,39 @@ int netcode_encryption_manager_remove_encryption_mapping( struct netcode_encrypt
     return 0;
 }
 
+int netcode_encryption_manager_remove_abandoned( struct netcode_encryption_manager_t * encryption_manager, double time, struct netcode_address_t * addresses, int max_addresses )
+{
+    netcode_assert( encryption_manager );
+    netcode_assert( addresses );
+    netcode_assert( max_addresses > 0 );
+
+    // an abandoned handshake is a mapping that expired before its client connected. report the addresses so the caller can tell someone
+
+    int num_removed = 0;
+
+    int i;
+    for ( i = 0; i < encryption_manager->num_encryption_mappings && num_removed < max_addresses; ++i )
+    {
+        if ( encryption_manager->address[i].type != NETCODE_ADDRESS_NONE && !encryption_manager->established[i] && netcode_encryption_manager_entry_expired( encryption_manager, i, time ) )
+        {
+            addresses[num_removed++] = encryption_manager->address[i];
+            encryption_manager->expire_time[i] = -1.0;
+            encryption_manager->last_access_time[i] = -1000.0;
+            memset( &encryption_manager->address[i], 0, sizeof( struct netcode_address_t ) );
+            memset( encryption_manager->send_key + i * NETCODE_KEY_BYTES, 0, NETCODE_KEY_BYTES );
+            memset( encryption_manager->receive_key + i * NETCODE_KEY_BYTES, 0, NETCODE_KEY_BYTES );
+            encryption_manager->challenge_cached[i] = 0;
+        }
+    }
+
+    while ( encryption_manager->num_encryption_mappings > 0 && encryption_manager->address[encryption_manager->num_encryption_mappings - 1].type == NETCODE_ADDRESS_NONE )
+    {
+        encryption_manager->num_encryption_mappings--;
+    }
+
+    return num_removed;
+}
+
 int netcode_encryption_manager_find_encryption_mapping( struct netcode_encryption_manager_t * encryption_manager, struct netcode_address_t * address, double time )
 {
     int i;
@@ -3447,6 +4309,14 @@ int netcode_encryption_manager_touch( struct netcode_encryption_manager_t * encr
     return 1;
 }
 
+void netcode_encryption_manager_set_address( struct netcode_encryption_manager_t * encryption_manager, int index, struct netcode_address_t * address )
+{
+    netcode_assert( index >= 0 );
+    netcode_assert( index < encryption_manager->num_encryption_mappings );
+    netcode_assert( address );
+    encryption_manager->address[index] = *address;
+}
+
 void netcode_encryption_manager_set_expire_time( struct netcode_encryption_manager_t * encryption_manager, int index, double expire_time )
 {
     netcode_assert( index >= 0 );
@@ -3454,7 +4324,118 @@ void netcode_encryption_manager_set_expire_time( struct netcode_encryption_manag
     encryption_manager->expire_time[index] = expire_time;
 }
 
-
+void netcode_encryption_manager_set_established( struct netcode_encryption_manager_t * encryption_manager, int index )
+{
+    netcode_assert( index >= 0 );
+    netcode_assert( index < encryption_manager->num_encryption_mappings );
+    encryption_manager->established[index] = 1;
+}
+
+void netcode_encryption_manager_set_protocol_index( struct netcode_encryption_manager_t * encryption_manager, int index, int protocol_index )
+{
+    netcode_assert( index >= 0 );
+    netcode_assert( index < encryption_manager->num_encryption_mappings );
+    netcode_assert( protocol_index >= 0 );
+    encryption_manager->protocol_index[index] = protocol_index;
+}
+
+void netcode_encryption_manager_set_challenge( struct netcode_encryption_manager_t * encryption_manager, 
+                                               int index, 
+                                               NETCODE_CONST uint8_t * connect_token_mac, 
+                                               uint64_t challenge_sequence, 
+                                               NETCODE_CONST uint8_t * challenge_token_data )
+{
+    netcode_assert( encryption_manager );
+    netcode_assert( index >= 0 );
+    netcode_assert( index < encryption_manager->num_encryption_mappings );
+    netcode_assert( connect_token_mac );
+    netcode_assert( challenge_token_data );
+    encryption_manager->challenge_cached[index] = 1;
+    encryption_manager->challenge_sequence[index] = challenge_sequence;
+    memcpy( encryption_manager->challenge_connect_token_mac + index * NETCODE_MAC_BYTES, connect_token_mac, NETCODE_MAC_BYTES );
+    memcpy( encryption_manager->challenge_token_data + index * NETCODE_CHALLENGE_TOKEN_BYTES, challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+}
+
+int netcode_encryption_manager_get_challenge( struct netcode_encryption_manager_t * encryption_manager, 
+                                              int index, 
+                                              NETCODE_CONST uint8_t * connect_token_mac, 
+                                              uint64_t * challenge_sequence, 
+                                              uint8_t * challenge_token_data )
+{
+    netcode_assert( encryption_manager );
+    netcode_assert( index >= 0 );
+    netcode_assert( index < encryption_manager->num_encryption_mappings );
+    netcode_assert( connect_token_mac );
+    netcode_assert( challenge_sequence );
+    netcode_assert( challenge_token_data );
+
+    // only a handshake still in flight, started by the same connect token, has a challenge worth sending again
+
+    if ( !encryption_manager->challenge_cached[index] || encryption_manager->established[index] )
+        return 0;
+
+    if ( memcmp( encryption_manager->challenge_connect_token_mac + index * NETCODE_MAC_BYTES, connect_token_mac, NETCODE_MAC_BYTES ) != 0 )
+        return 0;
+
+    *challenge_sequence = encryption_manager->challenge_sequence[index];
+    memcpy( challenge_token_data, encryption_manager->challenge_token_data + index * NETCODE_CHALLENGE_TOKEN_BYTES, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+    return 1;
+}
+
+void netcode_encryption_manager_clear_challenges( struct netcode_encryption_manager_t * encryption_manager )
+{
+    netcode_assert( encryption_manager );
+    memset( encryption_manager->challenge_cached, 0, sizeof( encryption_manager->challenge_cached ) );
+}
+
+int netcode_encryption_manager_num_pending( struct netcode_encryption_manager_t * encryption_manager, double time )
+{
+    netcode_assert( encryption_manager );
+
+    int num_pending = 0;
+
+    int i;
+    for ( i = 0; i < encryption_manager->num_encryption_mappings; ++i )
+    {
+        if ( encryption_manager->address[i].type != NETCODE_ADDRESS_NONE && !encryption_manager->established[i] && !netcode_encryption_manager_entry_expired( encryption_manager, i, time ) )
+        {
+            num_pending++;
+        }
+    }
+
+    return num_pending;
+}
+
+int netcode_encryption_manager_evict_oldest_pending( struct netcode_encryption_manager_t * encryption_manager, double time )
+{
+    netcode_assert( encryption_manager );
+
+    // oldest means least recently heard from. a client still handshaking keeps touching its mapping with every packet
+
+    int oldest_index = -1;
+
+    int i;
+    for ( i = 0; i < encryption_manager->num_encryption_mappings; ++i )
+    {
+        if ( encryption_manager->address[i].type != NETCODE_ADDRESS_NONE && !encryption_manager->established[i] && !netcode_encryption_manager_entry_expired( encryption_manager, i, time ) )
+        {
+            if ( oldest_index == -1 || encryption_manager->last_access_time[i] < encryption_manager->last_access_time[oldest_index] )
+            {
+                oldest_index = i;
+            }
+        }
+    }
+
+    if ( oldest_index == -1 )
+        return 0;
+
+    struct netcode_address_t address = encryption_manager->address[oldest_index];
+
+    return netcode_encryption_manager_remove_encryption_mapping( encryption_manager, &address, time );
+}
+
+
 uint8_t * netcode_encryption_manager_get_send_key( struct netcode_encryption_manager_t * encryption_manager, int index )
 {
     netcode_assert( encryption_manager );
@@ -3485,6 +4466,26 @@ int netcode_encryption_manager_get_timeout( struct netcode_encryption_manager_t
     return encryption_manager->timeout[index];
 }
 
+int netcode_encryption_manager_get_version_index( struct netcode_encryption_manager_t * encryption_manager, int index )
+{
+    netcode_assert( encryption_manager );
+    if ( index == -1 )
+        return 0;
+    netcode_assert( index >= 0 );
+    netcode_assert( index < encryption_manager->num_encryption_mappings );
+    return encryption_manager->version_index[index];
+}
+
+int netcode_encryption_manager_get_protocol_index( struct netcode_encryption_manager_t * encryption_manager, int index )
+{
+    netcode_assert( encryption_manager );
+    if ( index == -1 )
+        return 0;
+    netcode_assert( index >= 0 );
+    netcode_assert( index < encryption_manager->num_encryption_mappings );
+    return encryption_manager->protocol_index[index];
+}
+
 // ----------------------------------------------------------------
 
 #define NETCODE_MAX_CONNECT_TOKEN_ENTRIES ( NETCODE_MAX_CLIENTS * 8 )
@@ -3496,18 +4497,64 @@ struct netcode_connect_token_entry_t
     struct netcode_address_t address;
 };
 
-void netcode_connect_token_entries_reset( struct netcode_connect_token_entry_t * connect_token_entries )
+#define NETCODE_CONNECT_TOKEN_FILTER_BITS ( NETCODE_MAX_CONNECT_TOKEN_ENTRIES * 16 )
+#define NETCODE_CONNECT_TOKEN_FILTER_WORDS ( NETCODE_CONNECT_TOKEN_FILTER_BITS / 32 )
+#define NETCODE_CONNECT_TOKEN_FILTER_PROBES 4
+
+struct netcode_connect_token_entries_t
+{
+    int next_index;
+    int num_filter_entries;
+    uint32_t filter[2][NETCODE_CONNECT_TOKEN_FILTER_WORDS];
+    struct netcode_connect_token_entry_t entries[NETCODE_MAX_CONNECT_TOKEN_ENTRIES];
+};
+
+void netcode_connect_token_entries_reset( struct netcode_connect_token_entries_t * connect_token_entries )
 {
+    netcode_assert( connect_token_entries );
+
+    connect_token_entries->next_index = 0;
+    connect_token_entries->num_filter_entries = 0;
+    memset( connect_token_entries->filter, 0, sizeof( connect_token_entries->filter ) );
+
     int i;
     for ( i = 0; i < NETCODE_MAX_CONNECT_TOKEN_ENTRIES; ++i )
     {
-        connect_token_entries[i].time = -1000.0;
-        memset( connect_token_entries[i].mac, 0, NETCODE_MAC_BYTES );
-        memset( &connect_token_entries[i].address, 0, sizeof( struct netcode_address_t ) );
+        connect_token_entries->entries[i].time = -1000.0;
+        memset( connect_token_entries->entries[i].mac, 0, NETCODE_MAC_BYTES );
+        memset( &connect_token_entries->entries[i].address, 0, sizeof( struct netcode_address_t ) );
+    }
+}
+
+int netcode_connect_token_filter_contains( uint32_t * filter, uint8_t * mac )
+{
+    // the mac is the output of an AEAD under the server's private key, so its bytes are already as good as a hash
+
+    int i;
+    for ( i = 0; i < NETCODE_CONNECT_TOKEN_FILTER_PROBES; ++i )
+    {
+        uint32_t bit;
+        memcpy( &bit, mac + i * 4, 4 );
+        bit %= NETCODE_CONNECT_TOKEN_FILTER_BITS;
+        if ( ( filter[bit / 32] & ( 1U << ( bit % 32 ) ) ) == 0 )
+            return 0;
+    }
+    return 1;
+}
+
+void netcode_connect_token_filter_add( uint32_t * filter, uint8_t * mac )
+{
+    int i;
+    for ( i = 0; i < NETCODE_CONNECT_TOKEN_FILTER_PROBES; ++i )
+    {
+        uint32_t bit;
+        memcpy( &bit, mac + i * 4, 4 );
+        bit %= NETCODE_CONNECT_TOKEN_FILTER_BITS;
+        filter[bit / 32] |= ( 1U << ( bit % 32 ) );
     }
 }
 
-int netcode_connect_token_entries_find_or_add( struct netcode_connect_token_entry_t * connect_token_entries, 
+int netcode_connect_token_entries_find_or_add( struct netcode_connect_token_entries_t * connect_token_entries, 
                                                struct netcode_address_t * address, 
                                                uint8_t * mac, 
                                                double time )
@@ -3516,34 +4563,48 @@ int netcode_connect_token_entries_find_or_add( struct netcode_connect_token_entr
     netcode_assert( address );
     netcode_assert( mac );
 
-    // find the matching entry for the token mac and the oldest token entry. constant time worst case. This is intentional!
+    // entries are replaced oldest first, so they form a ring. the filters cover the macs added in the last two rotations, which 
+    // always includes every mac still in the ring. a mac neither filter has seen is a new token and skips the scan entirely
 
     int matching_token_index = -1;
-    int oldest_token_index = -1;
-    double oldest_token_time = 0.0;
 
-    int i;
-    for ( i = 0; i < NETCODE_MAX_CONNECT_TOKEN_ENTRIES; ++i )
+    if ( netcode_connect_token_filter_contains( connect_token_entries->filter[0], mac ) || 
+         netcode_connect_token_filter_contains( connect_token_entries->filter[1], mac ) )
     {
-        if ( memcmp( mac, connect_token_entries[i].mac, NETCODE_MAC_BYTES ) == 0 )
-            matching_token_index = i;
-        
-        if ( oldest_token_index == -1 || connect_token_entries[i].time < oldest_token_time )
+        // maybe seen before. scan every entry without stopping early, so the time taken doesn't say which entry matched.
+        // the filter check above does make a token the server has seen slower than a new one. that only tells the sender 
+        // whether this token was used recently, which it already learns from the reply: a token seen from another address 
+        // gets no challenge back. the token itself is encrypted and authenticated, so nothing else leaks through the timing
+
+        int i;
+        for ( i = 0; i < NETCODE_MAX_CONNECT_TOKEN_ENTRIES; ++i )
         {
-            oldest_token_time = connect_token_entries[i].time;
-            oldest_token_index = i;
+            if ( memcmp( mac, connect_token_entries->entries[i].mac, NETCODE_MAC_BYTES ) == 0 )
+                matching_token_index = i;
         }
     }
 
     // if no entry is found with the mac, this is a new connect token. replace the oldest token entry.
 
-    netcode_assert( oldest_token_index != -1 );
-
     if ( matching_token_index == -1 )
     {
-        connect_token_entries[oldest_token_index].time = time;
-        connect_token_entries[oldest_token_index].address = *address;
-        memcpy( connect_token_entries[oldest_token_index].mac, mac, NETCODE_MAC_BYTES );
+        struct netcode_connect_token_entry_t * entry = &connect_token_entries->entries[connect_token_entries->next_index];
+        entry->time = time;
+        entry->address = *address;
+        memcpy( entry->mac, mac, NETCODE_MAC_BYTES );
+
+        connect_token_entries->next_index = ( connect_token_entries->next_index + 1 ) % NETCODE_MAX_CONNECT_TOKEN_ENTRIES;
+
+        if ( connect_token_entries->num_filter_entries == NETCODE_MAX_CONNECT_TOKEN_ENTRIES )
+        {
+            memcpy( connect_token_entries->filter[1], connect_token_entries->filter[0], sizeof( connect_token_entries->filter[0] ) );
+            memset( connect_token_entries->filter[0], 0, sizeof( connect_token_entries->filter[0] ) );
+            connect_token_entries->num_filter_entries = 0;
+        }
+
+        netcode_connect_token_filter_add( connect_token_entries->filter[0], mac );
+        connect_token_entries->num_filter_entries++;
+
         return 1;
     }
 
@@ -3551,7 +4612,7 @@ int netcode_connect_token_entries_find_or_add( struct netcode_connect_token_entr
 
     netcode_assert( matching_token_index >= 0 );
     netcode_assert( matching_token_index < NETCODE_MAX_CONNECT_TOKEN_ENTRIES );
-    if ( netcode_address_equal( &connect_token_entries[matching_token_index].address, address ) )
+    if ( netcode_address_equal( &connect_token_entries->entries[matching_token_index].address, address ) )
         return 1;
 
     return 0;
@@ -3559,979 +4620,1293 @@ int netcode_connect_token_entries_find_or_add( struct netcode_connect_token_entr
 
 // ----------------------------------------------------------------
 
-#define NETCODE_SERVER_FLAG_IGNORE_CONNECTION_REQUEST_PACKETS       1
-#define NETCODE_SERVER_FLAG_IGNORE_CONNECTION_RESPONSE_PACKETS      (1<<1)
+#define NETCODE_MAX_CHALLENGE_RATE_ENTRIES ( NETCODE_MAX_CLIENTS * 4 )
 
-void netcode_default_server_config( struct netcode_server_config_t * config )
+struct netcode_challenge_rate_entry_t
 {
-    netcode_assert( config );
-    config->allocator_context = NULL;
-    config->allocate_function = netcode_default_allocate_function;
-    config->free_function = netcode_default_free_function;
-    config->network_simulator = NULL;
-    config->callback_context = NULL;
-    config->connect_disconnect_callback = NULL;
-    config->send_loopback_packet_callback = NULL;
-    config->override_send_and_receive = 0;
-    config->send_packet_override = NULL;
-    config->receive_packet_override = NULL;
+    double window_start_time;
+    int num_challenges;
+    struct netcode_address_t address;
 };
 
-struct netcode_server_t
+void netcode_challenge_rate_entries_reset( struct netcode_challenge_rate_entry_t * challenge_rate_entries )
 {
-    struct netcode_server_config_t config;
-    struct netcode_socket_holder_t socket_holder;
-    struct netcode_address_t address;
-    uint32_t flags;
-    double time;
-    int running;
-    int max_clients;
-    int num_connected_clients;
-    uint64_t global_sequence;
-    uint64_t challenge_sequence;
-    uint8_t challenge_key[NETCODE_KEY_BYTES];
-    int client_connected[NETCODE_MAX_CLIENTS];
-    int client_timeout[NETCODE_MAX_CLIENTS];
-    int client_loopback[NETCODE_MAX_CLIENTS];
-    int client_confirmed[NETCODE_MAX_CLIENTS];
-    int client_encryption_index[NETCODE_MAX_CLIENTS];
-    uint64_t client_id[NETCODE_MAX_CLIENTS];
-    uint64_t client_sequence[NETCODE_MAX_CLIENTS];
-    double client_last_packet_send_time[NETCODE_MAX_CLIENTS];
-    double client_last_packet_receive_time[NETCODE_MAX_CLIENTS];
-    uint8_t client_user_data[NETCODE_MAX_CLIENTS][NETCODE_USER_DATA_BYTES];
-    struct netcode_replay_protection_t client_replay_protection[NETCODE_MAX_CLIENTS];
-    struct netcode_packet_queue_t client_packet_queue[NETCODE_MAX_CLIENTS];
-    struct netcode_address_t client_address[NETCODE_MAX_CLIENTS];
-    struct netcode_connect_token_entry_t connect_token_entries[NETCODE_MAX_CONNECT_TOKEN_ENTRIES];
-    struct netcode_encryption_manager_t encryption_manager;
-    uint8_t * receive_packet_data[NETCODE_SERVER_MAX_RECEIVE_PACKETS];
-    int receive_packet_bytes[NETCODE_SERVER_MAX_RECEIVE_PACKETS];
-    struct netcode_address_t receive_from[NETCODE_SERVER_MAX_RECEIVE_PACKETS];
-};
+    int i;
+    for ( i = 0; i < NETCODE_MAX_CHALLENGE_RATE_ENTRIES; ++i )
+    {
+        challenge_rate_entries[i].window_start_time = -1000.0;
+        challenge_rate_entries[i].num_challenges = 0;
+        memset( &challenge_rate_entries[i].address, 0, sizeof( struct netcode_address_t ) );
+    }
+}
 
-int netcode_server_socket_create( struct netcode_socket_t * socket,
-                                  struct netcode_address_t * address,
-                                  int send_buffer_size,
-                                  int receive_buffer_size,
-                                  NETCODE_CONST struct netcode_server_config_t * config )
+struct netcode_challenge_rate_entry_t * netcode_challenge_rate_entries_find( struct netcode_challenge_rate_entry_t * challenge_rate_entries, 
+                                                                             struct netcode_address_t * address, 
+                                                                             double time )
 {
-    netcode_assert( socket );
+    netcode_assert( challenge_rate_entries );
     netcode_assert( address );
-    netcode_assert( config );
 
-    if ( !config->network_simulator )
+    // find the entry for this address and the entry with the oldest window
+
+    int matching_entry_index = -1;
+    int oldest_entry_index = -1;
+    double oldest_entry_time = 0.0;
+
+    int i;
+    for ( i = 0; i < NETCODE_MAX_CHALLENGE_RATE_ENTRIES; ++i )
     {
-        if ( !config->override_send_and_receive )
+        if ( netcode_address_equal( address, &challenge_rate_entries[i].address ) )
+            matching_entry_index = i;
+
+        if ( oldest_entry_index == -1 || challenge_rate_entries[i].window_start_time < oldest_entry_time )
         {
-            if ( netcode_socket_create( socket, address, send_buffer_size, receive_buffer_size ) != NETCODE_SOCKET_ERROR_NONE )
-            {
-                return 0;
-            }
+            oldest_entry_time = challenge_rate_entries[i].window_start_time;
+            oldest_entry_index = i;
         }
     }
 
+    netcode_assert( oldest_entry_index != -1 );
+
+    // a new address takes over the oldest entry. an address whose window has passed starts a new one
+
+    if ( matching_entry_index == -1 )
+    {
+        challenge_rate_entries[oldest_entry_index].address = *address;
+        challenge_rate_entries[oldest_entry_index].window_start_time = time;
+        challenge_rate_entries[oldest_entry_index].num_challenges = 0;
+        return &challenge_rate_entries[oldest_entry_index];
+    }
+
+    struct netcode_challenge_rate_entry_t * entry = &challenge_rate_entries[matching_entry_index];
+
+    if ( entry->window_start_time + 1.0 <= time )
+    {
+        entry->window_start_time = time;
+        entry->num_challenges = 0;
+    }
+
+    return entry;
+}
+
+int netcode_challenge_rate_entries_allow( struct netcode_challenge_rate_entry_t * challenge_rate_entries, 
+                                          struct netcode_address_t * address, 
+                                          double time, 
+                                          int max_challenges_per_second )
+{
+    netcode_assert( max_challenges_per_second > 0 );
+
+    struct netcode_challenge_rate_entry_t * entry = netcode_challenge_rate_entries_find( challenge_rate_entries, address, time );
+
+    if ( entry->num_challenges >= max_challenges_per_second )
+        return 0;
+
+    entry->num_challenges++;
+
     return 1;
 }
 
-struct netcode_server_t * netcode_server_create_overload( NETCODE_CONST char * server_address1_string, NETCODE_CONST char * server_address2_string, NETCODE_CONST struct netcode_server_config_t * config, double time )
+int netcode_challenge_rate_entries_count( struct netcode_challenge_rate_entry_t * challenge_rate_entries, 
+                                          struct netcode_address_t * address, 
+                                          double time )
 {
-    netcode_assert( config );
-    netcode_assert( netcode.initialized );
+    // counts every call from the address in the current one second window, this one included
 
-    struct netcode_address_t server_address1;
-    struct netcode_address_t server_address2;
+    struct netcode_challenge_rate_entry_t * entry = netcode_challenge_rate_entries_find( challenge_rate_entries, address, time );
 
-    memset( &server_address1, 0, sizeof( server_address1 ) );
-    memset( &server_address2, 0, sizeof( server_address2 ) );
+    entry->num_challenges++;
 
-    if ( netcode_parse_address( server_address1_string, &server_address1 ) != NETCODE_OK )
-    {
-        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to parse server public address\n" );
-        return NULL;
-    }
+    return entry->num_challenges;
+}
 
-    if ( server_address2_string != NULL && netcode_parse_address( server_address2_string, &server_address2 ) != NETCODE_OK )
-    {
-        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to parse server public address2\n" );
-        return NULL;
-    }
+// ----------------------------------------------------------------
 
-    struct netcode_address_t bind_address_ipv4;
-    struct netcode_address_t bind_address_ipv6;
+#define NETCODE_MAX_WAIT_LIST_ENTRIES NETCODE_MAX_CLIENTS
 
-    memset( &bind_address_ipv4, 0, sizeof( bind_address_ipv4 ) );
-    memset( &bind_address_ipv6, 0, sizeof( bind_address_ipv6 ) );
+struct netcode_wait_list_entry_t
+{
+    double expire_time;
+    struct netcode_address_t address;
+};
 
-    struct netcode_socket_t socket_ipv4;
-    struct netcode_socket_t socket_ipv6;
+struct netcode_wait_list_t
+{
+    int num_entries;
+    struct netcode_wait_list_entry_t entries[NETCODE_MAX_WAIT_LIST_ENTRIES];
+};
 
-    memset( &socket_ipv4, 0, sizeof( socket_ipv4 ) );
-    memset( &socket_ipv6, 0, sizeof( socket_ipv6 ) );
+void netcode_wait_list_reset( struct netcode_wait_list_t * wait_list )
+{
+    netcode_assert( wait_list );
+    wait_list->num_entries = 0;
+    memset( wait_list->entries, 0, sizeof( wait_list->entries ) );
+}
 
-    if ( server_address1.type == NETCODE_ADDRESS_IPV4 || server_address2.type == NETCODE_ADDRESS_IPV4 )
-    {
-        bind_address_ipv4.type = NETCODE_ADDRESS_IPV4;
-        bind_address_ipv4.port = server_address1.type == NETCODE_ADDRESS_IPV4 ? server_address1.port : server_address2.port;
+void netcode_wait_list_remove( struct netcode_wait_list_t * wait_list, int index )
+{
+    netcode_assert( wait_list );
+    netcode_assert( index >= 0 );
+    netcode_assert( index < wait_list->num_entries );
 
-        if ( !netcode_server_socket_create( &socket_ipv4, &bind_address_ipv4, NETCODE_SERVER_SOCKET_SNDBUF_SIZE, NETCODE_SERVER_SOCKET_RCVBUF_SIZE, config ) )
-        {
-            return NULL;
-        }
-    }
+    // keep the list in arrival order, so positions stay first come first served
 
-    if ( server_address1.type == NETCODE_ADDRESS_IPV6 || server_address2.type == NETCODE_ADDRESS_IPV6 )
+    int i;
+    for ( i = index; i < wait_list->num_entries - 1; ++i )
     {
-        bind_address_ipv6.type = NETCODE_ADDRESS_IPV6;
-        bind_address_ipv6.port = server_address1.type == NETCODE_ADDRESS_IPV6 ? server_address1.port : server_address2.port;
+        wait_list->entries[i] = wait_list->entries[i+1];
+    }
+
+    wait_list->num_entries--;
+}
 
-        if ( !netcode_server_socket_create( &socket_ipv6, &bind_address_ipv6, NETCODE_SERVER_SOCKET_SNDBUF_SIZE, NETCODE_SERVER_SOCKET_RCVBUF_SIZE, config ) )
+int netcode_wait_list_find_or_add( struct netcode_wait_list_t * wait_list, 
+                                   struct netcode_address_t * address, 
+                                   double time, 
+                                   int timeout_seconds, 
+                                   int max_entries )
+{
+    netcode_assert( wait_list );
+    netcode_assert( address );
+    netcode_assert( max_entries > 0 );
+    netcode_assert( max_entries <= NETCODE_MAX_WAIT_LIST_ENTRIES );
+
+    // a waiting client hears nothing back, so it gives up once its connect token timeout passes. drop it at the same time.
+    // with no timeout the client waits forever, so drop it when it stops resending its request instead
+
+    int i = 0;
+    while ( i < wait_list->num_entries )
+    {
+        if ( wait_list->entries[i].expire_time < time )
         {
-            return NULL;
+            netcode_wait_list_remove( wait_list, i );
+            continue;
         }
+        i++;
     }
 
-    struct netcode_server_t * server = (struct netcode_server_t*) config->allocate_function( config->allocator_context, sizeof( struct netcode_server_t ) );
-    if ( !server )
+    for ( i = 0; i < wait_list->num_entries; ++i )
     {
-        netcode_socket_destroy( &socket_ipv4 );
-        netcode_socket_destroy( &socket_ipv6 );
-        return NULL;
+        if ( netcode_address_equal( address, &wait_list->entries[i].address ) )
+        {
+            if ( timeout_seconds <= 0 )
+            {
+                wait_list->entries[i].expire_time = time + NETCODE_WAIT_LIST_TIMEOUT;
+            }
+            return i;
+        }
     }
 
-    if ( !config->network_simulator )
-    {
-        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server listening on %s\n", server_address1_string );
-    }
-    else
-    {
-        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server listening on %s (network simulator)\n", server_address1_string );
-    }
+    if ( wait_list->num_entries >= max_entries )
+        return -1;
 
-    server->config = *config;
-    server->socket_holder.ipv4 = socket_ipv4;
-    server->socket_holder.ipv6 = socket_ipv6;
-    server->address = server_address1;
-    server->flags = 0;
-    server->time = time;
-    server->running = 0;
-    server->max_clients = 0;
-    server->num_connected_clients = 0;
-    server->global_sequence = 1ULL << 63;
+    struct netcode_wait_list_entry_t * entry = &wait_list->entries[wait_list->num_entries];
+    entry->expire_time = time + ( ( timeout_seconds > 0 ) ? timeout_seconds : NETCODE_WAIT_LIST_TIMEOUT );
+    entry->address = *address;
 
-    memset( server->client_connected, 0, sizeof( server->client_connected ) );
-    memset( server->client_loopback, 0, sizeof( server->client_loopback ) );
-    memset( server->client_confirmed, 0, sizeof( server->client_confirmed ) );
-    memset( server->client_id, 0, sizeof( server->client_id ) );
-    memset( server->client_sequence, 0, sizeof( server->client_sequence ) );
-    memset( server->client_last_packet_send_time, 0, sizeof( server->client_last_packet_send_time ) );
-    memset( server->client_last_packet_receive_time, 0, sizeof( server->client_last_packet_receive_time ) );
-    memset( server->client_address, 0, sizeof( server->client_address ) );
-    memset( server->client_user_data, 0, sizeof( server->client_user_data ) );
+    return wait_list->num_entries++;
+}
 
-    int i;
-    for ( i = 0; i < NETCODE_MAX_CLIENTS; ++i )
-        server->client_encryption_index[i] = -1;
+// ----------------------------------------------------------------
 
-    netcode_connect_token_entries_reset( server->connect_token_entries );
+#define NETCODE_SERVER_FLAG_IGNORE_CONNECTION_REQUEST_PACKETS       1
+#define NETCODE_SERVER_FLAG_IGNORE_CONNECTION_RESPONSE_PACKETS      (1<<1)
 
-    netcode_encryption_manager_reset( &server->encryption_manager );
+void netcode_default_server_config( struct netcode_server_config_t * config )
+{
+    netcode_assert( config );
+    config->allocator_context = NULL;
+    config->allocate_function = netcode_default_allocate_function;
+    config->free_function = netcode_default_free_function;
+    config->network_simulator = NULL;
+    config->callback_context = NULL;
+    config->connect_disconnect_callback = NULL;
+    config->send_loopback_packet_callback = NULL;
+    config->override_send_and_receive = 0;
+    config->send_packet_override = NULL;
+    config->receive_packet_override = NULL;
+    config->packet_send_rate = NETCODE_PACKET_SEND_RATE;
+    config->alternate_version_info = NULL;
+    config->accept_version_1_01 = 0;
+    config->proxy_protocol = 0;
+    config->source_address_callback = NULL;
+    config->num_trusted_proxies = 0;
+    memset( (void*) config->trusted_proxy_address, 0, sizeof( config->trusted_proxy_address ) );
+    config->client_address_migration = 0;
+    config->max_migration_attempts_per_second = NETCODE_MAX_MIGRATION_ATTEMPTS_PER_SECOND;
+    config->max_migration_attempts_per_address_per_second = NETCODE_MAX_MIGRATION_ATTEMPTS_PER_ADDRESS_PER_SECOND;
+    config->connect_token_used_callback = NULL;
+    config->packet_queue_size = NETCODE_PACKET_QUEUE_SIZE;
+    config->packet_queue_overflow_policy = NETCODE_PACKET_QUEUE_DROP_NEWEST;
+    config->socket_send_buffer_size = NETCODE_SERVER_SOCKET_SNDBUF_SIZE;
+    config->socket_receive_buffer_size = NETCODE_SERVER_SOCKET_RCVBUF_SIZE;
+    config->socket_tos = 0;
+    config->socket_dont_fragment = 0;
+    config->event_callback = NULL;
+    config->time_sync = 0;
+    config->max_packet_size = NETCODE_MAX_PACKET_SIZE;
+    config->send_pacing_rate = 0.0;
+    config->bandwidth_limit = 0.0;
+    config->bandwidth_limit_policy = NETCODE_BANDWIDTH_LIMIT_DROP;
+    config->egress_limit = 0.0;
+    config->max_challenges_per_second = 0;
+    config->max_challenges_per_address_per_second = 0;
+    config->max_pending_connections = 0;
+    config->send_disconnect_reason = 0;
+    config->wait_list_size = 0;
+    config->reserved_slots = 0;
+    config->assign_slot_callback = NULL;
+    config->num_alternate_protocols = 0;
+    memset( config->alternate_protocol_id, 0, sizeof( config->alternate_protocol_id ) );
+    memset( config->alternate_private_key, 0, sizeof( config->alternate_private_key ) );
+    config->public_address = NULL;
+    config->server_address_match_callback = NULL;
+    config->admin_address = NULL;
+    config->admin_secret = NULL;
+    config->security_event_callback = NULL;
+    config->connection_request_callback = NULL;
+    config->source_filter_callback = NULL;
+    config->allow_list_only = 0;
+    config->duplicate_client_id_policy = NETCODE_DUPLICATE_CLIENT_ID_DENY;
+    config->socket_reuse_port = 0;
+    config->keep_alive_jitter = NETCODE_KEEP_ALIVE_JITTER;
+    config->num_disconnect_packets = NETCODE_NUM_DISCONNECT_PACKETS;
+};
 
-    for ( i = 0; i < NETCODE_MAX_CLIENTS; ++i )
-        netcode_replay_protection_reset( &server->client_replay_protection[i] );
+#define NETCODE_SEND_WHEEL_SLOTS 256
+#define NETCODE_SEND_WHEEL_SLOT_SECONDS ( 1.0 / 256.0 )
 
-    memset( &server->client_packet_queue, 0, sizeof( server->client_packet_queue ) );
+struct netcode_send_wheel_t
+{
+    uint64_t current_tick;
+    int slot_head[NETCODE_SEND_WHEEL_SLOTS];
+    int entry_next[NETCODE_MAX_CLIENTS];
+    int entry_prev[NETCODE_MAX_CLIENTS];
+    int entry_slot[NETCODE_MAX_CLIENTS];
+    double entry_time[NETCODE_MAX_CLIENTS];
+};
 
-    return server;
+uint64_t netcode_send_wheel_tick( double time )
+{
+    return ( time > 0.0 ) ? (uint64_t) ( time / NETCODE_SEND_WHEEL_SLOT_SECONDS ) : 0;
 }
 
-struct netcode_server_t * netcode_server_create( NETCODE_CONST char * server_address_string, NETCODE_CONST struct netcode_server_config_t * config, double time )
+void netcode_send_wheel_reset( struct netcode_send_wheel_t * wheel, double time )
 {
-    return netcode_server_create_overload( server_address_string, NULL, config, time );
-}
+    netcode_assert( wheel );
 
-void netcode_server_stop( struct netcode_server_t * server );
+    wheel->current_tick = netcode_send_wheel_tick( time );
 
-void netcode_server_destroy( struct netcode_server_t * server )
+    int i;
+    for ( i = 0; i < NETCODE_SEND_WHEEL_SLOTS; ++i )
+    {
+        wheel->slot_head[i] = -1;
+    }
+
+    for ( i = 0; i < NETCODE_MAX_CLIENTS; ++i )
+    {
+        wheel->entry_next[i] = -1;
+        wheel->entry_prev[i] = -1;
+        wheel->entry_slot[i] = -1;
+        wheel->entry_time[i] = 0.0;
+    }
+}
+
+void netcode_send_wheel_remove( struct netcode_send_wheel_t * wheel, int index )
 {
-    netcode_assert( server );
+    netcode_assert( wheel );
+    netcode_assert( index >= 0 );
+    netcode_assert( index < NETCODE_MAX_CLIENTS );
 
-    netcode_server_stop( server );
+    int slot = wheel->entry_slot[index];
+    if ( slot < 0 )
+        return;
 
-    netcode_socket_destroy( &server->socket_holder.ipv4 );
-    netcode_socket_destroy( &server->socket_holder.ipv6 );
+    int next = wheel->entry_next[index];
+    int prev = wheel->entry_prev[index];
 
-    server->config.free_function( server->config.allocator_context, server );
+    if ( prev >= 0 )
+        wheel->entry_next[prev] = next;
+    else
+        wheel->slot_head[slot] = next;
+
+    if ( next >= 0 )
+        wheel->entry_prev[next] = prev;
+
+    wheel->entry_next[index] = -1;
+    wheel->entry_prev[index] = -1;
+    wheel->entry_slot[index] = -1;
 }
 
-void netcode_server_start( struct netcode_server_t * server, int max_clients )
+void netcode_send_wheel_insert( struct netcode_send_wheel_t * wheel, int index, double time )
 {
-    netcode_assert( server );
-    netcode_assert( max_clients > 0 );
-    netcode_assert( max_clients <= NETCODE_MAX_CLIENTS );
+    netcode_assert( wheel );
+    netcode_assert( index >= 0 );
+    netcode_assert( index < NETCODE_MAX_CLIENTS );
 
-    if ( server->running )
-        netcode_server_stop( server );
+    netcode_send_wheel_remove( wheel, index );
 
-    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server started with %d client slots\n", max_clients );
+    // anything already due goes in the current slot so the next advance picks it up. times more than a turn of the wheel
+    // away share a slot with nearer ones and are skipped over until their turn comes around
 
-    server->running = 1;
-    server->max_clients = max_clients;
-    server->num_connected_clients = 0;
-    server->challenge_sequence = 0;    
-    netcode_generate_key( server->challenge_key );
+    uint64_t tick = netcode_send_wheel_tick( time );
+    if ( tick < wheel->current_tick )
+        tick = wheel->current_tick;
 
-    int i;
-    for ( i = 0; i < server->max_clients; ++i )
-    {
-        netcode_packet_queue_init( &server->client_packet_queue[i], server->config.allocator_context, server->config.allocate_function, server->config.free_function );
-    }
+    int slot = (int) ( tick % NETCODE_SEND_WHEEL_SLOTS );
+
+    wheel->entry_time[index] = time;
+    wheel->entry_slot[index] = slot;
+    wheel->entry_prev[index] = -1;
+    wheel->entry_next[index] = wheel->slot_head[slot];
+
+    if ( wheel->slot_head[slot] >= 0 )
+        wheel->entry_prev[wheel->slot_head[slot]] = index;
+
+    wheel->slot_head[slot] = index;
 }
 
-void netcode_server_send_global_packet( struct netcode_server_t * server, void * packet, struct netcode_address_t * to, uint8_t * packet_key )
+int netcode_send_wheel_advance( struct netcode_send_wheel_t * wheel, double time, int * due )
 {
-    netcode_assert( server );
-    netcode_assert( packet );
-    netcode_assert( to );
-    netcode_assert( packet_key );
+    netcode_assert( wheel );
+    netcode_assert( due );
 
-    uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
+    // visit the slots from the last advance up to now, removing everything that is due. the current slot is visited again
+    // next time, since it can still hold entries due later in the same tick. a jump of more than a turn visits each slot once
 
-    int packet_bytes = netcode_write_packet( packet, packet_data, NETCODE_MAX_PACKET_BYTES, server->global_sequence, packet_key, server->config.protocol_id );
+    uint64_t target_tick = netcode_send_wheel_tick( time );
+    if ( target_tick < wheel->current_tick )
+        target_tick = wheel->current_tick;
 
-    netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_BYTES );
+    uint64_t num_ticks = target_tick - wheel->current_tick + 1;
+    if ( num_ticks > NETCODE_SEND_WHEEL_SLOTS )
+        num_ticks = NETCODE_SEND_WHEEL_SLOTS;
 
-    if ( server->config.network_simulator )
-    {
-        netcode_network_simulator_send_packet( server->config.network_simulator, &server->address, to, packet_data, packet_bytes );
-    }
-    else
+    int num_due = 0;
+
+    uint64_t i;
+    for ( i = 0; i < num_ticks; ++i )
     {
-        if ( server->config.override_send_and_receive )
-        {
-            server->config.send_packet_override( server->config.callback_context, to, packet_data, packet_bytes );
-        }
-        else if ( to->type == NETCODE_ADDRESS_IPV4 )
-        {
-            netcode_socket_send_packet( &server->socket_holder.ipv4, to, packet_data, packet_bytes );
-        }
-        else if ( to->type == NETCODE_ADDRESS_IPV6 )
+        int slot = (int) ( ( wheel->current_tick + i ) % NETCODE_SEND_WHEEL_SLOTS );
+        int index = wheel->slot_head[slot];
+        while ( index >= 0 )
         {
-            netcode_socket_send_packet( &server->socket_holder.ipv6, to, packet_data, packet_bytes );
+            int next = wheel->entry_next[index];
+            if ( wheel->entry_time[index] <= time )
+            {
+                netcode_send_wheel_remove( wheel, index );
+                due[num_due++] = index;
+            }
+            index = next;
         }
     }
 
-    server->global_sequence++;
+    wheel->current_tick = target_tick;
+
+    return num_due;
 }
 
-void netcode_server_send_client_packet( struct netcode_server_t * server, void * packet, int client_index )
+#define NETCODE_SERVER_MAX_VERSION_INFO 3
+
+struct netcode_server_t
+{
+    struct netcode_server_config_t config;
+    struct netcode_socket_holder_t socket_holder;
+    struct netcode_socket_t admin_socket;
+    int admin_socket_open;
+    char admin_secret[NETCODE_MAX_ADMIN_SECRET_BYTES+1];
+    struct netcode_address_t address;
+    struct netcode_address_t public_address;
+    int num_trusted_proxies;
+    struct netcode_address_t trusted_proxy_address[NETCODE_MAX_TRUSTED_PROXIES];
+    uint32_t flags;
+    double time;
+    int running;
+    int paused;
+    int paused_freeze_timeouts;
+    int max_clients;
+    int num_connected_clients;
+    uint64_t global_sequence;
+    uint64_t challenge_sequence;
+    uint8_t challenge_key[NETCODE_KEY_BYTES];
+    int previous_challenge_key_valid;
+    uint8_t previous_challenge_key[NETCODE_KEY_BYTES];
+    int session_snapshot_written;
+    int session_snapshot_read;
+    uint8_t session_snapshot_nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    int num_version_info;
+    uint8_t version_info[NETCODE_SERVER_MAX_VERSION_INFO][NETCODE_VERSION_INFO_BYTES];
+    int client_connected[NETCODE_MAX_CLIENTS];
+    int client_timeout[NETCODE_MAX_CLIENTS];
+    int client_loopback[NETCODE_MAX_CLIENTS];
+    int client_confirmed[NETCODE_MAX_CLIENTS];
+    int client_disconnect_reason[NETCODE_MAX_CLIENTS];
+    int client_kick_reason[NETCODE_MAX_CLIENTS];
+    double client_kick_time[NETCODE_MAX_CLIENTS];
+    int client_encryption_index[NETCODE_MAX_CLIENTS];
+    uint64_t client_id[NETCODE_MAX_CLIENTS];
+    uint64_t client_sequence[NETCODE_MAX_CLIENTS];
+    double client_last_packet_send_time[NETCODE_MAX_CLIENTS];
+    double client_last_packet_receive_time[NETCODE_MAX_CLIENTS];
+    double client_packet_send_rate[NETCODE_MAX_CLIENTS];
+    double client_keep_alive_offset[NETCODE_MAX_CLIENTS];
+    uint8_t client_user_data[NETCODE_MAX_CLIENTS][NETCODE_USER_DATA_BYTES];
+    void * client_tag[NETCODE_MAX_CLIENTS];
+    struct netcode_replay_protection_t client_replay_protection[NETCODE_MAX_CLIENTS];
+    struct netcode_packet_queue_t client_packet_queue[NETCODE_MAX_CLIENTS];
+    struct netcode_packet_queue_t client_send_queue[NETCODE_MAX_CLIENTS];
+    struct netcode_packet_queue_t client_low_priority_send_queue[NETCODE_MAX_CLIENTS];
+    double client_paced_send_time[NETCODE_MAX_CLIENTS];
+    double client_bandwidth_limit[NETCODE_MAX_CLIENTS];
+    double client_bandwidth_tokens[NETCODE_MAX_CLIENTS];
+    double client_bandwidth_refill_time[NETCODE_MAX_CLIENTS];
+    double egress_tokens;
+    double egress_refill_time;
+    int egress_start_index;
+    int num_send_queue_clients;
+    int send_queue_client_index[NETCODE_MAX_CLIENTS];
+    uint8_t client_send_queue_scheduled[NETCODE_MAX_CLIENTS];
+    struct netcode_send_wheel_t keep_alive_wheel;
+    double last_handshake_sweep_time;
+    struct netcode_address_t client_address[NETCODE_MAX_CLIENTS];
+    struct netcode_address_t client_reply_address[NETCODE_MAX_CLIENTS];
+    struct netcode_address_t client_migration_address[NETCODE_MAX_CLIENTS];
+    struct netcode_address_t client_migration_reply_address[NETCODE_MAX_CLIENTS];
+    uint64_t client_migration_challenge[NETCODE_MAX_CLIENTS];
+    struct netcode_connect_token_entries_t connect_token_entries;
+    struct netcode_challenge_rate_entry_t challenge_rate_entries[NETCODE_MAX_CHALLENGE_RATE_ENTRIES];
+    struct netcode_challenge_rate_entry_t request_rate_entries[NETCODE_MAX_CHALLENGE_RATE_ENTRIES];
+    struct netcode_challenge_rate_entry_t migration_rate_entries[NETCODE_MAX_CHALLENGE_RATE_ENTRIES];
+    double challenge_window_start_time;
+    int challenge_window_num_challenges;
+    double migration_window_start_time;
+    int migration_window_num_attempts;
+    struct netcode_wait_list_t wait_list;
+    struct netcode_encryption_manager_t encryption_manager;
+    uint8_t * receive_packet_data[NETCODE_SERVER_MAX_RECEIVE_PACKETS];
+    int receive_packet_bytes[NETCODE_SERVER_MAX_RECEIVE_PACKETS];
+    struct netcode_address_t receive_from[NETCODE_SERVER_MAX_RECEIVE_PACKETS];
+    uint64_t counters[NETCODE_SERVER_NUM_COUNTERS];
+    int num_banned_clients;
+    uint64_t banned_client_id[NETCODE_MAX_BANNED_CLIENTS];
+    int num_allowed_clients;
+    uint64_t allowed_client_id[NETCODE_MAX_ALLOWED_CLIENTS];
+};
+
+double netcode_server_bandwidth_capacity( double bandwidth_limit )
+{
+    // the bucket holds a short burst, but always enough for one max size payload so large packets aren't starved forever
+
+    double capacity = bandwidth_limit * NETCODE_BANDWIDTH_LIMIT_BURST_SECONDS;
+    if ( capacity < NETCODE_MAX_PAYLOAD_BYTES )
+        capacity = NETCODE_MAX_PAYLOAD_BYTES;
+    return capacity;
+}
+
+void netcode_server_refill_bandwidth( struct netcode_server_t * server, int client_index )
 {
     netcode_assert( server );
-    netcode_assert( packet );
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    netcode_assert( server->client_connected[client_index] );
-    netcode_assert( !server->client_loopback[client_index] );
 
-    uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
+    double bandwidth_limit = server->client_bandwidth_limit[client_index];
 
-    if ( !netcode_encryption_manager_touch( &server->encryption_manager, 
-                                            server->client_encryption_index[client_index], 
-                                            &server->client_address[client_index], 
-                                            server->time ) )
+    if ( bandwidth_limit > 0.0 )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: encryption mapping is out of date for client %d\n", client_index );
-        return;
+        double capacity = netcode_server_bandwidth_capacity( bandwidth_limit );
+        server->client_bandwidth_tokens[client_index] += ( server->time - server->client_bandwidth_refill_time[client_index] ) * bandwidth_limit;
+        if ( server->client_bandwidth_tokens[client_index] > capacity )
+            server->client_bandwidth_tokens[client_index] = capacity;
     }
 
-    uint8_t * packet_key = netcode_encryption_manager_get_send_key( &server->encryption_manager, server->client_encryption_index[client_index] );
+    server->client_bandwidth_refill_time[client_index] = server->time;
+}
 
-    int packet_bytes = netcode_write_packet( packet, packet_data, NETCODE_MAX_PACKET_BYTES, server->client_sequence[client_index], packet_key, server->config.protocol_id );
+int netcode_server_consume_bandwidth( struct netcode_server_t * server, int client_index, int packet_bytes )
+{
+    netcode_assert( server );
 
-    netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_BYTES );
+    if ( server->client_bandwidth_limit[client_index] <= 0.0 )
+        return 1;
 
-    if ( server->config.network_simulator )
-    {
-        netcode_network_simulator_send_packet( server->config.network_simulator, &server->address, &server->client_address[client_index], packet_data, packet_bytes );
-    }
-    else
+    netcode_server_refill_bandwidth( server, client_index );
+
+    if ( server->client_bandwidth_tokens[client_index] < packet_bytes )
+        return 0;
+
+    server->client_bandwidth_tokens[client_index] -= packet_bytes;
+
+    return 1;
+}
+
+int netcode_server_socket_create( struct netcode_socket_t * socket,
+                                  struct netcode_address_t * address,
+                                  NETCODE_CONST struct netcode_server_config_t * config )
+{
+    netcode_assert( socket );
+    netcode_assert( address );
+    netcode_assert( config );
+
+    if ( !config->network_simulator )
     {
-        if ( server->config.override_send_and_receive )
-        {
-            server->config.send_packet_override( server->config.callback_context, &server->client_address[client_index], packet_data, packet_bytes );
-        }
-        else
+        if ( !config->override_send_and_receive )
         {
-            if ( server->client_address[client_index].type == NETCODE_ADDRESS_IPV4 )
+            if ( netcode_socket_create( socket, address, config->socket_send_buffer_size, config->socket_receive_buffer_size, config->socket_tos, config->socket_dont_fragment, config->socket_reuse_port ) != NETCODE_SOCKET_ERROR_NONE )
             {
-                netcode_socket_send_packet( &server->socket_holder.ipv4, &server->client_address[client_index], packet_data, packet_bytes );
-            }
-            else if ( server->client_address[client_index].type == NETCODE_ADDRESS_IPV6 )
-            {
-                netcode_socket_send_packet( &server->socket_holder.ipv6, &server->client_address[client_index], packet_data, packet_bytes );
+                return 0;
             }
         }
     }
 
-    server->client_sequence[client_index]++;
-
-    server->client_last_packet_send_time[client_index] = server->time;
+    return 1;
 }
 
-void netcode_server_disconnect_client_internal( struct netcode_server_t * server, int client_index, int send_disconnect_packets )
+int netcode_server_config_valid( NETCODE_CONST struct netcode_server_config_t * config )
 {
-    netcode_assert( server );
-    netcode_assert( server->running );
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    netcode_assert( server->client_connected[client_index] );
-    netcode_assert( !server->client_loopback[client_index] );
+    netcode_assert( config );
 
-    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server disconnected client %d\n", client_index );
+    // shared by create and update config. fields that can only be set at create are checked here too, since update config 
+    // rejects any change to them anyway
 
-    if ( server->config.connect_disconnect_callback )
+    if ( config->packet_send_rate <= 0.0 )
     {
-        server->config.connect_disconnect_callback( server->config.callback_context, client_index, 0 );
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config packet send rate must be positive\n" );
+        return 0;
     }
 
-    if ( send_disconnect_packets )
+    struct netcode_address_t public_address;
+
+    if ( config->public_address != NULL && netcode_parse_address( config->public_address, &public_address ) != NETCODE_OK )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server sent disconnect packets to client %d\n", client_index );
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to parse server config public address\n" );
+        return 0;
+    }
 
-        int i;
-        for ( i = 0; i < NETCODE_NUM_DISCONNECT_PACKETS; ++i )
-        {
-            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server sent disconnect packet %d\n", i );
+    // the admin interface takes plain text commands, so only tools on the same machine may reach it. 
+    // on shared hosts that isn't enough, and admin_secret must be set so other local users can't drive it
 
-            struct netcode_connection_disconnect_packet_t packet;
-            packet.packet_type = NETCODE_CONNECTION_DISCONNECT_PACKET;
+    struct netcode_address_t admin_address;
+    memset( &admin_address, 0, sizeof( admin_address ) );
 
-            netcode_server_send_client_packet( server, &packet, client_index );
+    if ( config->admin_address != NULL )
+    {
+        if ( netcode_parse_address( config->admin_address, &admin_address ) != NETCODE_OK )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to parse server config admin address\n" );
+            return 0;
+        }
+
+        if ( !netcode_address_is_loopback( &admin_address ) )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config admin address must be a loopback address\n" );
+            return 0;
         }
     }
 
-    while ( 1 )
+    if ( config->admin_secret != NULL && ( config->admin_secret[0] == '\0' || strlen( config->admin_secret ) > NETCODE_MAX_ADMIN_SECRET_BYTES || strchr( config->admin_secret, ' ' ) != NULL ) )
     {
-        void * packet = netcode_packet_queue_pop( &server->client_packet_queue[client_index], NULL );
-        if ( !packet )
-            break;
-        server->config.free_function( server->config.allocator_context, packet );
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config admin secret must be 1 to %d characters with no spaces\n", NETCODE_MAX_ADMIN_SECRET_BYTES );
+        return 0;
     }
 
-    netcode_packet_queue_clear( &server->client_packet_queue[client_index] );
+    if ( config->alternate_version_info && strlen( config->alternate_version_info ) != NETCODE_VERSION_INFO_BYTES - 1 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config alternate version info must be %d characters\n", NETCODE_VERSION_INFO_BYTES - 1 );
+        return 0;
+    }
 
-    netcode_replay_protection_reset( &server->client_replay_protection[client_index] );
+    if ( config->max_packet_size <= 0 || config->max_packet_size > NETCODE_MAX_PAYLOAD_BYTES )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config max packet size must be in [1,%d]\n", NETCODE_MAX_PAYLOAD_BYTES );
+        return 0;
+    }
 
-    netcode_encryption_manager_remove_encryption_mapping( &server->encryption_manager, &server->client_address[client_index], server->time );
+    if ( config->packet_queue_size <= 0 || config->packet_queue_size > NETCODE_PACKET_QUEUE_SIZE )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config packet queue size must be in [1,%d]\n", NETCODE_PACKET_QUEUE_SIZE );
+        return 0;
+    }
 
-    server->client_connected[client_index] = 0;
-    server->client_confirmed[client_index] = 0;
-    server->client_id[client_index] = 0;
-    server->client_sequence[client_index] = 0;
-    server->client_last_packet_send_time[client_index] = 0.0;
-    server->client_last_packet_receive_time[client_index] = 0.0;
-    memset( &server->client_address[client_index], 0, sizeof( struct netcode_address_t ) );
-    server->client_encryption_index[client_index] = -1;
-    memset( server->client_user_data[client_index], 0, NETCODE_USER_DATA_BYTES );
+    if ( config->packet_queue_overflow_policy != NETCODE_PACKET_QUEUE_DROP_NEWEST && config->packet_queue_overflow_policy != NETCODE_PACKET_QUEUE_DROP_OLDEST )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config packet queue overflow policy is not valid\n" );
+        return 0;
+    }
 
-    server->num_connected_clients--;
+    if ( config->send_pacing_rate < 0.0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config send pacing rate must not be negative\n" );
+        return 0;
+    }
 
-    netcode_assert( server->num_connected_clients >= 0 );
-}
+    if ( config->bandwidth_limit < 0.0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config bandwidth limit must not be negative\n" );
+        return 0;
+    }
 
-void netcode_server_disconnect_client( struct netcode_server_t * server, int client_index )
-{
-    netcode_assert( server );
+    if ( config->bandwidth_limit_policy != NETCODE_BANDWIDTH_LIMIT_DROP && config->bandwidth_limit_policy != NETCODE_BANDWIDTH_LIMIT_DELAY )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config bandwidth limit policy is not valid\n" );
+        return 0;
+    }
 
-    if ( !server->running )
-        return;
+    if ( config->duplicate_client_id_policy != NETCODE_DUPLICATE_CLIENT_ID_DENY && config->duplicate_client_id_policy != NETCODE_DUPLICATE_CLIENT_ID_REPLACE )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config duplicate client id policy is not valid\n" );
+        return 0;
+    }
 
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    netcode_assert( server->client_loopback[client_index] == 0 );
+    if ( config->keep_alive_jitter < 0.0 || config->keep_alive_jitter > 1.0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config keep alive jitter must be in [0,1]\n" );
+        return 0;
+    }
 
-    if ( !server->client_connected[client_index] )
-        return;
+    if ( config->num_disconnect_packets <= 0 || config->num_disconnect_packets > NETCODE_MAX_DISCONNECT_PACKETS )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config num disconnect packets must be in [1,%d]\n", NETCODE_MAX_DISCONNECT_PACKETS );
+        return 0;
+    }
 
-    if ( server->client_loopback[client_index] )
-        return;
+    if ( config->egress_limit < 0.0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config egress limit must not be negative\n" );
+        return 0;
+    }
 
-    netcode_server_disconnect_client_internal( server, client_index, 1 );
-}
+    if ( config->max_challenges_per_second < 0 || config->max_challenges_per_address_per_second < 0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config challenge rate limits must not be negative\n" );
+        return 0;
+    }
 
-void netcode_server_disconnect_all_clients( struct netcode_server_t * server )
-{
-    netcode_assert( server );
+    if ( config->max_migration_attempts_per_second < 0 || config->max_migration_attempts_per_address_per_second < 0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config migration rate limits must not be negative\n" );
+        return 0;
+    }
 
-    if ( !server->running )
-        return;
+    if ( config->max_pending_connections < 0 || config->max_pending_connections > NETCODE_MAX_ENCRYPTION_MAPPINGS )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config max pending connections must be in [0,%d]\n", NETCODE_MAX_ENCRYPTION_MAPPINGS );
+        return 0;
+    }
+
+    if ( config->wait_list_size < 0 || config->wait_list_size > NETCODE_MAX_WAIT_LIST_ENTRIES )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config wait list size must be in [0,%d]\n", NETCODE_MAX_WAIT_LIST_ENTRIES );
+        return 0;
+    }
+
+    if ( config->reserved_slots < 0 || config->reserved_slots > NETCODE_MAX_CLIENTS )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config reserved slots must be in [0,%d]\n", NETCODE_MAX_CLIENTS );
+        return 0;
+    }
+
+    if ( config->num_alternate_protocols < 0 || config->num_alternate_protocols > NETCODE_MAX_ALTERNATE_PROTOCOLS )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config num alternate protocols must be in [0,%d]\n", NETCODE_MAX_ALTERNATE_PROTOCOLS );
+        return 0;
+    }
 
     int i;
-    for ( i = 0; i < server->max_clients; ++i )
+    for ( i = 0; i < config->num_alternate_protocols; ++i )
     {
-        if ( server->client_connected[i] && !server->client_loopback[i] )
+        int duplicate = config->alternate_protocol_id[i] == config->protocol_id;
+        int j;
+        for ( j = 0; j < i; ++j )
+        {
+            if ( config->alternate_protocol_id[j] == config->alternate_protocol_id[i] )
+                duplicate = 1;
+        }
+        if ( duplicate )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config alternate protocol id %.16" PRIx64 " is not unique\n", config->alternate_protocol_id[i] );
+            return 0;
+        }
+    }
+
+    // a source address header is only believed when it comes from one of these. anyone else could claim to be any client
+
+    if ( config->num_trusted_proxies < 0 || config->num_trusted_proxies > NETCODE_MAX_TRUSTED_PROXIES )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config num trusted proxies must be in [0,%d]\n", NETCODE_MAX_TRUSTED_PROXIES );
+        return 0;
+    }
+
+    if ( ( config->proxy_protocol || config->source_address_callback ) && config->num_trusted_proxies == 0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config proxy protocol and source address callback need at least one trusted proxy address\n" );
+        return 0;
+    }
+
+    for ( i = 0; i < config->num_trusted_proxies; ++i )
+    {
+        struct netcode_address_t trusted_proxy_address;
+        if ( config->trusted_proxy_address[i] == NULL || netcode_parse_address( config->trusted_proxy_address[i], &trusted_proxy_address ) != NETCODE_OK )
         {
-            netcode_server_disconnect_client_internal( server, i, 1 );
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to parse server config trusted proxy address %d\n", i );
+            return 0;
         }
     }
+
+    return 1;
 }
 
-void netcode_server_stop( struct netcode_server_t * server )
+struct netcode_server_t * netcode_server_create_overload( NETCODE_CONST char * server_address1_string, NETCODE_CONST char * server_address2_string, NETCODE_CONST struct netcode_server_config_t * config, double time )
 {
-    netcode_assert( server );
-
-    if ( !server->running )
-        return;
+    netcode_assert( config );
+    netcode_assert( netcode.initialized );
 
-    netcode_server_disconnect_all_clients( server );
+    struct netcode_address_t server_address1;
+    struct netcode_address_t server_address2;
 
-    server->running = 0;
-    server->max_clients = 0;
-    server->num_connected_clients = 0;
+    memset( &server_address1, 0, sizeof( server_address1 ) );
+    memset( &server_address2, 0, sizeof( server_address2 ) );
 
-    server->global_sequence = 0;
-    server->challenge_sequence = 0;
-    memset( server->challenge_key, 0, NETCODE_KEY_BYTES );
+    if ( netcode_parse_address( server_address1_string, &server_address1 ) != NETCODE_OK )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to parse server public address\n" );
+        return NULL;
+    }
 
-    netcode_connect_token_entries_reset( server->connect_token_entries );
+    if ( server_address2_string != NULL && netcode_parse_address( server_address2_string, &server_address2 ) != NETCODE_OK )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to parse server public address2\n" );
+        return NULL;
+    }
 
-    netcode_encryption_manager_reset( &server->encryption_manager );
+    if ( !netcode_server_config_valid( config ) )
+        return NULL;
 
-    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server stopped\n" );
-}
+    // servers behind 1:1 NAT bind a private address but show up in connect tokens under the address clients actually reach
 
-int netcode_server_find_client_index_by_id( struct netcode_server_t * server, uint64_t client_id )
-{
-    netcode_assert( server );
+    struct netcode_address_t public_address = server_address1;
 
-    int i;
-    for ( i = 0; i < server->max_clients; ++i )
-    {   
-        if ( server->client_connected[i] && server->client_id[i] == client_id )
-            return i;
+    if ( config->public_address != NULL )
+    {
+        netcode_parse_address( config->public_address, &public_address );
     }
 
-    return -1;
-}
+    struct netcode_address_t admin_address;
+    memset( &admin_address, 0, sizeof( admin_address ) );
 
-int netcode_server_find_client_index_by_address( struct netcode_server_t * server, struct netcode_address_t * address )
-{
-    netcode_assert( server );
-    netcode_assert( address );
+    if ( config->admin_address != NULL )
+    {
+        netcode_parse_address( config->admin_address, &admin_address );
+    }
 
-    if ( address->type == 0 )
-        return -1;
+    struct netcode_address_t trusted_proxy_address[NETCODE_MAX_TRUSTED_PROXIES];
+    memset( trusted_proxy_address, 0, sizeof( trusted_proxy_address ) );
 
     int i;
-    for ( i = 0; i < server->max_clients; ++i )
-    {   
-        if ( server->client_connected[i] && netcode_address_equal( &server->client_address[i], address ) )
-            return i;
+    for ( i = 0; i < config->num_trusted_proxies; ++i )
+    {
+        netcode_parse_address( config->trusted_proxy_address[i], &trusted_proxy_address[i] );
     }
 
-    return -1;
-}
+    struct netcode_address_t bind_address_ipv4;
+    struct netcode_address_t bind_address_ipv6;
 
-void netcode_server_process_connection_request_packet( struct netcode_server_t * server, 
-                                                       struct netcode_address_t * from, 
-                                                       struct netcode_connection_request_packet_t * packet )
-{
-    netcode_assert( server );
+    memset( &bind_address_ipv4, 0, sizeof( bind_address_ipv4 ) );
+    memset( &bind_address_ipv6, 0, sizeof( bind_address_ipv6 ) );
 
-    (void) from;
+    struct netcode_socket_t socket_ipv4;
+    struct netcode_socket_t socket_ipv6;
 
-    struct netcode_connect_token_private_t connect_token_private;
-    if ( netcode_read_connect_token_private( packet->connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &connect_token_private ) != NETCODE_OK )
+    memset( &socket_ipv4, 0, sizeof( socket_ipv4 ) );
+    memset( &socket_ipv6, 0, sizeof( socket_ipv6 ) );
+
+    if ( server_address1.type == NETCODE_ADDRESS_IPV4 || server_address2.type == NETCODE_ADDRESS_IPV4 )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. failed to read connect token\n" );
-        return;
+        bind_address_ipv4.type = NETCODE_ADDRESS_IPV4;
+        bind_address_ipv4.port = server_address1.type == NETCODE_ADDRESS_IPV4 ? server_address1.port : server_address2.port;
+
+        if ( !netcode_server_socket_create( &socket_ipv4, &bind_address_ipv4, config ) )
+        {
+            return NULL;
+        }
     }
 
-    int found_server_address = 0;
-    int i;
-    for ( i = 0; i < connect_token_private.num_server_addresses; ++i )
+    if ( server_address1.type == NETCODE_ADDRESS_IPV6 || server_address2.type == NETCODE_ADDRESS_IPV6 )
     {
-        if ( netcode_address_equal( &server->address, &connect_token_private.server_addresses[i] ) )
+        bind_address_ipv6.type = NETCODE_ADDRESS_IPV6;
+        bind_address_ipv6.port = server_address1.type == NETCODE_ADDRESS_IPV6 ? server_address1.port : server_address2.port;
+
+        if ( !netcode_server_socket_create( &socket_ipv6, &bind_address_ipv6, config ) )
         {
-            found_server_address = 1;
+            return NULL;
         }
     }
-    if ( !found_server_address )
-    {   
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. server address not in connect token whitelist\n" );
-        return;
-    }
 
-    if ( netcode_server_find_client_index_by_address( server, from ) != -1 )
+    struct netcode_socket_t admin_socket;
+
+    memset( &admin_socket, 0, sizeof( admin_socket ) );
+
+    if ( config->admin_address != NULL )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. a client with this address is already connected\n" );
-        return;
+        if ( netcode_socket_create( &admin_socket, &admin_address, NETCODE_SERVER_ADMIN_SOCKET_BUFFER_SIZE, NETCODE_SERVER_ADMIN_SOCKET_BUFFER_SIZE, 0, 0, 0 ) != NETCODE_SOCKET_ERROR_NONE )
+        {
+            netcode_socket_destroy( &socket_ipv4 );
+            netcode_socket_destroy( &socket_ipv6 );
+            return NULL;
+        }
     }
 
-    if ( netcode_server_find_client_index_by_id( server, connect_token_private.client_id ) != -1 )
+    struct netcode_server_t * server = (struct netcode_server_t*) config->allocate_function( config->allocator_context, sizeof( struct netcode_server_t ) );
+    if ( !server )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. a client with this id is already connected\n" );
-        return;
+        netcode_socket_destroy( &socket_ipv4 );
+        netcode_socket_destroy( &socket_ipv6 );
+        if ( config->admin_address != NULL )
+        {
+            netcode_socket_destroy( &admin_socket );
+        }
+        return NULL;
     }
 
-    if ( !netcode_connect_token_entries_find_or_add( server->connect_token_entries, 
-                                                     from, 
-                                                     packet->connect_token_data + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES - NETCODE_MAC_BYTES, 
-                                                     server->time ) )
+    if ( !config->network_simulator )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. connect token has already been used\n" );
-        return;
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server listening on %s\n", server_address1_string );
     }
-
-    if ( server->num_connected_clients == server->max_clients )
+    else
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server denied connection request. server is full\n" );
-
-        struct netcode_connection_denied_packet_t p;
-        p.packet_type = NETCODE_CONNECTION_DENIED_PACKET;
-        
-        netcode_server_send_global_packet( server, &p, from, connect_token_private.server_to_client_key );
-
-        return;
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server listening on %s (network simulator)\n", server_address1_string );
     }
 
-    double expire_time = ( connect_token_private.timeout_seconds >= 0 ) ? server->time + connect_token_private.timeout_seconds : -1.0;
-
-    if ( !netcode_encryption_manager_add_encryption_mapping( &server->encryption_manager, 
-                                                             from, 
-                                                             connect_token_private.server_to_client_key, 
-                                                             connect_token_private.client_to_server_key, 
-                                                             server->time, 
-                                                             expire_time,
-                                                             connect_token_private.timeout_seconds ) )
+    if ( config->admin_address != NULL )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. failed to add encryption mapping\n" );
-        return;
+        char admin_address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server admin interface listening on %s%s\n", netcode_address_to_string( &admin_socket.address, admin_address_string ), config->admin_secret ? "" : " without a secret" );
     }
 
-    struct netcode_challenge_token_t challenge_token;
-    challenge_token.client_id = connect_token_private.client_id;
-    memcpy( challenge_token.user_data, connect_token_private.user_data, NETCODE_USER_DATA_BYTES );
+    server->config = *config;
+    server->socket_holder.ipv4 = socket_ipv4;
+    server->socket_holder.ipv6 = socket_ipv6;
+    server->admin_socket = admin_socket;
+    server->admin_socket_open = config->admin_address != NULL;
+    memset( server->admin_secret, 0, sizeof( server->admin_secret ) );
+    if ( config->admin_secret )
+    {
+        strncpy( server->admin_secret, config->admin_secret, NETCODE_MAX_ADMIN_SECRET_BYTES );
+    }
+    server->address = server_address1;
+    server->public_address = public_address;
+    server->num_trusted_proxies = config->num_trusted_proxies;
+    memcpy( server->trusted_proxy_address, trusted_proxy_address, sizeof( trusted_proxy_address ) );
+    server->flags = 0;
+    server->time = time;
+    server->running = 0;
+    server->paused = 0;
+    server->paused_freeze_timeouts = 0;
+    server->max_clients = 0;
+    server->num_connected_clients = 0;
+    server->global_sequence = NETCODE_GLOBAL_SEQUENCE_START;
+    server->session_snapshot_written = 0;
+    server->session_snapshot_read = 0;
+    memset( server->session_snapshot_nonce, 0, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+
+    memset( server->version_info, 0, sizeof( server->version_info ) );
+    memcpy( server->version_info[0], NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+    server->num_version_info = 1;
+    if ( config->alternate_version_info )
+    {
+        memcpy( server->version_info[server->num_version_info], config->alternate_version_info, NETCODE_VERSION_INFO_BYTES );
+        server->num_version_info++;
+    }
+    if ( config->accept_version_1_01 )
+    {
+        memcpy( server->version_info[server->num_version_info], NETCODE_VERSION_INFO_1_01, NETCODE_VERSION_INFO_BYTES );
+        server->num_version_info++;
+    }
 
-    struct netcode_connection_challenge_packet_t challenge_packet;
-    challenge_packet.packet_type = NETCODE_CONNECTION_CHALLENGE_PACKET;
-    challenge_packet.challenge_token_sequence = server->challenge_sequence;
-    netcode_write_challenge_token( &challenge_token, challenge_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
-    if ( netcode_encrypt_challenge_token( challenge_packet.challenge_token_data, 
-                                          NETCODE_CHALLENGE_TOKEN_BYTES, 
-                                          server->challenge_sequence, 
-                                          server->challenge_key ) != NETCODE_OK )
+    memset( server->client_connected, 0, sizeof( server->client_connected ) );
+    memset( server->client_loopback, 0, sizeof( server->client_loopback ) );
+    memset( server->client_confirmed, 0, sizeof( server->client_confirmed ) );
+    memset( server->client_disconnect_reason, 0, sizeof( server->client_disconnect_reason ) );
+    memset( server->client_kick_reason, 0, sizeof( server->client_kick_reason ) );
+    memset( server->client_kick_time, 0, sizeof( server->client_kick_time ) );
+    memset( server->client_id, 0, sizeof( server->client_id ) );
+    memset( server->client_sequence, 0, sizeof( server->client_sequence ) );
+    memset( server->client_last_packet_send_time, 0, sizeof( server->client_last_packet_send_time ) );
+    memset( server->client_last_packet_receive_time, 0, sizeof( server->client_last_packet_receive_time ) );
+    memset( server->client_address, 0, sizeof( server->client_address ) );
+    memset( server->client_reply_address, 0, sizeof( server->client_reply_address ) );
+    memset( server->client_migration_address, 0, sizeof( server->client_migration_address ) );
+    memset( server->client_migration_reply_address, 0, sizeof( server->client_migration_reply_address ) );
+    memset( server->client_migration_challenge, 0, sizeof( server->client_migration_challenge ) );
+    memset( server->client_user_data, 0, sizeof( server->client_user_data ) );
+    memset( server->client_tag, 0, sizeof( server->client_tag ) );
+    memset( server->client_keep_alive_offset, 0, sizeof( server->client_keep_alive_offset ) );
+    memset( server->client_send_queue_scheduled, 0, sizeof( server->client_send_queue_scheduled ) );
+
+    server->num_send_queue_clients = 0;
+
+    netcode_send_wheel_reset( &server->keep_alive_wheel, time );
+
+    for ( i = 0; i < NETCODE_MAX_CLIENTS; ++i )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. failed to encrypt challenge token\n" );
-        return;
+        server->client_encryption_index[i] = -1;
+        server->client_packet_send_rate[i] = config->packet_send_rate;
+        server->client_bandwidth_limit[i] = config->bandwidth_limit;
     }
 
-    server->challenge_sequence++;
+    netcode_connect_token_entries_reset( &server->connect_token_entries );
 
-    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server sent connection challenge packet\n" );
+    netcode_challenge_rate_entries_reset( server->challenge_rate_entries );
 
-    netcode_server_send_global_packet( server, &challenge_packet, from, connect_token_private.server_to_client_key );
-}
+    netcode_challenge_rate_entries_reset( server->request_rate_entries );
 
-int netcode_server_find_free_client_index( struct netcode_server_t * server )
-{
-    netcode_assert( server );
+    netcode_challenge_rate_entries_reset( server->migration_rate_entries );
 
-    int i;
-    for ( i = 0; i < server->max_clients; ++i )
+    server->challenge_window_start_time = -1000.0;
+    server->challenge_window_num_challenges = 0;
+
+    server->migration_window_start_time = -1000.0;
+    server->migration_window_num_attempts = 0;
+
+    netcode_wait_list_reset( &server->wait_list );
+
+    netcode_encryption_manager_reset( &server->encryption_manager );
+
+    for ( i = 0; i < NETCODE_MAX_CLIENTS; ++i )
     {
-        if ( !server->client_connected[i] )
-            return i;
+        netcode_replay_protection_reset( &server->client_replay_protection[i] );
+        server->client_replay_protection[i].num_replayed_packets = 0;
     }
 
-    return -1;
+    memset( &server->client_packet_queue, 0, sizeof( server->client_packet_queue ) );
+
+    memset( server->counters, 0, sizeof( server->counters ) );
+
+    server->num_banned_clients = 0;
+    memset( server->banned_client_id, 0, sizeof( server->banned_client_id ) );
+
+    server->num_allowed_clients = 0;
+    memset( server->allowed_client_id, 0, sizeof( server->allowed_client_id ) );
+
+    return server;
 }
 
-void netcode_server_connect_client( struct netcode_server_t * server, 
-                                    int client_index, 
-                                    struct netcode_address_t * address, 
-                                    uint64_t client_id, 
-                                    int encryption_index,
-                                    int timeout_seconds, 
-                                    void * user_data )
+struct netcode_server_t * netcode_server_create( NETCODE_CONST char * server_address_string, NETCODE_CONST struct netcode_server_config_t * config, double time )
 {
-    netcode_assert( server );
-    netcode_assert( server->running );
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    netcode_assert( address );
-    netcode_assert( encryption_index != -1 );
-    netcode_assert( user_data );
+    return netcode_server_create_overload( server_address_string, NULL, config, time );
+}
 
-    server->num_connected_clients++;
+void netcode_server_stop( struct netcode_server_t * server );
 
-    netcode_assert( server->num_connected_clients <= server->max_clients );
+void netcode_server_destroy( struct netcode_server_t * server )
+{
+    netcode_assert( server );
 
-    netcode_assert( server->client_connected[client_index] == 0 );
+    netcode_server_stop( server );
 
-    netcode_encryption_manager_set_expire_time( &server->encryption_manager, encryption_index, -1.0 );
+    netcode_socket_destroy( &server->socket_holder.ipv4 );
+    netcode_socket_destroy( &server->socket_holder.ipv6 );
+    if ( server->admin_socket_open )
+    {
+        netcode_socket_destroy( &server->admin_socket );
+    }
 
-    server->client_connected[client_index] = 1;
-    server->client_timeout[client_index] = timeout_seconds;
-    server->client_encryption_index[client_index] = encryption_index;
-    server->client_id[client_index] = client_id;
-    server->client_sequence[client_index] = 0;
-    server->client_address[client_index] = *address;
-    server->client_last_packet_send_time[client_index] = server->time;
-    server->client_last_packet_receive_time[client_index] = server->time;
-    memcpy( server->client_user_data[client_index], user_data, NETCODE_USER_DATA_BYTES );
+    server->config.free_function( server->config.allocator_context, server );
+}
 
-    char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+void netcode_server_start( struct netcode_server_t * server, int max_clients )
+{
+    netcode_assert( server );
+    netcode_assert( max_clients > 0 );
+    netcode_assert( max_clients <= NETCODE_MAX_CLIENTS );
 
-    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server accepted client %s %.16" PRIx64 " in slot %d\n", 
-        netcode_address_to_string( address, address_string ), client_id, client_index );
+    if ( server->running )
+        netcode_server_stop( server );
 
-    struct netcode_connection_keep_alive_packet_t packet;
-    packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
-    packet.client_index = client_index;
-    packet.max_clients = server->max_clients;
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server started with %d client slots\n", max_clients );
 
-    netcode_server_send_client_packet( server, &packet, client_index );
+    server->running = 1;
+    server->paused = 0;
+    server->paused_freeze_timeouts = 0;
+    server->max_clients = max_clients;
+    server->num_connected_clients = 0;
+    server->challenge_sequence = 0;    
+    netcode_generate_key( server->challenge_key );
+    server->previous_challenge_key_valid = 0;
+    memset( server->previous_challenge_key, 0, NETCODE_KEY_BYTES );
+    server->session_snapshot_written = 0;
+    server->egress_tokens = netcode_server_bandwidth_capacity( server->config.egress_limit );
+    server->egress_refill_time = server->time;
+    server->egress_start_index = 0;
+    server->num_send_queue_clients = 0;
+    memset( server->client_send_queue_scheduled, 0, sizeof( server->client_send_queue_scheduled ) );
+    netcode_send_wheel_reset( &server->keep_alive_wheel, server->time );
+    server->last_handshake_sweep_time = server->time;
 
-    if ( server->config.connect_disconnect_callback )
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
     {
-        server->config.connect_disconnect_callback( server->config.callback_context, client_index, 1 );
+        netcode_packet_queue_init( &server->client_packet_queue[i], server->config.allocator_context, server->config.allocate_function, server->config.free_function, server->config.packet_queue_size, server->config.packet_queue_overflow_policy );
+        netcode_packet_queue_init( &server->client_send_queue[i], server->config.allocator_context, server->config.allocate_function, server->config.free_function, server->config.packet_queue_size, server->config.packet_queue_overflow_policy );
+        netcode_packet_queue_init( &server->client_low_priority_send_queue[i], server->config.allocator_context, server->config.allocate_function, server->config.free_function, server->config.packet_queue_size, server->config.packet_queue_overflow_policy );
+        server->client_paced_send_time[i] = server->time;
     }
 }
 
-void netcode_server_process_connection_response_packet( struct netcode_server_t * server, 
-                                                        struct netcode_address_t * from, 
-                                                        struct netcode_connection_response_packet_t * packet, 
-                                                        int encryption_index )
+uint64_t netcode_server_protocol_id( struct netcode_server_t * server, int protocol_index )
 {
     netcode_assert( server );
+    netcode_assert( protocol_index >= 0 );
+    netcode_assert( protocol_index <= server->config.num_alternate_protocols );
+    return ( protocol_index == 0 ) ? server->config.protocol_id : server->config.alternate_protocol_id[protocol_index - 1];
+}
 
-    if ( netcode_decrypt_challenge_token( packet->challenge_token_data, 
-                                          NETCODE_CHALLENGE_TOKEN_BYTES, 
-                                          packet->challenge_token_sequence, 
-                                          server->challenge_key ) != NETCODE_OK )
-    {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. failed to decrypt challenge token\n" );
-        return;
-    }
+uint8_t * netcode_server_private_key( struct netcode_server_t * server, int protocol_index )
+{
+    netcode_assert( server );
+    netcode_assert( protocol_index >= 0 );
+    netcode_assert( protocol_index <= server->config.num_alternate_protocols );
+    return ( protocol_index == 0 ) ? server->config.private_key : server->config.alternate_private_key[protocol_index - 1];
+}
 
-    struct netcode_challenge_token_t challenge_token;
-    if ( netcode_read_challenge_token( packet->challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES, &challenge_token ) != NETCODE_OK )
+int netcode_server_find_protocol_index( struct netcode_server_t * server, uint64_t protocol_id )
+{
+    netcode_assert( server );
+
+    int i;
+    for ( i = 0; i <= server->config.num_alternate_protocols; ++i )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. failed to read challenge token\n" );
-        return;
+        if ( netcode_server_protocol_id( server, i ) == protocol_id )
+            return i;
     }
 
-    uint8_t * packet_send_key = netcode_encryption_manager_get_send_key( &server->encryption_manager, encryption_index );
+    return -1;
+}
 
-    if ( !packet_send_key )
+void netcode_server_send_global_packet( struct netcode_server_t * server, void * packet, struct netcode_address_t * to, uint8_t * packet_key, int version_index, int protocol_index )
+{
+    netcode_assert( server );
+    netcode_assert( packet );
+    netcode_assert( to );
+    netcode_assert( packet_key );
+    netcode_assert( version_index >= 0 );
+    netcode_assert( version_index < server->num_version_info );
+
+    if ( server->global_sequence >= NETCODE_GLOBAL_SEQUENCE_LIMIT )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. no packet send key\n" );
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server global sequence is exhausted. restart the server to send global packets again\n" );
         return;
     }
 
-    if ( netcode_server_find_client_index_by_address( server, from ) != -1 )
+    uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
+
+    int packet_bytes = netcode_write_packet( packet, packet_data, NETCODE_MAX_PACKET_BYTES, server->global_sequence, packet_key, server->version_info[version_index], netcode_server_protocol_id( server, protocol_index ) );
+
+    netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_BYTES );
+
+    if ( server->config.network_simulator )
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. a client with this address is already connected\n" );
-        return;
+        netcode_network_simulator_send_packet( server->config.network_simulator, &server->address, to, packet_data, packet_bytes );
     }
-
-    if ( netcode_server_find_client_index_by_id( server, challenge_token.client_id ) != -1 )
+    else
     {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. a client with this id is already connected\n" );
-        return;
+        if ( server->config.override_send_and_receive )
+        {
+            server->config.send_packet_override( server->config.callback_context, to, packet_data, packet_bytes );
+        }
+        else if ( to->type == NETCODE_ADDRESS_IPV4 )
+        {
+            netcode_socket_send_packet( &server->socket_holder.ipv4, to, packet_data, packet_bytes );
+        }
+        else if ( to->type == NETCODE_ADDRESS_IPV6 )
+        {
+            netcode_socket_send_packet( &server->socket_holder.ipv6, to, packet_data, packet_bytes );
+        }
     }
 
-    if ( server->num_connected_clients == server->max_clients )
-    {
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server denied connection response. server is full\n" );
+    server->global_sequence++;
+}
 
-        struct netcode_connection_denied_packet_t p;
-        p.packet_type = NETCODE_CONNECTION_DENIED_PACKET;
+void netcode_server_send_client_packet_to_address( struct netcode_server_t * server, void * packet, int client_index, struct netcode_address_t * to )
+{
+    netcode_assert( server );
+    netcode_assert( packet );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( to );
+    netcode_assert( server->client_connected[client_index] );
+    netcode_assert( !server->client_loopback[client_index] );
 
-        netcode_server_send_global_packet( server, &p, from, packet_send_key );
+    // once the sessions are in a snapshot they belong to the process that reads it. sending more from here would spend sequence numbers it will use too
 
+    if ( server->session_snapshot_written )
         return;
-    }
 
-    int client_index = netcode_server_find_free_client_index( server );
+    uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
 
-    netcode_assert( client_index != -1 );
+    if ( !netcode_encryption_manager_touch( &server->encryption_manager, 
+                                            server->client_encryption_index[client_index], 
+                                            &server->client_address[client_index], 
+                                            server->time ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: encryption mapping is out of date for client %d\n", client_index );
+        return;
+    }
 
-    int timeout_seconds = netcode_encryption_manager_get_timeout( &server->encryption_manager, encryption_index );
+    uint8_t * packet_key = netcode_encryption_manager_get_send_key( &server->encryption_manager, server->client_encryption_index[client_index] );
 
-    netcode_server_connect_client( server, client_index, from, challenge_token.client_id, encryption_index, timeout_seconds, challenge_token.user_data );
-}
+    int version_index = netcode_encryption_manager_get_version_index( &server->encryption_manager, server->client_encryption_index[client_index] );
 
-void netcode_server_process_packet_internal( struct netcode_server_t * server, 
-                                             struct netcode_address_t * from, 
-                                             void * packet, 
-                                             uint64_t sequence, 
-                                             int encryption_index, 
-                                             int client_index )
-{
-    netcode_assert( server );
-    netcode_assert( packet );
+    int protocol_index = netcode_encryption_manager_get_protocol_index( &server->encryption_manager, server->client_encryption_index[client_index] );
 
-    (void) from;
-    (void) sequence;
+    int packet_bytes = netcode_write_packet( packet, packet_data, NETCODE_MAX_PACKET_BYTES, server->client_sequence[client_index], packet_key, server->version_info[version_index], netcode_server_protocol_id( server, protocol_index ) );
 
-    uint8_t packet_type = ( (uint8_t*) packet ) [0];
+    netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_BYTES );
 
-    switch ( packet_type )
+    if ( server->config.network_simulator )
     {
-        case NETCODE_CONNECTION_REQUEST_PACKET:
-        {    
-            if ( ( server->flags & NETCODE_SERVER_FLAG_IGNORE_CONNECTION_REQUEST_PACKETS ) == 0 )
+        netcode_network_simulator_send_packet( server->config.network_simulator, &server->address, to, packet_data, packet_bytes );
+    }
+    else
+    {
+        if ( server->config.override_send_and_receive )
+        {
+            server->config.send_packet_override( server->config.callback_context, to, packet_data, packet_bytes );
+        }
+        else
+        {
+            if ( to->type == NETCODE_ADDRESS_IPV4 )
             {
-                char from_address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
-                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection request from %s\n", netcode_address_to_string( from, from_address_string ) );
-                netcode_server_process_connection_request_packet( server, from, (struct netcode_connection_request_packet_t*) packet );
+                netcode_socket_send_packet( &server->socket_holder.ipv4, to, packet_data, packet_bytes );
             }
-        }
-        break;
-
-        case NETCODE_CONNECTION_RESPONSE_PACKET:
-        {    
-            if ( ( server->flags & NETCODE_SERVER_FLAG_IGNORE_CONNECTION_RESPONSE_PACKETS ) == 0 )
+            else if ( to->type == NETCODE_ADDRESS_IPV6 )
             {
-                char from_address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
-                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection response from %s\n", netcode_address_to_string( from, from_address_string ) );
-                netcode_server_process_connection_response_packet( server, from, (struct netcode_connection_response_packet_t*) packet, encryption_index );
+                netcode_socket_send_packet( &server->socket_holder.ipv6, to, packet_data, packet_bytes );
             }
         }
-        break;
+    }
 
-        case NETCODE_CONNECTION_KEEP_ALIVE_PACKET:
-        {
-            if ( client_index != -1 )
-            {
-                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection keep alive packet from client %d\n", client_index );
-                server->client_last_packet_receive_time[client_index] = server->time;
-                if ( !server->client_confirmed[client_index] )
-                {
-                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server confirmed connection with client %d\n", client_index );
-                    server->client_confirmed[client_index] = 1;
-                }
-            }
-        }
-        break;
+    server->client_sequence[client_index]++;
 
-        case NETCODE_CONNECTION_PAYLOAD_PACKET:
-        {
-            if ( client_index != -1 )
-            {
-                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection payload packet from client %d\n", client_index );
-                server->client_last_packet_receive_time[client_index] = server->time;
-                if ( !server->client_confirmed[client_index] )
-                {
-                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server confirmed connection with client %d\n", client_index );
-                    server->client_confirmed[client_index] = 1;
-                }
-                netcode_packet_queue_push( &server->client_packet_queue[client_index], packet, sequence );
-                return;
-            }
-        }
-        break;
+    server->client_last_packet_send_time[client_index] = server->time;
 
-        case NETCODE_CONNECTION_DISCONNECT_PACKET:
-        {
-            if ( client_index != -1 )
-            {
-                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received disconnect packet from client %d\n", client_index );
-                netcode_server_disconnect_client_internal( server, client_index, 0 );
-           }
-        }
-        break;
+    // a connection about to run out of sequence numbers is closed cleanly on the next update. the client connects again with a new connect token and new keys
 
-        default:
-            break;
+    if ( server->client_sequence[client_index] >= NETCODE_CONNECTION_SEQUENCE_LIMIT && server->client_kick_reason[client_index] == NETCODE_DISCONNECT_REASON_NONE )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server sequence exhausted for client %d\n", client_index );
+        server->client_kick_reason[client_index] = NETCODE_DISCONNECT_REASON_SEQUENCE_EXHAUSTED;
+        server->client_kick_time[client_index] = server->time;
     }
+}
 
-    server->config.free_function( server->config.allocator_context, packet );
+void netcode_server_send_client_packet( struct netcode_server_t * server, void * packet, int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+
+    netcode_server_send_client_packet_to_address( server, packet, client_index, &server->client_reply_address[client_index] );
 }
 
-void netcode_server_process_packet( struct netcode_server_t * server, struct netcode_address_t * from, uint8_t * packet_data, int packet_bytes )
+void netcode_server_disconnect_client_internal( struct netcode_server_t * server, int client_index, int disconnect_reason, int send_disconnect_packets )
 {
-    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packets, 0, sizeof( allowed_packets ) );
-    allowed_packets[NETCODE_CONNECTION_REQUEST_PACKET] = 1;
-    allowed_packets[NETCODE_CONNECTION_RESPONSE_PACKET] = 1;
-    allowed_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET] = 1;
-    allowed_packets[NETCODE_CONNECTION_PAYLOAD_PACKET] = 1;
-    allowed_packets[NETCODE_CONNECTION_DISCONNECT_PACKET] = 1;
+    netcode_assert( server );
+    netcode_assert( server->running );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( server->client_connected[client_index] );
+    netcode_assert( !server->client_loopback[client_index] );
 
-    uint64_t current_timestamp = (uint64_t) time( NULL );
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server disconnected client %d\n", client_index );
 
-    uint64_t sequence;
+    server->client_disconnect_reason[client_index] = disconnect_reason;
+    server->client_kick_reason[client_index] = NETCODE_DISCONNECT_REASON_NONE;
 
-    int encryption_index = -1;
-    int client_index = netcode_server_find_client_index_by_address( server, from );
-    if ( client_index != -1 )
-    {
-        netcode_assert( client_index >= 0 );
-        netcode_assert( client_index < server->max_clients );
-        encryption_index = server->client_encryption_index[client_index];
-    }
-    else
+    if ( server->config.connect_disconnect_callback )
     {
-        encryption_index = netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, from, server->time );
+        server->config.connect_disconnect_callback( server->config.callback_context, client_index, 0 );
     }
-    
-    uint8_t * read_packet_key = netcode_encryption_manager_get_receive_key( &server->encryption_manager, encryption_index );
 
-    if ( !read_packet_key && packet_data[0] != 0 )
+    if ( send_disconnect_packets )
     {
-        char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server could not process packet because no encryption mapping exists for %s\n", netcode_address_to_string( from, address_string ) );
-        return;
-    }
-
-    void * packet = netcode_read_packet( packet_data, 
-                                         packet_bytes, 
-                                         &sequence, 
-                                         read_packet_key, 
-                                         server->config.protocol_id, 
-                                         current_timestamp, 
-                                         server->config.private_key, 
-                                         allowed_packets, 
-                                         ( client_index != -1 ) ? &server->client_replay_protection[client_index] : NULL, 
-                                         server->config.allocator_context, 
-                                         server->config.allocate_function );
-
-    if ( !packet )
-        return;
-
-    netcode_server_process_packet_internal( server, from, packet, sequence, encryption_index, client_index );
-}
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server sent disconnect packets to client %d\n", client_index );
 
-void netcode_server_read_and_process_packet( struct netcode_server_t * server, 
-                                             struct netcode_address_t * from, 
-                                             uint8_t * packet_data, 
-                                             int packet_bytes, 
-                                             uint64_t current_timestamp, 
-                                             uint8_t * allowed_packets )
-{
-    if ( !server->running )
-        return;
+        int i;
+        for ( i = 0; i < server->config.num_disconnect_packets; ++i )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server sent disconnect packet %d\n", i );
 
-    if ( packet_bytes <= 1 )
-        return;
+            // clients that don't understand the reason extension drop packets carrying it, so
+            // only every other packet in the burst carries the reason when it is enabled
 
-    uint64_t sequence;
+            struct netcode_connection_disconnect_packet_t packet;
+            packet.packet_type = NETCODE_CONNECTION_DISCONNECT_PACKET;
+            packet.reason = ( server->config.send_disconnect_reason && ( i % 2 ) == 0 ) ? (uint8_t) disconnect_reason : NETCODE_DISCONNECT_REASON_NONE;
 
-    int encryption_index = -1;
-    int client_index = netcode_server_find_client_index_by_address( server, from );
-    if ( client_index != -1 )
-    {
-        netcode_assert( client_index >= 0 );
-        netcode_assert( client_index < server->max_clients );
-        encryption_index = server->client_encryption_index[client_index];
-    }
-    else
-    {
-        encryption_index = netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, from, server->time );
+            netcode_server_send_client_packet( server, &packet, client_index );
+        }
     }
-    
-    uint8_t * read_packet_key = netcode_encryption_manager_get_receive_key( &server->encryption_manager, encryption_index );
 
-    if ( !read_packet_key && packet_data[0] != 0 )
+    while ( 1 )
     {
-        char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
-        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server could not process packet because no encryption mapping exists for %s\n", netcode_address_to_string( from, address_string ) );
-        return;
+        void * packet = netcode_packet_queue_pop( &server->client_packet_queue[client_index], NULL );
+        if ( !packet )
+            break;
+        server->config.free_function( server->config.allocator_context, packet );
     }
 
-    void * packet = netcode_read_packet( packet_data, 
-                                         packet_bytes, 
-                                         &sequence, 
-                                         read_packet_key, 
-                                         server->config.protocol_id, 
-                                         current_timestamp, 
-                                         server->config.private_key, 
-                                         allowed_packets, 
-                                         ( client_index != -1 ) ? &server->client_replay_protection[client_index] : NULL, 
-                                         server->config.allocator_context, 
-                                         server->config.allocate_function );
+    netcode_packet_queue_clear( &server->client_packet_queue[client_index] );
 
-    if ( !packet )
-        return;
+    netcode_packet_queue_clear( &server->client_send_queue[client_index] );
 
-    netcode_server_process_packet_internal( server, from, packet, sequence, encryption_index, client_index );
-}
+    netcode_packet_queue_clear( &server->client_low_priority_send_queue[client_index] );
 
-void netcode_server_receive_packets( struct netcode_server_t * server )
-{
-    netcode_assert( server );
+    netcode_replay_protection_reset( &server->client_replay_protection[client_index] );
 
-    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packets, 0, sizeof( allowed_packets ) );
-    allowed_packets[NETCODE_CONNECTION_REQUEST_PACKET] = 1;
-    allowed_packets[NETCODE_CONNECTION_RESPONSE_PACKET] = 1;
-    allowed_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET] = 1;
-    allowed_packets[NETCODE_CONNECTION_PAYLOAD_PACKET] = 1;
-    allowed_packets[NETCODE_CONNECTION_DISCONNECT_PACKET] = 1;
+    netcode_encryption_manager_remove_encryption_mapping( &server->encryption_manager, &server->client_address[client_index], server->time );
 
-    uint64_t current_timestamp = (uint64_t) time( NULL );
+    server->client_connected[client_index] = 0;
+    server->client_confirmed[client_index] = 0;
+    server->client_id[client_index] = 0;
+    server->client_sequence[client_index] = 0;
+    server->client_last_packet_send_time[client_index] = 0.0;
+    server->client_last_packet_receive_time[client_index] = 0.0;
+    server->client_packet_send_rate[client_index] = server->config.packet_send_rate;
+    server->client_keep_alive_offset[client_index] = 0.0;
+    netcode_send_wheel_remove( &server->keep_alive_wheel, client_index );
+    server->client_bandwidth_limit[client_index] = server->config.bandwidth_limit;
+    memset( &server->client_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    memset( &server->client_reply_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    memset( &server->client_migration_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    memset( &server->client_migration_reply_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    server->client_migration_challenge[client_index] = 0;
+    server->client_encryption_index[client_index] = -1;
+    memset( server->client_user_data[client_index], 0, NETCODE_USER_DATA_BYTES );
+    server->client_tag[client_index] = NULL;
 
-    if ( !server->config.network_simulator )
-    {
-        // process packets received from socket
+    server->num_connected_clients--;
 
-        while ( 1 )
-        {
-            struct netcode_address_t from;
-            
-            uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
-            
-            int packet_bytes = 0;
-            
-            if ( server->config.override_send_and_receive )
-            {
-                packet_bytes = server->config.receive_packet_override( server->config.callback_context, &from, packet_data, NETCODE_MAX_PACKET_BYTES );
-            }
-            else
-            {
-                if (server->socket_holder.ipv4.handle != 0)
-                    packet_bytes = netcode_socket_receive_packet( &server->socket_holder.ipv4, &from, packet_data, NETCODE_MAX_PACKET_BYTES );
+    netcode_assert( server->num_connected_clients >= 0 );
+}
 
-                if ( packet_bytes == 0 && server->socket_holder.ipv6.handle != 0)
-                    packet_bytes = netcode_socket_receive_packet( &server->socket_holder.ipv6, &from, packet_data, NETCODE_MAX_PACKET_BYTES );
-            }
+void netcode_server_disconnect_client( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
 
-            if ( packet_bytes == 0 )
-                break;
+    if ( !server->running )
+        return;
 
-            netcode_server_read_and_process_packet( server, &from, packet_data, packet_bytes, current_timestamp, allowed_packets );
-        }
-    }
-    else
-    {
-        // process packets received from network simulator
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( server->client_loopback[client_index] == 0 );
 
-        int num_packets_received = netcode_network_simulator_receive_packets( server->config.network_simulator, 
-                                                                              &server->address, 
-                                                                              NETCODE_SERVER_MAX_RECEIVE_PACKETS, 
-                                                                              server->receive_packet_data, 
-                                                                              server->receive_packet_bytes, 
-                                                                              server->receive_from );
+    if ( !server->client_connected[client_index] )
+        return;
 
-        int i;
-        for ( i = 0; i < num_packets_received; ++i )
-        {
-            netcode_server_read_and_process_packet( server, 
-                                                    &server->receive_from[i], 
-                                                    server->receive_packet_data[i], 
-                                                    server->receive_packet_bytes[i], 
-                                                    current_timestamp, 
-                                                    allowed_packets );
+    if ( server->client_loopback[client_index] )
+        return;
 
-            server->config.free_function( server->config.allocator_context, server->receive_packet_data[i] );
-        }
-    }
+    netcode_server_disconnect_client_internal( server, client_index, NETCODE_DISCONNECT_REASON_KICKED, 1 );
 }
 
-void netcode_server_send_packets( struct netcode_server_t * server )
+void netcode_server_disconnect_all_clients_internal( struct netcode_server_t * server, int disconnect_reason, int send_disconnect_packets )
 {
     netcode_assert( server );
 
@@ -4541,1787 +5916,11906 @@ void netcode_server_send_packets( struct netcode_server_t * server )
     int i;
     for ( i = 0; i < server->max_clients; ++i )
     {
-        if ( server->client_connected[i] && !server->client_loopback[i] &&
-             ( server->client_last_packet_send_time[i] + ( 1.0 / NETCODE_PACKET_SEND_RATE ) <= server->time ) )
+        if ( server->client_connected[i] && !server->client_loopback[i] )
         {
-            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server sent connection keep alive packet to client %d\n", i );
-            struct netcode_connection_keep_alive_packet_t packet;
-            packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
-            packet.client_index = i;
-            packet.max_clients = server->max_clients;
-            netcode_server_send_client_packet( server, &packet, i );
+            netcode_server_disconnect_client_internal( server, i, disconnect_reason, send_disconnect_packets );
         }
     }
 }
 
-void netcode_server_check_for_timeouts( struct netcode_server_t * server )
+void netcode_server_disconnect_all_clients( struct netcode_server_t * server )
+{
+    netcode_server_disconnect_all_clients_internal( server, NETCODE_DISCONNECT_REASON_KICKED, 1 );
+}
+
+void netcode_server_stop_internal( struct netcode_server_t * server, int send_disconnect_packets )
 {
     netcode_assert( server );
 
     if ( !server->running )
         return;
 
-    int i;
-    for ( i = 0; i < server->max_clients; ++i )
-    {
-        if ( server->client_connected[i] && server->client_timeout[i] > 0 && !server->client_loopback[i] &&
-             ( server->client_last_packet_receive_time[i] + server->client_timeout[i] <= server->time ) )
-        {
-            netcode_printf( NETCODE_LOG_LEVEL_INFO, "server timed out client %d\n", i );
-            netcode_server_disconnect_client_internal( server, i, 0 );
-            return;
-        }
-    }
-}
+    netcode_server_disconnect_all_clients_internal( server, NETCODE_DISCONNECT_REASON_SERVER_SHUTDOWN, send_disconnect_packets );
 
-int netcode_server_client_connected( struct netcode_server_t * server, int client_index )
-{
-    netcode_assert( server );
+    server->running = 0;
+    server->paused = 0;
+    server->paused_freeze_timeouts = 0;
+    server->max_clients = 0;
+    server->num_connected_clients = 0;
 
-    if ( !server->running )
-        return 0;
+    server->global_sequence = NETCODE_GLOBAL_SEQUENCE_START;
+    server->challenge_sequence = 0;
+    memset( server->challenge_key, 0, NETCODE_KEY_BYTES );
+    server->previous_challenge_key_valid = 0;
+    memset( server->previous_challenge_key, 0, NETCODE_KEY_BYTES );
 
-    if ( client_index < 0 || client_index >= server->max_clients )
-        return 0;
+    netcode_connect_token_entries_reset( &server->connect_token_entries );
 
-    return server->client_connected[client_index];
-}
+    netcode_challenge_rate_entries_reset( server->challenge_rate_entries );
 
-uint64_t netcode_server_client_id( struct netcode_server_t * server, int client_index )
-{
-    netcode_assert( server );
+    netcode_challenge_rate_entries_reset( server->request_rate_entries );
 
-    if ( !server->running )
-        return 0;
+    netcode_challenge_rate_entries_reset( server->migration_rate_entries );
 
-    if ( client_index < 0 || client_index >= server->max_clients )
-        return 0;
+    server->challenge_window_start_time = -1000.0;
+    server->challenge_window_num_challenges = 0;
 
-    return server->client_id[client_index];
+    server->migration_window_start_time = -1000.0;
+    server->migration_window_num_attempts = 0;
+
+    server->num_send_queue_clients = 0;
+    memset( server->client_send_queue_scheduled, 0, sizeof( server->client_send_queue_scheduled ) );
+
+    netcode_send_wheel_reset( &server->keep_alive_wheel, server->time );
+
+    netcode_wait_list_reset( &server->wait_list );
+
+    netcode_encryption_manager_reset( &server->encryption_manager );
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server stopped\n" );
 }
 
-uint64_t netcode_server_next_packet_sequence( struct netcode_server_t * server, int client_index )
+void netcode_server_stop( struct netcode_server_t * server )
 {
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    if ( !server->client_connected[client_index] )
-        return 0;
-    return server->client_sequence[client_index];    
+    netcode_server_stop_internal( server, 1 );
 }
 
-void netcode_server_send_packet( struct netcode_server_t * server, int client_index, NETCODE_CONST uint8_t * packet_data, int packet_bytes )
+void netcode_server_stop_for_restart( struct netcode_server_t * server )
+{
+    // clients are not told the server is going away, so the sessions in a session snapshot stay alive on their side until the restarted server reads it
+
+    netcode_server_stop_internal( server, 0 );
+}
+
+void netcode_server_pause( struct netcode_server_t * server, int freeze_timeouts )
 {
     netcode_assert( server );
-    netcode_assert( packet_data );
-    netcode_assert( packet_bytes >= 0 );
-    netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_SIZE );
 
     if ( !server->running )
         return;
 
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    if ( !server->client_connected[client_index] )
-        return;
-
-    if ( !server->client_loopback[client_index] )
-    {
-        uint8_t buffer[NETCODE_MAX_PAYLOAD_BYTES*2];
-
-        struct netcode_connection_payload_packet_t * packet = (struct netcode_connection_payload_packet_t*) buffer;
-
-        packet->packet_type = NETCODE_CONNECTION_PAYLOAD_PACKET;
-        packet->payload_bytes = packet_bytes;
-        memcpy( packet->payload_data, packet_data, packet_bytes );
-
-        if ( !server->client_confirmed[client_index] )
-        {
-            struct netcode_connection_keep_alive_packet_t keep_alive_packet;
-            keep_alive_packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
-            keep_alive_packet.client_index = client_index;
-            keep_alive_packet.max_clients = server->max_clients;
-            netcode_server_send_client_packet( server, &keep_alive_packet, client_index );
-        }
-
-        netcode_server_send_client_packet( server, packet, client_index );
-    }
-    else
-    {
-        netcode_assert( server->config.send_loopback_packet_callback );
+    // connected clients keep playing while paused. only new connections are turned away, and timeouts stop counting when
+    // asked, eg. while the process sits at a debugger break or the game is down for maintenance
 
-        server->config.send_loopback_packet_callback( server->config.callback_context,
-                                                      client_index, 
-                                                      packet_data, 
-                                                      packet_bytes, 
-                                                      server->client_sequence[client_index]++ );
+    server->paused = 1;
+    server->paused_freeze_timeouts = freeze_timeouts;
 
-        server->client_last_packet_send_time[client_index] = server->time;
-    }
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server paused%s\n", freeze_timeouts ? " with timeouts frozen" : "" );
 }
 
-uint8_t * netcode_server_receive_packet( struct netcode_server_t * server, int client_index, int * packet_bytes, uint64_t * packet_sequence )
+void netcode_server_resume( struct netcode_server_t * server )
 {
     netcode_assert( server );
-    netcode_assert( packet_bytes );
-
-    if ( !server->running )
-        return NULL;
 
-    if ( !server->client_connected[client_index] )
-        return NULL;
+    if ( !server->paused )
+        return;
 
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
+    // time spent paused with timeouts frozen doesn't count against clients
 
-    struct netcode_connection_payload_packet_t * packet = (struct netcode_connection_payload_packet_t*) 
-        netcode_packet_queue_pop( &server->client_packet_queue[client_index], packet_sequence );
-    
-    if ( packet )
-    {
-        netcode_assert( packet->packet_type == NETCODE_CONNECTION_PAYLOAD_PACKET );
-        *packet_bytes = packet->payload_bytes;
-        netcode_assert( *packet_bytes >= 0 );
-        netcode_assert( *packet_bytes <= NETCODE_MAX_PACKET_BYTES );
-        return (uint8_t*) &packet->payload_data;
-    }
-    else
+    if ( server->paused_freeze_timeouts )
     {
-        return NULL;
+        int i;
+        for ( i = 0; i < server->max_clients; ++i )
+        {
+            if ( server->client_connected[i] )
+                server->client_last_packet_receive_time[i] = server->time;
+        }
     }
+
+    server->paused = 0;
+    server->paused_freeze_timeouts = 0;
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server resumed\n" );
 }
 
-void netcode_server_free_packet( struct netcode_server_t * server, void * packet )
+int netcode_server_paused( struct netcode_server_t * server )
 {
     netcode_assert( server );
-    netcode_assert( packet );
-    (void) server;
-    int offset = offsetof( struct netcode_connection_payload_packet_t, payload_data );
-    server->config.free_function( server->config.allocator_context, ( (uint8_t*) packet ) - offset );
+    return server->paused;
 }
 
-int netcode_server_num_connected_clients( struct netcode_server_t * server )
+int netcode_server_find_client_index_by_id( struct netcode_server_t * server, uint64_t client_id )
 {
     netcode_assert( server );
-    return server->num_connected_clients;
+
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
+    {   
+        if ( server->client_connected[i] && server->client_id[i] == client_id )
+            return i;
+    }
+
+    return -1;
 }
 
-void * netcode_server_client_user_data( struct netcode_server_t * server, int client_index )
+int netcode_server_find_client_index_to_replace( struct netcode_server_t * server, uint64_t client_id, struct netcode_address_t * address )
 {
     netcode_assert( server );
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    return server->client_user_data[client_index];
+    netcode_assert( address );
+
+    // with the replace policy a new session for a connected client id takes over from the old one, so a client that 
+    // crashed can come straight back instead of waiting out its timeout. a new session from the same address can't be
+    // told apart from the old one in the encryption manager, and loopback clients belong to the application, so neither is replaced
+
+    if ( server->config.duplicate_client_id_policy != NETCODE_DUPLICATE_CLIENT_ID_REPLACE )
+        return -1;
+
+    int client_index = netcode_server_find_client_index_by_id( server, client_id );
+
+    if ( client_index == -1 || server->client_loopback[client_index] || netcode_address_equal( &server->client_address[client_index], address ) )
+        return -1;
+
+    return client_index;
 }
 
-int netcode_server_running( struct netcode_server_t * server )
+int netcode_server_find_client_index_by_address( struct netcode_server_t * server, struct netcode_address_t * address )
 {
     netcode_assert( server );
-    return server->running;
+    netcode_assert( address );
+
+    if ( address->type == 0 )
+        return -1;
+
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
+    {   
+        if ( server->client_connected[i] && netcode_address_equal( &server->client_address[i], address ) )
+            return i;
+    }
+
+    return -1;
 }
 
-int netcode_server_max_clients( struct netcode_server_t * server )
+int netcode_server_disconnect_client_by_id( struct netcode_server_t * server, uint64_t client_id )
 {
-    return server->max_clients;
+    netcode_assert( server );
+
+    if ( !server->running )
+        return NETCODE_ERROR;
+
+    int client_index = netcode_server_find_client_index_by_id( server, client_id );
+    if ( client_index == -1 )
+        return NETCODE_ERROR;
+
+    if ( server->client_loopback[client_index] )
+        return NETCODE_ERROR;
+
+    netcode_server_disconnect_client_internal( server, client_index, NETCODE_DISCONNECT_REASON_KICKED, 1 );
+
+    return NETCODE_OK;
 }
 
-void netcode_server_update( struct netcode_server_t * server, double time )
+int netcode_server_client_id_banned( struct netcode_server_t * server, uint64_t client_id )
 {
     netcode_assert( server );
-    server->time = time;
-    netcode_server_receive_packets( server );
-    netcode_server_send_packets( server );
-    netcode_server_check_for_timeouts( server );
+
+    int i;
+    for ( i = 0; i < server->num_banned_clients; ++i )
+    {
+        if ( server->banned_client_id[i] == client_id )
+            return 1;
+    }
+
+    return 0;
 }
 
-void netcode_server_connect_loopback_client( struct netcode_server_t * server, int client_index, uint64_t client_id, NETCODE_CONST uint8_t * user_data )
+int netcode_server_ban_client_id( struct netcode_server_t * server, uint64_t client_id )
 {
     netcode_assert( server );
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    netcode_assert( server->running );
-    netcode_assert( !server->client_connected[client_index] );
 
-    server->num_connected_clients++;
+    if ( !netcode_server_client_id_banned( server, client_id ) )
+    {
+        if ( server->num_banned_clients == NETCODE_MAX_BANNED_CLIENTS )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server ban list is full\n" );
+            return NETCODE_ERROR;
+        }
 
-    netcode_assert( server->num_connected_clients <= server->max_clients );
+        server->banned_client_id[server->num_banned_clients] = client_id;
+        server->num_banned_clients++;
 
-    server->client_loopback[client_index] = 1;
-    server->client_connected[client_index] = 1;
-    server->client_confirmed[client_index] = 1;
-    server->client_encryption_index[client_index] = -1;
-    server->client_id[client_index] = client_id;
-    server->client_sequence[client_index] = 0;
-    memset( &server->client_address[client_index], 0, sizeof( struct netcode_address_t ) );
-    server->client_last_packet_send_time[client_index] = server->time;
-    server->client_last_packet_receive_time[client_index] = server->time;
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server banned client %.16" PRIx64 "\n", client_id );
+    }
 
-    if ( user_data )
+    // a banned client that is already connected gets kicked. loopback clients belong to the application, so they are left alone
+
+    if ( server->running )
     {
-        memcpy( server->client_user_data[client_index], user_data, NETCODE_USER_DATA_BYTES );
+        int client_index = netcode_server_find_client_index_by_id( server, client_id );
+        if ( client_index != -1 && !server->client_loopback[client_index] )
+        {
+            netcode_server_kick_client( server, client_index, NETCODE_DISCONNECT_REASON_KICKED );
+        }
     }
-    else
+
+    return NETCODE_OK;
+}
+
+int netcode_server_unban_client_id( struct netcode_server_t * server, uint64_t client_id )
+{
+    netcode_assert( server );
+
+    int i;
+    for ( i = 0; i < server->num_banned_clients; ++i )
     {
-        memset( server->client_user_data[client_index], 0, NETCODE_USER_DATA_BYTES );
+        if ( server->banned_client_id[i] == client_id )
+        {
+            server->banned_client_id[i] = server->banned_client_id[server->num_banned_clients - 1];
+            server->num_banned_clients--;
+            netcode_printf( NETCODE_LOG_LEVEL_INFO, "server unbanned client %.16" PRIx64 "\n", client_id );
+            return NETCODE_OK;
+        }
     }
 
-    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server connected loopback client %.16" PRIx64 " in slot %d\n", client_id, client_index );
+    return NETCODE_ERROR;
+}
 
-    if ( server->config.connect_disconnect_callback )
+int netcode_server_client_id_allowed( struct netcode_server_t * server, uint64_t client_id )
+{
+    netcode_assert( server );
+
+    int i;
+    for ( i = 0; i < server->num_allowed_clients; ++i )
     {
-        server->config.connect_disconnect_callback( server->config.callback_context, client_index, 1 );
+        if ( server->allowed_client_id[i] == client_id )
+            return 1;
     }
+
+    return 0;
 }
 
-void netcode_server_disconnect_loopback_client( struct netcode_server_t * server, int client_index )
+int netcode_server_allow_client_id( struct netcode_server_t * server, uint64_t client_id )
 {
     netcode_assert( server );
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    netcode_assert( server->running );
-    netcode_assert( server->client_connected[client_index] );
-    netcode_assert( server->client_loopback[client_index] );
 
-    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server disconnected loopback client %d\n", client_index );
+    if ( netcode_server_client_id_allowed( server, client_id ) )
+        return NETCODE_OK;
 
-    if ( server->config.connect_disconnect_callback )
+    if ( server->num_allowed_clients == NETCODE_MAX_ALLOWED_CLIENTS )
     {
-        server->config.connect_disconnect_callback( server->config.callback_context, client_index, 0 );
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server allow list is full\n" );
+        return NETCODE_ERROR;
     }
 
-    while ( 1 )
+    server->allowed_client_id[server->num_allowed_clients] = client_id;
+    server->num_allowed_clients++;
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server allowed client %.16" PRIx64 "\n", client_id );
+
+    return NETCODE_OK;
+}
+
+int netcode_server_disallow_client_id( struct netcode_server_t * server, uint64_t client_id )
+{
+    netcode_assert( server );
+
+    int i;
+    for ( i = 0; i < server->num_allowed_clients; ++i )
     {
-        void * packet = netcode_packet_queue_pop( &server->client_packet_queue[client_index], NULL );
-        if ( !packet )
-            break;
-        server->config.free_function( server->config.allocator_context, packet );
-    }
+        if ( server->allowed_client_id[i] == client_id )
+        {
+            server->allowed_client_id[i] = server->allowed_client_id[server->num_allowed_clients - 1];
+            server->num_allowed_clients--;
 
-    netcode_packet_queue_clear( &server->client_packet_queue[client_index] );
+            netcode_printf( NETCODE_LOG_LEVEL_INFO, "server disallowed client %.16" PRIx64 "\n", client_id );
 
-    server->client_connected[client_index] = 0;
-    server->client_loopback[client_index] = 0;
-    server->client_confirmed[client_index] = 0;
-    server->client_id[client_index] = 0;
-    server->client_sequence[client_index] = 0;
-    server->client_last_packet_send_time[client_index] = 0.0;
-    server->client_last_packet_receive_time[client_index] = 0.0;
-    memset( &server->client_address[client_index], 0, sizeof( struct netcode_address_t ) );
-    server->client_encryption_index[client_index] = -1;
-    memset( server->client_user_data[client_index], 0, NETCODE_USER_DATA_BYTES );
+            // with the allow list in force, losing a place on it is the same as a ban for a client that is already connected
 
-    server->num_connected_clients--;
+            if ( server->running && server->config.allow_list_only )
+            {
+                int client_index = netcode_server_find_client_index_by_id( server, client_id );
+                if ( client_index != -1 && !server->client_loopback[client_index] )
+                {
+                    netcode_server_kick_client( server, client_index, NETCODE_DISCONNECT_REASON_KICKED );
+                }
+            }
 
-    netcode_assert( server->num_connected_clients >= 0 );
+            return NETCODE_OK;
+        }
+    }
+
+    return NETCODE_ERROR;
 }
 
-int netcode_server_client_loopback( struct netcode_server_t * server, int client_index )
+int netcode_server_client_disconnect_reason( struct netcode_server_t * server, int client_index )
 {
     netcode_assert( server );
-    netcode_assert( server->running );
     netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    return server->client_loopback[client_index];
+    netcode_assert( client_index < NETCODE_MAX_CLIENTS );
+    return server->client_disconnect_reason[client_index];
 }
 
-void netcode_server_process_loopback_packet( struct netcode_server_t * server, int client_index, NETCODE_CONST uint8_t * packet_data, int packet_bytes, uint64_t packet_sequence )
+int netcode_server_find_version_index( struct netcode_server_t * server, uint8_t * version_info )
 {
     netcode_assert( server );
-    netcode_assert( client_index >= 0 );
-    netcode_assert( client_index < server->max_clients );
-    netcode_assert( packet_data );
-    netcode_assert( packet_bytes >= 0 );
-    netcode_assert( packet_bytes <= NETCODE_MAX_PACKET_SIZE );
-    netcode_assert( server->client_connected[client_index] );
-    netcode_assert( server->client_loopback[client_index] );
-    netcode_assert( server->running );
+    netcode_assert( version_info );
 
-    struct netcode_connection_payload_packet_t * packet = netcode_create_payload_packet( packet_bytes, server->config.allocator_context, server->config.allocate_function );
-    if ( !packet )
-        return;
+    int i;
+    for ( i = 0; i < server->num_version_info; ++i )
+    {
+        if ( memcmp( server->version_info[i], version_info, NETCODE_VERSION_INFO_BYTES ) == 0 )
+            return i;
+    }
 
-    memcpy( packet->payload_data, packet_data, packet_bytes );
+    return -1;
+}
 
-    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server processing loopback packet from client %d\n", client_index );
+int netcode_server_event_is_security( int type, int reason )
+{
+    // events that point at an attacker or a misbehaving client, rather than at normal load
 
-    server->client_last_packet_receive_time[client_index] = server->time;
+    if ( type == NETCODE_SERVER_EVENT_PACKET_REJECTED )
+        return 1;
 
-    netcode_packet_queue_push( &server->client_packet_queue[client_index], packet, packet_sequence );
+    if ( type != NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED )
+        return 0;
+
+    return reason == NETCODE_SERVER_EVENT_REASON_INVALID_REQUEST ||
+           reason == NETCODE_SERVER_EVENT_REASON_INVALID_CONNECT_TOKEN ||
+           reason == NETCODE_SERVER_EVENT_REASON_SERVER_ADDRESS_NOT_IN_TOKEN ||
+           reason == NETCODE_SERVER_EVENT_REASON_CONNECT_TOKEN_ALREADY_USED ||
+           reason == NETCODE_SERVER_EVENT_REASON_CHALLENGE_RATE_LIMITED ||
+           reason == NETCODE_SERVER_EVENT_REASON_CLIENT_BANNED ||
+           reason == NETCODE_SERVER_EVENT_REASON_CLIENT_NOT_ALLOWED ||
+           reason == NETCODE_SERVER_EVENT_REASON_REQUEST_VETOED;
 }
 
-uint16_t netcode_server_get_port( struct netcode_server_t * server )
+void netcode_server_emit_event( struct netcode_server_t * server, 
+                                int type, 
+                                int reason, 
+                                int client_index, 
+                                uint64_t client_id, 
+                                NETCODE_CONST struct netcode_address_t * address )
 {
     netcode_assert( server );
-    return server->address.type == NETCODE_ADDRESS_IPV4 ? server->socket_holder.ipv4.address.port : server->socket_holder.ipv6.address.port;
-}
-
-// ----------------------------------------------------------------
 
-int netcode_generate_connect_token( int num_server_addresses, 
-                                    NETCODE_CONST char ** public_server_addresses, 
-                                    NETCODE_CONST char ** internal_server_addresses, 
-                                    int expire_seconds, 
-                                    int timeout_seconds,
-                                    uint64_t client_id, 
-                                    uint64_t protocol_id, 
-                                    uint64_t sequence, 
-                                    NETCODE_CONST uint8_t * private_key, 
-                                    uint8_t * output_buffer )
-{
-    netcode_assert( num_server_addresses > 0 );
-    netcode_assert( num_server_addresses <= NETCODE_MAX_SERVERS_PER_CONNECT );
-    netcode_assert( public_server_addresses );
-    netcode_assert( internal_server_addresses );
-    netcode_assert( private_key );
-    netcode_assert( output_buffer );
+    int security = server->config.security_event_callback && netcode_server_event_is_security( type, reason );
 
-    // parse public server addresses
+    if ( !server->config.event_callback && !security )
+        return;
 
-    struct netcode_address_t parsed_public_server_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
-    int i;
-    for ( i = 0; i < num_server_addresses; ++i )
+    struct netcode_server_event_t event;
+    memset( &event, 0, sizeof( event ) );
+    event.type = type;
+    event.reason = reason;
+    event.client_index = client_index;
+    event.client_id = client_id;
+    if ( address )
     {
-        if ( netcode_parse_address( public_server_addresses[i], &parsed_public_server_addresses[i] ) != NETCODE_OK )
-        {
-            return NETCODE_ERROR;
-        }
+        event.address = *address;
     }
+    event.time = server->time;
 
-    // parse internal server addresses
+    if ( server->config.event_callback )
+    {
+        server->config.event_callback( server->config.callback_context, &event );
+    }
 
-     struct netcode_address_t parsed_internal_server_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
-    for ( i = 0; i < num_server_addresses; ++i )
+    if ( security )
     {
-        if ( netcode_parse_address( internal_server_addresses[i], &parsed_internal_server_addresses[i] ) != NETCODE_OK )
-        {
-            return NETCODE_ERROR;
-        }
+        server->config.security_event_callback( server->config.callback_context, &event );
     }
+}
 
-    // generate a connect token
+int netcode_server_can_use_reserved_slots( struct netcode_server_t * server, uint8_t * user_data )
+{
+    netcode_assert( server );
+    netcode_assert( user_data );
 
-    uint8_t user_data[NETCODE_USER_DATA_BYTES];
-    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
-    struct netcode_connect_token_private_t connect_token_private;
-    netcode_generate_connect_token_private( &connect_token_private, client_id, timeout_seconds, num_server_addresses, parsed_internal_server_addresses, user_data );
+    if ( server->config.reserved_slots == 0 )
+        return 0;
 
-    // write it to a buffer
+    struct netcode_user_data_claims_t claims;
+    if ( netcode_read_user_data_claims( user_data, &claims ) != NETCODE_OK )
+        return 0;
 
-    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
-    netcode_write_connect_token_private( &connect_token_private, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+    return ( claims.permissions & NETCODE_PERMISSION_RESERVED_SLOT ) != 0;
+}
 
-    // encrypt the buffer
+int netcode_server_num_slots( struct netcode_server_t * server, int reserved_slots_allowed )
+{
+    netcode_assert( server );
 
-    uint64_t create_timestamp = time( NULL );
-    uint64_t expire_timestamp = ( expire_seconds >= 0 ) ? ( create_timestamp + expire_seconds ) : 0xFFFFFFFFFFFFFFFFULL;
-    if ( netcode_encrypt_connect_token_private( connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, NETCODE_VERSION_INFO, protocol_id, expire_timestamp, sequence, private_key ) != NETCODE_OK )
-        return NETCODE_ERROR;
+    // the last reserved slots are held back for clients whose connect token claims the reserved slot permission
 
-    // wrap a connect token around the private connect token data
+    if ( reserved_slots_allowed )
+        return server->max_clients;
 
-    struct netcode_connect_token_t connect_token;
-    memcpy( connect_token.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
-    connect_token.protocol_id = protocol_id;
-    connect_token.create_timestamp = create_timestamp;
-    connect_token.expire_timestamp = expire_timestamp;
-    connect_token.sequence = sequence;
-    memcpy( connect_token.private_data, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
-    connect_token.num_server_addresses = num_server_addresses;
-    for ( i = 0; i < num_server_addresses; ++i )
-        connect_token.server_addresses[i] = parsed_public_server_addresses[i];
-    memcpy( connect_token.client_to_server_key, connect_token_private.client_to_server_key, NETCODE_KEY_BYTES );
-    memcpy( connect_token.server_to_client_key, connect_token_private.server_to_client_key, NETCODE_KEY_BYTES );
-    connect_token.timeout_seconds = timeout_seconds;
+    int num_slots = server->max_clients - server->config.reserved_slots;
 
-    // write the connect token to the output buffer
+    return ( num_slots > 0 ) ? num_slots : 0;
+}
 
-    netcode_write_connect_token( &connect_token, output_buffer, NETCODE_CONNECT_TOKEN_BYTES );
+int netcode_server_allow_challenge( struct netcode_server_t * server, struct netcode_address_t * from, uint64_t client_id )
+{
+    netcode_assert( server );
 
-    return NETCODE_OK;
-}
+    // cap the challenges sent per second, overall and to any one address, so a flood of requests can't turn the server into a crypto and bandwidth amplifier.
+    // the per address limit goes by the client's real address. behind a proxy the reply address is the proxy's, shared by every client that comes through it
 
-// ---------------------------------------------------------------
+    if ( server->config.max_challenges_per_second > 0 )
+    {
+        if ( server->challenge_window_start_time + 1.0 <= server->time )
+        {
+            server->challenge_window_start_time = server->time;
+            server->challenge_window_num_challenges = 0;
+        }
 
-#if __APPLE__
+        if ( server->challenge_window_num_challenges >= server->config.max_challenges_per_second )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. too many challenges sent this second\n" );
+            server->counters[NETCODE_SERVER_COUNTER_CHALLENGES_RATE_LIMITED]++;
+            netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CHALLENGE_RATE_LIMITED, -1, client_id, from );
+            return 0;
+        }
+    }
 
-// MacOS
+    if ( server->config.max_challenges_per_address_per_second > 0 && 
+         !netcode_challenge_rate_entries_allow( server->challenge_rate_entries, from, server->time, server->config.max_challenges_per_address_per_second ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. too many challenges sent to this address this second\n" );
+        server->counters[NETCODE_SERVER_COUNTER_CHALLENGES_RATE_LIMITED]++;
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CHALLENGE_RATE_LIMITED, -1, client_id, from );
+        return 0;
+    }
 
-#include <unistd.h>
-#include <mach/mach.h>
-#include <mach/mach_time.h>
+    server->challenge_window_num_challenges++;
 
-void netcode_sleep( double time )
-{
-    usleep( (int) ( time * 1000000 ) );
+    return 1;
 }
 
-static uint64_t start = 0;
-static mach_timebase_info_data_t timebase_info;
-
-double netcode_time()
+void netcode_server_rotate_challenge_key( struct netcode_server_t * server )
 {
-    if ( start == 0 )
-    {
-        mach_timebase_info( &timebase_info );
-        start = mach_absolute_time();
-        return 0.0;
-    }
-    uint64_t current = mach_absolute_time();
-    return ( (double) ( current - start ) ) * ( (double) timebase_info.numer ) / ( (double) timebase_info.denom ) / 1000000000.0;
-}
+    netcode_assert( server );
 
-#elif __linux
+    // clients already holding a challenge never ask for another, they just keep sending it back in connection responses. 
+    // keep the old key for one generation so those responses still decrypt. cached challenges are dropped, so duplicate 
+    // requests get a challenge under the new key
 
-// linux
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server challenge sequence exhausted. generating a new challenge key\n" );
 
-#include <unistd.h>
+    memcpy( server->previous_challenge_key, server->challenge_key, NETCODE_KEY_BYTES );
+    server->previous_challenge_key_valid = 1;
 
-void netcode_sleep( double time )
-{
-    usleep( (int) ( time * 1000000 ) );
+    netcode_generate_key( server->challenge_key );
+    server->challenge_sequence = 0;
+
+    netcode_encryption_manager_clear_challenges( &server->encryption_manager );
 }
 
-double netcode_time()
+void netcode_server_process_connection_request_packet( struct netcode_server_t * server, 
+                                                       struct netcode_address_t * from, 
+                                                       struct netcode_address_t * reply_address, 
+                                                       struct netcode_connection_request_packet_t * packet )
 {
-    static double start = -1;
-    if ( start == -1 )
-    {
-        struct timespec ts;
-        clock_gettime( CLOCK_MONOTONIC_RAW, &ts );
-        start = ts.tv_sec + ( (double) ( ts.tv_nsec ) ) / 1000000000.0;
-        return 0.0;
-    }
-    struct timespec ts;
-    clock_gettime( CLOCK_MONOTONIC_RAW, &ts );
-    double current = ts.tv_sec + ( (double) ( ts.tv_nsec ) ) / 1000000000.0;
-    return current - start;
-}
+    netcode_assert( server );
 
-#elif defined( _WIN32 )
+    (void) from;
 
-// windows
+    int version_index = netcode_server_find_version_index( server, packet->version_info );
 
-#define NOMINMAX
-#include <windows.h>
+    netcode_assert( version_index != -1 );
 
-void netcode_sleep( double time )
-{
-    int milliseconds = (int) ( time * 1000 );
-    Sleep( milliseconds );
-}
+    int protocol_index = netcode_server_find_protocol_index( server, packet->protocol_id );
 
-static int timer_initialized = 0;
-static LARGE_INTEGER timer_frequency;
-static LARGE_INTEGER timer_start;
+    netcode_assert( protocol_index != -1 );
 
-double netcode_time()
-{
-    if ( !timer_initialized )
+    struct netcode_connect_token_private_t connect_token_private;
+    if ( netcode_read_connect_token_private( packet->connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &connect_token_private ) != NETCODE_OK )
     {
-        QueryPerformanceFrequency( &timer_frequency );
-        QueryPerformanceCounter( &timer_start );
-        timer_initialized = 1;
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. failed to read connect token\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_INVALID_CONNECT_TOKEN, -1, 0, from );
+        return;
     }
-    LARGE_INTEGER now;
-    QueryPerformanceCounter( &now );
-    return ( (double) ( now.QuadPart - timer_start.QuadPart ) ) / ( (double) ( timer_frequency.QuadPart ) );
-}
-
-#else
 
-#error unsupported platform!
+    netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST, NETCODE_SERVER_EVENT_REASON_NONE, -1, connect_token_private.client_id, from );
 
-#endif
+    int requests_per_second = 0;
+    if ( server->config.connection_request_callback )
+    {
+        requests_per_second = netcode_challenge_rate_entries_count( server->request_rate_entries, from, server->time );
+    }
 
-// ---------------------------------------------------------------
+    // the token is good for this server if any address in it is ours. deployments with their own address translation can decide what "ours" means
 
-#if NETCODE_ENABLE_TESTS
+    int found_server_address = 0;
+    int i;
+    for ( i = 0; i < connect_token_private.num_server_addresses; ++i )
+    {
+        struct netcode_address_t * token_address = &connect_token_private.server_addresses[i];
 
-#include <stdio.h>
-#include <stdlib.h>
-#include <memory.h>
-#include <time.h>
+        int match = server->config.server_address_match_callback ? 
+            server->config.server_address_match_callback( server->config.callback_context, token_address ) : 
+            ( netcode_address_equal( &server->address, token_address ) || netcode_address_equal( &server->public_address, token_address ) );
 
-static void check_handler( NETCODE_CONST char * condition, 
-                           NETCODE_CONST char * function,
-                           NETCODE_CONST char * file,
-                           int line )
-{
-    printf( "check failed: ( %s ), function %s, file %s, line %d\n", condition, function, file, line );
-#ifndef NDEBUG
-    #if defined( __GNUC__ )
-        __builtin_trap();
-    #elif defined( _MSC_VER )
-        __debugbreak();
-    #endif
-#endif
-    exit( 1 );
-}
+        if ( match )
+        {
+            found_server_address = 1;
+            break;
+        }
+    }
+    if ( !found_server_address )
+    {   
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. server address not in connect token whitelist\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_SERVER_ADDRESS_NOT_IN_TOKEN, -1, connect_token_private.client_id, from );
+        return;
+    }
 
-#define check( condition )                                                                                      \
-do                                                                                                              \
-{                                                                                                               \
-    if ( !(condition) )                                                                                         \
-    {                                                                                                           \
-        check_handler( #condition, (NETCODE_CONST char*) __FUNCTION__, (char*) __FILE__, __LINE__ );            \
-    }                                                                                                           \
-} while(0)
+    if ( netcode_server_find_client_index_by_address( server, from ) != -1 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. a client with this address is already connected\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_ADDRESS_ALREADY_CONNECTED, -1, connect_token_private.client_id, from );
+        return;
+    }
 
-static void test_queue()
-{
-    struct netcode_packet_queue_t queue;
+    if ( netcode_server_find_client_index_by_id( server, connect_token_private.client_id ) != -1 && netcode_server_find_client_index_to_replace( server, connect_token_private.client_id, from ) == -1 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. a client with this id is already connected\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CLIENT_ID_ALREADY_CONNECTED, -1, connect_token_private.client_id, from );
+        return;
+    }
 
-    netcode_packet_queue_init( &queue, NULL, NULL, NULL );
+    if ( netcode_server_client_id_banned( server, connect_token_private.client_id ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. client id is banned\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CLIENT_BANNED, -1, connect_token_private.client_id, from );
+        return;
+    }
 
-    check( queue.num_packets == 0 );
-    check( queue.start_index == 0 );
+    if ( server->config.allow_list_only && !netcode_server_client_id_allowed( server, connect_token_private.client_id ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. client id is not on the allow list\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CLIENT_NOT_ALLOWED, -1, connect_token_private.client_id, from );
+        return;
+    }
 
-    // attempting to pop a packet off an empty queue should return NULL
+    // the application gets a look at every request that passed the checks above, before the connect token is spent
 
-    check( netcode_packet_queue_pop( &queue, NULL ) == NULL );
+    if ( server->config.connection_request_callback )
+    {
+        struct netcode_connection_request_info_t info;
+        memset( &info, 0, sizeof( info ) );
+        info.address = *from;
+        info.client_id = connect_token_private.client_id;
+        info.protocol_id = packet->protocol_id;
+        info.expire_timestamp = packet->connect_token_expire_timestamp;
+        info.requests_per_second = requests_per_second;
+        info.user_data = connect_token_private.user_data;
+
+        if ( !server->config.connection_request_callback( server->config.callback_context, &info ) )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. connection request callback said no\n" );
+            netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_REQUEST_VETOED, -1, connect_token_private.client_id, from );
+            return;
+        }
+    }
 
-    // add some packets to the queue and make sure they pop off in the correct order
+    // a resent request for a handshake already in flight gets the same challenge it got before. the client resends because the challenge
+    // or its response went missing, so there's no new challenge sequence, wait list position or pending mapping to set up
+
+    struct netcode_connection_challenge_packet_t challenge_packet;
+    challenge_packet.packet_type = NETCODE_CONNECTION_CHALLENGE_PACKET;
+
+    uint8_t * connect_token_mac = packet->connect_token_data + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES - NETCODE_MAC_BYTES;
+
+    int pending_encryption_index = netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, from, server->time );
+
+    if ( pending_encryption_index != -1 && 
+         netcode_encryption_manager_get_challenge( &server->encryption_manager, 
+                                                   pending_encryption_index, 
+                                                   connect_token_mac, 
+                                                   &challenge_packet.challenge_token_sequence, 
+                                                   challenge_packet.challenge_token_data ) )
     {
-        #define NUM_PACKETS 100
+        if ( !netcode_server_allow_challenge( server, from, connect_token_private.client_id ) )
+            return;
 
-        void * packets[NUM_PACKETS];
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server resent connection challenge packet\n" );
+        server->counters[NETCODE_SERVER_COUNTER_CHALLENGES_RESENT]++;
+        netcode_server_send_global_packet( server, &challenge_packet, reply_address, connect_token_private.server_to_client_key, version_index, protocol_index );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CHALLENGE_SENT, NETCODE_SERVER_EVENT_REASON_NONE, -1, connect_token_private.client_id, from );
+        return;
+    }
 
-        int i;
-        for ( i = 0; i < NUM_PACKETS; ++i )
+    if ( !netcode_connect_token_entries_find_or_add( &server->connect_token_entries, 
+                                                     from, 
+                                                     connect_token_mac, 
+                                                     server->time ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. connect token has already been used\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CONNECT_TOKEN_ALREADY_USED, -1, connect_token_private.client_id, from );
+        return;
+    }
+
+    // servers sharing a public endpoint can jointly reject token reuse through a shared store
+
+    if ( server->config.connect_token_used_callback && 
+         !server->config.connect_token_used_callback( server->config.callback_context, 
+                                                      connect_token_mac, 
+                                                      from, 
+                                                      packet->connect_token_expire_timestamp ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. connect token has already been used on another server\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CONNECT_TOKEN_ALREADY_USED, -1, connect_token_private.client_id, from );
+        return;
+    }
+
+    // with a wait list, requests that arrive while the server is full wait their turn instead of being denied. the client keeps resending
+    // its request, and as slots free up the clients at the front of the list get their challenge first. handshakes already in flight hold
+    // on to a slot, so a freed slot isn't promised to two clients at once
+
+    int reserved_slots_allowed = netcode_server_can_use_reserved_slots( server, connect_token_private.user_data );
+
+    int num_slots = netcode_server_num_slots( server, reserved_slots_allowed );
+
+    int wait_list_full = 0;
+
+    // clients allowed into a reserved slot go straight past the wait list while one is free
+
+    if ( server->config.wait_list_size > 0 && ( server->num_connected_clients >= num_slots || ( !reserved_slots_allowed && server->wait_list.num_entries > 0 ) ) )
+    {
+        int num_waiting_clients = server->wait_list.num_entries;
+
+        int position = netcode_wait_list_find_or_add( &server->wait_list, 
+                                                      from, 
+                                                      server->time, 
+                                                      connect_token_private.timeout_seconds, 
+                                                      server->config.wait_list_size );
+
+        if ( position != -1 )
         {
-            packets[i] = malloc( (i+1) * 256 );
-            check( netcode_packet_queue_push( &queue, packets[i], (uint64_t) i ) == 1 );
-        }
+            int num_free_slots = num_slots - server->num_connected_clients - netcode_encryption_manager_num_pending( &server->encryption_manager, server->time );
 
-        check( queue.num_packets == NUM_PACKETS );
+            if ( position >= num_free_slots )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. server is full, client is waiting in position %d\n", position + 1 );
+                if ( server->wait_list.num_entries > num_waiting_clients )
+                {
+                    netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CLIENT_WAITING, NETCODE_SERVER_EVENT_REASON_NONE, -1, connect_token_private.client_id, from );
+                }
+                return;
+            }
 
-        for ( i = 0; i < NUM_PACKETS; ++i )
+            netcode_wait_list_remove( &server->wait_list, position );
+        }
+        else
         {
-            uint64_t sequence = 0;
-            void * packet = netcode_packet_queue_pop( &queue, &sequence );
-            check( sequence == (uint64_t) i ) ;
-            check( packet == packets[i] );
-            free( packet );
+            wait_list_full = 1;
         }
     }
 
-    // after all entries are popped off, the queue is empty, so calls to pop should return NULL
+    if ( server->num_connected_clients >= num_slots || wait_list_full )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server denied connection request. server is full\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_SERVER_FULL, -1, connect_token_private.client_id, from );
 
-    check( queue.num_packets == 0 );
+        struct netcode_connection_denied_packet_t p;
+        p.packet_type = NETCODE_CONNECTION_DENIED_PACKET;
+        
+        netcode_server_send_global_packet( server, &p, reply_address, connect_token_private.server_to_client_key, version_index, protocol_index );
 
-    check( netcode_packet_queue_pop( &queue, NULL ) == NULL );
+        return;
+    }
 
-    // test that the packet queue can be filled to max capacity
+    if ( !netcode_server_allow_challenge( server, from, connect_token_private.client_id ) )
+        return;
 
-    void * packets[NETCODE_PACKET_QUEUE_SIZE];
+    // cap the handshakes in flight. when a new address would go over, the pending mapping heard from least recently makes room
 
-    int i;
-    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
+    if ( server->config.max_pending_connections > 0 && netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, from, server->time ) == -1 )
     {
-        packets[i] = malloc( i * 256 );
-        check( netcode_packet_queue_push( &queue, packets[i], (uint64_t) i ) == 1 );
+        while ( netcode_encryption_manager_num_pending( &server->encryption_manager, server->time ) >= server->config.max_pending_connections )
+        {
+            if ( !netcode_encryption_manager_evict_oldest_pending( &server->encryption_manager, server->time ) )
+                break;
+
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server evicted oldest pending connection\n" );
+            server->counters[NETCODE_SERVER_COUNTER_PENDING_CONNECTIONS_EVICTED]++;
+        }
     }
 
-    check( queue.num_packets == NETCODE_PACKET_QUEUE_SIZE );
+    double expire_time = ( connect_token_private.timeout_seconds >= 0 ) ? server->time + connect_token_private.timeout_seconds : -1.0;
 
-    // when the queue is full, attempting to push a packet should fail and return 0
+    if ( !netcode_encryption_manager_add_encryption_mapping( &server->encryption_manager, 
+                                                             from, 
+                                                             connect_token_private.server_to_client_key, 
+                                                             connect_token_private.client_to_server_key, 
+                                                             server->time, 
+                                                             expire_time,
+                                                             connect_token_private.timeout_seconds, 
+                                                             version_index ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. failed to add encryption mapping\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_ENCRYPTION_MAPPING_FAILED, -1, connect_token_private.client_id, from );
+        return;
+    }
 
-    check( netcode_packet_queue_push( &queue, malloc( 100 ), 0 ) == 0 );
+    int encryption_index = netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, from, server->time );
 
-    // make sure all packets pop off in the correct order
+    netcode_encryption_manager_set_protocol_index( &server->encryption_manager, encryption_index, protocol_index );
 
-    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
+    struct netcode_challenge_token_t challenge_token;
+    challenge_token.client_id = connect_token_private.client_id;
+    memcpy( challenge_token.user_data, connect_token_private.user_data, NETCODE_USER_DATA_BYTES );
+
+    // challenge tokens are encrypted with the challenge sequence as nonce, so pick a new challenge key before it wraps
+
+    if ( server->challenge_sequence >= NETCODE_GLOBAL_SEQUENCE_LIMIT )
     {
-        uint64_t sequence = 0;
-        void * packet = netcode_packet_queue_pop( &queue, &sequence );
-        check( sequence == (uint64_t) i );
-        check( packet == packets[i] );
-        free( packet );
+        netcode_server_rotate_challenge_key( server );
     }
 
-    // add some packets again
-
-    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
+    challenge_packet.challenge_token_sequence = server->challenge_sequence;
+    netcode_write_challenge_token( &challenge_token, challenge_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+    if ( netcode_encrypt_challenge_token( challenge_packet.challenge_token_data, 
+                                          NETCODE_CHALLENGE_TOKEN_BYTES, 
+                                          server->challenge_sequence, 
+                                          from, 
+                                          server->challenge_key ) != NETCODE_OK )
     {
-        packets[i] = malloc( i * 256 );
-        check( netcode_packet_queue_push( &queue, packets[i], (uint64_t) i ) == 1 );
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. failed to encrypt challenge token\n" );
+        return;
     }
 
-    // clear the queue and make sure that all packets are freed
+    netcode_encryption_manager_set_challenge( &server->encryption_manager, encryption_index, connect_token_mac, server->challenge_sequence, challenge_packet.challenge_token_data );
 
-    netcode_packet_queue_clear( &queue );
+    server->challenge_sequence++;
 
-    check( queue.start_index == 0 );
-    check( queue.num_packets == 0 );
-    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
-        check( queue.packet_data[i] == NULL );
+    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server sent connection challenge packet\n" );
+
+    netcode_server_send_global_packet( server, &challenge_packet, reply_address, connect_token_private.server_to_client_key, version_index, protocol_index );
+
+    netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CHALLENGE_SENT, NETCODE_SERVER_EVENT_REASON_NONE, -1, connect_token_private.client_id, from );
 }
 
-static void test_endian()
+int netcode_server_find_free_client_index( struct netcode_server_t * server )
 {
-    uint32_t value = 0x11223344;
+    netcode_assert( server );
 
-    char * bytes = (char*) &value;
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
+    {
+        if ( !server->client_connected[i] )
+            return i;
+    }
 
-#if NETCODE_LITTLE_ENDIAN
+    return -1;
+}
 
-    check( bytes[0] == 0x44 );
-    check( bytes[1] == 0x33 );
-    check( bytes[2] == 0x22 );
-    check( bytes[3] == 0x11 );
+double netcode_server_keep_alive_offset( struct netcode_server_t * server, int client_index )
+{
+    // each keep-alive goes out up to half the jitter early or late, so clients that connected in the same update (eg. at match
+    // start, or restored from a session snapshot) drift apart instead of all being sent a keep-alive in the same update forever
 
-#else // #if NETCODE_LITTLE_ENDIAN
+    if ( server->config.keep_alive_jitter <= 0.0 )
+        return 0.0;
 
-    check( bytes[3] == 0x44 );
-    check( bytes[2] == 0x33 );
-    check( bytes[1] == 0x22 );
-    check( bytes[0] == 0x11 );
+    double interval = 1.0 / server->client_packet_send_rate[client_index];
 
-#endif // #if NETCODE_LITTLE_ENDIAN
+    return interval * server->config.keep_alive_jitter * ( (double) netcode_random_float( 0.0f, 1.0f ) - 0.5 );
 }
 
-static void test_sequence()
+void netcode_server_schedule_keep_alive( struct netcode_server_t * server, int client_index )
 {
-    check( netcode_sequence_number_bytes_required( 0 ) == 1 );
-    check( netcode_sequence_number_bytes_required( 0x11 ) == 1 );
-    check( netcode_sequence_number_bytes_required( 0x1122 ) == 2 );
-    check( netcode_sequence_number_bytes_required( 0x112233 ) == 3 );
-    check( netcode_sequence_number_bytes_required( 0x11223344 ) == 4 );
-    check( netcode_sequence_number_bytes_required( 0x1122334455 ) == 5 );
-    check( netcode_sequence_number_bytes_required( 0x112233445566 ) == 6 );
-    check( netcode_sequence_number_bytes_required( 0x11223344556677 ) == 7 );
-    check( netcode_sequence_number_bytes_required( 0x1122334455667788 ) == 8 );
+    netcode_assert( server );
+
+    double keep_alive_time = server->client_last_packet_send_time[client_index] + ( 1.0 / server->client_packet_send_rate[client_index] ) + server->client_keep_alive_offset[client_index];
+
+    netcode_send_wheel_insert( &server->keep_alive_wheel, client_index, keep_alive_time );
 }
 
-static void test_address()
+void netcode_server_schedule_send_queue( struct netcode_server_t * server, int client_index )
 {
-    {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "[", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "[]", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "[]:", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( ":", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "1", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "12", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "123", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "1234", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "1234.0.12313.0000", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "1234.0.12313.0000.0.0.0.0.0", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "1312313:123131:1312313:123131:1312313:123131:1312313:123131:1312313:123131:1312313:123131", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( ".", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "..", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "...", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( "....", &address ) == NETCODE_ERROR );
-        check( netcode_parse_address( ".....", &address ) == NETCODE_ERROR );
-    }
+    netcode_assert( server );
 
-    {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "107.77.207.77", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV4 );
-        check( address.port == 0 );
-        check( address.data.ipv4[0] == 107 );
-        check( address.data.ipv4[1] == 77 );
-        check( address.data.ipv4[2] == 207 );
-        check( address.data.ipv4[3] == 77 );
-    }
+    if ( server->client_send_queue_scheduled[client_index] )
+        return;
 
-    {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "127.0.0.1", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV4 );
-        check( address.port == 0 );
-        check( address.data.ipv4[0] == 127 );
-        check( address.data.ipv4[1] == 0 );
-        check( address.data.ipv4[2] == 0 );
-        check( address.data.ipv4[3] == 1 );
-    }
+    // don't bank send credit while a queue sits idle
 
+    if ( server->client_paced_send_time[client_index] < server->time )
     {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "107.77.207.77:40000", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV4 );
-        check( address.port == 40000 );
-        check( address.data.ipv4[0] == 107 );
-        check( address.data.ipv4[1] == 77 );
-        check( address.data.ipv4[2] == 207 );
-        check( address.data.ipv4[3] == 77 );
+        server->client_paced_send_time[client_index] = server->time;
     }
 
-    {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "127.0.0.1:40000", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV4 );
-        check( address.port == 40000 );
-        check( address.data.ipv4[0] == 127 );
-        check( address.data.ipv4[1] == 0 );
-        check( address.data.ipv4[2] == 0 );
-        check( address.data.ipv4[3] == 1 );
-    }
+    netcode_assert( server->num_send_queue_clients < NETCODE_MAX_CLIENTS );
 
-    {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "fe80::202:b3ff:fe1e:8329", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV6 );
-        check( address.port == 0 );
-        check( address.data.ipv6[0] == 0xfe80 );
-        check( address.data.ipv6[1] == 0x0000 );
-        check( address.data.ipv6[2] == 0x0000 );
-        check( address.data.ipv6[3] == 0x0000 );
-        check( address.data.ipv6[4] == 0x0202 );
-        check( address.data.ipv6[5] == 0xb3ff );
-        check( address.data.ipv6[6] == 0xfe1e );
-        check( address.data.ipv6[7] == 0x8329 );
+    server->client_send_queue_scheduled[client_index] = 1;
+    server->send_queue_client_index[server->num_send_queue_clients++] = client_index;
+}
+
+void netcode_server_connect_client( struct netcode_server_t * server, 
+                                    int client_index, 
+                                    struct netcode_address_t * address, 
+                                    struct netcode_address_t * reply_address, 
+                                    uint64_t client_id, 
+                                    int encryption_index,
+                                    int timeout_seconds, 
+                                    uint64_t sequence,
+                                    void * user_data )
+{
+    netcode_assert( server );
+    netcode_assert( server->running );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( address );
+    netcode_assert( reply_address );
+    netcode_assert( encryption_index != -1 );
+    netcode_assert( user_data );
+
+    server->num_connected_clients++;
+
+    netcode_assert( server->num_connected_clients <= server->max_clients );
+
+    netcode_assert( server->client_connected[client_index] == 0 );
+
+    netcode_encryption_manager_set_expire_time( &server->encryption_manager, encryption_index, -1.0 );
+
+    netcode_encryption_manager_set_established( &server->encryption_manager, encryption_index );
+
+    server->client_connected[client_index] = 1;
+    server->client_timeout[client_index] = timeout_seconds;
+    server->client_encryption_index[client_index] = encryption_index;
+    server->client_id[client_index] = client_id;
+    server->client_sequence[client_index] = sequence;
+    server->client_address[client_index] = *address;
+    server->client_reply_address[client_index] = *reply_address;
+    memset( &server->client_migration_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    memset( &server->client_migration_reply_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    server->client_migration_challenge[client_index] = 0;
+    server->client_last_packet_send_time[client_index] = server->time;
+    server->client_last_packet_receive_time[client_index] = server->time;
+    server->client_packet_send_rate[client_index] = server->config.packet_send_rate;
+    server->client_keep_alive_offset[client_index] = netcode_server_keep_alive_offset( server, client_index );
+    netcode_server_schedule_keep_alive( server, client_index );
+    server->client_paced_send_time[client_index] = server->time;
+    server->client_bandwidth_limit[client_index] = server->config.bandwidth_limit;
+    server->client_bandwidth_tokens[client_index] = netcode_server_bandwidth_capacity( server->config.bandwidth_limit );
+    server->client_bandwidth_refill_time[client_index] = server->time;
+    server->client_disconnect_reason[client_index] = NETCODE_DISCONNECT_REASON_NONE;
+    server->client_kick_reason[client_index] = NETCODE_DISCONNECT_REASON_NONE;
+    memcpy( server->client_user_data[client_index], user_data, NETCODE_USER_DATA_BYTES );
+    server->client_tag[client_index] = NULL;
+
+    char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server accepted client %s %.16" PRIx64 " in slot %d\n", 
+        netcode_address_to_string( address, address_string ), client_id, client_index );
+
+    struct netcode_connection_keep_alive_packet_t packet;
+    packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+    packet.client_index = client_index;
+    packet.max_clients = server->max_clients;
+
+    netcode_server_send_client_packet( server, &packet, client_index );
+
+    netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CLIENT_CONNECTED, NETCODE_SERVER_EVENT_REASON_NONE, client_index, client_id, address );
+
+    if ( server->config.connect_disconnect_callback )
+    {
+        server->config.connect_disconnect_callback( server->config.callback_context, client_index, 1 );
     }
+}
 
+void netcode_server_process_connection_response_packet( struct netcode_server_t * server, 
+                                                        struct netcode_address_t * from, 
+                                                        struct netcode_address_t * reply_address, 
+                                                        struct netcode_connection_response_packet_t * packet, 
+                                                        int encryption_index )
+{
+    netcode_assert( server );
+
+    // a client may still be answering a challenge sent under the previous challenge key. decryption wipes the 
+    // buffer when it fails, so keep a copy of the token to try the previous key on
+
+    uint8_t encrypted_challenge_token_data[NETCODE_CHALLENGE_TOKEN_BYTES];
+    memcpy( encrypted_challenge_token_data, packet->challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+    int challenge_token_decrypted = netcode_decrypt_challenge_token( packet->challenge_token_data, 
+                                                                     NETCODE_CHALLENGE_TOKEN_BYTES, 
+                                                                     packet->challenge_token_sequence, 
+                                                                     from, 
+                                                                     server->challenge_key ) == NETCODE_OK;
+
+    if ( !challenge_token_decrypted && server->previous_challenge_key_valid )
     {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "::", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV6 );
-        check( address.port == 0 );
-        check( address.data.ipv6[0] == 0x0000 );
-        check( address.data.ipv6[1] == 0x0000 );
-        check( address.data.ipv6[2] == 0x0000 );
-        check( address.data.ipv6[3] == 0x0000 );
-        check( address.data.ipv6[4] == 0x0000 );
-        check( address.data.ipv6[5] == 0x0000 );
-        check( address.data.ipv6[6] == 0x0000 );
-        check( address.data.ipv6[7] == 0x0000 );
+        memcpy( packet->challenge_token_data, encrypted_challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+        challenge_token_decrypted = netcode_decrypt_challenge_token( packet->challenge_token_data, 
+                                                                     NETCODE_CHALLENGE_TOKEN_BYTES, 
+                                                                     packet->challenge_token_sequence, 
+                                                                     from, 
+                                                                     server->previous_challenge_key ) == NETCODE_OK;
     }
 
+    if ( !challenge_token_decrypted )
     {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "::1", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV6 );
-        check( address.port == 0 );
-        check( address.data.ipv6[0] == 0x0000 );
-        check( address.data.ipv6[1] == 0x0000 );
-        check( address.data.ipv6[2] == 0x0000 );
-        check( address.data.ipv6[3] == 0x0000 );
-        check( address.data.ipv6[4] == 0x0000 );
-        check( address.data.ipv6[5] == 0x0000 );
-        check( address.data.ipv6[6] == 0x0000 );
-        check( address.data.ipv6[7] == 0x0001 );
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. failed to decrypt challenge token\n" );
+        netcode_server_emit_event( server, NETCODE_SERVER_EVENT_PACKET_REJECTED, NETCODE_SERVER_EVENT_REASON_CHALLENGE_TOKEN_INVALID, -1, 0, from );
+        return;
     }
 
+    struct netcode_challenge_token_t challenge_token;
+    if ( netcode_read_challenge_token( packet->challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES, &challenge_token ) != NETCODE_OK )
     {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "[fe80::202:b3ff:fe1e:8329]:40000", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV6 );
-        check( address.port == 40000 );
-        check( address.data.ipv6[0] == 0xfe80 );
-        check( address.data.ipv6[1] == 0x0000 );
-        check( address.data.ipv6[2] == 0x0000 );
-        check( address.data.ipv6[3] == 0x0000 );
-        check( address.data.ipv6[4] == 0x0202 );
-        check( address.data.ipv6[5] == 0xb3ff );
-        check( address.data.ipv6[6] == 0xfe1e );
-        check( address.data.ipv6[7] == 0x8329 );
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. failed to read challenge token\n" );
+        return;
     }
 
+    uint8_t * packet_send_key = netcode_encryption_manager_get_send_key( &server->encryption_manager, encryption_index );
+
+    if ( !packet_send_key )
     {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "[::]:40000", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV6 );
-        check( address.port == 40000 );
-        check( address.data.ipv6[0] == 0x0000 );
-        check( address.data.ipv6[1] == 0x0000 );
-        check( address.data.ipv6[2] == 0x0000 );
-        check( address.data.ipv6[3] == 0x0000 );
-        check( address.data.ipv6[4] == 0x0000 );
-        check( address.data.ipv6[5] == 0x0000 );
-        check( address.data.ipv6[6] == 0x0000 );
-        check( address.data.ipv6[7] == 0x0000 );
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. no packet send key\n" );
+        return;
     }
 
+    if ( netcode_server_find_client_index_by_address( server, from ) != -1 )
     {
-        struct netcode_address_t address;
-        check( netcode_parse_address( "[::1]:40000", &address ) == NETCODE_OK );
-        check( address.type == NETCODE_ADDRESS_IPV6 );
-        check( address.port == 40000 );
-        check( address.data.ipv6[0] == 0x0000 );
-        check( address.data.ipv6[1] == 0x0000 );
-        check( address.data.ipv6[2] == 0x0000 );
-        check( address.data.ipv6[3] == 0x0000 );
-        check( address.data.ipv6[4] == 0x0000 );
-        check( address.data.ipv6[5] == 0x0000 );
-        check( address.data.ipv6[6] == 0x0000 );
-        check( address.data.ipv6[7] == 0x0001 );
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. a client with this address is already connected\n" );
+        return;
     }
-}
 
-#define TEST_PROTOCOL_ID            0x1122334455667788ULL
-#define TEST_CLIENT_ID              0x1ULL
-#define TEST_SERVER_PORT            40000
-#define TEST_CONNECT_TOKEN_EXPIRY   30
-#define TEST_TIMEOUT_SECONDS        15
+    int replace_client_index = netcode_server_find_client_index_to_replace( server, challenge_token.client_id, from );
 
-static void test_connect_token()
-{
-    // generate a connect token
+    if ( netcode_server_find_client_index_by_id( server, challenge_token.client_id ) != -1 && replace_client_index == -1 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. a client with this id is already connected\n" );
+        return;
+    }
 
-    struct netcode_address_t server_address;
-    server_address.type = NETCODE_ADDRESS_IPV4;
-    server_address.data.ipv4[0] = 127;
-    server_address.data.ipv4[1] = 0;
-    server_address.data.ipv4[2] = 0;
-    server_address.data.ipv4[3] = 1;
-    server_address.port = TEST_SERVER_PORT;
+    if ( netcode_server_client_id_banned( server, challenge_token.client_id ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. client id is banned\n" );
+        return;
+    }
 
-    uint8_t user_data[NETCODE_USER_DATA_BYTES];
-    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+    if ( server->config.allow_list_only && !netcode_server_client_id_allowed( server, challenge_token.client_id ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. client id is not on the allow list\n" );
+        return;
+    }
 
-    struct netcode_connect_token_private_t input_token;
+    if ( replace_client_index != -1 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server replacing client %d with a new connection for client id %.16" PRIx64 "\n", replace_client_index, challenge_token.client_id );
+        netcode_server_disconnect_client_internal( server, replace_client_index, NETCODE_DISCONNECT_REASON_REPLACED, 1 );
+    }
 
-    netcode_generate_connect_token_private( &input_token, TEST_CLIENT_ID, TEST_TIMEOUT_SECONDS, 1, &server_address, user_data );
+    if ( server->num_connected_clients >= netcode_server_num_slots( server, netcode_server_can_use_reserved_slots( server, challenge_token.user_data ) ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server denied connection response. server is full\n" );
 
-    check( input_token.client_id == TEST_CLIENT_ID );
-    check( input_token.num_server_addresses == 1 );
-    check( memcmp( input_token.user_data, user_data, NETCODE_USER_DATA_BYTES ) == 0 );
-    check( netcode_address_equal( &input_token.server_addresses[0], &server_address ) );
+        struct netcode_connection_denied_packet_t p;
+        p.packet_type = NETCODE_CONNECTION_DENIED_PACKET;
 
-    // write it to a buffer
+        int version_index = netcode_encryption_manager_get_version_index( &server->encryption_manager, encryption_index );
 
-    uint8_t buffer[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+        int protocol_index = netcode_encryption_manager_get_protocol_index( &server->encryption_manager, encryption_index );
 
-    netcode_write_connect_token_private( &input_token, buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+        netcode_server_send_global_packet( server, &p, reply_address, packet_send_key, version_index, protocol_index );
 
-    // encrypt the buffer
+        return;
+    }
 
-    uint64_t sequence = 1000;
-    uint64_t expire_timestamp = time( NULL ) + 30;
-    uint8_t key[NETCODE_KEY_BYTES];
-    netcode_generate_key( key );    
+    // the game may pick the slot, for example to balance teams. anything but a free slot falls back to the first free one
 
-    check( netcode_encrypt_connect_token_private( buffer, 
-                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
-                                                  NETCODE_VERSION_INFO, 
-                                                  TEST_PROTOCOL_ID, 
-                                                  expire_timestamp, 
-                                                  sequence, 
-                                                  key ) == NETCODE_OK );
+    int client_index = -1;
 
-    // decrypt the buffer
+    if ( server->config.assign_slot_callback )
+    {
+        client_index = server->config.assign_slot_callback( server->config.callback_context, challenge_token.client_id, challenge_token.user_data );
 
-    check( netcode_decrypt_connect_token_private( buffer, 
-                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
-                                                  NETCODE_VERSION_INFO, 
-                                                  TEST_PROTOCOL_ID, 
-                                                  expire_timestamp, 
-                                                  sequence, 
-                                                  key ) == NETCODE_OK );
+        if ( client_index != -1 && ( client_index < 0 || client_index >= server->max_clients || server->client_connected[client_index] ) )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored slot %d from assign slot callback. slot is not free\n", client_index );
+            client_index = -1;
+        }
+    }
 
-    // read the connect token back in
+    if ( client_index == -1 )
+    {
+        client_index = netcode_server_find_free_client_index( server );
+    }
 
-    struct netcode_connect_token_private_t output_token;
+    netcode_assert( client_index != -1 );
 
-    check( netcode_read_connect_token_private( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &output_token ) == NETCODE_OK );
+    int timeout_seconds = netcode_encryption_manager_get_timeout( &server->encryption_manager, encryption_index );
 
-    // make sure that everything matches the original connect token
+    netcode_server_connect_client( server, client_index, from, reply_address, challenge_token.client_id, encryption_index, timeout_seconds, 0, challenge_token.user_data );
+}
 
-    check( output_token.client_id == input_token.client_id );
-    check( output_token.timeout_seconds == input_token.timeout_seconds );
-    check( output_token.num_server_addresses == input_token.num_server_addresses );
-    check( netcode_address_equal( &output_token.server_addresses[0], &input_token.server_addresses[0] ) );
-    check( memcmp( output_token.client_to_server_key, input_token.client_to_server_key, NETCODE_KEY_BYTES ) == 0 );
-    check( memcmp( output_token.server_to_client_key, input_token.server_to_client_key, NETCODE_KEY_BYTES ) == 0 );
-    check( memcmp( output_token.user_data, input_token.user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+void netcode_server_process_packet_internal( struct netcode_server_t * server, 
+                                             struct netcode_address_t * from, 
+                                             struct netcode_address_t * reply_address, 
+                                             void * packet, 
+                                             uint64_t sequence, 
+                                             int encryption_index, 
+                                             int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( packet );
+
+    (void) from;
+    (void) sequence;
+
+    uint8_t packet_type = ( (uint8_t*) packet ) [0];
+
+    switch ( packet_type )
+    {
+        case NETCODE_CONNECTION_REQUEST_PACKET:
+        {    
+            if ( ( server->flags & NETCODE_SERVER_FLAG_IGNORE_CONNECTION_REQUEST_PACKETS ) == 0 )
+            {
+                char from_address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection request from %s\n", netcode_address_to_string( from, from_address_string ) );
+                netcode_server_process_connection_request_packet( server, from, reply_address, (struct netcode_connection_request_packet_t*) packet );
+            }
+        }
+        break;
+
+        case NETCODE_CONNECTION_RESPONSE_PACKET:
+        {    
+            if ( server->paused )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection response. server is paused\n" );
+            }
+            else if ( ( server->flags & NETCODE_SERVER_FLAG_IGNORE_CONNECTION_RESPONSE_PACKETS ) == 0 )
+            {
+                char from_address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection response from %s\n", netcode_address_to_string( from, from_address_string ) );
+                netcode_server_process_connection_response_packet( server, from, reply_address, (struct netcode_connection_response_packet_t*) packet, encryption_index );
+            }
+        }
+        break;
+
+        case NETCODE_CONNECTION_KEEP_ALIVE_PACKET:
+        {
+            if ( client_index != -1 )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection keep alive packet from client %d\n", client_index );
+                server->client_last_packet_receive_time[client_index] = server->time;
+                if ( !server->client_confirmed[client_index] )
+                {
+                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server confirmed connection with client %d\n", client_index );
+                    server->client_confirmed[client_index] = 1;
+                    netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CLIENT_CONFIRMED, NETCODE_SERVER_EVENT_REASON_NONE, client_index, server->client_id[client_index], from );
+                }
+            }
+        }
+        break;
+
+        case NETCODE_CONNECTION_PAYLOAD_PACKET:
+        {
+            if ( client_index != -1 )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection payload packet from client %d\n", client_index );
+                if ( (int) ( (struct netcode_connection_payload_packet_t*) packet )->payload_bytes > server->config.max_packet_size )
+                {
+                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection payload packet from client %d. payload is larger than max packet size\n", client_index );
+                    break;
+                }
+                server->client_last_packet_receive_time[client_index] = server->time;
+                if ( !server->client_confirmed[client_index] )
+                {
+                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server confirmed connection with client %d\n", client_index );
+                    server->client_confirmed[client_index] = 1;
+                    netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CLIENT_CONFIRMED, NETCODE_SERVER_EVENT_REASON_NONE, client_index, server->client_id[client_index], from );
+                }
+                if ( !netcode_packet_queue_push( &server->client_packet_queue[client_index], packet, sequence ) )
+                {
+                    server->counters[NETCODE_SERVER_COUNTER_PAYLOAD_PACKETS_DROPPED]++;
+                }
+                return;
+            }
+        }
+        break;
+
+        case NETCODE_CONNECTION_DISCONNECT_PACKET:
+        {
+            if ( client_index != -1 )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received disconnect packet from client %d\n", client_index );
+                netcode_server_disconnect_client_internal( server, client_index, NETCODE_DISCONNECT_REASON_CLIENT_DISCONNECTED, 0 );
+           }
+        }
+        break;
+
+        case NETCODE_CONNECTION_TIME_SYNC_PACKET:
+        {
+            if ( client_index != -1 )
+            {
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server received connection time sync packet from client %d\n", client_index );
+                server->client_last_packet_receive_time[client_index] = server->time;
+                if ( !server->client_confirmed[client_index] )
+                {
+                    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server confirmed connection with client %d\n", client_index );
+                    server->client_confirmed[client_index] = 1;
+                    netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CLIENT_CONFIRMED, NETCODE_SERVER_EVENT_REASON_NONE, client_index, server->client_id[client_index], from );
+                }
+
+                // echo the client time back so the client can measure the round trip
+
+                struct netcode_connection_time_sync_packet_t * p = (struct netcode_connection_time_sync_packet_t*) packet;
+
+                struct netcode_connection_time_sync_packet_t reply;
+                reply.packet_type = NETCODE_CONNECTION_TIME_SYNC_PACKET;
+                reply.client_time = p->client_time;
+                reply.server_time = server->time;
+
+                netcode_server_send_client_packet( server, &reply, client_index );
+            }
+        }
+        break;
+
+        default:
+            break;
+    }
+
+    server->config.free_function( server->config.allocator_context, packet );
+}
+
+int netcode_server_is_trusted_proxy( struct netcode_server_t * server, struct netcode_address_t * from )
+{
+    netcode_assert( server );
+    netcode_assert( from );
+
+    // a trusted proxy given without a port matches any port on that address
+
+    int i;
+    for ( i = 0; i < server->num_trusted_proxies; ++i )
+    {
+        struct netcode_address_t address = *from;
+        if ( server->trusted_proxy_address[i].port == 0 )
+            address.port = 0;
+        if ( netcode_address_equal( &address, &server->trusted_proxy_address[i] ) )
+            return 1;
+    }
+
+    return 0;
+}
+
+int netcode_read_proxy_protocol_header( uint8_t * packet_data, int packet_bytes, struct netcode_address_t * source_address )
+{
+    netcode_assert( packet_data );
+    netcode_assert( source_address );
+
+    // PROXY protocol v2. see https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+    static const uint8_t signature[12] = { 0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A };
+
+    if ( packet_bytes < 16 || memcmp( packet_data, signature, sizeof( signature ) ) != 0 )
+        return -1;
+
+    int version = packet_data[12] >> 4;
+    int command = packet_data[12] & 0xF;
+    int family = packet_data[13];
+    int length = ( packet_data[14] << 8 ) | packet_data[15];
+
+    if ( version != 2 || 16 + length > packet_bytes )
+        return -1;
+
+    uint8_t * p = packet_data + 16;
+
+    if ( command == 0x0 )
+    {
+        // LOCAL: sent by the proxy itself (eg. health checks). keep the datagram source address
+    }
+    else if ( command == 0x1 && family == 0x12 )
+    {
+        // PROXY over UDP/IPv4: source address, destination address, source port, destination port
+
+        if ( length < 12 )
+            return -1;
+
+        memset( source_address, 0, sizeof( struct netcode_address_t ) );
+        source_address->type = NETCODE_ADDRESS_IPV4;
+        memcpy( source_address->data.ipv4, p, 4 );
+        source_address->port = (uint16_t) ( ( p[8] << 8 ) | p[9] );
+    }
+    else if ( command == 0x1 && family == 0x22 )
+    {
+        // PROXY over UDP/IPv6
+
+        if ( length < 36 )
+            return -1;
+
+        memset( source_address, 0, sizeof( struct netcode_address_t ) );
+        source_address->type = NETCODE_ADDRESS_IPV6;
+        int i;
+        for ( i = 0; i < 8; ++i )
+        {
+            source_address->data.ipv6[i] = (uint16_t) ( ( p[i*2] << 8 ) | p[i*2+1] );
+        }
+        source_address->port = (uint16_t) ( ( p[32] << 8 ) | p[33] );
+    }
+    else
+    {
+        return -1;
+    }
+
+    return 16 + length;
+}
+
+void * netcode_server_read_migrating_client_packet( struct netcode_server_t * server, 
+                                                   struct netcode_address_t * from, 
+                                                   uint8_t * packet_data, 
+                                                   int packet_bytes, 
+                                                   uint64_t * sequence, 
+                                                   uint64_t current_timestamp, 
+                                                   uint8_t * allowed_packets, 
+                                                   int * client_index )
+{
+    netcode_assert( server );
+    netcode_assert( from );
+    netcode_assert( client_index );
+
+    // a connected client's address changes when its NAT rebinds. the packet carries no connection id, so it is tried against each connected
+    // client's key. that costs up to one decrypt per client, so attempts are capped per second, overall and per source address, to keep
+    // a flood of packets from unknown addresses from costing max clients decrypts each
+
+    if ( packet_bytes > NETCODE_MAX_PACKET_BYTES )
+        return NULL;
+
+    if ( server->config.max_migration_attempts_per_second > 0 )
+    {
+        if ( server->migration_window_start_time + 1.0 <= server->time )
+        {
+            server->migration_window_start_time = server->time;
+            server->migration_window_num_attempts = 0;
+        }
+
+        if ( server->migration_window_num_attempts >= server->config.max_migration_attempts_per_second )
+        {
+            server->counters[NETCODE_SERVER_COUNTER_MIGRATIONS_RATE_LIMITED]++;
+            return NULL;
+        }
+    }
+
+    if ( server->config.max_migration_attempts_per_address_per_second > 0 && 
+         !netcode_challenge_rate_entries_allow( server->migration_rate_entries, from, server->time, server->config.max_migration_attempts_per_address_per_second ) )
+    {
+        server->counters[NETCODE_SERVER_COUNTER_MIGRATIONS_RATE_LIMITED]++;
+        return NULL;
+    }
+
+    server->migration_window_num_attempts++;
+
+    uint8_t connected_packets[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( connected_packets, 0, sizeof( connected_packets ) );
+    connected_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET] = allowed_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET];
+    connected_packets[NETCODE_CONNECTION_PAYLOAD_PACKET] = allowed_packets[NETCODE_CONNECTION_PAYLOAD_PACKET];
+    connected_packets[NETCODE_CONNECTION_DISCONNECT_PACKET] = allowed_packets[NETCODE_CONNECTION_DISCONNECT_PACKET];
+    connected_packets[NETCODE_CONNECTION_TIME_SYNC_PACKET] = allowed_packets[NETCODE_CONNECTION_TIME_SYNC_PACKET];
+
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
+    {
+        if ( !server->client_connected[i] || server->client_loopback[i] )
+            continue;
+
+        int encryption_index = server->client_encryption_index[i];
+
+        int protocol_index = netcode_encryption_manager_get_protocol_index( &server->encryption_manager, encryption_index );
+
+        // decryption is done in place, so each attempt needs its own copy of the packet
+
+        uint8_t packet_copy[NETCODE_MAX_PACKET_BYTES];
+        memcpy( packet_copy, packet_data, packet_bytes );
+
+        server->counters[NETCODE_SERVER_COUNTER_MIGRATION_DECRYPTS]++;
+
+        // a packet that isn't this client's may still look like a replay against its window. that's no replay of 
+        // this client's traffic, so only count it if the packet turns out to be the client's
+
+        uint64_t num_replayed_packets = server->client_replay_protection[i].num_replayed_packets;
+
+        void * packet = netcode_read_packet( packet_copy, 
+                                             packet_bytes, 
+                                             sequence, 
+                                             netcode_encryption_manager_get_receive_key( &server->encryption_manager, encryption_index ), 
+                                             server->version_info[netcode_encryption_manager_get_version_index( &server->encryption_manager, encryption_index )], 
+                                             netcode_server_protocol_id( server, protocol_index ), 
+                                             current_timestamp, 
+                                             netcode_server_private_key( server, protocol_index ), 
+                                             connected_packets, 
+                                             &server->client_replay_protection[i], 
+                                             server->config.allocator_context, 
+                                             server->config.allocate_function );
+        if ( packet )
+        {
+            *client_index = i;
+            return packet;
+        }
+
+        server->client_replay_protection[i].num_replayed_packets = num_replayed_packets;
+    }
+
+    return NULL;
+}
+
+void netcode_server_send_migration_challenge( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+
+    // the challenge goes out as a keep-alive with the challenge in place of the client index and max clients
+
+    struct netcode_connection_keep_alive_packet_t packet;
+    packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+    packet.client_index = (int) (uint32_t) server->client_migration_challenge[client_index];
+    packet.max_clients = (int) (uint32_t) ( server->client_migration_challenge[client_index] >> 32 );
+
+    netcode_server_send_client_packet_to_address( server, &packet, client_index, &server->client_migration_reply_address[client_index] );
+}
+
+int netcode_server_migrate_client( struct netcode_server_t * server, int client_index, struct netcode_address_t * address, struct netcode_address_t * reply_address, void * packet )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( address );
+    netcode_assert( reply_address );
+    netcode_assert( packet );
+
+    if ( !netcode_address_equal( &server->client_migration_address[client_index], address ) )
+    {
+        // first authenticated packet from the new address. send a random challenge there, and only move the session once a keep-alive
+        // from the same address echoes it. a stray or replayed packet from an address the client isn't at can't move the session, since
+        // nothing there can read the challenge
+
+        server->client_migration_address[client_index] = *address;
+        server->client_migration_reply_address[client_index] = *reply_address;
+
+        // the client tells a challenge apart from a regular keep-alive by it not matching its slot
+
+        uint64_t slot = ( (uint64_t) (uint32_t) client_index ) | ( ( (uint64_t) (uint32_t) server->max_clients ) << 32 );
+        do
+        {
+            netcode_random_bytes( (uint8_t*) &server->client_migration_challenge[client_index], 8 );
+        }
+        while ( server->client_migration_challenge[client_index] == slot );
+
+        netcode_server_send_migration_challenge( server, client_index );
+
+        return 0;
+    }
+
+    struct netcode_connection_keep_alive_packet_t * p = (struct netcode_connection_keep_alive_packet_t*) packet;
+
+    if ( p->packet_type != NETCODE_CONNECTION_KEEP_ALIVE_PACKET || 
+         ( ( (uint64_t) (uint32_t) p->client_index ) | ( ( (uint64_t) (uint32_t) p->max_clients ) << 32 ) ) != server->client_migration_challenge[client_index] )
+    {
+        // the challenge or its echo may have been lost. send the same challenge again, so an echo already on its way still counts
+
+        netcode_server_send_migration_challenge( server, client_index );
+
+        return 0;
+    }
+
+    char from_address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+    char to_address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server migrated client %d from %s to %s\n", client_index, 
+        netcode_address_to_string( &server->client_address[client_index], from_address_string ), 
+        netcode_address_to_string( address, to_address_string ) );
+
+    netcode_encryption_manager_set_address( &server->encryption_manager, server->client_encryption_index[client_index], address );
+
+    server->client_address[client_index] = *address;
+    server->client_reply_address[client_index] = *reply_address;
+
+    memset( &server->client_migration_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    memset( &server->client_migration_reply_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    server->client_migration_challenge[client_index] = 0;
+
+    return 1;
+}
+
+void netcode_server_read_and_process_packet( struct netcode_server_t * server, 
+                                             struct netcode_address_t * from, 
+                                             uint8_t * packet_data, 
+                                             int packet_bytes, 
+                                             uint64_t current_timestamp, 
+                                             uint8_t * allowed_packets )
+{
+    if ( !server->running )
+        return;
+
+    // when the server sits behind a proxy, the real client address is carried in a header in front of the packet.
+    // the client is identified by the real address, but packets back to it must go to the proxy they came through.
+
+    struct netcode_address_t * reply_address = from;
+
+    struct netcode_address_t source_address = *from;
+
+    int trusted_source = netcode_server_is_trusted_proxy( server, from );
+
+    if ( !trusted_source && server->config.proxy_protocol && netcode_read_proxy_protocol_header( packet_data, packet_bytes, &source_address ) >= 0 )
+    {
+        char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored packet from %s. proxy header from untrusted address\n", netcode_address_to_string( from, address_string ) );
+        return;
+    }
+
+    if ( trusted_source && ( server->config.source_address_callback || server->config.proxy_protocol ) )
+    {
+        int header_bytes = server->config.source_address_callback ? 
+            server->config.source_address_callback( server->config.callback_context, &source_address, packet_data, packet_bytes ) : 
+            netcode_read_proxy_protocol_header( packet_data, packet_bytes, &source_address );
+
+        if ( header_bytes < 0 || header_bytes > packet_bytes )
+        {
+            char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored packet from %s. could not read source address\n", netcode_address_to_string( from, address_string ) );
+            return;
+        }
+
+        packet_data += header_bytes;
+        packet_bytes -= header_bytes;
+        from = &source_address;
+    }
+
+    if ( packet_bytes <= 1 )
+        return;
+
+    int version_index = -1;
+    int protocol_index = -1;
+
+    if ( packet_data[0] == NETCODE_CONNECTION_REQUEST_PACKET )
+    {
+        if ( server->paused )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. server is paused\n" );
+            netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_SERVER_PAUSED, -1, 0, from );
+            return;
+        }
+
+        // source policy (eg. region locking) is checked on the address alone, so unwanted requests are dropped before any crypto is spent on them
+
+        if ( server->config.source_filter_callback && !server->config.source_filter_callback( server->config.callback_context, from ) )
+        {
+            char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request from %s. source filtered\n", netcode_address_to_string( from, address_string ) );
+            server->counters[NETCODE_SERVER_COUNTER_SOURCE_FILTERED]++;
+            netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_SOURCE_FILTERED, -1, 0, from );
+            return;
+        }
+
+        if ( packet_bytes >= 1 + NETCODE_VERSION_INFO_BYTES )
+        {
+            version_index = netcode_server_find_version_index( server, packet_data + 1 );
+        }
+
+        if ( version_index == -1 )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored connection request. bad version info\n" );
+            server->counters[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH]++;
+            return;
+        }
+
+        // the protocol id follows version info in the clear, and picks which private key opens the connect token. unknown ids are left to fail against the primary protocol
+
+        protocol_index = 0;
+
+        if ( packet_bytes >= 1 + NETCODE_VERSION_INFO_BYTES + 8 )
+        {
+            uint8_t * p = packet_data + 1 + NETCODE_VERSION_INFO_BYTES;
+            int index = netcode_server_find_protocol_index( server, netcode_read_uint64( &p ) );
+            if ( index != -1 )
+            {
+                protocol_index = index;
+            }
+        }
+    }
+
+    uint64_t sequence;
+
+    int encryption_index = -1;
+    int client_index = netcode_server_find_client_index_by_address( server, from );
+    if ( client_index != -1 )
+    {
+        netcode_assert( client_index >= 0 );
+        netcode_assert( client_index < server->max_clients );
+        encryption_index = server->client_encryption_index[client_index];
+    }
+    else
+    {
+        encryption_index = netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, from, server->time );
+    }
+    
+    uint8_t * read_packet_key = netcode_encryption_manager_get_receive_key( &server->encryption_manager, encryption_index );
+
+    if ( version_index == -1 )
+    {
+        version_index = netcode_encryption_manager_get_version_index( &server->encryption_manager, encryption_index );
+    }
+
+    if ( protocol_index == -1 )
+    {
+        protocol_index = netcode_encryption_manager_get_protocol_index( &server->encryption_manager, encryption_index );
+    }
+
+    if ( !read_packet_key && packet_data[0] != 0 && server->config.client_address_migration )
+    {
+        void * packet = netcode_server_read_migrating_client_packet( server, from, packet_data, packet_bytes, &sequence, current_timestamp, allowed_packets, &client_index );
+
+        if ( !packet )
+            return;
+
+        // nothing from the new address is delivered until the client has echoed the challenge from there
+
+        if ( !netcode_server_migrate_client( server, client_index, from, reply_address, packet ) )
+        {
+            server->config.free_function( server->config.allocator_context, packet );
+            return;
+        }
+
+        netcode_server_process_packet_internal( server, from, reply_address, packet, sequence, server->client_encryption_index[client_index], client_index );
+
+        return;
+    }
+
+    if ( !read_packet_key && packet_data[0] != 0 )
+    {
+        char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server could not process packet because no encryption mapping exists for %s\n", netcode_address_to_string( from, address_string ) );
+        return;
+    }
+
+    uint64_t num_replayed_packets = ( client_index != -1 ) ? server->client_replay_protection[client_index].num_replayed_packets : 0;
+
+    void * packet = netcode_read_packet( packet_data, 
+                                         packet_bytes, 
+                                         &sequence, 
+                                         read_packet_key, 
+                                         server->version_info[version_index], 
+                                         netcode_server_protocol_id( server, protocol_index ), 
+                                         current_timestamp, 
+                                         netcode_server_private_key( server, protocol_index ), 
+                                         allowed_packets, 
+                                         ( client_index != -1 ) ? &server->client_replay_protection[client_index] : NULL, 
+                                         server->config.allocator_context, 
+                                         server->config.allocate_function );
+
+    if ( !packet )
+    {
+        if ( packet_data[0] == NETCODE_CONNECTION_REQUEST_PACKET && allowed_packets[NETCODE_CONNECTION_REQUEST_PACKET] )
+        {
+            netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_INVALID_REQUEST, -1, 0, from );
+        }
+        else if ( packet_data[0] != NETCODE_CONNECTION_REQUEST_PACKET )
+        {
+            // an encrypted packet from a known address that is replayed, forged or malformed
+
+            int replayed = client_index != -1 && server->client_replay_protection[client_index].num_replayed_packets != num_replayed_packets;
+
+            netcode_server_emit_event( server, 
+                                       NETCODE_SERVER_EVENT_PACKET_REJECTED, 
+                                       replayed ? NETCODE_SERVER_EVENT_REASON_PACKET_REPLAYED : NETCODE_SERVER_EVENT_REASON_PACKET_INVALID, 
+                                       client_index, 
+                                       ( client_index != -1 ) ? server->client_id[client_index] : 0, 
+                                       from );
+        }
+        return;
+    }
+
+    if ( client_index != -1 )
+    {
+        server->client_reply_address[client_index] = *reply_address;
+    }
+
+    netcode_server_process_packet_internal( server, from, reply_address, packet, sequence, encryption_index, client_index );
+}
+
+void netcode_server_process_packet( struct netcode_server_t * server, struct netcode_address_t * from, uint8_t * packet_data, int packet_bytes )
+{
+    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packets, 0, sizeof( allowed_packets ) );
+    allowed_packets[NETCODE_CONNECTION_REQUEST_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_RESPONSE_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_PAYLOAD_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_DISCONNECT_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_TIME_SYNC_PACKET] = server->config.time_sync ? 1 : 0;
+
+    uint64_t current_timestamp = netcode_timestamp();
+
+    netcode_server_read_and_process_packet( server, from, packet_data, packet_bytes, current_timestamp, allowed_packets );
+}
+
+void netcode_server_receive_packets( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+
+    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packets, 0, sizeof( allowed_packets ) );
+    allowed_packets[NETCODE_CONNECTION_REQUEST_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_RESPONSE_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_PAYLOAD_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_DISCONNECT_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_TIME_SYNC_PACKET] = server->config.time_sync ? 1 : 0;
+
+    uint64_t current_timestamp = netcode_timestamp();
+
+    if ( !server->config.network_simulator )
+    {
+        // process packets received from socket
+
+        while ( 1 )
+        {
+            struct netcode_address_t from;
+            
+            uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
+            
+            int packet_bytes = 0;
+            
+            if ( server->config.override_send_and_receive )
+            {
+                packet_bytes = server->config.receive_packet_override( server->config.callback_context, &from, packet_data, NETCODE_MAX_PACKET_BYTES );
+            }
+            else
+            {
+                if (server->socket_holder.ipv4.handle != 0)
+                    packet_bytes = netcode_socket_receive_packet( &server->socket_holder.ipv4, &from, packet_data, NETCODE_MAX_PACKET_BYTES );
+
+                if ( packet_bytes == 0 && server->socket_holder.ipv6.handle != 0)
+                    packet_bytes = netcode_socket_receive_packet( &server->socket_holder.ipv6, &from, packet_data, NETCODE_MAX_PACKET_BYTES );
+            }
+
+            if ( packet_bytes == 0 )
+                break;
+
+            netcode_server_read_and_process_packet( server, &from, packet_data, packet_bytes, current_timestamp, allowed_packets );
+        }
+    }
+    else
+    {
+        // process packets received from network simulator
+
+        int num_packets_received = netcode_network_simulator_receive_packets( server->config.network_simulator, 
+                                                                              &server->address, 
+                                                                              NETCODE_SERVER_MAX_RECEIVE_PACKETS, 
+                                                                              server->receive_packet_data, 
+                                                                              server->receive_packet_bytes, 
+                                                                              server->receive_from );
+
+        int i;
+        for ( i = 0; i < num_packets_received; ++i )
+        {
+            netcode_server_read_and_process_packet( server, 
+                                                    &server->receive_from[i], 
+                                                    server->receive_packet_data[i], 
+                                                    server->receive_packet_bytes[i], 
+                                                    current_timestamp, 
+                                                    allowed_packets );
+
+            server->config.free_function( server->config.allocator_context, server->receive_packet_data[i] );
+        }
+    }
+}
+
+void netcode_server_send_payload_packet_internal( struct netcode_server_t * server, struct netcode_connection_payload_packet_t * packet, int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( packet );
+
+    if ( !server->client_confirmed[client_index] )
+    {
+        struct netcode_connection_keep_alive_packet_t keep_alive_packet;
+        keep_alive_packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+        keep_alive_packet.client_index = client_index;
+        keep_alive_packet.max_clients = server->max_clients;
+        netcode_server_send_client_packet( server, &keep_alive_packet, client_index );
+    }
+
+    netcode_server_send_client_packet( server, packet, client_index );
+}
+
+int netcode_server_send_queued_packet( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+
+    // low priority packets only go out once everything at normal priority has
+
+    struct netcode_packet_queue_t * queue = &server->client_send_queue[client_index];
+
+    if ( queue->num_packets == 0 )
+        queue = &server->client_low_priority_send_queue[client_index];
+
+    if ( queue->num_packets == 0 )
+        return 0;
+
+    double pacing_rate = server->config.send_pacing_rate;
+
+    if ( pacing_rate > 0.0 && server->client_paced_send_time[client_index] > server->time )
+        return 0;
+
+    struct netcode_connection_payload_packet_t * packet = (struct netcode_connection_payload_packet_t*) queue->packet_data[queue->start_index];
+
+    // the server wide egress budget always delays. check it before the client's own bucket is charged
+
+    if ( server->config.egress_limit > 0.0 && server->egress_tokens < packet->payload_bytes )
+        return 0;
+
+    if ( !netcode_server_consume_bandwidth( server, client_index, packet->payload_bytes ) )
+    {
+        if ( server->config.bandwidth_limit_policy == NETCODE_BANDWIDTH_LIMIT_DELAY )
+            return 0;
+
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server dropped payload packet to client %d. over bandwidth limit\n", client_index );
+        server->counters[NETCODE_SERVER_COUNTER_BANDWIDTH_PACKETS_DROPPED]++;
+        netcode_packet_queue_pop( queue, NULL );
+        server->config.free_function( server->config.allocator_context, packet );
+        return 1;
+    }
+
+    if ( server->config.egress_limit > 0.0 )
+    {
+        server->egress_tokens -= packet->payload_bytes;
+    }
+
+    netcode_packet_queue_pop( queue, NULL );
+    netcode_server_send_payload_packet_internal( server, packet, client_index );
+    server->config.free_function( server->config.allocator_context, packet );
+
+    if ( pacing_rate > 0.0 )
+    {
+        server->client_paced_send_time[client_index] += 1.0 / pacing_rate;
+    }
+
+    return 1;
+}
+
+void netcode_server_send_queued_packets( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+
+    if ( server->config.egress_limit > 0.0 )
+    {
+        double capacity = netcode_server_bandwidth_capacity( server->config.egress_limit );
+        server->egress_tokens += ( server->time - server->egress_refill_time ) * server->config.egress_limit;
+        if ( server->egress_tokens > capacity )
+            server->egress_tokens = capacity;
+    }
+
+    server->egress_refill_time = server->time;
+
+    // drain send queues round robin, one packet per client per pass, so when the egress budget runs out every client got a fair share of it.
+    // each queue drains at the pacing rate, as far as the client's bandwidth limit allows. with pacing switched off, whatever was still queued goes out now.
+    // only clients with something queued are visited, so this costs nothing for the clients that are idle
+
+    int num_clients = server->num_send_queue_clients;
+
+    if ( num_clients == 0 )
+        return;
+
+    int start_index = server->egress_start_index % num_clients;
+
+    int i;
+    int sent = 1;
+    while ( sent )
+    {
+        sent = 0;
+
+        for ( i = 0; i < num_clients; ++i )
+        {
+            int client_index = server->send_queue_client_index[( start_index + i ) % num_clients];
+
+            if ( server->client_connected[client_index] && !server->client_loopback[client_index] )
+            {
+                sent |= netcode_server_send_queued_packet( server, client_index );
+            }
+        }
+    }
+
+    server->egress_start_index = ( start_index + 1 ) % num_clients;
+
+    // clients with nothing left queued drop out until their next queued send. the rest don't bank send credit while they wait
+
+    int num_remaining = 0;
+
+    for ( i = 0; i < num_clients; ++i )
+    {
+        int client_index = server->send_queue_client_index[i];
+
+        if ( server->client_connected[client_index] && !server->client_loopback[client_index] &&
+             ( server->client_send_queue[client_index].num_packets > 0 || server->client_low_priority_send_queue[client_index].num_packets > 0 ) )
+        {
+            if ( server->client_paced_send_time[client_index] < server->time )
+            {
+                server->client_paced_send_time[client_index] = server->time;
+            }
+
+            server->send_queue_client_index[num_remaining++] = client_index;
+        }
+        else
+        {
+            server->client_send_queue_scheduled[client_index] = 0;
+        }
+    }
+
+    server->num_send_queue_clients = num_remaining;
+}
+
+void netcode_server_send_packets( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+
+    if ( !server->running )
+        return;
+
+    netcode_server_send_queued_packets( server );
+
+    // keep-alives come off a timing wheel, so an update only looks at the clients that are due one
+
+    int due[NETCODE_MAX_CLIENTS];
+
+    int num_due = netcode_send_wheel_advance( &server->keep_alive_wheel, server->time, due );
+
+    int i;
+    for ( i = 0; i < num_due; ++i )
+    {
+        int client_index = due[i];
+
+        if ( !server->client_connected[client_index] || server->client_loopback[client_index] )
+            continue;
+
+        // anything sent to the client since the keep-alive was scheduled pushes it back
+
+        if ( server->client_last_packet_send_time[client_index] + ( 1.0 / server->client_packet_send_rate[client_index] ) + server->client_keep_alive_offset[client_index] > server->time )
+        {
+            netcode_server_schedule_keep_alive( server, client_index );
+            continue;
+        }
+
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server sent connection keep alive packet to client %d\n", client_index );
+        struct netcode_connection_keep_alive_packet_t packet;
+        packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+        packet.client_index = client_index;
+        packet.max_clients = server->max_clients;
+        netcode_server_send_client_packet( server, &packet, client_index );
+        server->client_keep_alive_offset[client_index] = netcode_server_keep_alive_offset( server, client_index );
+        netcode_server_schedule_keep_alive( server, client_index );
+    }
+}
+
+void netcode_server_check_for_timeouts( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+
+    if ( !server->running )
+        return;
+
+    if ( server->paused && server->paused_freeze_timeouts )
+        return;
+
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
+    {
+        if ( server->client_connected[i] && server->client_timeout[i] > 0 && !server->client_loopback[i] &&
+             ( server->client_last_packet_receive_time[i] + server->client_timeout[i] <= server->time ) )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_INFO, "server timed out client %d\n", i );
+            netcode_server_emit_event( server, NETCODE_SERVER_EVENT_CLIENT_TIMED_OUT, NETCODE_SERVER_EVENT_REASON_NONE, i, server->client_id[i], &server->client_address[i] );
+            netcode_server_disconnect_client_internal( server, i, NETCODE_DISCONNECT_REASON_TIMED_OUT, 0 );
+            return;
+        }
+    }
+}
+
+void netcode_server_check_for_abandoned_handshakes( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+
+    if ( !server->running )
+        return;
+
+    if ( server->last_handshake_sweep_time + NETCODE_HANDSHAKE_SWEEP_INTERVAL > server->time )
+        return;
+
+    server->last_handshake_sweep_time = server->time;
+
+    struct netcode_address_t addresses[NETCODE_MAX_CLIENTS];
+
+    int num_removed;
+    do
+    {
+        num_removed = netcode_encryption_manager_remove_abandoned( &server->encryption_manager, server->time, addresses, NETCODE_MAX_CLIENTS );
+
+        int i;
+        for ( i = 0; i < num_removed; ++i )
+        {
+            char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server removed abandoned handshake from %s\n", netcode_address_to_string( &addresses[i], address_string ) );
+            netcode_server_emit_event( server, NETCODE_SERVER_EVENT_HANDSHAKE_ABANDONED, NETCODE_SERVER_EVENT_REASON_NONE, -1, 0, &addresses[i] );
+        }
+    }
+    while ( num_removed == NETCODE_MAX_CLIENTS );
+}
+
+void netcode_server_flush_send_queue( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+
+    // a kicked client gets everything still queued for it right away, ignoring pacing and bandwidth limits
+
+    while ( 1 )
+    {
+        struct netcode_connection_payload_packet_t * packet = (struct netcode_connection_payload_packet_t*) netcode_packet_queue_pop( &server->client_send_queue[client_index], NULL );
+        if ( !packet )
+            packet = (struct netcode_connection_payload_packet_t*) netcode_packet_queue_pop( &server->client_low_priority_send_queue[client_index], NULL );
+        if ( !packet )
+            break;
+        netcode_server_send_payload_packet_internal( server, packet, client_index );
+        server->config.free_function( server->config.allocator_context, packet );
+    }
+}
+
+void netcode_server_kick_client( struct netcode_server_t * server, int client_index, int disconnect_reason )
+{
+    netcode_assert( server );
+    netcode_assert( disconnect_reason > NETCODE_DISCONNECT_REASON_NONE );
+    netcode_assert( disconnect_reason <= 255 );
+
+    if ( !server->running )
+        return;
+
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( server->client_loopback[client_index] == 0 );
+
+    if ( !server->client_connected[client_index] )
+        return;
+
+    if ( server->client_loopback[client_index] )
+        return;
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server kicked client %d\n", client_index );
+
+    // send whatever the application queued for the client now, then give it a tick to arrive before the disconnect packets follow
+
+    netcode_server_flush_send_queue( server, client_index );
+
+    server->client_kick_reason[client_index] = disconnect_reason;
+    server->client_kick_time[client_index] = server->time;
+}
+
+void netcode_server_check_for_kicks( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+
+    if ( !server->running )
+        return;
+
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
+    {
+        if ( server->client_connected[i] && server->client_kick_reason[i] != NETCODE_DISCONNECT_REASON_NONE && server->client_kick_time[i] < server->time )
+        {
+            netcode_server_flush_send_queue( server, i );
+            netcode_server_disconnect_client_internal( server, i, server->client_kick_reason[i], 1 );
+        }
+    }
+}
+
+int netcode_server_client_connected( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+
+    if ( !server->running )
+        return 0;
+
+    if ( client_index < 0 || client_index >= server->max_clients )
+        return 0;
+
+    return server->client_connected[client_index];
+}
+
+uint64_t netcode_server_client_id( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+
+    if ( !server->running )
+        return 0;
+
+    if ( client_index < 0 || client_index >= server->max_clients )
+        return 0;
+
+    return server->client_id[client_index];
+}
+
+NETCODE_CONST char * netcode_server_client_version_info( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+
+    if ( !server->running )
+        return NULL;
+
+    if ( client_index < 0 || client_index >= server->max_clients )
+        return NULL;
+
+    if ( !server->client_connected[client_index] )
+        return NULL;
+
+    int version_index = netcode_encryption_manager_get_version_index( &server->encryption_manager, server->client_encryption_index[client_index] );
+
+    return (NETCODE_CONST char*) server->version_info[version_index];
+}
+
+void netcode_server_set_client_packet_send_rate( struct netcode_server_t * server, int client_index, double packet_send_rate )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( packet_send_rate > 0.0 );
+
+    if ( !server->client_connected[client_index] )
+        return;
+
+    server->client_packet_send_rate[client_index] = packet_send_rate;
+
+    if ( !server->client_loopback[client_index] )
+    {
+        netcode_server_schedule_keep_alive( server, client_index );
+    }
+}
+
+void netcode_server_set_client_bandwidth_limit( struct netcode_server_t * server, int client_index, double bandwidth_limit )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( bandwidth_limit >= 0.0 );
+
+    if ( !server->client_connected[client_index] )
+        return;
+
+    netcode_server_refill_bandwidth( server, client_index );
+
+    server->client_bandwidth_limit[client_index] = bandwidth_limit;
+}
+
+int netcode_server_update_config( struct netcode_server_t * server, NETCODE_CONST struct netcode_server_config_t * config )
+{
+    netcode_assert( server );
+    netcode_assert( config );
+
+    if ( !netcode_server_config_valid( config ) )
+        return NETCODE_ERROR;
+
+    // fields baked into sockets, packet queues and the wire format of connected clients can only be set at create
+
+    NETCODE_CONST struct netcode_server_config_t * current = &server->config;
+
+    int alternate_version_info_changed = ( current->alternate_version_info == NULL ) != ( config->alternate_version_info == NULL ) ||
+        ( current->alternate_version_info && strcmp( current->alternate_version_info, config->alternate_version_info ) != 0 );
+
+    int public_address_changed = ( current->public_address == NULL ) != ( config->public_address == NULL ) ||
+        ( current->public_address && strcmp( current->public_address, config->public_address ) != 0 );
+
+    int admin_address_changed = ( current->admin_address == NULL ) != ( config->admin_address == NULL ) ||
+        ( current->admin_address && strcmp( current->admin_address, config->admin_address ) != 0 );
+
+    int admin_secret_changed = ( server->admin_secret[0] != '\0' ) != ( config->admin_secret != NULL ) ||
+        ( config->admin_secret && strcmp( server->admin_secret, config->admin_secret ) != 0 );
+
+    // trusted proxies are compared against the addresses parsed at create, since the strings in config may be gone by now
+
+    int trusted_proxies_changed = config->num_trusted_proxies != server->num_trusted_proxies;
+
+    int i;
+    for ( i = 0; i < server->num_trusted_proxies && !trusted_proxies_changed; ++i )
+    {
+        struct netcode_address_t trusted_proxy_address;
+        trusted_proxies_changed = config->trusted_proxy_address[i] == NULL || 
+            netcode_parse_address( config->trusted_proxy_address[i], &trusted_proxy_address ) != NETCODE_OK ||
+            !netcode_address_equal( &trusted_proxy_address, &server->trusted_proxy_address[i] );
+    }
+
+    if ( config->protocol_id != current->protocol_id ||
+         config->allocator_context != current->allocator_context ||
+         config->allocate_function != current->allocate_function ||
+         config->free_function != current->free_function ||
+         config->network_simulator != current->network_simulator ||
+         config->override_send_and_receive != current->override_send_and_receive ||
+         config->send_packet_override != current->send_packet_override ||
+         config->receive_packet_override != current->receive_packet_override ||
+         alternate_version_info_changed ||
+         public_address_changed ||
+         admin_address_changed ||
+         admin_secret_changed ||
+         trusted_proxies_changed ||
+         config->accept_version_1_01 != current->accept_version_1_01 ||
+         config->packet_queue_size != current->packet_queue_size ||
+         config->packet_queue_overflow_policy != current->packet_queue_overflow_policy ||
+         config->socket_send_buffer_size != current->socket_send_buffer_size ||
+         config->socket_receive_buffer_size != current->socket_receive_buffer_size ||
+         config->socket_tos != current->socket_tos ||
+         config->socket_dont_fragment != current->socket_dont_fragment ||
+         config->socket_reuse_port != current->socket_reuse_port ||
+         config->num_alternate_protocols != current->num_alternate_protocols ||
+         memcmp( config->alternate_protocol_id, current->alternate_protocol_id, sizeof( config->alternate_protocol_id ) ) != 0  )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server config change touches a field that can't be changed while the server exists\n" );
+        return NETCODE_ERROR;
+    }
+
+    // connected clients still on the old default rate or bandwidth limit follow the new one. values set per-client are left alone
+
+    for ( i = 0; i < server->max_clients; ++i )
+    {
+        if ( server->client_connected[i] && server->client_packet_send_rate[i] == current->packet_send_rate )
+        {
+            server->client_packet_send_rate[i] = config->packet_send_rate;
+
+            if ( !server->client_loopback[i] )
+            {
+                netcode_server_schedule_keep_alive( server, i );
+            }
+        }
+
+        if ( server->client_connected[i] && server->client_bandwidth_limit[i] == current->bandwidth_limit )
+        {
+            netcode_server_refill_bandwidth( server, i );
+            server->client_bandwidth_limit[i] = config->bandwidth_limit;
+        }
+    }
+
+    // a smaller wait list keeps the clients at the front. the rest are denied the next time they ask
+
+    if ( server->wait_list.num_entries > config->wait_list_size )
+    {
+        server->wait_list.num_entries = config->wait_list_size;
+    }
+
+    server->config = *config;
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server updated config\n" );
+
+    return NETCODE_OK;
+}
+
+uint64_t netcode_server_next_packet_sequence( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    if ( !server->client_connected[client_index] )
+        return 0;
+    return server->client_sequence[client_index];    
+}
+
+int netcode_server_queued_payload_bytes( struct netcode_packet_queue_t * queue )
+{
+    netcode_assert( queue );
+
+    int queued_bytes = 0;
+    int i;
+    for ( i = 0; i < queue->num_packets; ++i )
+    {
+        struct netcode_connection_payload_packet_t * queued_packet = (struct netcode_connection_payload_packet_t*) queue->packet_data[( queue->start_index + i ) % NETCODE_PACKET_QUEUE_SIZE];
+        queued_bytes += queued_packet->payload_bytes;
+    }
+
+    return queued_bytes;
+}
+
+void netcode_server_send_packet_with_priority( struct netcode_server_t * server, int client_index, NETCODE_CONST uint8_t * packet_data, int packet_bytes, int priority )
+{
+    netcode_assert( server );
+    netcode_assert( packet_data );
+    netcode_assert( packet_bytes >= 0 );
+    netcode_assert( packet_bytes <= server->config.max_packet_size );
+    netcode_assert( priority >= NETCODE_PACKET_PRIORITY_LOW );
+    netcode_assert( priority <= NETCODE_PACKET_PRIORITY_URGENT );
+
+    if ( !server->running )
+        return;
+
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    if ( !server->client_connected[client_index] )
+        return;
+
+    int bandwidth_delay = server->client_bandwidth_limit[client_index] > 0.0 && server->config.bandwidth_limit_policy == NETCODE_BANDWIDTH_LIMIT_DELAY;
+
+    if ( !server->client_loopback[client_index] && priority == NETCODE_PACKET_PRIORITY_URGENT )
+    {
+        // urgent packets skip the send queues and go out now. they are still charged to the client and egress budgets, so queued traffic makes room for them afterwards
+
+        if ( server->client_bandwidth_limit[client_index] > 0.0 )
+        {
+            netcode_server_refill_bandwidth( server, client_index );
+            server->client_bandwidth_tokens[client_index] -= packet_bytes;
+        }
+
+        if ( server->config.egress_limit > 0.0 )
+        {
+            server->egress_tokens -= packet_bytes;
+        }
+
+        uint8_t buffer[NETCODE_MAX_PAYLOAD_BYTES*2];
+
+        struct netcode_connection_payload_packet_t * packet = (struct netcode_connection_payload_packet_t*) buffer;
+
+        packet->packet_type = NETCODE_CONNECTION_PAYLOAD_PACKET;
+        packet->payload_bytes = packet_bytes;
+        memcpy( packet->payload_data, packet_data, packet_bytes );
+
+        netcode_server_send_payload_packet_internal( server, packet, client_index );
+    }
+    else if ( !server->client_loopback[client_index] && ( server->config.send_pacing_rate > 0.0 || bandwidth_delay || server->config.egress_limit > 0.0 ) )
+    {
+        // paced, bandwidth delayed and egress limited sends are copied into the client's send queue and go out from netcode_server_send_packets
+
+        struct netcode_connection_payload_packet_t * packet = netcode_create_payload_packet( packet_bytes, server->config.allocator_context, server->config.allocate_function );
+        if ( !packet )
+            return;
+
+        memcpy( packet->payload_data, packet_data, packet_bytes );
+
+        struct netcode_packet_queue_t * send_queue = ( priority == NETCODE_PACKET_PRIORITY_LOW ) ? &server->client_low_priority_send_queue[client_index] : &server->client_send_queue[client_index];
+
+        if ( bandwidth_delay )
+        {
+            // count packets that can't go out on the next update because the bucket won't cover them and everything queued ahead
+
+            double queued_bytes = packet_bytes + netcode_server_queued_payload_bytes( &server->client_send_queue[client_index] );
+            if ( priority == NETCODE_PACKET_PRIORITY_LOW )
+            {
+                queued_bytes += netcode_server_queued_payload_bytes( &server->client_low_priority_send_queue[client_index] );
+            }
+
+            netcode_server_refill_bandwidth( server, client_index );
+
+            if ( server->client_bandwidth_tokens[client_index] < queued_bytes )
+            {
+                server->counters[NETCODE_SERVER_COUNTER_BANDWIDTH_PACKETS_DELAYED]++;
+            }
+        }
+
+        if ( !netcode_packet_queue_push( send_queue, packet, 0 ) )
+        {
+            server->counters[NETCODE_SERVER_COUNTER_SEND_QUEUE_PACKETS_DROPPED]++;
+        }
+
+        netcode_server_schedule_send_queue( server, client_index );
+    }
+    else if ( !server->client_loopback[client_index] )
+    {
+        if ( !netcode_server_consume_bandwidth( server, client_index, packet_bytes ) )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server dropped payload packet to client %d. over bandwidth limit\n", client_index );
+            server->counters[NETCODE_SERVER_COUNTER_BANDWIDTH_PACKETS_DROPPED]++;
+            return;
+        }
+
+        uint8_t buffer[NETCODE_MAX_PAYLOAD_BYTES*2];
+
+        struct netcode_connection_payload_packet_t * packet = (struct netcode_connection_payload_packet_t*) buffer;
+
+        packet->packet_type = NETCODE_CONNECTION_PAYLOAD_PACKET;
+        packet->payload_bytes = packet_bytes;
+        memcpy( packet->payload_data, packet_data, packet_bytes );
+
+        netcode_server_send_payload_packet_internal( server, packet, client_index );
+    }
+    else
+    {
+        netcode_assert( server->config.send_loopback_packet_callback );
+
+        server->config.send_loopback_packet_callback( server->config.callback_context,
+                                                      client_index, 
+                                                      packet_data, 
+                                                      packet_bytes, 
+                                                      server->client_sequence[client_index]++ );
+
+        server->client_last_packet_send_time[client_index] = server->time;
+    }
+}
+
+void netcode_server_send_packet( struct netcode_server_t * server, int client_index, NETCODE_CONST uint8_t * packet_data, int packet_bytes )
+{
+    netcode_server_send_packet_with_priority( server, client_index, packet_data, packet_bytes, NETCODE_PACKET_PRIORITY_NORMAL );
+}
+
+uint8_t * netcode_server_receive_packet( struct netcode_server_t * server, int client_index, int * packet_bytes, uint64_t * packet_sequence )
+{
+    netcode_assert( server );
+    netcode_assert( packet_bytes );
+
+    if ( !server->running )
+        return NULL;
+
+    if ( !server->client_connected[client_index] )
+        return NULL;
+
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+
+    struct netcode_connection_payload_packet_t * packet = (struct netcode_connection_payload_packet_t*) 
+        netcode_packet_queue_pop( &server->client_packet_queue[client_index], packet_sequence );
+    
+    if ( packet )
+    {
+        netcode_assert( packet->packet_type == NETCODE_CONNECTION_PAYLOAD_PACKET );
+        *packet_bytes = packet->payload_bytes;
+        netcode_assert( *packet_bytes >= 0 );
+        netcode_assert( *packet_bytes <= NETCODE_MAX_PACKET_BYTES );
+        return (uint8_t*) &packet->payload_data;
+    }
+    else
+    {
+        return NULL;
+    }
+}
+
+void netcode_server_free_packet( struct netcode_server_t * server, void * packet )
+{
+    netcode_assert( server );
+    netcode_assert( packet );
+    (void) server;
+    int offset = offsetof( struct netcode_connection_payload_packet_t, payload_data );
+    server->config.free_function( server->config.allocator_context, ( (uint8_t*) packet ) - offset );
+}
+
+int netcode_server_num_connected_clients( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+    return server->num_connected_clients;
+}
+
+int netcode_server_num_waiting_clients( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+    return server->wait_list.num_entries;
+}
+
+void * netcode_server_client_user_data( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    return server->client_user_data[client_index];
+}
+
+void netcode_server_set_client_tag( struct netcode_server_t * server, int client_index, void * tag )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( server->client_connected[client_index] );
+    server->client_tag[client_index] = tag;
+}
+
+void * netcode_server_client_tag( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    return server->client_tag[client_index];
+}
+
+uint64_t netcode_server_client_protocol_id( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+
+    if ( !server->client_connected[client_index] )
+        return 0;
+
+    return netcode_server_protocol_id( server, netcode_encryption_manager_get_protocol_index( &server->encryption_manager, server->client_encryption_index[client_index] ) );
+}
+
+int netcode_server_running( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+    return server->running;
+}
+
+int netcode_server_max_clients( struct netcode_server_t * server )
+{
+    return server->max_clients;
+}
+
+NETCODE_CONST uint64_t * netcode_server_counters( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+    server->counters[NETCODE_SERVER_COUNTER_REPLAYED_PACKETS_DROPPED] = 0;
+    int i;
+    for ( i = 0; i < NETCODE_MAX_CLIENTS; ++i )
+        server->counters[NETCODE_SERVER_COUNTER_REPLAYED_PACKETS_DROPPED] += server->client_replay_protection[i].num_replayed_packets;
+    return server->counters;
+}
+
+#define NETCODE_SERVER_ADMIN_COMMAND_BYTES 256
+#define NETCODE_SERVER_ADMIN_RESPONSE_BYTES ( 32 * 1024 )
+#define NETCODE_SERVER_MAX_ADMIN_COMMANDS 16
+
+static NETCODE_CONST char * netcode_server_counter_names[NETCODE_SERVER_NUM_COUNTERS] = 
+{
+    "version info mismatch",
+    "payload packets dropped",
+    "replayed packets dropped",
+    "send queue packets dropped",
+    "bandwidth packets dropped",
+    "bandwidth packets delayed",
+    "challenges rate limited",
+    "pending connections evicted",
+    "source filtered",
+    "challenges resent",
+    "migration decrypts",
+    "migrations rate limited",
+};
+
+static NETCODE_CONST char * netcode_log_level_names[] = { "none", "error", "info", "debug" };
+
+struct netcode_admin_response_t
+{
+    char * data;
+    int size;
+    int bytes;
+};
+
+void netcode_admin_response_printf( struct netcode_admin_response_t * response, NETCODE_CONST char * format, ... )
+{
+    netcode_assert( response );
+
+    if ( response->bytes >= response->size - 1 )
+        return;
+
+    va_list args;
+    va_start( args, format );
+    int result = vsnprintf( response->data + response->bytes, response->size - response->bytes, format, args );
+    va_end( args );
+
+    if ( result > 0 )
+    {
+        response->bytes += result;
+        if ( response->bytes > response->size - 1 )
+            response->bytes = response->size - 1;
+    }
+}
+
+int netcode_parse_client_id( NETCODE_CONST char * string, uint64_t * client_id )
+{
+    // client ids are read as hex, the same way the server logs them
+
+    char * end = NULL;
+    *client_id = strtoull( string, &end, 16 );
+    return end != string && *end == '\0';
+}
+
+int netcode_server_admin_command( struct netcode_server_t * server, NETCODE_CONST char * command, char * response_data, int response_size )
+{
+    netcode_assert( server );
+    netcode_assert( command );
+    netcode_assert( response_data );
+    netcode_assert( response_size > 0 );
+
+    struct netcode_admin_response_t response;
+    response.data = response_data;
+    response.size = response_size;
+    response.bytes = 0;
+    response_data[0] = '\0';
+
+    char name[32];
+    char argument[64];
+    name[0] = '\0';
+    argument[0] = '\0';
+
+    int num_words = sscanf( command, "%31s %63s", name, argument );
+
+    if ( num_words < 1 || strcmp( name, "help" ) == 0 )
+    {
+        netcode_admin_response_printf( &response, "commands:\n" );
+        netcode_admin_response_printf( &response, "    clients                 list connected clients\n" );
+        netcode_admin_response_printf( &response, "    kick <client index>     kick the client in a slot\n" );
+        netcode_admin_response_printf( &response, "    ban <client id>         kick a client id and refuse it from now on\n" );
+        netcode_admin_response_printf( &response, "    unban <client id>       lift a ban\n" );
+        netcode_admin_response_printf( &response, "    bans                    list banned client ids\n" );
+        netcode_admin_response_printf( &response, "    allow <client id>       add a client id to the allow list\n" );
+        netcode_admin_response_printf( &response, "    disallow <client id>    remove a client id from the allow list\n" );
+        netcode_admin_response_printf( &response, "    allowed                 list allowed client ids\n" );
+        netcode_admin_response_printf( &response, "    stats                   show server state and counters\n" );
+        netcode_admin_response_printf( &response, "    health                  check the server is running, for liveness and readiness probes\n" );
+        netcode_admin_response_printf( &response, "    pause [freeze]          stop accepting new connections, optionally freezing client timeouts\n" );
+        netcode_admin_response_printf( &response, "    resume                  accept new connections again\n" );
+        netcode_admin_response_printf( &response, "    log <level>             set the log level: none, error, info or debug\n" );
+        return num_words < 1 ? NETCODE_ERROR : NETCODE_OK;
+    }
+
+    if ( strcmp( name, "clients" ) == 0 )
+    {
+        netcode_admin_response_printf( &response, "%d/%d clients connected, %d waiting\n", server->num_connected_clients, server->max_clients, server->wait_list.num_entries );
+
+        int i;
+        for ( i = 0; i < server->max_clients; ++i )
+        {
+            if ( !server->client_connected[i] )
+                continue;
+
+            if ( server->client_loopback[i] )
+            {
+                netcode_admin_response_printf( &response, "    %3d  %.16" PRIx64 "  loopback\n", i, server->client_id[i] );
+            }
+            else
+            {
+                char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+                netcode_admin_response_printf( &response, "    %3d  %.16" PRIx64 "  %s\n", i, server->client_id[i], netcode_address_to_string( &server->client_address[i], address_string ) );
+            }
+        }
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "kick" ) == 0 )
+    {
+        char * end = NULL;
+        long client_index = strtol( argument, &end, 10 );
+
+        if ( num_words < 2 || end == argument || *end != '\0' || client_index < 0 || client_index >= server->max_clients || !server->client_connected[client_index] )
+        {
+            netcode_admin_response_printf( &response, "error: no client connected in slot '%s'\n", argument );
+            return NETCODE_ERROR;
+        }
+
+        if ( server->client_loopback[client_index] )
+        {
+            netcode_admin_response_printf( &response, "error: client %d is a loopback client\n", (int) client_index );
+            return NETCODE_ERROR;
+        }
+
+        netcode_server_kick_client( server, (int) client_index, NETCODE_DISCONNECT_REASON_KICKED );
+
+        netcode_admin_response_printf( &response, "kicked client %d\n", (int) client_index );
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "ban" ) == 0 || strcmp( name, "unban" ) == 0 )
+    {
+        uint64_t client_id = 0;
+
+        if ( num_words < 2 || !netcode_parse_client_id( argument, &client_id ) )
+        {
+            netcode_admin_response_printf( &response, "error: '%s' is not a client id\n", argument );
+            return NETCODE_ERROR;
+        }
+
+        if ( strcmp( name, "ban" ) == 0 )
+        {
+            if ( netcode_server_ban_client_id( server, client_id ) != NETCODE_OK )
+            {
+                netcode_admin_response_printf( &response, "error: ban list is full\n" );
+                return NETCODE_ERROR;
+            }
+
+            netcode_admin_response_printf( &response, "banned client %.16" PRIx64 "\n", client_id );
+        }
+        else
+        {
+            if ( netcode_server_unban_client_id( server, client_id ) != NETCODE_OK )
+            {
+                netcode_admin_response_printf( &response, "error: client %.16" PRIx64 " is not banned\n", client_id );
+                return NETCODE_ERROR;
+            }
+
+            netcode_admin_response_printf( &response, "unbanned client %.16" PRIx64 "\n", client_id );
+        }
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "bans" ) == 0 )
+    {
+        netcode_admin_response_printf( &response, "%d/%d client ids banned\n", server->num_banned_clients, NETCODE_MAX_BANNED_CLIENTS );
+
+        int i;
+        for ( i = 0; i < server->num_banned_clients; ++i )
+        {
+            netcode_admin_response_printf( &response, "    %.16" PRIx64 "\n", server->banned_client_id[i] );
+        }
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "allow" ) == 0 || strcmp( name, "disallow" ) == 0 )
+    {
+        uint64_t client_id = 0;
+
+        if ( num_words < 2 || !netcode_parse_client_id( argument, &client_id ) )
+        {
+            netcode_admin_response_printf( &response, "error: '%s' is not a client id\n", argument );
+            return NETCODE_ERROR;
+        }
+
+        if ( strcmp( name, "allow" ) == 0 )
+        {
+            if ( netcode_server_allow_client_id( server, client_id ) != NETCODE_OK )
+            {
+                netcode_admin_response_printf( &response, "error: allow list is full\n" );
+                return NETCODE_ERROR;
+            }
+
+            netcode_admin_response_printf( &response, "allowed client %.16" PRIx64 "\n", client_id );
+        }
+        else
+        {
+            if ( netcode_server_disallow_client_id( server, client_id ) != NETCODE_OK )
+            {
+                netcode_admin_response_printf( &response, "error: client %.16" PRIx64 " is not on the allow list\n", client_id );
+                return NETCODE_ERROR;
+            }
+
+            netcode_admin_response_printf( &response, "disallowed client %.16" PRIx64 "\n", client_id );
+        }
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "allowed" ) == 0 )
+    {
+        netcode_admin_response_printf( &response, "%d/%d client ids allowed%s\n", server->num_allowed_clients, NETCODE_MAX_ALLOWED_CLIENTS, server->config.allow_list_only ? "" : " (allow list not enforced)" );
+
+        int i;
+        for ( i = 0; i < server->num_allowed_clients; ++i )
+        {
+            netcode_admin_response_printf( &response, "    %.16" PRIx64 "\n", server->allowed_client_id[i] );
+        }
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "stats" ) == 0 )
+    {
+        netcode_admin_response_printf( &response, "    %-28s%s\n", "running", server->running ? "yes" : "no" );
+        netcode_admin_response_printf( &response, "    %-28s%s\n", "paused", !server->paused ? "no" : ( server->paused_freeze_timeouts ? "yes, timeouts frozen" : "yes" ) );
+        netcode_admin_response_printf( &response, "    %-28s%d/%d\n", "connected clients", server->num_connected_clients, server->max_clients );
+        netcode_admin_response_printf( &response, "    %-28s%d\n", "waiting clients", server->wait_list.num_entries );
+        netcode_admin_response_printf( &response, "    %-28s%d\n", "banned clients", server->num_banned_clients );
+        netcode_admin_response_printf( &response, "    %-28s%d%s\n", "allowed clients", server->num_allowed_clients, server->config.allow_list_only ? "" : " (not enforced)" );
+
+        NETCODE_CONST uint64_t * counters = netcode_server_counters( server );
+
+        int i;
+        for ( i = 0; i < NETCODE_SERVER_NUM_COUNTERS; ++i )
+        {
+            netcode_admin_response_printf( &response, "    %-28s%" PRIu64 "\n", netcode_server_counter_names[i], counters[i] );
+        }
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "health" ) == 0 )
+    {
+        // commands are answered from inside netcode_server_update, so any reply over the admin socket also shows the update loop is advancing
+
+        if ( !server->running )
+        {
+            netcode_admin_response_printf( &response, "error: server is not running\n" );
+            return NETCODE_ERROR;
+        }
+
+        netcode_admin_response_printf( &response, "ok: %d/%d clients connected\n", server->num_connected_clients, server->max_clients );
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "pause" ) == 0 )
+    {
+        if ( num_words == 2 && strcmp( argument, "freeze" ) != 0 )
+        {
+            netcode_admin_response_printf( &response, "error: unknown pause option '%s'\n", argument );
+            return NETCODE_ERROR;
+        }
+
+        if ( !server->running )
+        {
+            netcode_admin_response_printf( &response, "error: server is not running\n" );
+            return NETCODE_ERROR;
+        }
+
+        netcode_server_pause( server, num_words == 2 );
+
+        netcode_admin_response_printf( &response, "server paused%s\n", num_words == 2 ? " with timeouts frozen" : "" );
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "resume" ) == 0 )
+    {
+        netcode_server_resume( server );
+
+        netcode_admin_response_printf( &response, "server resumed\n" );
+
+        return NETCODE_OK;
+    }
+
+    if ( strcmp( name, "log" ) == 0 )
+    {
+        int level = -1;
+
+        int i;
+        for ( i = NETCODE_LOG_LEVEL_NONE; i <= NETCODE_LOG_LEVEL_DEBUG; ++i )
+        {
+            if ( strcmp( argument, netcode_log_level_names[i] ) == 0 || ( argument[0] == '0' + i && argument[1] == '\0' ) )
+                level = i;
+        }
+
+        if ( num_words < 2 || level == -1 )
+        {
+            netcode_admin_response_printf( &response, "error: log level must be none, error, info or debug\n" );
+            return NETCODE_ERROR;
+        }
+
+        netcode_log_level( level );
+
+        netcode_admin_response_printf( &response, "log level set to %s\n", netcode_log_level_names[level] );
+
+        return NETCODE_OK;
+    }
+
+    netcode_admin_response_printf( &response, "error: unknown command '%s'. try 'help'\n", name );
+
+    return NETCODE_ERROR;
+}
+
+int netcode_admin_secret_matches( NETCODE_CONST char * secret, NETCODE_CONST char * command, int command_bytes )
+{
+    netcode_assert( secret );
+    netcode_assert( command );
+
+    // compare every byte of the secret regardless of where the first difference is, so timing doesn't give it away
+
+    int secret_bytes = (int) strlen( secret );
+
+    if ( command_bytes <= secret_bytes || command[secret_bytes] != ' ' )
+        return 0;
+
+    uint8_t difference = 0;
+    int i;
+    for ( i = 0; i < secret_bytes; ++i )
+    {
+        difference |= (uint8_t) ( secret[i] ^ command[i] );
+    }
+
+    return difference == 0;
+}
+
+void netcode_server_receive_admin_commands( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+
+    if ( !server->admin_socket_open )
+        return;
+
+    // one datagram per command, one datagram back. capped per update so a chatty tool can't stall the server
+
+    int i;
+    for ( i = 0; i < NETCODE_SERVER_MAX_ADMIN_COMMANDS; ++i )
+    {
+        char command[NETCODE_SERVER_ADMIN_COMMAND_BYTES];
+        struct netcode_address_t from;
+
+        int command_bytes = netcode_socket_receive_packet( &server->admin_socket, &from, command, sizeof( command ) - 1 );
+        if ( command_bytes == 0 )
+            break;
+
+        command[command_bytes] = '\0';
+
+        // with a secret set, commands without it get no reply at all, so a local user can't probe for it. the secret is 
+        // checked against the server's own copy, since the string in config may be gone by now
+
+        char * command_start = command;
+
+        if ( server->admin_secret[0] != '\0' )
+        {
+            if ( !netcode_admin_secret_matches( server->admin_secret, command, command_bytes ) )
+            {
+                char address_string[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+                netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server ignored admin command from %s. wrong secret\n", netcode_address_to_string( &from, address_string ) );
+                continue;
+            }
+
+            command_start += strlen( server->admin_secret ) + 1;
+        }
+
+        char response[NETCODE_SERVER_ADMIN_RESPONSE_BYTES];
+        netcode_server_admin_command( server, command_start, response, sizeof( response ) );
+
+        netcode_socket_send_packet( &server->admin_socket, &from, response, (int) strlen( response ) );
+    }
+}
+
+void netcode_server_update( struct netcode_server_t * server, double time )
+{
+    netcode_assert( server );
+    server->time = time;
+    netcode_server_receive_packets( server );
+    netcode_server_receive_admin_commands( server );
+    netcode_server_send_packets( server );
+    netcode_server_check_for_kicks( server );
+    netcode_server_check_for_timeouts( server );
+    netcode_server_check_for_abandoned_handshakes( server );
+}
+
+void netcode_server_connect_loopback_client( struct netcode_server_t * server, int client_index, uint64_t client_id, NETCODE_CONST uint8_t * user_data )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( server->running );
+    netcode_assert( !server->client_connected[client_index] );
+
+    server->num_connected_clients++;
+
+    netcode_assert( server->num_connected_clients <= server->max_clients );
+
+    server->client_loopback[client_index] = 1;
+    server->client_connected[client_index] = 1;
+    server->client_confirmed[client_index] = 1;
+    server->client_encryption_index[client_index] = -1;
+    server->client_id[client_index] = client_id;
+    server->client_sequence[client_index] = 0;
+    memset( &server->client_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    server->client_last_packet_send_time[client_index] = server->time;
+    server->client_last_packet_receive_time[client_index] = server->time;
+    server->client_disconnect_reason[client_index] = NETCODE_DISCONNECT_REASON_NONE;
+
+    if ( user_data )
+    {
+        memcpy( server->client_user_data[client_index], user_data, NETCODE_USER_DATA_BYTES );
+    }
+    else
+    {
+        memset( server->client_user_data[client_index], 0, NETCODE_USER_DATA_BYTES );
+    }
+
+    server->client_tag[client_index] = NULL;
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server connected loopback client %.16" PRIx64 " in slot %d\n", client_id, client_index );
+
+    if ( server->config.connect_disconnect_callback )
+    {
+        server->config.connect_disconnect_callback( server->config.callback_context, client_index, 1 );
+    }
+}
+
+void netcode_server_disconnect_loopback_client( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( server->running );
+    netcode_assert( server->client_connected[client_index] );
+    netcode_assert( server->client_loopback[client_index] );
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server disconnected loopback client %d\n", client_index );
+
+    server->client_disconnect_reason[client_index] = NETCODE_DISCONNECT_REASON_KICKED;
+
+    if ( server->config.connect_disconnect_callback )
+    {
+        server->config.connect_disconnect_callback( server->config.callback_context, client_index, 0 );
+    }
+
+    while ( 1 )
+    {
+        void * packet = netcode_packet_queue_pop( &server->client_packet_queue[client_index], NULL );
+        if ( !packet )
+            break;
+        server->config.free_function( server->config.allocator_context, packet );
+    }
+
+    netcode_packet_queue_clear( &server->client_packet_queue[client_index] );
+
+    server->client_connected[client_index] = 0;
+    server->client_loopback[client_index] = 0;
+    server->client_confirmed[client_index] = 0;
+    server->client_id[client_index] = 0;
+    server->client_sequence[client_index] = 0;
+    server->client_last_packet_send_time[client_index] = 0.0;
+    server->client_last_packet_receive_time[client_index] = 0.0;
+    server->client_packet_send_rate[client_index] = server->config.packet_send_rate;
+    server->client_keep_alive_offset[client_index] = 0.0;
+    netcode_send_wheel_remove( &server->keep_alive_wheel, client_index );
+    server->client_bandwidth_limit[client_index] = server->config.bandwidth_limit;
+    memset( &server->client_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    memset( &server->client_reply_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    memset( &server->client_migration_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    memset( &server->client_migration_reply_address[client_index], 0, sizeof( struct netcode_address_t ) );
+    server->client_migration_challenge[client_index] = 0;
+    server->client_encryption_index[client_index] = -1;
+    memset( server->client_user_data[client_index], 0, NETCODE_USER_DATA_BYTES );
+    server->client_tag[client_index] = NULL;
+
+    server->num_connected_clients--;
+
+    netcode_assert( server->num_connected_clients >= 0 );
+}
+
+int netcode_server_client_loopback( struct netcode_server_t * server, int client_index )
+{
+    netcode_assert( server );
+    netcode_assert( server->running );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    return server->client_loopback[client_index];
+}
+
+void netcode_server_process_loopback_packet( struct netcode_server_t * server, int client_index, NETCODE_CONST uint8_t * packet_data, int packet_bytes, uint64_t packet_sequence )
+{
+    netcode_assert( server );
+    netcode_assert( client_index >= 0 );
+    netcode_assert( client_index < server->max_clients );
+    netcode_assert( packet_data );
+    netcode_assert( packet_bytes >= 0 );
+    netcode_assert( packet_bytes <= NETCODE_MAX_PAYLOAD_BYTES );
+    netcode_assert( server->client_connected[client_index] );
+    netcode_assert( server->client_loopback[client_index] );
+    netcode_assert( server->running );
+
+    struct netcode_connection_payload_packet_t * packet = netcode_create_payload_packet( packet_bytes, server->config.allocator_context, server->config.allocate_function );
+    if ( !packet )
+        return;
+
+    memcpy( packet->payload_data, packet_data, packet_bytes );
+
+    netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "server processing loopback packet from client %d\n", client_index );
+
+    server->client_last_packet_receive_time[client_index] = server->time;
+
+    if ( !netcode_packet_queue_push( &server->client_packet_queue[client_index], packet, packet_sequence ) )
+    {
+        server->counters[NETCODE_SERVER_COUNTER_PAYLOAD_PACKETS_DROPPED]++;
+    }
+}
+
+uint16_t netcode_server_get_port( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+    return server->address.type == NETCODE_ADDRESS_IPV4 ? server->socket_holder.ipv4.address.port : server->socket_holder.ipv6.address.port;
+}
+
+// ----------------------------------------------------------------
+
+// a session snapshot lets a restarting server process pick up its connected clients, as long as it comes back before they time out.
+// it also carries the used connect token set, so tokens already spent on the old process can't be spent again on the new one.
+// snapshots hold session keys, so everything after the header is encrypted with the server private key.
+// handshakes in progress are not carried over. those clients retry, or fail over to the next server in their connect token
+
+#define NETCODE_SESSION_SNAPSHOT_VERSION "NETCODE SS 01"
+
+#define NETCODE_SESSION_SNAPSHOT_HEADER_BYTES ( NETCODE_VERSION_INFO_BYTES + 8 + 8 + NETCODE_CONNECT_TOKEN_NONCE_BYTES )
+
+#define NETCODE_SESSION_SNAPSHOT_ADDRESS_BYTES ( 1 + 16 + 2 )
+
+#define NETCODE_SESSION_SNAPSHOT_CLIENT_BYTES ( 4 + 8 + NETCODE_SESSION_SNAPSHOT_ADDRESS_BYTES * 2 + 4 + NETCODE_VERSION_INFO_BYTES + 8 + 1 + NETCODE_KEY_BYTES * 2 + 8 + NETCODE_USER_DATA_BYTES + 8 + NETCODE_REPLAY_PROTECTION_BUFFER_SIZE * 8 )
+
+#define NETCODE_SESSION_SNAPSHOT_TOKEN_BYTES ( NETCODE_MAC_BYTES + NETCODE_SESSION_SNAPSHOT_ADDRESS_BYTES )
+
+// restored sessions skip this far ahead in sequence for every second the snapshot is old, plus one. the old process sends nothing after
+// writing the snapshot, so this only has to keep restores of the same snapshot apart: restores a second or more apart land in ranges
+// that don't overlap, as long as no client is sent more than half this many packets a second
+
+#define NETCODE_SESSION_SNAPSHOT_SEQUENCE_GAP ( 1ULL << 24 )
+
+void netcode_write_session_snapshot_address( uint8_t ** p, struct netcode_address_t * address )
+{
+    netcode_write_uint8( p, address->type );
+
+    int i;
+    if ( address->type == NETCODE_ADDRESS_IPV4 )
+    {
+        for ( i = 0; i < 4; ++i )
+            netcode_write_uint8( p, address->data.ipv4[i] );
+        for ( i = 4; i < 16; ++i )
+            netcode_write_uint8( p, 0 );
+    }
+    else
+    {
+        for ( i = 0; i < 8; ++i )
+            netcode_write_uint16( p, address->type == NETCODE_ADDRESS_IPV6 ? address->data.ipv6[i] : 0 );
+    }
+
+    netcode_write_uint16( p, address->port );
+}
+
+int netcode_read_session_snapshot_address( uint8_t ** p, struct netcode_address_t * address )
+{
+    memset( address, 0, sizeof( struct netcode_address_t ) );
+
+    address->type = netcode_read_uint8( p );
+
+    int i;
+    if ( address->type == NETCODE_ADDRESS_IPV4 )
+    {
+        for ( i = 0; i < 4; ++i )
+            address->data.ipv4[i] = netcode_read_uint8( p );
+        for ( i = 4; i < 16; ++i )
+            netcode_read_uint8( p );
+    }
+    else
+    {
+        for ( i = 0; i < 8; ++i )
+            address->data.ipv6[i] = netcode_read_uint16( p );
+    }
+
+    address->port = netcode_read_uint16( p );
+
+    return address->type == NETCODE_ADDRESS_IPV4 || address->type == NETCODE_ADDRESS_IPV6;
+}
+
+int netcode_server_session_snapshot_num_sessions( struct netcode_server_t * server )
+{
+    int num_sessions = 0;
+
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
+    {
+        if ( server->client_connected[i] && !server->client_loopback[i] )
+            num_sessions++;
+    }
+
+    return num_sessions;
+}
+
+int netcode_server_session_snapshot_num_used_tokens( struct netcode_server_t * server )
+{
+    int num_used_tokens = 0;
+
+    int i;
+    for ( i = 0; i < NETCODE_MAX_CONNECT_TOKEN_ENTRIES; ++i )
+    {
+        if ( server->connect_token_entries.entries[i].address.type != NETCODE_ADDRESS_NONE )
+            num_used_tokens++;
+    }
+
+    return num_used_tokens;
+}
+
+int netcode_server_session_snapshot_bytes( struct netcode_server_t * server )
+{
+    netcode_assert( server );
+
+    return NETCODE_SESSION_SNAPSHOT_HEADER_BYTES + 
+           4 + netcode_server_session_snapshot_num_sessions( server ) * NETCODE_SESSION_SNAPSHOT_CLIENT_BYTES + 
+           4 + netcode_server_session_snapshot_num_used_tokens( server ) * NETCODE_SESSION_SNAPSHOT_TOKEN_BYTES + 
+           NETCODE_MAC_BYTES;
+}
+
+int netcode_server_write_session_snapshot( struct netcode_server_t * server, uint8_t * buffer, int buffer_size )
+{
+    netcode_assert( server );
+    netcode_assert( buffer );
+
+    int snapshot_bytes = netcode_server_session_snapshot_bytes( server );
+
+    if ( buffer_size < snapshot_bytes )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: session snapshot needs %d bytes, buffer is only %d\n", snapshot_bytes, buffer_size );
+        return 0;
+    }
+
+    uint8_t * p = buffer;
+
+    netcode_write_bytes( &p, (uint8_t*) NETCODE_SESSION_SNAPSHOT_VERSION, NETCODE_VERSION_INFO_BYTES );
+    netcode_write_uint64( &p, server->config.protocol_id );
+    netcode_write_uint64( &p, netcode_timestamp() );
+
+    uint8_t * nonce = p;
+    netcode_random_bytes( nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    p += NETCODE_CONNECT_TOKEN_NONCE_BYTES;
+
+    uint8_t * body = p;
+
+    netcode_write_uint32( &p, (uint32_t) netcode_server_session_snapshot_num_sessions( server ) );
+
+    int i;
+    for ( i = 0; i < server->max_clients; ++i )
+    {
+        if ( !server->client_connected[i] || server->client_loopback[i] )
+            continue;
+
+        int encryption_index = server->client_encryption_index[i];
+        int version_index = netcode_encryption_manager_get_version_index( &server->encryption_manager, encryption_index );
+        int protocol_index = netcode_encryption_manager_get_protocol_index( &server->encryption_manager, encryption_index );
+
+        netcode_write_uint32( &p, (uint32_t) i );
+        netcode_write_uint64( &p, server->client_id[i] );
+        netcode_write_session_snapshot_address( &p, &server->client_address[i] );
+        netcode_write_session_snapshot_address( &p, &server->client_reply_address[i] );
+        netcode_write_uint32( &p, (uint32_t) server->client_timeout[i] );
+        netcode_write_bytes( &p, server->version_info[version_index], NETCODE_VERSION_INFO_BYTES );
+        netcode_write_uint64( &p, netcode_server_protocol_id( server, protocol_index ) );
+        netcode_write_uint8( &p, (uint8_t) server->client_confirmed[i] );
+        netcode_write_bytes( &p, netcode_encryption_manager_get_send_key( &server->encryption_manager, encryption_index ), NETCODE_KEY_BYTES );
+        netcode_write_bytes( &p, netcode_encryption_manager_get_receive_key( &server->encryption_manager, encryption_index ), NETCODE_KEY_BYTES );
+        netcode_write_uint64( &p, server->client_sequence[i] );
+        netcode_write_bytes( &p, server->client_user_data[i], NETCODE_USER_DATA_BYTES );
+
+        // replay protection comes along too, otherwise packets captured before the restart could be replayed after it
+
+        netcode_write_uint64( &p, server->client_replay_protection[i].most_recent_sequence );
+
+        int j;
+        for ( j = 0; j < NETCODE_REPLAY_PROTECTION_BUFFER_SIZE; ++j )
+            netcode_write_uint64( &p, server->client_replay_protection[i].received_packet[j] );
+    }
+
+    // used tokens are written oldest first, so the new process ages them out in the same order
+
+    netcode_write_uint32( &p, (uint32_t) netcode_server_session_snapshot_num_used_tokens( server ) );
+
+    for ( i = 0; i < NETCODE_MAX_CONNECT_TOKEN_ENTRIES; ++i )
+    {
+        struct netcode_connect_token_entry_t * entry = &server->connect_token_entries.entries[( server->connect_token_entries.next_index + i ) % NETCODE_MAX_CONNECT_TOKEN_ENTRIES];
+
+        if ( entry->address.type == NETCODE_ADDRESS_NONE )
+            continue;
+
+        netcode_write_bytes( &p, entry->mac, NETCODE_MAC_BYTES );
+        netcode_write_session_snapshot_address( &p, &entry->address );
+    }
+
+    netcode_assert( p - buffer == snapshot_bytes - NETCODE_MAC_BYTES );
+
+    if ( netcode_encrypt_aead_bignonce( body, p - body, buffer, NETCODE_SESSION_SNAPSHOT_HEADER_BYTES - NETCODE_CONNECT_TOKEN_NONCE_BYTES, nonce, server->config.private_key ) != NETCODE_OK )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to encrypt session snapshot\n" );
+        return 0;
+    }
+
+    server->session_snapshot_written = 1;
+
+    netcode_printf( NETCODE_LOG_LEVEL_INFO, "server wrote session snapshot. no more packets will be sent to clients\n" );
+
+    return snapshot_bytes;
+}
+
+int netcode_server_restore_session( struct netcode_server_t * server, uint8_t ** p, uint64_t snapshot_age )
+{
+    int client_index = (int) netcode_read_uint32( p );
+    uint64_t client_id = netcode_read_uint64( p );
+
+    struct netcode_address_t address;
+    struct netcode_address_t reply_address;
+    int address_ok = netcode_read_session_snapshot_address( p, &address );
+    int reply_address_ok = netcode_read_session_snapshot_address( p, &reply_address );
+
+    int timeout_seconds = (int) netcode_read_uint32( p );
+
+    uint8_t version_info[NETCODE_VERSION_INFO_BYTES];
+    netcode_read_bytes( p, version_info, NETCODE_VERSION_INFO_BYTES );
+
+    uint64_t protocol_id = netcode_read_uint64( p );
+
+    int confirmed = netcode_read_uint8( p );
+
+    uint8_t send_key[NETCODE_KEY_BYTES];
+    uint8_t receive_key[NETCODE_KEY_BYTES];
+    netcode_read_bytes( p, send_key, NETCODE_KEY_BYTES );
+    netcode_read_bytes( p, receive_key, NETCODE_KEY_BYTES );
+
+    uint64_t sequence = netcode_read_uint64( p );
+
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_read_bytes( p, user_data, NETCODE_USER_DATA_BYTES );
+
+    struct netcode_replay_protection_t replay_protection;
+    replay_protection.most_recent_sequence = netcode_read_uint64( p );
+
+    int i;
+    for ( i = 0; i < NETCODE_REPLAY_PROTECTION_BUFFER_SIZE; ++i )
+        replay_protection.received_packet[i] = netcode_read_uint64( p );
+
+    int version_index = -1;
+    for ( i = 0; i < server->num_version_info; ++i )
+    {
+        if ( memcmp( server->version_info[i], version_info, NETCODE_VERSION_INFO_BYTES ) == 0 )
+            version_index = i;
+    }
+
+    int protocol_index = -1;
+    for ( i = 0; i <= server->config.num_alternate_protocols; ++i )
+    {
+        if ( netcode_server_protocol_id( server, i ) == protocol_id )
+            protocol_index = i;
+    }
+
+    int result = NETCODE_ERROR;
+
+    if ( !address_ok || !reply_address_ok )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: session snapshot has a bad address for client %.16" PRIx64 "\n", client_id );
+    }
+    else if ( timeout_seconds > 0 && snapshot_age >= (uint64_t) timeout_seconds )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server did not restore client %.16" PRIx64 ". session has timed out\n", client_id );
+    }
+    else if ( client_index < 0 || client_index >= server->max_clients || server->client_connected[client_index] )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server did not restore client %.16" PRIx64 ". slot %d is not available\n", client_id, client_index );
+    }
+    else if ( netcode_server_find_client_index_by_id( server, client_id ) != -1 || netcode_server_find_client_index_by_address( server, &address ) != -1 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server did not restore client %.16" PRIx64 ". client is already connected\n", client_id );
+    }
+    else if ( version_index == -1 || protocol_index == -1 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server did not restore client %.16" PRIx64 ". server no longer accepts its version or protocol id\n", client_id );
+    }
+    else if ( !netcode_encryption_manager_add_encryption_mapping( &server->encryption_manager, &address, send_key, receive_key, server->time, -1.0, timeout_seconds, version_index ) )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_INFO, "server did not restore client %.16" PRIx64 ". failed to add encryption mapping\n", client_id );
+    }
+    else
+    {
+        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, &address, server->time );
+
+        netcode_encryption_manager_set_protocol_index( &server->encryption_manager, encryption_index, protocol_index );
+
+        netcode_server_connect_client( server, client_index, &address, &reply_address, client_id, encryption_index, timeout_seconds, sequence + NETCODE_SESSION_SNAPSHOT_SEQUENCE_GAP * ( snapshot_age + 1 ), user_data );
+
+        server->client_confirmed[client_index] = confirmed;
+        server->client_replay_protection[client_index].most_recent_sequence = replay_protection.most_recent_sequence;
+        memcpy( server->client_replay_protection[client_index].received_packet, replay_protection.received_packet, sizeof( replay_protection.received_packet ) );
+
+        result = NETCODE_OK;
+    }
+
+    sodium_memzero( send_key, NETCODE_KEY_BYTES );
+    sodium_memzero( receive_key, NETCODE_KEY_BYTES );
+
+    return result;
+}
+
+int netcode_server_read_session_snapshot( struct netcode_server_t * server, NETCODE_CONST uint8_t * buffer, int buffer_bytes )
+{
+    netcode_assert( server );
+    netcode_assert( buffer );
+
+    if ( !server->running )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: server must be started before reading a session snapshot\n" );
+        return NETCODE_ERROR;
+    }
+
+    if ( buffer_bytes < NETCODE_SESSION_SNAPSHOT_HEADER_BYTES + 4 + NETCODE_MAC_BYTES )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: session snapshot is too small\n" );
+        return NETCODE_ERROR;
+    }
+
+    if ( memcmp( buffer, NETCODE_SESSION_SNAPSHOT_VERSION, NETCODE_VERSION_INFO_BYTES ) != 0 )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: session snapshot has the wrong version\n" );
+        return NETCODE_ERROR;
+    }
+
+    // decrypt a copy, so the caller's buffer can stay const
+
+    uint8_t * snapshot = (uint8_t*) server->config.allocate_function( server->config.allocator_context, buffer_bytes );
+    if ( !snapshot )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: failed to allocate session snapshot buffer\n" );
+        return NETCODE_ERROR;
+    }
+
+    memcpy( snapshot, buffer, buffer_bytes );
+
+    uint8_t * p = snapshot + NETCODE_VERSION_INFO_BYTES;
+
+    uint64_t protocol_id = netcode_read_uint64( &p );
+    uint64_t timestamp = netcode_read_uint64( &p );
+
+    uint8_t * nonce = p;
+    p += NETCODE_CONNECT_TOKEN_NONCE_BYTES;
+
+    int result = NETCODE_ERROR;
+
+    if ( protocol_id != server->config.protocol_id )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: session snapshot is for protocol id %.16" PRIx64 "\n", protocol_id );
+    }
+    else if ( netcode_decrypt_aead_bignonce( p, buffer_bytes - NETCODE_SESSION_SNAPSHOT_HEADER_BYTES, snapshot, NETCODE_SESSION_SNAPSHOT_HEADER_BYTES - NETCODE_CONNECT_TOKEN_NONCE_BYTES, nonce, server->config.private_key ) != NETCODE_OK )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: session snapshot failed to decrypt\n" );
+    }
+    else if ( server->session_snapshot_read && memcmp( nonce, server->session_snapshot_nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES ) == 0 )
+    {
+        // restoring the same snapshot twice within a second would hand out the same sequence range twice under the same keys
+
+        netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: session snapshot was already read\n" );
+    }
+    else
+    {
+        uint64_t body_bytes = (uint64_t) buffer_bytes - NETCODE_SESSION_SNAPSHOT_HEADER_BYTES - NETCODE_MAC_BYTES;
+
+        uint32_t num_sessions = netcode_read_uint32( &p );
+
+        uint64_t sessions_bytes = 4 + (uint64_t) num_sessions * NETCODE_SESSION_SNAPSHOT_CLIENT_BYTES;
+
+        uint32_t num_used_tokens = 0;
+        if ( sessions_bytes + 4 <= body_bytes )
+        {
+            uint8_t * q = p + sessions_bytes - 4;
+            num_used_tokens = netcode_read_uint32( &q );
+        }
+
+        if ( body_bytes != sessions_bytes + 4 + (uint64_t) num_used_tokens * NETCODE_SESSION_SNAPSHOT_TOKEN_BYTES )
+        {
+            netcode_printf( NETCODE_LOG_LEVEL_ERROR, "error: session snapshot has the wrong size for %u sessions\n", num_sessions );
+        }
+        else
+        {
+            uint64_t now = netcode_timestamp();
+            uint64_t snapshot_age = ( now > timestamp ) ? now - timestamp : 0;
+
+            int num_restored = 0;
+
+            uint32_t i;
+            for ( i = 0; i < num_sessions; ++i )
+            {
+                if ( netcode_server_restore_session( server, &p, snapshot_age ) == NETCODE_OK )
+                    num_restored++;
+            }
+
+            netcode_printf( NETCODE_LOG_LEVEL_INFO, "server restored %d/%u sessions from snapshot\n", num_restored, num_sessions );
+
+            netcode_read_uint32( &p );
+
+            for ( i = 0; i < num_used_tokens; ++i )
+            {
+                uint8_t mac[NETCODE_MAC_BYTES];
+                netcode_read_bytes( &p, mac, NETCODE_MAC_BYTES );
+
+                struct netcode_address_t address;
+                if ( netcode_read_session_snapshot_address( &p, &address ) )
+                    netcode_connect_token_entries_find_or_add( &server->connect_token_entries, &address, mac, server->time );
+            }
+
+            server->session_snapshot_read = 1;
+            memcpy( server->session_snapshot_nonce, nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+
+            result = NETCODE_OK;
+        }
+    }
+
+    sodium_memzero( snapshot, buffer_bytes );
+
+    server->config.free_function( server->config.allocator_context, snapshot );
+
+    return result;
+}
+
+// ----------------------------------------------------------------
+
+static uint64_t netcode_server_selection_score( NETCODE_CONST char * server_address, uint64_t client_id )
+{
+    // FNV-1a over the address string and client id, then a 64 bit finalizer so nearby ids spread out
+
+    uint64_t hash = 0xCBF29CE484222325ULL;
+
+    NETCODE_CONST char * p = server_address;
+    while ( *p )
+    {
+        hash ^= (uint8_t) *p++;
+        hash *= 0x100000001B3ULL;
+    }
+
+    int i;
+    for ( i = 0; i < 8; ++i )
+    {
+        hash ^= (uint8_t) ( client_id >> ( i * 8 ) );
+        hash *= 0x100000001B3ULL;
+    }
+
+    hash ^= hash >> 30;
+    hash *= 0xBF58476D1CE4E5B9ULL;
+    hash ^= hash >> 27;
+    hash *= 0x94D049BB133111EBULL;
+    hash ^= hash >> 31;
+
+    return hash;
+}
+
+int netcode_select_servers( int num_servers, 
+                            NETCODE_CONST char ** server_addresses, 
+                            uint64_t client_id, 
+                            int max_selected, 
+                            int * selected_indices )
+{
+    netcode_assert( num_servers >= 0 );
+    netcode_assert( num_servers == 0 || server_addresses );
+    netcode_assert( max_selected >= 0 );
+    netcode_assert( max_selected <= NETCODE_MAX_SERVERS_PER_CONNECT );
+    netcode_assert( selected_indices );
+
+    // rendezvous hashing: every server gets a score for this client and the highest scores win. 
+    // adding or removing a server only moves the clients whose selection included that server
+
+    int num_selected = 0;
+
+    uint64_t previous_score = 0;
+    int previous_index = -1;
+
+    while ( num_selected < max_selected && num_selected < num_servers )
+    {
+        int best_index = -1;
+        uint64_t best_score = 0;
+
+        int i;
+        for ( i = 0; i < num_servers; ++i )
+        {
+            uint64_t score = netcode_server_selection_score( server_addresses[i], client_id );
+
+            // skip servers already selected, which rank at or above the previous selection (ties broken by index)
+
+            if ( previous_index != -1 && ( score > previous_score || ( score == previous_score && i <= previous_index ) ) )
+                continue;
+
+            if ( best_index == -1 || score > best_score )
+            {
+                best_index = i;
+                best_score = score;
+            }
+        }
+
+        if ( best_index == -1 )
+            break;
+
+        selected_indices[num_selected++] = best_index;
+
+        previous_score = best_score;
+        previous_index = best_index;
+    }
+
+    return num_selected;
+}
+
+int netcode_generate_connect_token( int num_server_addresses, 
+                                    NETCODE_CONST char ** public_server_addresses, 
+                                    NETCODE_CONST char ** internal_server_addresses, 
+                                    int expire_seconds, 
+                                    int timeout_seconds,
+                                    uint64_t client_id, 
+                                    uint64_t protocol_id, 
+                                    NETCODE_CONST uint8_t * private_key, 
+                                    NETCODE_CONST uint8_t * user_data, 
+                                    uint8_t * output_buffer )
+{
+    netcode_assert( num_server_addresses > 0 );
+    netcode_assert( num_server_addresses <= NETCODE_MAX_SERVERS_PER_CONNECT );
+    netcode_assert( public_server_addresses );
+    netcode_assert( internal_server_addresses );
+    netcode_assert( private_key );
+    netcode_assert( output_buffer );
+
+    // parse public server addresses
+
+    struct netcode_address_t parsed_public_server_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
+    int i;
+    for ( i = 0; i < num_server_addresses; ++i )
+    {
+        if ( netcode_parse_address( public_server_addresses[i], &parsed_public_server_addresses[i] ) != NETCODE_OK )
+        {
+            return NETCODE_ERROR;
+        }
+    }
+
+    // parse internal server addresses
+
+     struct netcode_address_t parsed_internal_server_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
+    for ( i = 0; i < num_server_addresses; ++i )
+    {
+        if ( netcode_parse_address( internal_server_addresses[i], &parsed_internal_server_addresses[i] ) != NETCODE_OK )
+        {
+            return NETCODE_ERROR;
+        }
+    }
+
+    // generate a connect token. if no user data is passed in it is filled with random bytes
+
+    uint8_t connect_token_user_data[NETCODE_USER_DATA_BYTES];
+    if ( user_data )
+    {
+        memcpy( connect_token_user_data, user_data, NETCODE_USER_DATA_BYTES );
+    }
+    else
+    {
+        netcode_random_bytes( connect_token_user_data, NETCODE_USER_DATA_BYTES );
+    }
+
+    struct netcode_connect_token_private_t connect_token_private;
+    netcode_generate_connect_token_private( &connect_token_private, client_id, timeout_seconds, num_server_addresses, parsed_internal_server_addresses, connect_token_user_data );
+
+    // write it to a buffer
+
+    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    netcode_write_connect_token_private( &connect_token_private, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    // encrypt the buffer. the nonce is random, so web backends sharing a private key don't need to coordinate a sequence
+
+    uint64_t create_timestamp = netcode_timestamp();
+    uint64_t expire_timestamp = ( expire_seconds >= 0 ) ? ( create_timestamp + expire_seconds ) : 0xFFFFFFFFFFFFFFFFULL;
+    uint8_t nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    netcode_random_bytes( nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    if ( netcode_encrypt_connect_token_private( connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, NETCODE_VERSION_INFO, protocol_id, expire_timestamp, nonce, private_key ) != NETCODE_OK )
+        return NETCODE_ERROR;
+
+    // wrap a connect token around the private connect token data
+
+    struct netcode_connect_token_t connect_token;
+    memcpy( connect_token.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+    connect_token.protocol_id = protocol_id;
+    connect_token.create_timestamp = create_timestamp;
+    connect_token.expire_timestamp = expire_timestamp;
+    memcpy( connect_token.nonce, nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    memcpy( connect_token.private_data, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+    connect_token.num_server_addresses = num_server_addresses;
+    for ( i = 0; i < num_server_addresses; ++i )
+        connect_token.server_addresses[i] = parsed_public_server_addresses[i];
+    memcpy( connect_token.client_to_server_key, connect_token_private.client_to_server_key, NETCODE_KEY_BYTES );
+    memcpy( connect_token.server_to_client_key, connect_token_private.server_to_client_key, NETCODE_KEY_BYTES );
+    connect_token.timeout_seconds = timeout_seconds;
+
+    // write the connect token to the output buffer
+
+    netcode_write_connect_token( &connect_token, output_buffer, NETCODE_CONNECT_TOKEN_BYTES );
+
+    return NETCODE_OK;
+}
+
+static const char netcode_base64_table_encode[] = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+int netcode_base64_encode_data( NETCODE_CONST uint8_t * input, int input_size, char * output, int output_size )
+{
+    netcode_assert( input );
+    netcode_assert( input_size >= 0 );
+    netcode_assert( output );
+
+    int encoded_size = 4 * ( ( input_size + 2 ) / 3 );
+
+    if ( output_size < encoded_size + 1 )
+        return -1;
+
+    int i = 0;
+    int j = 0;
+    while ( i < input_size )
+    {
+        uint32_t octet_a = input[i++];
+        uint32_t octet_b = i < input_size ? input[i++] : 0;
+        uint32_t octet_c = i < input_size ? input[i++] : 0;
+
+        uint32_t triple = ( octet_a << 16 ) | ( octet_b << 8 ) | octet_c;
+
+        output[j++] = netcode_base64_table_encode[( triple >> 18 ) & 0x3F];
+        output[j++] = netcode_base64_table_encode[( triple >> 12 ) & 0x3F];
+        output[j++] = netcode_base64_table_encode[( triple >> 6 ) & 0x3F];
+        output[j++] = netcode_base64_table_encode[triple & 0x3F];
+    }
+
+    int padding = ( 3 - ( input_size % 3 ) ) % 3;
+    for ( i = 0; i < padding; ++i )
+    {
+        output[encoded_size - 1 - i] = '=';
+    }
+
+    output[encoded_size] = '\0';
+
+    return encoded_size;
+}
+
+static int netcode_base64_decode_char( char c )
+{
+    if ( c >= 'A' && c <= 'Z' ) return c - 'A';
+    if ( c >= 'a' && c <= 'z' ) return c - 'a' + 26;
+    if ( c >= '0' && c <= '9' ) return c - '0' + 52;
+    if ( c == '+' ) return 62;
+    if ( c == '/' ) return 63;
+    return -1;
+}
+
+int netcode_base64_decode_data( NETCODE_CONST char * input, uint8_t * output, int output_size )
+{
+    netcode_assert( input );
+    netcode_assert( output );
+    netcode_assert( output_size >= 0 );
+
+    int input_length = (int) strlen( input );
+
+    if ( input_length % 4 != 0 )
+        return -1;
+
+    if ( input_length == 0 )
+        return 0;
+
+    int padding = 0;
+    if ( input[input_length-1] == '=' ) padding++;
+    if ( input[input_length-2] == '=' ) padding++;
+
+    int decoded_size = input_length / 4 * 3 - padding;
+
+    if ( output_size < decoded_size )
+        return -1;
+
+    int i;
+    int j = 0;
+    for ( i = 0; i < input_length; i += 4 )
+    {
+        int last_group = ( i + 4 == input_length );
+
+        int a = netcode_base64_decode_char( input[i] );
+        int b = netcode_base64_decode_char( input[i+1] );
+        int c = ( last_group && padding == 2 ) ? 0 : netcode_base64_decode_char( input[i+2] );
+        int d = ( last_group && padding >= 1 ) ? 0 : netcode_base64_decode_char( input[i+3] );
+
+        if ( a < 0 || b < 0 || c < 0 || d < 0 )
+            return -1;
+
+        uint32_t triple = ( (uint32_t) a << 18 ) | ( (uint32_t) b << 12 ) | ( (uint32_t) c << 6 ) | (uint32_t) d;
+
+        output[j++] = (uint8_t) ( triple >> 16 );
+        if ( j < decoded_size ) output[j++] = (uint8_t) ( triple >> 8 );
+        if ( j < decoded_size ) output[j++] = (uint8_t) triple;
+    }
+
+    netcode_assert( j == decoded_size );
+
+    return decoded_size;
+}
+
+void netcode_write_user_data_claims( struct netcode_user_data_claims_t * claims, uint8_t * user_data )
+{
+    netcode_assert( claims );
+    netcode_assert( user_data );
+
+    uint8_t * start = user_data;
+
+    netcode_write_uint32( &user_data, NETCODE_USER_DATA_CLAIMS_VERSION );
+    netcode_write_uint64( &user_data, claims->player_id );
+    netcode_write_uint32( &user_data, claims->team );
+    netcode_write_uint32( &user_data, claims->region );
+    netcode_write_uint64( &user_data, claims->permissions );
+    netcode_write_bytes( &user_data, claims->extra_data, NETCODE_USER_DATA_CLAIMS_EXTRA_BYTES );
+
+    (void) start;
+
+    netcode_assert( user_data - start == NETCODE_USER_DATA_BYTES );
+}
+
+int netcode_read_user_data_claims( uint8_t * user_data, struct netcode_user_data_claims_t * claims )
+{
+    netcode_assert( user_data );
+    netcode_assert( claims );
+
+    uint8_t * start = user_data;
+
+    uint32_t version = netcode_read_uint32( &user_data );
+    if ( version != NETCODE_USER_DATA_CLAIMS_VERSION )
+    {
+        netcode_printf( NETCODE_LOG_LEVEL_DEBUG, "user data claims has unknown version (got %d, expected %d)\n", version, NETCODE_USER_DATA_CLAIMS_VERSION );
+        return NETCODE_ERROR;
+    }
+
+    claims->player_id = netcode_read_uint64( &user_data );
+    claims->team = netcode_read_uint32( &user_data );
+    claims->region = netcode_read_uint32( &user_data );
+    claims->permissions = netcode_read_uint64( &user_data );
+    netcode_read_bytes( &user_data, claims->extra_data, NETCODE_USER_DATA_CLAIMS_EXTRA_BYTES );
+
+    (void) start;
+
+    netcode_assert( user_data - start == NETCODE_USER_DATA_BYTES );
+
+    return NETCODE_OK;
+}
+
+// ---------------------------------------------------------------
+
+#if __APPLE__
+
+// MacOS
+
+#include <unistd.h>
+#include <mach/mach.h>
+#include <mach/mach_time.h>
+
+void netcode_sleep( double time )
+{
+    usleep( (int) ( time * 1000000 ) );
+}
+
+static uint64_t start = 0;
+static mach_timebase_info_data_t timebase_info;
+
+double netcode_time()
+{
+    if ( start == 0 )
+    {
+        mach_timebase_info( &timebase_info );
+        start = mach_absolute_time();
+        return 0.0;
+    }
+    uint64_t current = mach_absolute_time();
+    return ( (double) ( current - start ) ) * ( (double) timebase_info.numer ) / ( (double) timebase_info.denom ) / 1000000000.0;
+}
+
+#elif __linux
+
+// linux
+
+#include <unistd.h>
+
+void netcode_sleep( double time )
+{
+    usleep( (int) ( time * 1000000 ) );
+}
+
+double netcode_time()
+{
+    static double start = -1;
+    if ( start == -1 )
+    {
+        struct timespec ts;
+        clock_gettime( CLOCK_MONOTONIC_RAW, &ts );
+        start = ts.tv_sec + ( (double) ( ts.tv_nsec ) ) / 1000000000.0;
+        return 0.0;
+    }
+    struct timespec ts;
+    clock_gettime( CLOCK_MONOTONIC_RAW, &ts );
+    double current = ts.tv_sec + ( (double) ( ts.tv_nsec ) ) / 1000000000.0;
+    return current - start;
+}
+
+#elif defined( _WIN32 )
+
+// windows
+
+#define NOMINMAX
+#include <windows.h>
+
+void netcode_sleep( double time )
+{
+    int milliseconds = (int) ( time * 1000 );
+    Sleep( milliseconds );
+}
+
+static int timer_initialized = 0;
+static LARGE_INTEGER timer_frequency;
+static LARGE_INTEGER timer_start;
+
+double netcode_time()
+{
+    if ( !timer_initialized )
+    {
+        QueryPerformanceFrequency( &timer_frequency );
+        QueryPerformanceCounter( &timer_start );
+        timer_initialized = 1;
+    }
+    LARGE_INTEGER now;
+    QueryPerformanceCounter( &now );
+    return ( (double) ( now.QuadPart - timer_start.QuadPart ) ) / ( (double) ( timer_frequency.QuadPart ) );
+}
+
+#else
+
+#error unsupported platform!
+
+#endif
+
+// ---------------------------------------------------------------
+
+#if NETCODE_ENABLE_TESTS
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <memory.h>
+#include <time.h>
+
+static void check_handler( NETCODE_CONST char * condition, 
+                           NETCODE_CONST char * function,
+                           NETCODE_CONST char * file,
+                           int line )
+{
+    printf( "check failed: ( %s ), function %s, file %s, line %d\n", condition, function, file, line );
+#ifndef NDEBUG
+    #if defined( __GNUC__ )
+        __builtin_trap();
+    #elif defined( _MSC_VER )
+        __debugbreak();
+    #endif
+#endif
+    exit( 1 );
+}
+
+#define check( condition )                                                                                      \
+do                                                                                                              \
+{                                                                                                               \
+    if ( !(condition) )                                                                                         \
+    {                                                                                                           \
+        check_handler( #condition, (NETCODE_CONST char*) __FUNCTION__, (char*) __FILE__, __LINE__ );            \
+    }                                                                                                           \
+} while(0)
+
+static void test_queue()
+{
+    struct netcode_packet_queue_t queue;
+
+    netcode_packet_queue_init( &queue, NULL, NULL, NULL, NETCODE_PACKET_QUEUE_SIZE, NETCODE_PACKET_QUEUE_DROP_NEWEST );
+
+    check( queue.num_packets == 0 );
+    check( queue.start_index == 0 );
+
+    // attempting to pop a packet off an empty queue should return NULL
+
+    check( netcode_packet_queue_pop( &queue, NULL ) == NULL );
+
+    // add some packets to the queue and make sure they pop off in the correct order
+    {
+        #define NUM_PACKETS 100
+
+        void * packets[NUM_PACKETS];
+
+        int i;
+        for ( i = 0; i < NUM_PACKETS; ++i )
+        {
+            packets[i] = malloc( (i+1) * 256 );
+            check( netcode_packet_queue_push( &queue, packets[i], (uint64_t) i ) == 1 );
+        }
+
+        check( queue.num_packets == NUM_PACKETS );
+
+        for ( i = 0; i < NUM_PACKETS; ++i )
+        {
+            uint64_t sequence = 0;
+            void * packet = netcode_packet_queue_pop( &queue, &sequence );
+            check( sequence == (uint64_t) i ) ;
+            check( packet == packets[i] );
+            free( packet );
+        }
+    }
+
+    // after all entries are popped off, the queue is empty, so calls to pop should return NULL
+
+    check( queue.num_packets == 0 );
+
+    check( netcode_packet_queue_pop( &queue, NULL ) == NULL );
+
+    // test that the packet queue can be filled to max capacity
+
+    void * packets[NETCODE_PACKET_QUEUE_SIZE];
+
+    int i;
+    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
+    {
+        packets[i] = malloc( i * 256 );
+        check( netcode_packet_queue_push( &queue, packets[i], (uint64_t) i ) == 1 );
+    }
+
+    check( queue.num_packets == NETCODE_PACKET_QUEUE_SIZE );
+
+    // when the queue is full, attempting to push a packet should fail and return 0
+
+    check( netcode_packet_queue_push( &queue, malloc( 100 ), 0 ) == 0 );
+
+    // make sure all packets pop off in the correct order
+
+    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
+    {
+        uint64_t sequence = 0;
+        void * packet = netcode_packet_queue_pop( &queue, &sequence );
+        check( sequence == (uint64_t) i );
+        check( packet == packets[i] );
+        free( packet );
+    }
+
+    // add some packets again
+
+    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
+    {
+        packets[i] = malloc( i * 256 );
+        check( netcode_packet_queue_push( &queue, packets[i], (uint64_t) i ) == 1 );
+    }
+
+    // clear the queue and make sure that all packets are freed
+
+    netcode_packet_queue_clear( &queue );
+
+    check( queue.start_index == 0 );
+    check( queue.num_packets == 0 );
+    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
+        check( queue.packet_data[i] == NULL );
+}
+
+static void test_queue_overflow_policy()
+{
+    struct netcode_packet_queue_t queue;
+
+    // when a bounded queue is full, drop newest rejects the incoming packet
+
+    netcode_packet_queue_init( &queue, NULL, NULL, NULL, 4, NETCODE_PACKET_QUEUE_DROP_NEWEST );
+
+    void * packets[6];
+
+    int i;
+    for ( i = 0; i < 6; ++i )
+    {
+        packets[i] = malloc( 100 );
+        check( netcode_packet_queue_push( &queue, packets[i], (uint64_t) i ) == ( i < 4 ) );
+    }
+
+    check( queue.num_packets == 4 );
+
+    for ( i = 0; i < 4; ++i )
+    {
+        uint64_t sequence = 0;
+        void * packet = netcode_packet_queue_pop( &queue, &sequence );
+        check( sequence == (uint64_t) i );
+        check( packet == packets[i] );
+        free( packet );
+    }
+
+    check( netcode_packet_queue_pop( &queue, NULL ) == NULL );
+
+    // drop oldest accepts the incoming packet and frees the packet at the head of the queue
+
+    netcode_packet_queue_init( &queue, NULL, NULL, NULL, 4, NETCODE_PACKET_QUEUE_DROP_OLDEST );
+
+    for ( i = 0; i < 6; ++i )
+    {
+        packets[i] = malloc( 100 );
+        check( netcode_packet_queue_push( &queue, packets[i], (uint64_t) i ) == ( i < 4 ) );
+    }
+
+    check( queue.num_packets == 4 );
+
+    for ( i = 2; i < 6; ++i )
+    {
+        uint64_t sequence = 0;
+        void * packet = netcode_packet_queue_pop( &queue, &sequence );
+        check( sequence == (uint64_t) i );
+        check( packet == packets[i] );
+        free( packet );
+    }
+
+    check( netcode_packet_queue_pop( &queue, NULL ) == NULL );
+
+    // clearing a queue whose head has moved away from the first slot frees every queued packet
+
+    for ( i = 0; i < 3; ++i )
+    {
+        check( netcode_packet_queue_push( &queue, malloc( 100 ), (uint64_t) i ) == 1 );
+    }
+
+    netcode_packet_queue_clear( &queue );
+
+    check( queue.start_index == 0 );
+    check( queue.num_packets == 0 );
+    for ( i = 0; i < NETCODE_PACKET_QUEUE_SIZE; ++i )
+        check( queue.packet_data[i] == NULL );
+}
+
+static void test_endian()
+{
+    uint32_t value = 0x11223344;
+
+    char * bytes = (char*) &value;
+
+#if NETCODE_LITTLE_ENDIAN
+
+    check( bytes[0] == 0x44 );
+    check( bytes[1] == 0x33 );
+    check( bytes[2] == 0x22 );
+    check( bytes[3] == 0x11 );
+
+#else // #if NETCODE_LITTLE_ENDIAN
+
+    check( bytes[3] == 0x44 );
+    check( bytes[2] == 0x33 );
+    check( bytes[1] == 0x22 );
+    check( bytes[0] == 0x11 );
+
+#endif // #if NETCODE_LITTLE_ENDIAN
+}
+
+static void test_sequence()
+{
+    check( netcode_sequence_number_bytes_required( 0 ) == 1 );
+    check( netcode_sequence_number_bytes_required( 0x11 ) == 1 );
+    check( netcode_sequence_number_bytes_required( 0x1122 ) == 2 );
+    check( netcode_sequence_number_bytes_required( 0x112233 ) == 3 );
+    check( netcode_sequence_number_bytes_required( 0x11223344 ) == 4 );
+    check( netcode_sequence_number_bytes_required( 0x1122334455 ) == 5 );
+    check( netcode_sequence_number_bytes_required( 0x112233445566 ) == 6 );
+    check( netcode_sequence_number_bytes_required( 0x11223344556677 ) == 7 );
+    check( netcode_sequence_number_bytes_required( 0x1122334455667788 ) == 8 );
+}
+
+static void test_address()
+{
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "[", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "[]", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "[]:", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( ":", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "1", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "12", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "123", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "1234", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "1234.0.12313.0000", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "1234.0.12313.0000.0.0.0.0.0", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "1312313:123131:1312313:123131:1312313:123131:1312313:123131:1312313:123131:1312313:123131", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( ".", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "..", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "...", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( "....", &address ) == NETCODE_ERROR );
+        check( netcode_parse_address( ".....", &address ) == NETCODE_ERROR );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "107.77.207.77", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV4 );
+        check( address.port == 0 );
+        check( address.data.ipv4[0] == 107 );
+        check( address.data.ipv4[1] == 77 );
+        check( address.data.ipv4[2] == 207 );
+        check( address.data.ipv4[3] == 77 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "127.0.0.1", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV4 );
+        check( address.port == 0 );
+        check( address.data.ipv4[0] == 127 );
+        check( address.data.ipv4[1] == 0 );
+        check( address.data.ipv4[2] == 0 );
+        check( address.data.ipv4[3] == 1 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "107.77.207.77:40000", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV4 );
+        check( address.port == 40000 );
+        check( address.data.ipv4[0] == 107 );
+        check( address.data.ipv4[1] == 77 );
+        check( address.data.ipv4[2] == 207 );
+        check( address.data.ipv4[3] == 77 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "127.0.0.1:40000", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV4 );
+        check( address.port == 40000 );
+        check( address.data.ipv4[0] == 127 );
+        check( address.data.ipv4[1] == 0 );
+        check( address.data.ipv4[2] == 0 );
+        check( address.data.ipv4[3] == 1 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "fe80::202:b3ff:fe1e:8329", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV6 );
+        check( address.port == 0 );
+        check( address.data.ipv6[0] == 0xfe80 );
+        check( address.data.ipv6[1] == 0x0000 );
+        check( address.data.ipv6[2] == 0x0000 );
+        check( address.data.ipv6[3] == 0x0000 );
+        check( address.data.ipv6[4] == 0x0202 );
+        check( address.data.ipv6[5] == 0xb3ff );
+        check( address.data.ipv6[6] == 0xfe1e );
+        check( address.data.ipv6[7] == 0x8329 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "::", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV6 );
+        check( address.port == 0 );
+        check( address.data.ipv6[0] == 0x0000 );
+        check( address.data.ipv6[1] == 0x0000 );
+        check( address.data.ipv6[2] == 0x0000 );
+        check( address.data.ipv6[3] == 0x0000 );
+        check( address.data.ipv6[4] == 0x0000 );
+        check( address.data.ipv6[5] == 0x0000 );
+        check( address.data.ipv6[6] == 0x0000 );
+        check( address.data.ipv6[7] == 0x0000 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "::1", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV6 );
+        check( address.port == 0 );
+        check( address.data.ipv6[0] == 0x0000 );
+        check( address.data.ipv6[1] == 0x0000 );
+        check( address.data.ipv6[2] == 0x0000 );
+        check( address.data.ipv6[3] == 0x0000 );
+        check( address.data.ipv6[4] == 0x0000 );
+        check( address.data.ipv6[5] == 0x0000 );
+        check( address.data.ipv6[6] == 0x0000 );
+        check( address.data.ipv6[7] == 0x0001 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "[fe80::202:b3ff:fe1e:8329]:40000", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV6 );
+        check( address.port == 40000 );
+        check( address.data.ipv6[0] == 0xfe80 );
+        check( address.data.ipv6[1] == 0x0000 );
+        check( address.data.ipv6[2] == 0x0000 );
+        check( address.data.ipv6[3] == 0x0000 );
+        check( address.data.ipv6[4] == 0x0202 );
+        check( address.data.ipv6[5] == 0xb3ff );
+        check( address.data.ipv6[6] == 0xfe1e );
+        check( address.data.ipv6[7] == 0x8329 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "[::]:40000", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV6 );
+        check( address.port == 40000 );
+        check( address.data.ipv6[0] == 0x0000 );
+        check( address.data.ipv6[1] == 0x0000 );
+        check( address.data.ipv6[2] == 0x0000 );
+        check( address.data.ipv6[3] == 0x0000 );
+        check( address.data.ipv6[4] == 0x0000 );
+        check( address.data.ipv6[5] == 0x0000 );
+        check( address.data.ipv6[6] == 0x0000 );
+        check( address.data.ipv6[7] == 0x0000 );
+    }
+
+    {
+        struct netcode_address_t address;
+        check( netcode_parse_address( "[::1]:40000", &address ) == NETCODE_OK );
+        check( address.type == NETCODE_ADDRESS_IPV6 );
+        check( address.port == 40000 );
+        check( address.data.ipv6[0] == 0x0000 );
+        check( address.data.ipv6[1] == 0x0000 );
+        check( address.data.ipv6[2] == 0x0000 );
+        check( address.data.ipv6[3] == 0x0000 );
+        check( address.data.ipv6[4] == 0x0000 );
+        check( address.data.ipv6[5] == 0x0000 );
+        check( address.data.ipv6[6] == 0x0000 );
+        check( address.data.ipv6[7] == 0x0001 );
+    }
+
+    {
+        struct netcode_address_t mapped_address;
+        struct netcode_address_t ipv4_address;
+        struct netcode_address_t other_address;
+        check( netcode_parse_address( "[::ffff:10.0.0.5]:40000", &mapped_address ) == NETCODE_OK );
+        check( netcode_parse_address( "10.0.0.5:40000", &ipv4_address ) == NETCODE_OK );
+        check( mapped_address.type == NETCODE_ADDRESS_IPV6 );
+        check( netcode_address_equal( &mapped_address, &ipv4_address ) );
+        check( netcode_address_equal( &ipv4_address, &mapped_address ) );
+        check( netcode_parse_address( "10.0.0.5:40001", &other_address ) == NETCODE_OK );
+        check( !netcode_address_equal( &mapped_address, &other_address ) );
+        check( netcode_parse_address( "[::10.0.0.5]:40000", &other_address ) == NETCODE_OK );
+        check( !netcode_address_equal( &other_address, &ipv4_address ) );
+    }
+}
+
+#define TEST_PROTOCOL_ID            0x1122334455667788ULL
+#define TEST_CLIENT_ID              0x1ULL
+#define TEST_SERVER_PORT            40000
+#define TEST_CONNECT_TOKEN_EXPIRY   30
+#define TEST_TIMEOUT_SECONDS        15
+
+static void test_connect_token()
+{
+    // generate a connect token
+
+    struct netcode_address_t server_address;
+    server_address.type = NETCODE_ADDRESS_IPV4;
+    server_address.data.ipv4[0] = 127;
+    server_address.data.ipv4[1] = 0;
+    server_address.data.ipv4[2] = 0;
+    server_address.data.ipv4[3] = 1;
+    server_address.port = TEST_SERVER_PORT;
+
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+
+    struct netcode_connect_token_private_t input_token;
+
+    netcode_generate_connect_token_private( &input_token, TEST_CLIENT_ID, TEST_TIMEOUT_SECONDS, 1, &server_address, user_data );
+
+    check( input_token.client_id == TEST_CLIENT_ID );
+    check( input_token.num_server_addresses == 1 );
+    check( memcmp( input_token.user_data, user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+    check( netcode_address_equal( &input_token.server_addresses[0], &server_address ) );
+
+    // write it to a buffer
+
+    uint8_t buffer[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+
+    netcode_write_connect_token_private( &input_token, buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    // encrypt the buffer
+
+    uint8_t nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    netcode_random_bytes( nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    uint64_t expire_timestamp = time( NULL ) + 30;
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );    
+
+    check( netcode_encrypt_connect_token_private( buffer, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  NETCODE_VERSION_INFO, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  expire_timestamp, 
+                                                  nonce, 
+                                                  key ) == NETCODE_OK );
+
+    // decrypt the buffer
+
+    check( netcode_decrypt_connect_token_private( buffer, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  NETCODE_VERSION_INFO, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  expire_timestamp, 
+                                                  nonce, 
+                                                  key ) == NETCODE_OK );
+
+    // read the connect token back in
+
+    struct netcode_connect_token_private_t output_token;
+
+    check( netcode_read_connect_token_private( buffer, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &output_token ) == NETCODE_OK );
+
+    // make sure that everything matches the original connect token
+
+    check( output_token.client_id == input_token.client_id );
+    check( output_token.timeout_seconds == input_token.timeout_seconds );
+    check( output_token.num_server_addresses == input_token.num_server_addresses );
+    check( netcode_address_equal( &output_token.server_addresses[0], &input_token.server_addresses[0] ) );
+    check( memcmp( output_token.client_to_server_key, input_token.client_to_server_key, NETCODE_KEY_BYTES ) == 0 );
+    check( memcmp( output_token.server_to_client_key, input_token.server_to_client_key, NETCODE_KEY_BYTES ) == 0 );
+    check( memcmp( output_token.user_data, input_token.user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+}
+
+static void test_aead_xchacha20poly1305()
+{
+    // test vector from draft-irtf-cfrg-xchacha, section A.3.1
+
+    uint8_t key[NETCODE_KEY_BYTES];
+    uint8_t nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    uint8_t additional[12] = { 0x50, 0x51, 0x52, 0x53, 0xc0, 0xc1, 0xc2, 0xc3, 0xc4, 0xc5, 0xc6, 0xc7 };
+
+    int i;
+    for ( i = 0; i < NETCODE_KEY_BYTES; ++i )
+        key[i] = (uint8_t) ( 0x80 + i );
+    for ( i = 0; i < NETCODE_CONNECT_TOKEN_NONCE_BYTES; ++i )
+        nonce[i] = (uint8_t) ( 0x40 + i );
+
+    NETCODE_CONST char * plaintext = "Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.";
+
+    static const uint8_t expected[] = 
+    {
+        0xbd, 0x6d, 0x17, 0x9d, 0x3e, 0x83, 0xd4, 0x3b, 0x95, 0x76, 0x57, 0x94, 0x93, 0xc0, 0xe9, 0x39, 
+        0x57, 0x2a, 0x17, 0x00, 0x25, 0x2b, 0xfa, 0xcc, 0xbe, 0xd2, 0x90, 0x2c, 0x21, 0x39, 0x6c, 0xbb, 
+        0x73, 0x1c, 0x7f, 0x1b, 0x0b, 0x4a, 0xa6, 0x44, 0x0b, 0xf3, 0xa8, 0x2f, 0x4e, 0xda, 0x7e, 0x39, 
+        0xae, 0x64, 0xc6, 0x70, 0x8c, 0x54, 0xc2, 0x16, 0xcb, 0x96, 0xb7, 0x2e, 0x12, 0x13, 0xb4, 0x52, 
+        0x2f, 0x8c, 0x9b, 0xa4, 0x0d, 0xb5, 0xd9, 0x45, 0xb1, 0x1b, 0x69, 0xb9, 0x82, 0xc1, 0xbb, 0x9e, 
+        0x3f, 0x3f, 0xac, 0x2b, 0xc3, 0x69, 0x48, 0x8f, 0x76, 0xb2, 0x38, 0x35, 0x65, 0xd3, 0xff, 0xf9, 
+        0x21, 0xf9, 0x66, 0x4c, 0x97, 0x63, 0x7d, 0xa9, 0x76, 0x88, 0x12, 0xf6, 0x15, 0xc6, 0x8b, 0x13, 
+        0xb5, 0x2e, 0xc0, 0x87, 0x59, 0x24, 0xc1, 0xc7, 0x98, 0x79, 0x47, 0xde, 0xaf, 0xd8, 0x78, 0x0a, 
+        0xcf, 0x49, 
+    };
+
+    int message_length = (int) strlen( plaintext );
+
+    check( message_length + NETCODE_MAC_BYTES == (int) sizeof( expected ) );
+
+    uint8_t buffer[256];
+    memcpy( buffer, plaintext, message_length );
+
+    check( netcode_encrypt_aead_bignonce( buffer, message_length, additional, sizeof( additional ), nonce, key ) == NETCODE_OK );
+    check( memcmp( buffer, expected, sizeof( expected ) ) == 0 );
+
+    check( netcode_decrypt_aead_bignonce( buffer, sizeof( expected ), additional, sizeof( additional ), nonce, key ) == NETCODE_OK );
+    check( memcmp( buffer, plaintext, message_length ) == 0 );
+
+    // connect token private data encrypted under a random nonce round trips, and fails to decrypt with any other nonce
+
+    struct netcode_connect_token_private_t input_token;
+    memset( &input_token, 0, sizeof( input_token ) );
+    input_token.client_id = 1;
+    input_token.timeout_seconds = 15;
+    input_token.num_server_addresses = 1;
+    check( netcode_parse_address( "127.0.0.1:40000", &input_token.server_addresses[0] ) );
+    netcode_generate_key( input_token.client_to_server_key );
+    netcode_generate_key( input_token.server_to_client_key );
+    netcode_random_bytes( input_token.user_data, NETCODE_USER_DATA_BYTES );
+
+    uint8_t token_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( token_key );
+
+    uint8_t token_nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    netcode_random_bytes( token_nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+
+    uint8_t token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    netcode_write_connect_token_private( &input_token, token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    uint8_t encrypted_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+
+    check( netcode_encrypt_connect_token_private( token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, 1000, token_nonce, token_key ) == NETCODE_OK );
+
+    memcpy( encrypted_token_data, token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    check( netcode_decrypt_connect_token_private( token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, 1000, token_nonce, token_key ) == NETCODE_OK );
+
+    struct netcode_connect_token_private_t output_token;
+    check( netcode_read_connect_token_private( token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &output_token ) == NETCODE_OK );
+    check( output_token.client_id == input_token.client_id );
+    check( memcmp( output_token.client_to_server_key, input_token.client_to_server_key, NETCODE_KEY_BYTES ) == 0 );
+    check( memcmp( output_token.user_data, input_token.user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+
+    token_nonce[0] ^= 1;
+
+    check( netcode_decrypt_connect_token_private( encrypted_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, 1000, token_nonce, token_key ) == NETCODE_ERROR );
+}
+
+static void test_connect_token_known_answer()
+{
+    // a 1.02 connect token built from fixed inputs. the expected ciphertext and mac came from encrypting the same 
+    // private data layout directly with libsodium's crypto_aead_xchacha20poly1305_ietf_encrypt, as STANDARD.md specifies
+
+    uint8_t key[NETCODE_KEY_BYTES];
+    uint8_t nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+
+    int i;
+    for ( i = 0; i < NETCODE_KEY_BYTES; ++i )
+        key[i] = (uint8_t) i;
+    for ( i = 0; i < NETCODE_CONNECT_TOKEN_NONCE_BYTES; ++i )
+        nonce[i] = (uint8_t) ( 0xA0 + i );
+
+    const uint64_t protocol_id = 0x1122334455667788ULL;
+    const uint64_t create_timestamp = 1699999000ULL;
+    const uint64_t expire_timestamp = 1700000000ULL;
+
+    struct netcode_connect_token_private_t private_token;
+    memset( &private_token, 0, sizeof( private_token ) );
+    private_token.client_id = 0x0123456789ABCDEFULL;
+    private_token.timeout_seconds = 15;
+    private_token.num_server_addresses = 1;
+    check( netcode_parse_address( "127.0.0.1:40000", &private_token.server_addresses[0] ) == NETCODE_OK );
+    for ( i = 0; i < NETCODE_KEY_BYTES; ++i )
+    {
+        private_token.client_to_server_key[i] = (uint8_t) ( 0x10 + i );
+        private_token.server_to_client_key[i] = (uint8_t) ( 0x30 + i );
+    }
+    for ( i = 0; i < NETCODE_USER_DATA_BYTES; ++i )
+        private_token.user_data[i] = (uint8_t) i;
+
+    static const uint8_t expected_ciphertext[] = 
+    {
+        0xaa, 0x21, 0xa1, 0x94, 0xd0, 0x18, 0x87, 0xad, 0x6e, 0x6f, 0x2d, 0x89, 0x70, 0x30, 0xa3, 0xc0, 
+    };
+
+    static const uint8_t expected_mac[] = 
+    {
+        0xe8, 0xa4, 0xe2, 0xc2, 0xac, 0x2f, 0xfa, 0xd2, 0x66, 0xde, 0x90, 0x56, 0xbc, 0x5a, 0x62, 0xa9, 
+    };
+
+    struct netcode_connect_token_t connect_token;
+    memset( &connect_token, 0, sizeof( connect_token ) );
+    memcpy( connect_token.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+    connect_token.protocol_id = protocol_id;
+    connect_token.create_timestamp = create_timestamp;
+    connect_token.expire_timestamp = expire_timestamp;
+    memcpy( connect_token.nonce, nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    connect_token.timeout_seconds = private_token.timeout_seconds;
+    connect_token.num_server_addresses = 1;
+    connect_token.server_addresses[0] = private_token.server_addresses[0];
+    memcpy( connect_token.client_to_server_key, private_token.client_to_server_key, NETCODE_KEY_BYTES );
+    memcpy( connect_token.server_to_client_key, private_token.server_to_client_key, NETCODE_KEY_BYTES );
+
+    netcode_write_connect_token_private( &private_token, connect_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    check( netcode_encrypt_connect_token_private( connect_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, NETCODE_VERSION_INFO, protocol_id, expire_timestamp, nonce, key ) == NETCODE_OK );
+
+    check( memcmp( connect_token.private_data, expected_ciphertext, sizeof( expected_ciphertext ) ) == 0 );
+    check( memcmp( connect_token.private_data + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES - NETCODE_MAC_BYTES, expected_mac, NETCODE_MAC_BYTES ) == 0 );
+
+    // the public portion lands at the offsets given in STANDARD.md
+
+    uint8_t buffer[NETCODE_CONNECT_TOKEN_BYTES];
+    netcode_write_connect_token( &connect_token, buffer, NETCODE_CONNECT_TOKEN_BYTES );
+
+    uint8_t * p = buffer;
+    check( memcmp( p, "NETCODE 1.02", NETCODE_VERSION_INFO_BYTES ) == 0 );
+    p += NETCODE_VERSION_INFO_BYTES;
+    check( netcode_read_uint64( &p ) == protocol_id );
+    check( netcode_read_uint64( &p ) == create_timestamp );
+    check( netcode_read_uint64( &p ) == expire_timestamp );
+    check( memcmp( p, nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES ) == 0 );
+    p += NETCODE_CONNECT_TOKEN_NONCE_BYTES;
+    check( p - buffer == 61 );
+    check( memcmp( p, expected_ciphertext, sizeof( expected_ciphertext ) ) == 0 );
+    p += NETCODE_CONNECT_TOKEN_PRIVATE_BYTES;
+    check( netcode_read_uint32( &p ) == 15 );
+    check( netcode_read_uint32( &p ) == 1 );
+    check( netcode_read_uint8( &p ) == NETCODE_ADDRESS_IPV4 );
+
+    // and reads back to the private data it was built from
+
+    struct netcode_connect_token_t read_token;
+    check( netcode_read_connect_token( buffer, NETCODE_CONNECT_TOKEN_BYTES, &read_token ) );
+
+    check( netcode_decrypt_connect_token_private( read_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, read_token.version_info, read_token.protocol_id, read_token.expire_timestamp, read_token.nonce, key ) == NETCODE_OK );
+
+    struct netcode_connect_token_private_t read_private_token;
+    check( netcode_read_connect_token_private( read_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &read_private_token ) == NETCODE_OK );
+    check( read_private_token.client_id == private_token.client_id );
+    check( memcmp( read_private_token.user_data, private_token.user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+}
+static void test_aead_aes256gcm()
+{
+    if ( !netcode_aes256gcm_available() )
+    {
+        printf( "    (aes256gcm not available on this cpu)\n" );
+        return;
+    }
+
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );
+
+    uint8_t nonce[12];
+    netcode_random_bytes( nonce, sizeof( nonce ) );
+
+    uint8_t additional[21];
+    netcode_random_bytes( additional, sizeof( additional ) );
+
+    uint8_t message[NETCODE_MAX_PAYLOAD_BYTES];
+    netcode_random_bytes( message, NETCODE_MAX_PAYLOAD_BYTES );
+
+    uint8_t buffer[NETCODE_MAX_PAYLOAD_BYTES + NETCODE_MAC_BYTES];
+    memcpy( buffer, message, NETCODE_MAX_PAYLOAD_BYTES );
+
+    check( netcode_encrypt_aead_aes256gcm( buffer, NETCODE_MAX_PAYLOAD_BYTES, additional, sizeof( additional ), nonce, key ) == NETCODE_OK );
+    check( memcmp( buffer, message, NETCODE_MAX_PAYLOAD_BYTES ) != 0 );
+    check( netcode_decrypt_aead_aes256gcm( buffer, sizeof( buffer ), additional, sizeof( additional ), nonce, key ) == NETCODE_OK );
+    check( memcmp( buffer, message, NETCODE_MAX_PAYLOAD_BYTES ) == 0 );
+
+    // tampered data and mismatched additional data must fail to decrypt
+
+    check( netcode_encrypt_aead_aes256gcm( buffer, NETCODE_MAX_PAYLOAD_BYTES, additional, sizeof( additional ), nonce, key ) == NETCODE_OK );
+    buffer[10] ^= 1;
+    check( netcode_decrypt_aead_aes256gcm( buffer, sizeof( buffer ), additional, sizeof( additional ), nonce, key ) == NETCODE_ERROR );
+    buffer[10] ^= 1;
+    additional[0] ^= 1;
+    check( netcode_decrypt_aead_aes256gcm( buffer, sizeof( buffer ), additional, sizeof( additional ), nonce, key ) == NETCODE_ERROR );
+    additional[0] ^= 1;
+    check( netcode_decrypt_aead_aes256gcm( buffer, sizeof( buffer ), additional, sizeof( additional ), nonce, key ) == NETCODE_OK );
+
+    // plugged in as the backend, packets round trip through aes256gcm
+
+    netcode_set_aead_functions( netcode_encrypt_aead_aes256gcm, netcode_decrypt_aead_aes256gcm );
+
+    struct netcode_connection_payload_packet_t * input_packet = netcode_create_payload_packet( NETCODE_MAX_PAYLOAD_BYTES, NULL, NULL );
+    memcpy( input_packet->payload_data, message, NETCODE_MAX_PAYLOAD_BYTES );
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( packet_key );
+
+    uint8_t packet_buffer[NETCODE_MAX_PACKET_BYTES];
+    int bytes_written = netcode_write_packet( input_packet, packet_buffer, NETCODE_MAX_PACKET_BYTES, 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+    check( bytes_written > 0 );
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+
+    uint64_t sequence;
+    struct netcode_connection_payload_packet_t * output_packet = (struct netcode_connection_payload_packet_t*) 
+        netcode_read_packet( packet_buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, netcode_timestamp(), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    netcode_set_aead_functions( NULL, NULL );
+
+    check( output_packet );
+    check( sequence == 1000 );
+    check( output_packet->payload_bytes == NETCODE_MAX_PAYLOAD_BYTES );
+    check( memcmp( output_packet->payload_data, message, NETCODE_MAX_PAYLOAD_BYTES ) == 0 );
+
+    free( input_packet );
+    free( output_packet );
+}
+
+static void test_challenge_token()
+{
+    // generate a challenge token
+
+    struct netcode_challenge_token_t input_token;
+
+    input_token.client_id = TEST_CLIENT_ID;
+    netcode_random_bytes( input_token.user_data, NETCODE_USER_DATA_BYTES );
+
+    // write it to a buffer
+
+    uint8_t buffer[NETCODE_CHALLENGE_TOKEN_BYTES];
+
+    netcode_write_challenge_token( &input_token, buffer, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+    // encrypt the buffer
+
+    uint64_t sequence = 1000;
+    uint8_t key[NETCODE_KEY_BYTES]; 
+    netcode_generate_key( key );    
+
+    struct netcode_address_t client_address;
+    check( netcode_parse_address( "[::1]:50000", &client_address ) == NETCODE_OK );
+
+    check( netcode_encrypt_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, sequence, &client_address, key ) == NETCODE_OK );
+
+    // a response from any other address can't decrypt it
+
+    struct netcode_address_t other_address;
+    check( netcode_parse_address( "[::1]:50001", &other_address ) == NETCODE_OK );
+
+    uint8_t copy[NETCODE_CHALLENGE_TOKEN_BYTES];
+    memcpy( copy, buffer, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+    check( netcode_decrypt_challenge_token( copy, NETCODE_CHALLENGE_TOKEN_BYTES, sequence, &other_address, key ) == NETCODE_ERROR );
+
+    // decrypt the buffer
+
+    check( netcode_decrypt_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, sequence, &client_address, key ) == NETCODE_OK );
+
+    // read the challenge token back in
+
+    struct netcode_challenge_token_t output_token;
+
+    check( netcode_read_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, &output_token ) == NETCODE_OK );
+
+    // make sure that everything matches the original challenge token
+
+    check( output_token.client_id == input_token.client_id );
+    check( memcmp( output_token.user_data, input_token.user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+}
+
+static int test_aead_encrypt_calls = 0;
+static int test_aead_decrypt_calls = 0;
+
+static int test_encrypt_aead( uint8_t * message, uint64_t message_length, uint8_t * additional, uint64_t additional_length, uint8_t * nonce, NETCODE_CONST uint8_t * key )
+{
+    // stand-in for an alternative backend: the default cipher with a different key
+
+    uint8_t other_key[NETCODE_KEY_BYTES];
+    int i;
+    for ( i = 0; i < NETCODE_KEY_BYTES; ++i )
+        other_key[i] = key[i] ^ 0xFF;
+    test_aead_encrypt_calls++;
+    return netcode_encrypt_aead_chacha20poly1305( message, message_length, additional, additional_length, nonce, other_key );
+}
+
+static int test_decrypt_aead( uint8_t * message, uint64_t message_length, uint8_t * additional, uint64_t additional_length, uint8_t * nonce, NETCODE_CONST uint8_t * key )
+{
+    uint8_t other_key[NETCODE_KEY_BYTES];
+    int i;
+    for ( i = 0; i < NETCODE_KEY_BYTES; ++i )
+        other_key[i] = key[i] ^ 0xFF;
+    test_aead_decrypt_calls++;
+    return netcode_decrypt_aead_chacha20poly1305( message, message_length, additional, additional_length, nonce, other_key );
+}
+
+void test_aead_functions()
+{
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );
+
+    struct netcode_challenge_token_t challenge_token;
+    memset( &challenge_token, 0, sizeof( challenge_token ) );
+    challenge_token.client_id = 1;
+    netcode_random_bytes( challenge_token.user_data, NETCODE_USER_DATA_BYTES );
+
+    struct netcode_address_t client_address;
+    check( netcode_parse_address( "127.0.0.1:50000", &client_address ) == NETCODE_OK );
+
+    uint8_t buffer[NETCODE_CHALLENGE_TOKEN_BYTES];
+    uint8_t original[NETCODE_CHALLENGE_TOKEN_BYTES];
+    netcode_write_challenge_token( &challenge_token, buffer, NETCODE_CHALLENGE_TOKEN_BYTES );
+    memcpy( original, buffer, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+    // tokens encrypted with a plugged in backend round trip through the same backend
+
+    netcode_set_aead_functions( test_encrypt_aead, test_decrypt_aead );
+
+    check( netcode_encrypt_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, 0, &client_address, key ) == NETCODE_OK );
+    check( netcode_decrypt_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, 0, &client_address, key ) == NETCODE_OK );
+    check( memcmp( buffer, original, NETCODE_CHALLENGE_TOKEN_BYTES - NETCODE_MAC_BYTES ) == 0 );
+    check( test_aead_encrypt_calls == 1 );
+    check( test_aead_decrypt_calls == 1 );
+
+    // but not through the default backend
+
+    check( netcode_encrypt_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, 0, &client_address, key ) == NETCODE_OK );
+
+    netcode_set_aead_functions( NULL, NULL );
+
+    check( netcode_decrypt_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, 0, &client_address, key ) == NETCODE_ERROR );
+    check( test_aead_decrypt_calls == 1 );
+}
+
+static void test_connection_request_packet()
+{
+    // generate a connect token
+
+    struct netcode_address_t server_address;
+    server_address.type = NETCODE_ADDRESS_IPV4;
+    server_address.data.ipv4[0] = 127;
+    server_address.data.ipv4[1] = 0;
+    server_address.data.ipv4[2] = 0;
+    server_address.data.ipv4[3] = 1;
+    server_address.port = TEST_SERVER_PORT;
+
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+
+    struct netcode_connect_token_private_t input_token;
+
+    netcode_generate_connect_token_private( &input_token, TEST_CLIENT_ID, TEST_TIMEOUT_SECONDS, 1, &server_address, user_data );
+
+    check( input_token.client_id == TEST_CLIENT_ID );
+    check( input_token.num_server_addresses == 1 );
+    check( memcmp( input_token.user_data, user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+    check( netcode_address_equal( &input_token.server_addresses[0], &server_address ) );
+
+    // write the conect token to a buffer (non-encrypted)
+
+    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+
+    netcode_write_connect_token_private( &input_token, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    // copy to a second buffer then encrypt it in place (we need the unencrypted token for verification later on)
+
+    uint8_t encrypted_connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+
+    memcpy( encrypted_connect_token_data, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    uint8_t connect_token_nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    netcode_random_bytes( connect_token_nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    uint64_t connect_token_expire_timestamp = time( NULL ) + 30;
+    uint8_t connect_token_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( connect_token_key );
+
+    check( netcode_encrypt_connect_token_private( encrypted_connect_token_data, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  NETCODE_VERSION_INFO, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  connect_token_expire_timestamp, 
+                                                  connect_token_nonce, 
+                                                  connect_token_key ) == NETCODE_OK );
+
+    // setup a connection request packet wrapping the encrypted connect token
+
+    struct netcode_connection_request_packet_t input_packet;
+
+    input_packet.packet_type = NETCODE_CONNECTION_REQUEST_PACKET;
+    memcpy( input_packet.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+    input_packet.protocol_id = TEST_PROTOCOL_ID;
+    input_packet.connect_token_expire_timestamp = connect_token_expire_timestamp;
+    memcpy( input_packet.connect_token_nonce, connect_token_nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    memcpy( input_packet.connect_token_data, encrypted_connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    // write the connection request packet to a buffer
+
+    uint8_t buffer[2048];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written > 0 );
+
+    // read the connection request packet back in from the buffer (the connect token data is decrypted as part of the read packet validation)
+
+    uint64_t sequence = 1000;
+
+    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packets, 1, sizeof( allowed_packets ) );
+
+    struct netcode_connection_request_packet_t * output_packet = (struct netcode_connection_request_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), connect_token_key, allowed_packets, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    // make sure the read packet matches what was written
+    
+    check( output_packet->packet_type == NETCODE_CONNECTION_REQUEST_PACKET );
+    check( memcmp( output_packet->version_info, input_packet.version_info, NETCODE_VERSION_INFO_BYTES ) == 0 );
+    check( output_packet->protocol_id == input_packet.protocol_id );
+    check( output_packet->connect_token_expire_timestamp == input_packet.connect_token_expire_timestamp );
+    check( memcmp( output_packet->connect_token_nonce, input_packet.connect_token_nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES ) == 0 );
+    check( memcmp( output_packet->connect_token_data, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES - NETCODE_MAC_BYTES ) == 0 );
+
+    free( output_packet );
+}
+
+static void test_connection_request_packet_1_01()
+{
+    // a 1.01 connection request carries a 64 bit connect token sequence and is encrypted with a 96 bit nonce
+
+    struct netcode_address_t server_address;
+    check( netcode_parse_address( "127.0.0.1:40000", &server_address ) == NETCODE_OK );
+
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+
+    struct netcode_connect_token_private_t input_token;
+
+    netcode_generate_connect_token_private( &input_token, TEST_CLIENT_ID, TEST_TIMEOUT_SECONDS, 1, &server_address, user_data );
+
+    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+
+    netcode_write_connect_token_private( &input_token, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    uint8_t encrypted_connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+
+    memcpy( encrypted_connect_token_data, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    uint64_t connect_token_sequence = 1000;
+    uint64_t connect_token_expire_timestamp = time( NULL ) + 30;
+    uint8_t connect_token_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( connect_token_key );
+
+    check( netcode_encrypt_connect_token_private_1_01( encrypted_connect_token_data, 
+                                                       NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                       NETCODE_VERSION_INFO_1_01, 
+                                                       TEST_PROTOCOL_ID, 
+                                                       connect_token_expire_timestamp, 
+                                                       connect_token_sequence, 
+                                                       connect_token_key ) == NETCODE_OK );
+
+    struct netcode_connection_request_packet_t input_packet;
+    memset( &input_packet, 0, sizeof( input_packet ) );
+
+    input_packet.packet_type = NETCODE_CONNECTION_REQUEST_PACKET;
+    memcpy( input_packet.version_info, NETCODE_VERSION_INFO_1_01, NETCODE_VERSION_INFO_BYTES );
+    input_packet.protocol_id = TEST_PROTOCOL_ID;
+    input_packet.connect_token_expire_timestamp = connect_token_expire_timestamp;
+    input_packet.connect_token_sequence = connect_token_sequence;
+    memcpy( input_packet.connect_token_data, encrypted_connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    uint8_t buffer[2048];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO_1_01, TEST_PROTOCOL_ID );
+
+    check( bytes_written == 1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + 8 + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    uint64_t sequence = 1000;
+
+    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packets, 1, sizeof( allowed_packets ) );
+
+    // a reader expecting 1.02 rejects it
+
+    check( netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), connect_token_key, allowed_packets, NULL, NULL, NULL ) == NULL );
+
+    // a reader expecting 1.01 decrypts it
+
+    struct netcode_connection_request_packet_t * output_packet = (struct netcode_connection_request_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO_1_01, TEST_PROTOCOL_ID, time( NULL ), connect_token_key, allowed_packets, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    check( output_packet->packet_type == NETCODE_CONNECTION_REQUEST_PACKET );
+    check( memcmp( output_packet->version_info, NETCODE_VERSION_INFO_1_01, NETCODE_VERSION_INFO_BYTES ) == 0 );
+    check( output_packet->protocol_id == input_packet.protocol_id );
+    check( output_packet->connect_token_expire_timestamp == input_packet.connect_token_expire_timestamp );
+    check( output_packet->connect_token_sequence == input_packet.connect_token_sequence );
+    check( memcmp( output_packet->connect_token_data, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES - NETCODE_MAC_BYTES ) == 0 );
+
+    free( output_packet );
+}
+
+void test_connection_denied_packet()
+{
+    // setup a connection denied packet
+
+    struct netcode_connection_denied_packet_t input_packet;
+
+    input_packet.packet_type = NETCODE_CONNECTION_DENIED_PACKET;
+
+    // write the packet to a buffer
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written > 0 );
+
+    // read the packet back in from the buffer
+
+    uint64_t sequence;
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+
+    struct netcode_connection_denied_packet_t * output_packet = (struct netcode_connection_denied_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    // make sure the read packet matches what was written
+    
+    check( output_packet->packet_type == NETCODE_CONNECTION_DENIED_PACKET );
+
+    free( output_packet );
+}
+
+void test_connection_challenge_packet()
+{
+    // setup a connection challenge packet
+
+    struct netcode_connection_challenge_packet_t input_packet;
+
+    input_packet.packet_type = NETCODE_CONNECTION_CHALLENGE_PACKET;
+    input_packet.challenge_token_sequence = 0;
+    netcode_random_bytes( input_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+    // write the packet to a buffer
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written > 0 );
+
+    // read the packet back in from the buffer
+
+    uint64_t sequence;
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+
+    struct netcode_connection_challenge_packet_t * output_packet = (struct netcode_connection_challenge_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    // make sure the read packet packet matches what was written
+    
+    check( output_packet->packet_type == NETCODE_CONNECTION_CHALLENGE_PACKET );
+    check( output_packet->challenge_token_sequence == input_packet.challenge_token_sequence );
+    check( memcmp( output_packet->challenge_token_data, input_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES ) == 0 );
+
+    free( output_packet );
+}
+
+void test_connection_response_packet()
+{
+    // setup a connection response packet
+
+    struct netcode_connection_response_packet_t input_packet;
+
+    input_packet.packet_type = NETCODE_CONNECTION_RESPONSE_PACKET;
+    input_packet.challenge_token_sequence = 0;
+    netcode_random_bytes( input_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+    // write the packet to a buffer
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+    
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written > 0 );
+
+    // read the packet back in from the buffer
+
+    uint64_t sequence;
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+
+    struct netcode_connection_response_packet_t * output_packet = (struct netcode_connection_response_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    // make sure the read packet matches what was written
+    
+    check( output_packet->packet_type == NETCODE_CONNECTION_RESPONSE_PACKET );
+    check( output_packet->challenge_token_sequence == input_packet.challenge_token_sequence );
+    check( memcmp( output_packet->challenge_token_data, input_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES ) == 0 );
+
+    free( output_packet );
+}
+
+void test_connection_keep_alive_packet()
+{
+    // setup a connection keep alive packet
+
+    struct netcode_connection_keep_alive_packet_t input_packet;
+
+    input_packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+    input_packet.client_index = 10;
+    input_packet.max_clients = 16;
+
+    // write the packet to a buffer
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written > 0 );
+
+    // read the packet back in from the buffer
+
+    uint64_t sequence;
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+    
+    struct netcode_connection_keep_alive_packet_t * output_packet = (struct netcode_connection_keep_alive_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    // make sure the read packet matches what was written
+    
+    check( output_packet->packet_type == NETCODE_CONNECTION_KEEP_ALIVE_PACKET );
+    check( output_packet->client_index == input_packet.client_index );
+    check( output_packet->max_clients == input_packet.max_clients );
+
+    free( output_packet );
+}
+
+void test_connection_time_sync_packet()
+{
+    // setup a connection time sync packet
+
+    struct netcode_connection_time_sync_packet_t input_packet;
+
+    input_packet.packet_type = NETCODE_CONNECTION_TIME_SYNC_PACKET;
+    input_packet.client_time = 12.25;
+    input_packet.server_time = 1000.5;
+
+    // write the packet to a buffer
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written > 0 );
+
+    // time sync packets are dropped unless they are allowed
+
+    uint64_t sequence;
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+    allowed_packet_types[NETCODE_CONNECTION_TIME_SYNC_PACKET] = 0;
+
+    uint8_t buffer_copy[NETCODE_MAX_PACKET_BYTES];
+    memcpy( buffer_copy, buffer, bytes_written );
+
+    check( netcode_read_packet( buffer_copy, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL ) == NULL );
+
+    // read the packet back in from the buffer
+
+    allowed_packet_types[NETCODE_CONNECTION_TIME_SYNC_PACKET] = 1;
+
+    struct netcode_connection_time_sync_packet_t * output_packet = (struct netcode_connection_time_sync_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    // make sure the read packet matches what was written
+    
+    check( output_packet->packet_type == NETCODE_CONNECTION_TIME_SYNC_PACKET );
+    check( output_packet->client_time == input_packet.client_time );
+    check( output_packet->server_time == input_packet.server_time );
+
+    free( output_packet );
+}
+
+void test_connection_packet_sequence_encoding()
+{
+    // sequence numbers are written in the fewest bytes [1,8] that hold them, with the byte count in the high nibble of the prefix byte
+
+    static const uint64_t sequences[] = { 0, 0x11, 0x1122, 0x112233, 0x11223344, 0x1122334455, 0x112233445566, 0x11223344556677, 0x1122334455667788 };
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+
+    int i;
+    for ( i = 0; i < (int) ( sizeof( sequences ) / sizeof( sequences[0] ) ); ++i )
+    {
+        struct netcode_connection_keep_alive_packet_t input_packet;
+        input_packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+        input_packet.client_index = 1;
+        input_packet.max_clients = 2;
+
+        uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+        int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), sequences[i], packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+        int sequence_bytes = netcode_sequence_number_bytes_required( sequences[i] );
+
+        check( sequence_bytes == ( i == 0 ? 1 : i ) );
+        check( bytes_written == 1 + sequence_bytes + 8 + NETCODE_MAC_BYTES );
+        check( ( buffer[0] & 0xF ) == NETCODE_CONNECTION_KEEP_ALIVE_PACKET );
+        check( ( buffer[0] >> 4 ) == sequence_bytes );
+
+        uint64_t sequence = 0;
+        struct netcode_connection_keep_alive_packet_t * output_packet = (struct netcode_connection_keep_alive_packet_t*) 
+            netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, netcode_timestamp(), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+        check( output_packet );
+        check( sequence == sequences[i] );
+
+        free( output_packet );
+    }
+
+    // a prefix byte with a sequence byte count outside [1,8] is rejected
+
+    struct netcode_connection_keep_alive_packet_t input_packet;
+    input_packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+    input_packet.client_index = 1;
+    input_packet.max_clients = 2;
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    uint64_t sequence = 0;
+
+    buffer[0] = (uint8_t) ( NETCODE_CONNECTION_KEEP_ALIVE_PACKET | ( 0 << 4 ) );
+    check( netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, netcode_timestamp(), NULL, allowed_packet_types, NULL, NULL, NULL ) == NULL );
+
+    buffer[0] = (uint8_t) ( NETCODE_CONNECTION_KEEP_ALIVE_PACKET | ( 9 << 4 ) );
+    check( netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, netcode_timestamp(), NULL, allowed_packet_types, NULL, NULL, NULL ) == NULL );
+}
+
+void test_connection_payload_packet()
+{
+    // setup a connection payload packet
+
+    struct netcode_connection_payload_packet_t * input_packet = netcode_create_payload_packet( NETCODE_MAX_PAYLOAD_BYTES, NULL, NULL );
+
+    check( input_packet->packet_type == NETCODE_CONNECTION_PAYLOAD_PACKET );
+    check( input_packet->payload_bytes == NETCODE_MAX_PAYLOAD_BYTES );
+
+    netcode_random_bytes( input_packet->payload_data, NETCODE_MAX_PAYLOAD_BYTES );
+    
+    // write the packet to a buffer
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    int bytes_written = netcode_write_packet( input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written > 0 );
+
+    // read the packet back in from the buffer
+
+    uint64_t sequence;
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+
+    struct netcode_connection_payload_packet_t * output_packet = (struct netcode_connection_payload_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    // make sure the read packet matches what was written
+    
+    check( output_packet->packet_type == NETCODE_CONNECTION_PAYLOAD_PACKET );
+    check( output_packet->payload_bytes == input_packet->payload_bytes );
+    check( memcmp( output_packet->payload_data, input_packet->payload_data, NETCODE_MAX_PAYLOAD_BYTES ) == 0 );
+
+    free( input_packet );
+    free( output_packet );
+}
+
+void test_connection_disconnect_packet()
+{
+    // setup a connection disconnect packet
+
+    struct netcode_connection_disconnect_packet_t input_packet;
+
+    input_packet.packet_type = NETCODE_CONNECTION_DISCONNECT_PACKET;
+    input_packet.reason = NETCODE_DISCONNECT_REASON_NONE;
+
+    // write the packet to a buffer
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+
+    uint8_t packet_key[NETCODE_KEY_BYTES];
+
+    netcode_generate_key( packet_key );
+
+    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written > 0 );
+
+    // read the packet back in from the buffer
+
+    uint64_t sequence;
+
+    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+
+    struct netcode_connection_disconnect_packet_t * output_packet = (struct netcode_connection_disconnect_packet_t*) 
+        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    check( output_packet );
+
+    // make sure the read packet matches what was written
+    
+    check( output_packet->packet_type == NETCODE_CONNECTION_DISCONNECT_PACKET );
+    check( output_packet->reason == NETCODE_DISCONNECT_REASON_NONE );
+
+    free( output_packet );
+
+    // the optional reason extension carries the reason in one extra byte
+
+    input_packet.reason = NETCODE_DISCONNECT_REASON_KICKED;
+
+    int bytes_written_with_reason = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1001, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+
+    check( bytes_written_with_reason == bytes_written + 1 );
+
+    output_packet = (struct netcode_connection_disconnect_packet_t*) 
+        netcode_read_packet( buffer, bytes_written_with_reason, &sequence, packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+
+    check( output_packet );
+    check( output_packet->packet_type == NETCODE_CONNECTION_DISCONNECT_PACKET );
+    check( output_packet->reason == NETCODE_DISCONNECT_REASON_KICKED );
+
+    free( output_packet );
+}
+
+void test_connect_token_public()
+{
+    // generate a private connect token
+
+    struct netcode_address_t server_address;
+    server_address.type = NETCODE_ADDRESS_IPV4;
+    server_address.data.ipv4[0] = 127;
+    server_address.data.ipv4[1] = 0;
+    server_address.data.ipv4[2] = 0;
+    server_address.data.ipv4[3] = 1;
+    server_address.port = TEST_SERVER_PORT;
+
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+
+    struct netcode_connect_token_private_t connect_token_private;
+
+    netcode_generate_connect_token_private( &connect_token_private, TEST_CLIENT_ID, TEST_TIMEOUT_SECONDS, 1, &server_address, user_data );
+
+    check( connect_token_private.client_id == TEST_CLIENT_ID );
+    check( connect_token_private.num_server_addresses == 1 );
+    check( memcmp( connect_token_private.user_data, user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+    check( netcode_address_equal( &connect_token_private.server_addresses[0], &server_address ) );
+
+    // write it to a buffer
+
+    uint8_t connect_token_private_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    netcode_write_connect_token_private( &connect_token_private, connect_token_private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    // encrypt the buffer
+
+    uint8_t nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    netcode_random_bytes( nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    uint64_t create_timestamp = time( NULL );
+    uint64_t expire_timestamp = create_timestamp + 30;
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );    
+    check( netcode_encrypt_connect_token_private( connect_token_private_data, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  NETCODE_VERSION_INFO, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  expire_timestamp, 
+                                                  nonce, 
+                                                  key ) == 1 );
+
+    // wrap a public connect token around the private connect token data
+
+    struct netcode_connect_token_t input_connect_token;
+    memset( &input_connect_token, 0, sizeof( struct netcode_connect_token_t ) );
+    memcpy( input_connect_token.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+    input_connect_token.protocol_id = TEST_PROTOCOL_ID;
+    input_connect_token.create_timestamp = create_timestamp;
+    input_connect_token.expire_timestamp = expire_timestamp;
+    memcpy( input_connect_token.nonce, nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    memcpy( input_connect_token.private_data, connect_token_private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+    input_connect_token.num_server_addresses = 1;
+    input_connect_token.server_addresses[0] = server_address;
+    memcpy( input_connect_token.client_to_server_key, connect_token_private.client_to_server_key, NETCODE_KEY_BYTES );
+    memcpy( input_connect_token.server_to_client_key, connect_token_private.server_to_client_key, NETCODE_KEY_BYTES );
+    input_connect_token.timeout_seconds = (int) TEST_TIMEOUT_SECONDS;
+
+    // write the connect token to a buffer
+
+    uint8_t buffer[NETCODE_CONNECT_TOKEN_BYTES];
+    netcode_write_connect_token( &input_connect_token, buffer, NETCODE_CONNECT_TOKEN_BYTES );
+
+    // read the buffer back in
+
+    struct netcode_connect_token_t output_connect_token;
+    memset( &output_connect_token, 0, sizeof( struct netcode_connect_token_t ) );
+    check( netcode_read_connect_token( buffer, NETCODE_CONNECT_TOKEN_BYTES, &output_connect_token ) == 1 );
+
+    // make sure the public connect token matches what was written
+
+    check( memcmp( output_connect_token.version_info, input_connect_token.version_info, NETCODE_VERSION_INFO_BYTES ) == 0 );
+    check( output_connect_token.protocol_id == input_connect_token.protocol_id );
+    check( output_connect_token.create_timestamp == input_connect_token.create_timestamp );
+    check( output_connect_token.expire_timestamp == input_connect_token.expire_timestamp );
+    check( memcmp( output_connect_token.nonce, input_connect_token.nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES ) == 0 );
+    check( memcmp( output_connect_token.private_data, input_connect_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES ) == 0 );
+    check( output_connect_token.num_server_addresses == input_connect_token.num_server_addresses );
+    check( netcode_address_equal( &output_connect_token.server_addresses[0], &input_connect_token.server_addresses[0] ) );
+    check( memcmp( output_connect_token.client_to_server_key, input_connect_token.client_to_server_key, NETCODE_KEY_BYTES ) == 0 );
+    check( memcmp( output_connect_token.server_to_client_key, input_connect_token.server_to_client_key, NETCODE_KEY_BYTES ) == 0 );
+    check( output_connect_token.timeout_seconds == input_connect_token.timeout_seconds );
+}
+
+void test_connect_token_signature()
+{
+    // a token with the most server addresses still leaves room for the signature at the end of the zero pad
+
+    char address_strings[NETCODE_MAX_SERVERS_PER_CONNECT][NETCODE_MAX_ADDRESS_STRING_LENGTH];
+    NETCODE_CONST char * server_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_SERVERS_PER_CONNECT; ++i )
+    {
+        snprintf( address_strings[i], sizeof( address_strings[i] ), "[fe80:1:2:3:4:5:6:%x]:%d", i, 40000 + i );
+        server_addresses[i] = address_strings[i];
+    }
+
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    check( netcode_generate_connect_token( NETCODE_MAX_SERVERS_PER_CONNECT, server_addresses, server_addresses, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, key, NULL, connect_token ) );
+
+    uint8_t unsigned_connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    memcpy( unsigned_connect_token, connect_token, NETCODE_CONNECT_TOKEN_BYTES );
+
+    uint8_t signing_public_key[NETCODE_SIGNING_PUBLIC_KEY_BYTES];
+    uint8_t signing_private_key[NETCODE_SIGNING_PRIVATE_KEY_BYTES];
+    netcode_generate_signing_keys( signing_public_key, signing_private_key );
+
+    check( netcode_verify_connect_token( connect_token, signing_public_key ) == NETCODE_ERROR );
+
+    netcode_sign_connect_token( connect_token, signing_private_key );
+
+    check( netcode_verify_connect_token( connect_token, signing_public_key ) == NETCODE_OK );
+    check( memcmp( connect_token, unsigned_connect_token, NETCODE_CONNECT_TOKEN_BYTES - NETCODE_CONNECT_TOKEN_SIGNATURE_BYTES ) == 0 );
+
+    // signed tokens read the same as unsigned ones, so clients and servers that don't know about signatures are unaffected
+
+    struct netcode_connect_token_t connect_token_public;
+    check( netcode_read_connect_token( connect_token, NETCODE_CONNECT_TOKEN_BYTES, &connect_token_public ) == NETCODE_OK );
+    check( connect_token_public.num_server_addresses == NETCODE_MAX_SERVERS_PER_CONNECT );
+    check( connect_token_public.protocol_id == TEST_PROTOCOL_ID );
+
+    // any change to the token, or the wrong key, fails verification
+
+    uint8_t other_public_key[NETCODE_SIGNING_PUBLIC_KEY_BYTES];
+    uint8_t other_private_key[NETCODE_SIGNING_PRIVATE_KEY_BYTES];
+    netcode_generate_signing_keys( other_public_key, other_private_key );
+
+    check( netcode_verify_connect_token( connect_token, other_public_key ) == NETCODE_ERROR );
+
+    connect_token[NETCODE_VERSION_INFO_BYTES] ^= 1;
+    check( netcode_verify_connect_token( connect_token, signing_public_key ) == NETCODE_ERROR );
+    connect_token[NETCODE_VERSION_INFO_BYTES] ^= 1;
+
+    connect_token[NETCODE_CONNECT_TOKEN_BYTES - 1] ^= 1;
+    check( netcode_verify_connect_token( connect_token, signing_public_key ) == NETCODE_ERROR );
+    connect_token[NETCODE_CONNECT_TOKEN_BYTES - 1] ^= 1;
+
+    check( netcode_verify_connect_token( connect_token, signing_public_key ) == NETCODE_OK );
+}
+
+void test_read_connect_token()
+{
+    // parse a connect token the way a client receives it from the backend
+
+    NETCODE_CONST char * public_server_addresses[] = { "127.0.0.1:40000", "[::1]:50000" };
+    NETCODE_CONST char * internal_server_addresses[] = { "10.0.0.1:40000", "10.0.0.2:50000" };
+
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );
+
+    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
+
+    check( netcode_generate_connect_token( 2, 
+                                           public_server_addresses, 
+                                           internal_server_addresses, 
+                                           TEST_CONNECT_TOKEN_EXPIRY, 
+                                           TEST_TIMEOUT_SECONDS, 
+                                           TEST_CLIENT_ID, 
+                                           TEST_PROTOCOL_ID, 
+                                           key, 
+                                           NULL, 
+                                           connect_token_data ) == NETCODE_OK );
+
+    struct netcode_connect_token_t connect_token;
+    check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token ) == NETCODE_OK );
+
+    check( memcmp( connect_token.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES ) == 0 );
+    check( connect_token.protocol_id == TEST_PROTOCOL_ID );
+    check( connect_token.expire_timestamp == connect_token.create_timestamp + TEST_CONNECT_TOKEN_EXPIRY );
+    check( connect_token.timeout_seconds == TEST_TIMEOUT_SECONDS );
+    check( connect_token.num_server_addresses == 2 );
+
+    struct netcode_address_t address;
+    check( netcode_parse_address( public_server_addresses[0], &address ) == NETCODE_OK );
+    check( netcode_address_equal( &connect_token.server_addresses[0], &address ) );
+    check( netcode_parse_address( public_server_addresses[1], &address ) == NETCODE_OK );
+    check( netcode_address_equal( &connect_token.server_addresses[1], &address ) );
+
+    // the keys in the public portion must match the keys the server will see in the private portion
+
+    check( netcode_decrypt_connect_token_private( connect_token.private_data, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  NETCODE_VERSION_INFO, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  connect_token.expire_timestamp, 
+                                                  connect_token.nonce, 
+                                                  key ) == NETCODE_OK );
+
+    struct netcode_connect_token_private_t connect_token_private;
+    check( netcode_read_connect_token_private( connect_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &connect_token_private ) == NETCODE_OK );
+    check( connect_token_private.client_id == TEST_CLIENT_ID );
+    check( memcmp( connect_token.client_to_server_key, connect_token_private.client_to_server_key, NETCODE_KEY_BYTES ) == 0 );
+    check( memcmp( connect_token.server_to_client_key, connect_token_private.server_to_client_key, NETCODE_KEY_BYTES ) == 0 );
+
+    // malformed connect tokens are rejected
+
+    check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES - 1, &connect_token ) == NETCODE_ERROR );
+
+    uint8_t bad_connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
+
+    memcpy( bad_connect_token_data, connect_token_data, NETCODE_CONNECT_TOKEN_BYTES );
+    bad_connect_token_data[0] = 'X';
+    check( netcode_read_connect_token( bad_connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token ) == NETCODE_ERROR );
+
+    memset( bad_connect_token_data, 0, NETCODE_CONNECT_TOKEN_BYTES );
+    check( netcode_read_connect_token( bad_connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token ) == NETCODE_ERROR );
+}
+
+void test_base64()
+{
+    // known values from RFC 4648
+
+    NETCODE_CONST char * inputs[] = { "", "f", "fo", "foo", "foob", "fooba", "foobar" };
+    NETCODE_CONST char * outputs[] = { "", "Zg==", "Zm8=", "Zm9v", "Zm9vYg==", "Zm9vYmE=", "Zm9vYmFy" };
+
+    int i;
+    for ( i = 0; i < (int) ( sizeof( inputs ) / sizeof( inputs[0] ) ); ++i )
+    {
+        char encoded[16];
+        int input_length = (int) strlen( inputs[i] );
+        check( netcode_base64_encode_data( (NETCODE_CONST uint8_t*) inputs[i], input_length, encoded, sizeof( encoded ) ) == (int) strlen( outputs[i] ) );
+        check( strcmp( encoded, outputs[i] ) == 0 );
+
+        uint8_t decoded[16];
+        check( netcode_base64_decode_data( outputs[i], decoded, sizeof( decoded ) ) == input_length );
+        check( memcmp( decoded, inputs[i], input_length ) == 0 );
+    }
+
+    // a connect token round trips through base64
+
+    NETCODE_CONST char * server_address = "127.0.0.1:40000";
+
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, key, NULL, connect_token ) == NETCODE_OK );
+
+    char connect_token_base64[NETCODE_CONNECT_TOKEN_BASE64_BYTES];
+    check( netcode_base64_encode_data( connect_token, NETCODE_CONNECT_TOKEN_BYTES, connect_token_base64, sizeof( connect_token_base64 ) ) == NETCODE_CONNECT_TOKEN_BASE64_BYTES - 1 );
+    check( netcode_base64_encode_data( connect_token, NETCODE_CONNECT_TOKEN_BYTES, connect_token_base64, sizeof( connect_token_base64 ) - 1 ) == -1 );
+
+    uint8_t decoded_connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    check( netcode_base64_decode_data( connect_token_base64, decoded_connect_token, sizeof( decoded_connect_token ) ) == NETCODE_CONNECT_TOKEN_BYTES );
+    check( memcmp( decoded_connect_token, connect_token, NETCODE_CONNECT_TOKEN_BYTES ) == 0 );
+    check( netcode_base64_decode_data( connect_token_base64, decoded_connect_token, sizeof( decoded_connect_token ) - 1 ) == -1 );
+
+    // invalid input is rejected
+
+    uint8_t decoded[16];
+    check( netcode_base64_decode_data( "Zm9", decoded, sizeof( decoded ) ) == -1 );
+    check( netcode_base64_decode_data( "Zm9*", decoded, sizeof( decoded ) ) == -1 );
+    check( netcode_base64_decode_data( "Z===", decoded, sizeof( decoded ) ) == -1 );
+    check( netcode_base64_decode_data( "Zg==Zm9v", decoded, sizeof( decoded ) ) == -1 );
+}
+
+void test_select_servers()
+{
+    NETCODE_CONST char * server_addresses[8] = 
+    {
+        "10.0.0.1:40000", "10.0.0.2:40000", "10.0.0.3:40000", "10.0.0.4:40000", 
+        "10.0.0.5:40000", "10.0.0.6:40000", "10.0.0.7:40000", "10.0.0.8:40000", 
+    };
+
+    // selection is deterministic, has no duplicates and is capped by the number of servers
+
+    int selected[NETCODE_MAX_SERVERS_PER_CONNECT];
+    int selected_again[NETCODE_MAX_SERVERS_PER_CONNECT];
+
+    check( netcode_select_servers( 8, server_addresses, 12345, 3, selected ) == 3 );
+    check( netcode_select_servers( 8, server_addresses, 12345, 3, selected_again ) == 3 );
+    check( memcmp( selected, selected_again, sizeof( int ) * 3 ) == 0 );
+
+    check( netcode_select_servers( 8, server_addresses, 12345, NETCODE_MAX_SERVERS_PER_CONNECT, selected ) == 8 );
+
+    int seen[8] = { 0 };
+    int i;
+    for ( i = 0; i < 8; ++i )
+    {
+        check( selected[i] >= 0 && selected[i] < 8 );
+        check( !seen[selected[i]] );
+        seen[selected[i]] = 1;
+    }
+
+    // a shorter selection is a prefix of the longer one
+
+    check( netcode_select_servers( 8, server_addresses, 12345, 3, selected_again ) == 3 );
+    check( memcmp( selected, selected_again, sizeof( int ) * 3 ) == 0 );
+
+    check( netcode_select_servers( 0, NULL, 12345, 3, selected ) == 0 );
+
+    // clients spread across all servers, and removing the last server only moves the clients that were on it
+
+    NETCODE_CONST char * fewer_server_addresses[7];
+    memcpy( fewer_server_addresses, server_addresses, sizeof( fewer_server_addresses ) );
+
+    int count[8] = { 0 };
+    int num_moved = 0;
+    uint64_t client_id;
+    for ( client_id = 0; client_id < 8000; ++client_id )
+    {
+        int first = -1;
+        check( netcode_select_servers( 8, server_addresses, client_id, 1, &first ) == 1 );
+        count[first]++;
+
+        int first_without_last = -1;
+        check( netcode_select_servers( 7, fewer_server_addresses, client_id, 1, &first_without_last ) == 1 );
+
+        if ( first != 7 )
+        {
+            check( first_without_last == first );
+        }
+        else
+        {
+            num_moved++;
+        }
+    }
+
+    for ( i = 0; i < 8; ++i )
+    {
+        check( count[i] > 700 && count[i] < 1300 );
+    }
+
+    check( num_moved == count[7] );
+}
+
+static uint8_t test_random_bytes_counter = 0;
+
+static void test_random_bytes_function( uint8_t * data, int bytes )
+{
+    int i;
+    for ( i = 0; i < bytes; ++i )
+        data[i] = test_random_bytes_counter++;
+}
+
+void test_random_bytes_function_override()
+{
+    // all randomness in netcode goes through one source, which can be made deterministic for tests
+
+    netcode_set_random_bytes_function( test_random_bytes_function );
+
+    test_random_bytes_counter = 0;
+
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );
+
+    int i;
+    for ( i = 0; i < NETCODE_KEY_BYTES; ++i )
+        check( key[i] == (uint8_t) i );
+
+    uint8_t data[8];
+    netcode_random_bytes( data, sizeof( data ) );
+
+    for ( i = 0; i < (int) sizeof( data ); ++i )
+        check( data[i] == (uint8_t) ( NETCODE_KEY_BYTES + i ) );
+
+    // restoring the default source gives real random bytes again
+
+    netcode_set_random_bytes_function( NULL );
+
+    uint8_t other_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );
+    netcode_generate_key( other_key );
+    check( memcmp( key, other_key, NETCODE_KEY_BYTES ) != 0 );
+}
+
+void test_socket_options()
+{
+    struct netcode_address_t address;
+    check( netcode_parse_address( "127.0.0.1:0", &address ) );
+
+    struct netcode_socket_t socket;
+    check( netcode_socket_create( &socket, &address, 64 * 1024, 64 * 1024, 0x88, 1, 0 ) == NETCODE_SOCKET_ERROR_NONE );
+
+#if NETCODE_PLATFORM == NETCODE_PLATFORM_UNIX
+    int tos = 0;
+    socklen_t length = sizeof( tos );
+    check( getsockopt( socket.handle, IPPROTO_IP, IP_TOS, (char*)&tos, &length ) == 0 );
+    check( tos == 0x88 );
+#endif // #if NETCODE_PLATFORM == NETCODE_PLATFORM_UNIX
+
+    netcode_socket_destroy( &socket );
+
+    check( netcode_socket_create( &socket, &address, 64 * 1024, 64 * 1024, 0, 0, 0 ) == NETCODE_SOCKET_ERROR_NONE );
+
+    netcode_socket_destroy( &socket );
+
+#ifdef SO_REUSEPORT
+
+    // a second socket can only share the port when both asked for it
+
+    check( netcode_socket_create( &socket, &address, 64 * 1024, 64 * 1024, 0, 0, 1 ) == NETCODE_SOCKET_ERROR_NONE );
+
+    struct netcode_address_t bound_address = socket.address;
+    check( bound_address.port != 0 );
+
+    struct netcode_socket_t other_socket;
+    check( netcode_socket_create( &other_socket, &bound_address, 64 * 1024, 64 * 1024, 0, 0, 0 ) != NETCODE_SOCKET_ERROR_NONE );
+    check( netcode_socket_create( &other_socket, &bound_address, 64 * 1024, 64 * 1024, 0, 0, 1 ) == NETCODE_SOCKET_ERROR_NONE );
+
+    netcode_socket_destroy( &other_socket );
+    netcode_socket_destroy( &socket );
+
+#endif // #ifdef SO_REUSEPORT
+}
+
+void test_proxy_protocol_header()
+{
+    static const uint8_t signature[12] = { 0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A };
+
+    struct netcode_address_t transport_address;
+    check( netcode_parse_address( "10.0.0.1:45000", &transport_address ) );
+
+    uint8_t packet[256];
+    memset( packet, 0xFF, sizeof( packet ) );
+    memcpy( packet, signature, sizeof( signature ) );
+
+    // PROXY over UDP/IPv4
+
+    packet[12] = 0x21;
+    packet[13] = 0x12;
+    packet[14] = 0;
+    packet[15] = 12;
+    uint8_t ipv4_body[12] = { 192, 168, 1, 2, 10, 0, 0, 2, 0x9C, 0x40, 0x9C, 0x41 };
+    memcpy( packet + 16, ipv4_body, sizeof( ipv4_body ) );
+
+    struct netcode_address_t address = transport_address;
+    check( netcode_read_proxy_protocol_header( packet, 100, &address ) == 28 );
+
+    struct netcode_address_t expected;
+    check( netcode_parse_address( "192.168.1.2:40000", &expected ) );
+    check( netcode_address_equal( &address, &expected ) );
+
+    // PROXY over UDP/IPv6
+
+    packet[13] = 0x22;
+    packet[15] = 36;
+    uint8_t ipv6_body[36];
+    memset( ipv6_body, 0, sizeof( ipv6_body ) );
+    ipv6_body[0] = 0xFE;
+    ipv6_body[1] = 0x80;
+    ipv6_body[15] = 0x01;
+    ipv6_body[32] = 0xC3;
+    ipv6_body[33] = 0x50;
+    memcpy( packet + 16, ipv6_body, sizeof( ipv6_body ) );
+
+    address = transport_address;
+    check( netcode_read_proxy_protocol_header( packet, 100, &address ) == 52 );
+    check( netcode_parse_address( "[fe80::1]:50000", &expected ) );
+    check( netcode_address_equal( &address, &expected ) );
+
+    // LOCAL keeps the transport address
+
+    packet[12] = 0x20;
+    packet[13] = 0x00;
+    packet[15] = 0;
+    address = transport_address;
+    check( netcode_read_proxy_protocol_header( packet, 100, &address ) == 16 );
+    check( netcode_address_equal( &address, &transport_address ) );
+
+    // bad signature, version, family and lengths are rejected
+
+    packet[12] = 0x21;
+    packet[13] = 0x12;
+    packet[15] = 12;
+    check( netcode_read_proxy_protocol_header( packet, 27, &address ) == -1 );
+    check( netcode_read_proxy_protocol_header( packet, 15, &address ) == -1 );
+
+    packet[15] = 8;
+    check( netcode_read_proxy_protocol_header( packet, 100, &address ) == -1 );
+
+    packet[15] = 12;
+    packet[13] = 0x11;
+    check( netcode_read_proxy_protocol_header( packet, 100, &address ) == -1 );
+
+    packet[13] = 0x12;
+    packet[12] = 0x11;
+    check( netcode_read_proxy_protocol_header( packet, 100, &address ) == -1 );
+
+    packet[12] = 0x21;
+    packet[0] = 0x00;
+    check( netcode_read_proxy_protocol_header( packet, 100, &address ) == -1 );
+}
+
+void test_user_data_claims()
+{
+    // claims written into user data must read back exactly
+
+    struct netcode_user_data_claims_t input_claims;
+    input_claims.player_id = 0x1122334455667788ULL;
+    input_claims.team = 2;
+    input_claims.region = 7;
+    input_claims.permissions = ( 1ULL << 63 ) | 5;
+    netcode_random_bytes( input_claims.extra_data, NETCODE_USER_DATA_CLAIMS_EXTRA_BYTES );
+
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_write_user_data_claims( &input_claims, user_data );
+
+    struct netcode_user_data_claims_t output_claims;
+    check( netcode_read_user_data_claims( user_data, &output_claims ) == NETCODE_OK );
+    check( output_claims.player_id == input_claims.player_id );
+    check( output_claims.team == input_claims.team );
+    check( output_claims.region == input_claims.region );
+    check( output_claims.permissions == input_claims.permissions );
+    check( memcmp( output_claims.extra_data, input_claims.extra_data, NETCODE_USER_DATA_CLAIMS_EXTRA_BYTES ) == 0 );
+
+    // claims with an unknown version are rejected
+
+    uint8_t bad_user_data[NETCODE_USER_DATA_BYTES];
+    memcpy( bad_user_data, user_data, NETCODE_USER_DATA_BYTES );
+    bad_user_data[0] = NETCODE_USER_DATA_CLAIMS_VERSION + 1;
+    check( netcode_read_user_data_claims( bad_user_data, &output_claims ) == NETCODE_ERROR );
+
+    memset( bad_user_data, 0, NETCODE_USER_DATA_BYTES );
+    check( netcode_read_user_data_claims( bad_user_data, &output_claims ) == NETCODE_ERROR );
+
+    // claims survive the trip through a generated connect token
+
+    NETCODE_CONST char * server_address = "127.0.0.1:40000";
+
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_generate_key( key );
+
+    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, key, user_data, connect_token_data ) == NETCODE_OK );
+
+    struct netcode_connect_token_t connect_token;
+    check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token ) == NETCODE_OK );
+
+    check( netcode_decrypt_connect_token_private( connect_token.private_data, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  NETCODE_VERSION_INFO, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  connect_token.expire_timestamp, 
+                                                  connect_token.nonce, 
+                                                  key ) == NETCODE_OK );
+
+    struct netcode_connect_token_private_t connect_token_private;
+    check( netcode_read_connect_token_private( connect_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, &connect_token_private ) == NETCODE_OK );
+
+    memset( &output_claims, 0, sizeof( output_claims ) );
+    check( netcode_read_user_data_claims( connect_token_private.user_data, &output_claims ) == NETCODE_OK );
+    check( output_claims.player_id == input_claims.player_id );
+    check( output_claims.team == input_claims.team );
+    check( output_claims.region == input_claims.region );
+    check( output_claims.permissions == input_claims.permissions );
+    check( memcmp( output_claims.extra_data, input_claims.extra_data, NETCODE_USER_DATA_CLAIMS_EXTRA_BYTES ) == 0 );
+}
+
+void test_encryption_manager()
+{
+    struct netcode_encryption_manager_t encryption_manager;
+
+    netcode_encryption_manager_reset( &encryption_manager );
+
+    double time = 100.0;
+
+    // generate some test encryption mappings
+
+    struct encryption_mapping_t
+    {
+        struct netcode_address_t address;
+        uint8_t send_key[NETCODE_KEY_BYTES];
+        uint8_t receive_key[NETCODE_KEY_BYTES];
+    };
+
+    #define NUM_ENCRYPTION_MAPPINGS 5
+
+    struct encryption_mapping_t encryption_mapping[NUM_ENCRYPTION_MAPPINGS];
+    memset( encryption_mapping, 0, sizeof( encryption_mapping ) );
+    int i;
+    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    {
+        encryption_mapping[i].address.type = NETCODE_ADDRESS_IPV6;
+        encryption_mapping[i].address.data.ipv6[7] = 1;
+        encryption_mapping[i].address.port = ( uint16_t) ( 20000 + i );
+        netcode_generate_key( encryption_mapping[i].send_key );
+        netcode_generate_key( encryption_mapping[i].receive_key );
+    }
+
+    // add the encryption mappings to the manager and make sure they can be looked up by address
+
+    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    {
+        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+
+        check( encryption_index == -1 );
+
+        check( netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index ) == NULL );
+        check( netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index ) == NULL );
+
+        check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
+                                                                  &encryption_mapping[i].address, 
+                                                                  encryption_mapping[i].send_key, 
+                                                                  encryption_mapping[i].receive_key, 
+                                                                  time, 
+                                                                  -1.0,
+                                                                  TEST_TIMEOUT_SECONDS, 
+                                                                  0 ) );
+
+        encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+
+        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
+        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+
+        check( send_key );
+        check( receive_key );
+
+        check( memcmp( send_key, encryption_mapping[i].send_key, NETCODE_KEY_BYTES ) == 0 );
+        check( memcmp( receive_key, encryption_mapping[i].receive_key, NETCODE_KEY_BYTES ) == 0 );
+    }
+
+    // removing an encryption mapping that doesn't exist should return 0
+    {
+        struct netcode_address_t address;
+        address.type = NETCODE_ADDRESS_IPV6;
+        address.data.ipv6[7] = 1;
+        address.port = 50000;
+
+        check( netcode_encryption_manager_remove_encryption_mapping( &encryption_manager, &address, time ) == 0 );
+    }
+
+    // remove the first and last encryption mappings
+
+    check( netcode_encryption_manager_remove_encryption_mapping( &encryption_manager, &encryption_mapping[0].address, time ) == 1 );
+
+    check( netcode_encryption_manager_remove_encryption_mapping( &encryption_manager, &encryption_mapping[NUM_ENCRYPTION_MAPPINGS-1].address, time ) == 1 );
+
+    // make sure the encryption mappings that were removed can no longer be looked up by address
+
+    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    {
+        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+
+        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
+        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+
+        if ( i != 0 && i != NUM_ENCRYPTION_MAPPINGS - 1 )
+        {
+            check( send_key );
+            check( receive_key );
+
+            check( memcmp( send_key, encryption_mapping[i].send_key, NETCODE_KEY_BYTES ) == 0 );
+            check( memcmp( receive_key, encryption_mapping[i].receive_key, NETCODE_KEY_BYTES ) == 0 );
+        }
+        else
+        {
+            check( !send_key );
+            check( !receive_key );
+        }
+    }
+
+    // add the encryption mappings back in
+    
+    check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
+                                                              &encryption_mapping[0].address, 
+                                                              encryption_mapping[0].send_key, 
+                                                              encryption_mapping[0].receive_key, 
+                                                              time, 
+                                                              -1.0,
+                                                              TEST_TIMEOUT_SECONDS, 
+                                                              0 ) );
+    
+    check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
+                                                              &encryption_mapping[NUM_ENCRYPTION_MAPPINGS-1].address, 
+                                                              encryption_mapping[NUM_ENCRYPTION_MAPPINGS-1].send_key, 
+                                                              encryption_mapping[NUM_ENCRYPTION_MAPPINGS-1].receive_key, 
+                                                              time, 
+                                                              -1.0,
+                                                              TEST_TIMEOUT_SECONDS, 
+                                                              0 ) );
+
+    // all encryption mappings should be able to be looked up by address again
+
+    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    {
+        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+
+        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
+        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+
+        check( send_key );
+        check( receive_key );
+
+        check( memcmp( send_key, encryption_mapping[i].send_key, NETCODE_KEY_BYTES ) == 0 );
+        check( memcmp( receive_key, encryption_mapping[i].receive_key, NETCODE_KEY_BYTES ) == 0 );
+    }
+
+    // check that encryption mappings time out properly
+
+    time += TEST_TIMEOUT_SECONDS * 2;
+
+    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    {
+        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+
+        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
+        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+
+        check( !send_key );
+        check( !receive_key );
+    }
+
+    // add the same encryption mappings after timeout
+
+    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    {
+        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+
+        check( encryption_index == -1 );
+
+        check( netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index ) == NULL );
+        check( netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index ) == NULL );
+
+        check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
+                                                                  &encryption_mapping[i].address, 
+                                                                  encryption_mapping[i].send_key, 
+                                                                  encryption_mapping[i].receive_key, 
+                                                                  time, 
+                                                                  -1.0,
+                                                                  TEST_TIMEOUT_SECONDS, 
+                                                                  0 ) );
+
+        encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+
+        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
+        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+
+        check( send_key );
+        check( receive_key );
+
+        check( memcmp( send_key, encryption_mapping[i].send_key, NETCODE_KEY_BYTES ) == 0 );
+        check( memcmp( receive_key, encryption_mapping[i].receive_key, NETCODE_KEY_BYTES ) == 0 );
+    }
+
+    // reset the encryption mapping and verify that all encryption mappings have been removed
+
+    netcode_encryption_manager_reset( &encryption_manager );
+
+    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    {
+        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+
+        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
+        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+
+        check( !send_key );
+        check( !receive_key );
+    }
+
+    // test the expire time for encryption mapping works as expected
+
+    check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
+                                                              &encryption_mapping[0].address, 
+                                                              encryption_mapping[0].send_key, 
+                                                              encryption_mapping[0].receive_key, 
+                                                              time, 
+                                                              time + 1.0,
+                                                              TEST_TIMEOUT_SECONDS, 
+                                                              0 ) );
+
+    int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[0].address, time );
+
+    check( encryption_index != -1 );
+
+    check( netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[0].address, time + 1.1f ) == -1 );
+
+    netcode_encryption_manager_set_expire_time( &encryption_manager, encryption_index, -1.0 );
+
+    check( netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[0].address, time ) == encryption_index );
+}
+
+void test_connect_token_entries()
+{
+    struct netcode_connect_token_entries_t * connect_token_entries = (struct netcode_connect_token_entries_t*) malloc( sizeof( struct netcode_connect_token_entries_t ) );
+
+    netcode_connect_token_entries_reset( connect_token_entries );
+
+    struct netcode_address_t address;
+    struct netcode_address_t other_address;
+    check( netcode_parse_address( "[::1]:50000", &address ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50001", &other_address ) == NETCODE_OK );
+
+    double time = 100.0;
+
+    uint8_t random_mac[NETCODE_MAC_BYTES];
+
+    // fill half the entries so the filters rotate while the token below is still in the ring
+
+    int i;
+    for ( i = 0; i < NETCODE_MAX_CONNECT_TOKEN_ENTRIES / 2; ++i )
+    {
+        netcode_random_bytes( random_mac, NETCODE_MAC_BYTES );
+        check( netcode_connect_token_entries_find_or_add( connect_token_entries, &address, random_mac, time ) );
+    }
+
+    // a token may be reused from the address that first used it, but not from another address
+
+    uint8_t mac[NETCODE_MAC_BYTES];
+    netcode_random_bytes( mac, NETCODE_MAC_BYTES );
+
+    check( netcode_connect_token_entries_find_or_add( connect_token_entries, &address, mac, time ) );
+    check( netcode_connect_token_entries_find_or_add( connect_token_entries, &address, mac, time ) );
+    check( !netcode_connect_token_entries_find_or_add( connect_token_entries, &other_address, mac, time ) );
+
+    // the token is remembered until every other entry has been replaced
+
+    for ( i = 0; i < NETCODE_MAX_CONNECT_TOKEN_ENTRIES - 1; ++i )
+    {
+        netcode_random_bytes( random_mac, NETCODE_MAC_BYTES );
+        check( netcode_connect_token_entries_find_or_add( connect_token_entries, &address, random_mac, time ) );
+    }
+
+    check( !netcode_connect_token_entries_find_or_add( connect_token_entries, &other_address, mac, time ) );
+
+    // one more new token replaces it as the oldest entry
+
+    netcode_random_bytes( random_mac, NETCODE_MAC_BYTES );
+    check( netcode_connect_token_entries_find_or_add( connect_token_entries, &address, random_mac, time ) );
+
+    check( netcode_connect_token_entries_find_or_add( connect_token_entries, &other_address, mac, time ) );
+
+    free( connect_token_entries );
+}
+
+void test_replay_protection()
+{
+    struct netcode_replay_protection_t replay_protection;
+
+    int i;
+    for ( i = 0; i < 2; ++i )
+    {
+        netcode_replay_protection_reset( &replay_protection );
+
+        check( replay_protection.most_recent_sequence == 0 );
+
+        // the first time we receive packets, they should not be already received
+
+        #define MAX_SEQUENCE ( NETCODE_REPLAY_PROTECTION_BUFFER_SIZE * 4 )
+
+        uint64_t sequence;
+        for ( sequence = 0; sequence < MAX_SEQUENCE; ++sequence )
+        {
+            check( netcode_replay_protection_packet_already_received( &replay_protection, sequence ) == 0 );
+            netcode_replay_protection_advance_sequence( &replay_protection, sequence );
+        }
+
+        // old packets outside buffer should be considered already received
+
+        check( netcode_replay_protection_packet_already_received( &replay_protection, 0 ) == 1 );
+
+        // packets received a second time should be flagged already received
+
+        for ( sequence = MAX_SEQUENCE - 10; sequence < MAX_SEQUENCE; ++sequence )
+        {
+            check( netcode_replay_protection_packet_already_received( &replay_protection, sequence ) == 1 );
+        }
+
+        // jumping ahead to a much higher sequence should be considered not already received
+
+        check( netcode_replay_protection_packet_already_received( &replay_protection, MAX_SEQUENCE + NETCODE_REPLAY_PROTECTION_BUFFER_SIZE ) == 0 );
+
+        // checking a sequence does not mark it as received. only advancing the sequence does
+
+        check( netcode_replay_protection_packet_already_received( &replay_protection, MAX_SEQUENCE + NETCODE_REPLAY_PROTECTION_BUFFER_SIZE ) == 0 );
+
+        netcode_replay_protection_advance_sequence( &replay_protection, MAX_SEQUENCE + NETCODE_REPLAY_PROTECTION_BUFFER_SIZE );
+
+        check( netcode_replay_protection_packet_already_received( &replay_protection, MAX_SEQUENCE + NETCODE_REPLAY_PROTECTION_BUFFER_SIZE ) == 1 );
+
+        // old packets should be considered already received
+
+        for ( sequence = 0; sequence < MAX_SEQUENCE; ++sequence )
+        {
+            check( netcode_replay_protection_packet_already_received( &replay_protection, sequence ) == 1 );
+        }
+    }
+}
+
+void test_network_simulator_faults()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    struct netcode_address_t from;
+    struct netcode_address_t to;
+    check( netcode_parse_address( "[::1]:50000", &from ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:40000", &to ) == NETCODE_OK );
+
+    uint8_t packet_data[100];
+    int i;
+    for ( i = 0; i < (int) sizeof( packet_data ); ++i )
+        packet_data[i] = (uint8_t) i;
+
+    uint8_t * received_packet_data[10];
+    int received_packet_bytes[10];
+    struct netcode_address_t received_from[10];
+
+    // exactly the next N packets are dropped
+
+    network_simulator->drop_next_packets = 3;
+
+    for ( i = 0; i < 5; ++i )
+    {
+        netcode_network_simulator_send_packet( network_simulator, &from, &to, packet_data, sizeof( packet_data ) );
+    }
+
+    netcode_network_simulator_update( network_simulator, 0.0 );
+
+    check( netcode_network_simulator_receive_packets( network_simulator, &to, 10, received_packet_data, received_packet_bytes, received_from ) == 2 );
+    check( network_simulator->drop_next_packets == 0 );
+
+    // corrupted packets arrive with one byte changed, and the sender's buffer is left alone
+
+    network_simulator->corrupt_packet_percent = 100.0f;
+
+    netcode_network_simulator_send_packet( network_simulator, &from, &to, packet_data, sizeof( packet_data ) );
+
+    netcode_network_simulator_update( network_simulator, 0.0 );
+
+    check( netcode_network_simulator_receive_packets( network_simulator, &to, 10, received_packet_data, received_packet_bytes, received_from ) == 1 );
+    check( received_packet_bytes[0] == (int) sizeof( packet_data ) );
+
+    int num_bytes_changed = 0;
+    for ( i = 0; i < (int) sizeof( packet_data ); ++i )
+    {
+        check( packet_data[i] == (uint8_t) i );
+        if ( received_packet_data[0][i] != packet_data[i] )
+            num_bytes_changed++;
+    }
+
+    check( num_bytes_changed == 1 );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_network_simulator_bandwidth()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // 64 kbps moves one 125 byte packet every 1/64th of a second
+
+    network_simulator->bandwidth_kbps = 64.0f;
+
+    struct netcode_address_t from;
+    struct netcode_address_t to;
+    check( netcode_parse_address( "[::1]:50000", &from ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:40000", &to ) == NETCODE_OK );
+
+    uint8_t packet_data[125];
+    memset( packet_data, 0, sizeof( packet_data ) );
+
+    netcode_network_simulator_update( network_simulator, 0.0 );
+
+    int i;
+    for ( i = 0; i < 100; ++i )
+    {
+        netcode_network_simulator_send_packet( network_simulator, &from, &to, packet_data, sizeof( packet_data ) );
+    }
+
+    // packets trickle out at the link rate instead of arriving together
+
+    uint8_t * received_packet_data[100];
+    int received_packet_bytes[100];
+    struct netcode_address_t received_from[100];
+
+    netcode_network_simulator_update( network_simulator, 0.05 );
+
+    int num_packets_received = netcode_network_simulator_receive_packets( network_simulator, &to, 100, received_packet_data, received_packet_bytes, received_from );
+
+    check( num_packets_received == 3 );
+
+    // the link buffers a quarter of a second of traffic and drops the rest of the burst
+
+    netcode_network_simulator_update( network_simulator, 1.0 );
+
+    num_packets_received += netcode_network_simulator_receive_packets( network_simulator, &to, 100, received_packet_data, received_packet_bytes, received_from );
+
+    check( num_packets_received == 17 );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_create()
+{
+    {
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create( "127.0.0.1:40000", &client_config, 0.0 );
+
+        struct netcode_address_t test_address;
+        netcode_parse_address( "127.0.0.1:40000", &test_address );
+
+        check( client );
+        check( client->socket_holder.ipv4.handle != 0 );
+        check( client->socket_holder.ipv6.handle == 0 );
+        check( netcode_address_equal( &client->address, &test_address ) );
+
+        netcode_client_destroy( client );
+    }
+
+    {
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, 0.0 );
+
+        struct netcode_address_t test_address;
+        netcode_parse_address( "[::]:50000", &test_address );
+
+        check( client );
+        check( client->socket_holder.ipv4.handle == 0 );
+        check( client->socket_holder.ipv6.handle != 0 );
+        check( netcode_address_equal( &client->address, &test_address ) );
+
+        netcode_client_destroy( client );
+    }
+
+    {
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create_overload( "127.0.0.1:40000", "[::]:50000", &client_config, 0.0 );
+
+        struct netcode_address_t test_address;
+        netcode_parse_address( "127.0.0.1:40000", &test_address );
+
+        check( client );
+        check( client->socket_holder.ipv4.handle != 0 );
+        check( client->socket_holder.ipv6.handle != 0 );
+        check( netcode_address_equal( &client->address, &test_address ) );
+
+        netcode_client_destroy( client );
+    }
+
+    {
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create_overload( "[::]:50000", "127.0.0.1:40000", &client_config, 0.0 );
+
+        struct netcode_address_t test_address;
+        netcode_parse_address( "[::]:50000", &test_address );
+
+        check( client );
+        check( client->socket_holder.ipv4.handle != 0 );
+        check( client->socket_holder.ipv6.handle != 0 );
+        check( netcode_address_equal( &client->address, &test_address ) );
+
+        netcode_client_destroy( client );
+    }
+}
+
+void test_server_create()
+{
+    {
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+
+        struct netcode_server_t * server = netcode_server_create( "127.0.0.1:40000", &server_config, 0.0 );
+
+        struct netcode_address_t test_address;
+        netcode_parse_address( "127.0.0.1:40000", &test_address );
+
+        check( server );
+        check( server->socket_holder.ipv4.handle != 0 );
+        check( server->socket_holder.ipv6.handle == 0 );
+        check( netcode_address_equal( &server->address, &test_address ) );
+
+        netcode_server_destroy( server );
+    }
+
+    {
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+
+        struct netcode_server_t * server = netcode_server_create( "[::1]:50000", &server_config, 0.0 );
+
+        struct netcode_address_t test_address;
+        netcode_parse_address( "[::1]:50000", &test_address );
+
+        check( server );
+        check( server->socket_holder.ipv4.handle == 0 );
+        check( server->socket_holder.ipv6.handle != 0 );
+        check( netcode_address_equal( &server->address, &test_address ) );
+
+        netcode_server_destroy( server );
+    }
+
+    {
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+
+        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:50000", &server_config, 0.0 );
+
+        struct netcode_address_t test_address;
+        netcode_parse_address( "127.0.0.1:40000", &test_address );
+
+        check( server );
+        check( server->socket_holder.ipv4.handle != 0 );
+        check( server->socket_holder.ipv6.handle != 0 );
+        check( netcode_address_equal( &server->address, &test_address ) );
+
+        netcode_server_destroy( server );
+    }
+
+    {
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+
+        struct netcode_server_t * server = netcode_server_create_overload( "[::1]:50000", "127.0.0.1:40000", &server_config, 0.0 );
+
+        struct netcode_address_t test_address;
+        netcode_parse_address( "[::1]:50000", &test_address );
+
+        check( server );
+        check( server->socket_holder.ipv4.handle != 0 );
+        check( server->socket_holder.ipv6.handle != 0 );
+        check( netcode_address_equal( &server->address, &test_address ) );
+
+        netcode_server_destroy( server );
+    }
+}
+
+static uint8_t private_key[NETCODE_KEY_BYTES] = { 0x60, 0x6a, 0xbe, 0x6e, 0xc9, 0x19, 0x10, 0xea, 
+                                                  0x9a, 0x65, 0x62, 0xf6, 0x6f, 0x2b, 0x30, 0xe4, 
+                                                  0x43, 0x71, 0xd6, 0x2c, 0xd1, 0x99, 0x27, 0x26,
+                                                  0x6b, 0x3c, 0x60, 0xf4, 0xb7, 0x15, 0xab, 0xa1 };
+
+void test_server_version_info_mismatch()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, 0.0 );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH] == 0 );
+
+    struct netcode_address_t from;
+    check( netcode_parse_address( "[::1]:50000", &from ) == NETCODE_OK );
+
+    // a connection request with the current version info but a garbage connect token is dropped, but is not a version mismatch
+
+    uint8_t packet_data[1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + NETCODE_CONNECT_TOKEN_NONCE_BYTES + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    memset( packet_data, 0, sizeof( packet_data ) );
+    packet_data[0] = NETCODE_CONNECTION_REQUEST_PACKET;
+    memcpy( packet_data + 1, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
+
+    netcode_server_process_packet( server, &from, packet_data, sizeof( packet_data ) );
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH] == 0 );
+
+    // connection requests from a different protocol version are counted
+
+    memcpy( packet_data + 1, "NETCODE 1.00", NETCODE_VERSION_INFO_BYTES );
+
+    netcode_server_process_packet( server, &from, packet_data, sizeof( packet_data ) );
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH] == 1 );
+
+    // so are connection requests too short to hold the version info
+
+    netcode_server_process_packet( server, &from, packet_data, 8 );
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH] == 2 );
+
+    check( netcode_server_num_connected_clients( server ) == 0 );
+
+    netcode_server_destroy( server );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_connect()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    int server_num_packets_received = 0;
+    int client_num_packets_received = 0;
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
+        packet_data[i] = (uint8_t) i;
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            (void) packet_sequence;
+            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            (void) packet_sequence;
+            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            server_num_packets_received++;
+            netcode_server_free_packet( server, packet );
+        }
+
+        if ( client_num_packets_received >= 10 && server_num_packets_received >= 10 )
+        {
+            if ( netcode_server_client_connected( server, 0 ) )
+            {
+                netcode_server_disconnect_client( server, 0 );
+            }
+        }
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( client_num_packets_received >= 10 && server_num_packets_received >= 10 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_max_packet_size()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    // max packet size must fit in a payload packet
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+    client_config.max_packet_size = NETCODE_MAX_PAYLOAD_BYTES + 1;
+
+    check( netcode_client_create( "[::]:50000", &client_config, time ) == NULL );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    server_config.max_packet_size = 0;
+
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+
+    // the client raises its max packet size. the server keeps the default
+
+    client_config.max_packet_size = NETCODE_MAX_PAYLOAD_BYTES;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    server_config.max_packet_size = NETCODE_MAX_PACKET_SIZE;
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+
+    uint8_t packet_data[NETCODE_MAX_PAYLOAD_BYTES];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_PAYLOAD_BYTES; ++i )
+        packet_data[i] = (uint8_t) i;
+
+    // the server drops payloads larger than its own max packet size
+
+    int server_num_packets_received = 0;
+
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PAYLOAD_BYTES );
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            server_num_packets_received++;
+            netcode_server_free_packet( server, packet );
+        }
+
+        time += delta_time;
+    }
+
+    check( server_num_packets_received == 0 );
+
+    // once the server raises its max packet size, large payloads get through in both directions
+
+    server_config.max_packet_size = NETCODE_MAX_PAYLOAD_BYTES;
+
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
+
+    int client_num_packets_received = 0;
+
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PAYLOAD_BYTES );
+
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PAYLOAD_BYTES );
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            check( packet_bytes == NETCODE_MAX_PAYLOAD_BYTES );
+            check( memcmp( packet, packet_data, NETCODE_MAX_PAYLOAD_BYTES ) == 0 );
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            check( packet_bytes == NETCODE_MAX_PAYLOAD_BYTES );
+            check( memcmp( packet, packet_data, NETCODE_MAX_PAYLOAD_BYTES ) == 0 );
+            server_num_packets_received++;
+            netcode_server_free_packet( server, packet );
+        }
+
+        time += delta_time;
+    }
+
+    check( client_num_packets_received > 0 );
+    check( server_num_packets_received > 0 );
+
+    server_config.max_packet_size = NETCODE_MAX_PAYLOAD_BYTES + 1;
+
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_ERROR );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_send_pacing()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    // pace sends at one packet per update, through a send queue that holds eight packets
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    server_config.send_pacing_rate = 1.0 / delta_time;
+    server_config.packet_queue_size = 8;
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+
+    // a burst of ten packets fills the send queue and the last two are dropped
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
+        packet_data[i] = (uint8_t) i;
+
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+    }
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_SEND_QUEUE_PACKETS_DROPPED] == 2 );
+
+    // the queued packets go out at the pacing rate instead of all at once. the first update may also spend the interval since the queue went idle
+
+    int client_num_packets_received = 0;
+    int num_updates_with_packets = 0;
+
+    for ( i = 0; i < 20; ++i )
+    {
+        time += delta_time;
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        int num_packets_received = 0;
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            check( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            check( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );
+            num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        check( num_packets_received <= 2 );
+
+        if ( num_packets_received > 0 )
+            num_updates_with_packets++;
+
+        client_num_packets_received += num_packets_received;
+    }
+
+    check( client_num_packets_received == 8 );
+    check( num_updates_with_packets >= 7 );
+
+    // switching pacing off flushes anything still queued on the next update
+
+    for ( i = 0; i < 4; ++i )
+    {
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+    }
+
+    server_config.send_pacing_rate = 0.0;
+
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
+
+    client_num_packets_received = 0;
+
+    for ( i = 0; i < 2; ++i )
+    {
+        time += delta_time;
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+    }
+
+    check( client_num_packets_received == 4 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_bandwidth_limit()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    // 10000 bytes per second refills 1000 bytes per update. the bucket holds one max size payload
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    server_config.bandwidth_limit = 10000.0;
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+
+    uint8_t packet_data[500];
+    memset( packet_data, 0, sizeof( packet_data ) );
+
+    // with the drop policy, packets beyond the bucket are dropped on send
+
+    int i;
+    for ( i = 0; i < 4; ++i )
+    {
+        netcode_server_send_packet( server, 0, packet_data, sizeof( packet_data ) );
+    }
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_BANDWIDTH_PACKETS_DROPPED] == 2 );
+
+    int client_num_packets_received = 0;
+
+    for ( i = 0; i < 10; ++i )
+    {
+        time += delta_time;
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+    }
+
+    check( client_num_packets_received == 2 );
+
+    // with the delay policy, the same packets wait in the send queue until the bucket covers them
+
+    server_config.bandwidth_limit_policy = NETCODE_BANDWIDTH_LIMIT_DELAY;
+
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
+
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_server_send_packet( server, 0, packet_data, sizeof( packet_data ) );
+    }
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_BANDWIDTH_PACKETS_DELAYED] == 8 );
+
+    client_num_packets_received = 0;
+    int num_updates_with_packets = 0;
+
+    for ( i = 0; i < 10; ++i )
+    {
+        time += delta_time;
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        int num_packets_received = 0;
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        check( num_packets_received <= 2 );
+
+        if ( num_packets_received > 0 )
+            num_updates_with_packets++;
+
+        client_num_packets_received += num_packets_received;
+    }
+
+    check( client_num_packets_received == 10 );
+    check( num_updates_with_packets >= 5 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_BANDWIDTH_PACKETS_DROPPED] == 2 );
+
+    // a per-client limit of zero lifts the limit for that client only
+
+    netcode_server_set_client_bandwidth_limit( server, 0, 0.0 );
+
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_server_send_packet( server, 0, packet_data, sizeof( packet_data ) );
+    }
+
+    time += delta_time;
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_client_update( client, time );
+
+    netcode_server_update( server, time );
+
+    time += delta_time;
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_client_update( client, time );
+
+    client_num_packets_received = 0;
+
+    while ( 1 )
+    {
+        int packet_bytes;
+        uint64_t packet_sequence;
+        uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+        if ( !packet )
+            break;
+        client_num_packets_received++;
+        netcode_client_free_packet( client, packet );
+    }
+
+    check( client_num_packets_received == 10 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_egress_limit()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client[2];
+    client[0] = netcode_client_create( "[::]:50000", &client_config, time );
+    client[1] = netcode_client_create( "[::]:50001", &client_config, time );
+
+    check( client[0] );
+    check( client[1] );
+
+    // 10000 bytes per second across the whole server refills 1000 bytes per update
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    server_config.egress_limit = 10000.0;
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 2 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    int i;
+    for ( i = 0; i < 2; ++i )
+    {
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client[i], connect_token );
+    }
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client[0], time );
+        netcode_client_update( client[1], time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client[0] ) <= NETCODE_CLIENT_STATE_DISCONNECTED || netcode_client_state( client[1] ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client[0] ) == NETCODE_CLIENT_STATE_CONNECTED && netcode_client_state( client[1] ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client[0] ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_state( client[1] ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_num_connected_clients( server ) == 2 );
+
+    // queue ten packets for each client. the budget covers two packets per update, shared between the clients
+
+    uint8_t packet_data[500];
+    memset( packet_data, 0, sizeof( packet_data ) );
+
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_server_send_packet( server, 0, packet_data, sizeof( packet_data ) );
+        netcode_server_send_packet( server, 1, packet_data, sizeof( packet_data ) );
+    }
+
+    int client_num_packets_received[2] = { 0, 0 };
+
+    for ( i = 0; i < 20; ++i )
+    {
+        time += delta_time;
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client[0], time );
+        netcode_client_update( client[1], time );
+
+        netcode_server_update( server, time );
+
+        int num_packets_received = 0;
+
+        int j;
+        for ( j = 0; j < 2; ++j )
+        {
+            while ( 1 )
+            {
+                int packet_bytes;
+                uint64_t packet_sequence;
+                uint8_t * packet = netcode_client_receive_packet( client[j], &packet_bytes, &packet_sequence );
+                if ( !packet )
+                    break;
+                num_packets_received++;
+                client_num_packets_received[j]++;
+                netcode_client_free_packet( client[j], packet );
+            }
+        }
+
+        check( num_packets_received <= 2 );
+
+        // neither client gets ahead of the other by more than a packet
+
+        check( abs( client_num_packets_received[0] - client_num_packets_received[1] ) <= 1 );
+    }
+
+    check( client_num_packets_received[0] == 10 );
+    check( client_num_packets_received[1] == 10 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client[0] );
+    netcode_client_destroy( client[1] );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_send_connection_request( struct netcode_network_simulator_t * network_simulator, 
+                                   struct netcode_address_t * from, 
+                                   struct netcode_address_t * to, 
+                                   struct netcode_connect_token_t * connect_token )
+{
+    struct netcode_connection_request_packet_t packet;
+    packet.packet_type = NETCODE_CONNECTION_REQUEST_PACKET;
+    memcpy( packet.version_info, connect_token->version_info, NETCODE_VERSION_INFO_BYTES );
+    packet.protocol_id = connect_token->protocol_id;
+    packet.connect_token_expire_timestamp = connect_token->expire_timestamp;
+    memcpy( packet.connect_token_nonce, connect_token->nonce, NETCODE_CONNECT_TOKEN_NONCE_BYTES );
+    memcpy( packet.connect_token_data, connect_token->private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
+
+    int packet_bytes = netcode_write_packet( &packet, packet_data, NETCODE_MAX_PACKET_BYTES, 0, connect_token->client_to_server_key, NETCODE_VERSION_INFO, connect_token->protocol_id );
+
+    check( packet_bytes > 0 );
+
+    netcode_network_simulator_send_packet( network_simulator, from, to, packet_data, packet_bytes );
+}
+
+int test_count_received_packets( struct netcode_network_simulator_t * network_simulator, struct netcode_address_t * to )
+{
+    uint8_t * packet_data[NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS];
+    int packet_bytes[NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS];
+    struct netcode_address_t from[NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS];
+
+    int num_packets = netcode_network_simulator_receive_packets( network_simulator, to, NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS, packet_data, packet_bytes, from );
+
+    int i;
+    for ( i = 0; i < num_packets; ++i )
+    {
+        network_simulator->free_function( network_simulator->allocator_context, packet_data[i] );
+    }
+
+    return num_packets;
+}
+
+void test_server_challenge_rate_limit()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    server_config.max_challenges_per_address_per_second = 3;
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
+
+    struct netcode_address_t server_address;
+    struct netcode_address_t client_address[2];
+    check( netcode_parse_address( server_address_string, &server_address ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50000", &client_address[0] ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50001", &client_address[1] ) == NETCODE_OK );
+
+    struct netcode_connect_token_t connect_token[2];
+
+    int i;
+    for ( i = 0; i < 2; ++i )
+    {
+        uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token_data ) );
+
+        check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token[i] ) );
+    }
+
+    // ten requests from one address in the same second get three challenges back
+
+    for ( i = 0; i < 10; ++i )
+    {
+        test_send_connection_request( network_simulator, &client_address[0], &server_address, &connect_token[0] );
+    }
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    check( test_count_received_packets( network_simulator, &client_address[0] ) == 3 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_CHALLENGES_RATE_LIMITED] == 7 );
+
+    // the next second the address gets another three
+
+    time += 1.0;
+
+    for ( i = 0; i < 10; ++i )
+    {
+        test_send_connection_request( network_simulator, &client_address[0], &server_address, &connect_token[0] );
+    }
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    check( test_count_received_packets( network_simulator, &client_address[0] ) == 3 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_CHALLENGES_RATE_LIMITED] == 14 );
+
+    // the overall limit is shared between addresses
+
+    server_config.max_challenges_per_address_per_second = 0;
+    server_config.max_challenges_per_second = 4;
+
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
+
+    time += 1.0;
+
+    for ( i = 0; i < 5; ++i )
+    {
+        test_send_connection_request( network_simulator, &client_address[0], &server_address, &connect_token[0] );
+        test_send_connection_request( network_simulator, &client_address[1], &server_address, &connect_token[1] );
+    }
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    int num_challenges = test_count_received_packets( network_simulator, &client_address[0] ) + test_count_received_packets( network_simulator, &client_address[1] );
+
+    check( num_challenges == 4 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_CHALLENGES_RATE_LIMITED] == 20 );
+
+    server_config.max_challenges_per_second = -1;
+
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_ERROR );
+
+    netcode_server_destroy( server );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_max_pending_connections()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    server_config.max_pending_connections = 2;
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 4 );
+
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
+
+    struct netcode_address_t server_address;
+    check( netcode_parse_address( server_address_string, &server_address ) == NETCODE_OK );
+
+    struct netcode_address_t client_address[3];
+    check( netcode_parse_address( "[::1]:50000", &client_address[0] ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50001", &client_address[1] ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50002", &client_address[2] ) == NETCODE_OK );
+
+    // three addresses start a handshake one after the other and never finish it
+
+    int i;
+    for ( i = 0; i < 3; ++i )
+    {
+        uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token_data ) );
+
+        struct netcode_connect_token_t connect_token;
+        check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token ) );
+
+        test_send_connection_request( network_simulator, &client_address[i], &server_address, &connect_token );
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_server_update( server, time );
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        check( test_count_received_packets( network_simulator, &client_address[i] ) == 1 );
+
+        time += delta_time;
+    }
+
+    // the third handshake evicted the first, which was heard from least recently
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_PENDING_CONNECTIONS_EVICTED] == 1 );
+    check( netcode_encryption_manager_num_pending( &server->encryption_manager, time ) == 2 );
+    check( netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, &client_address[0], time ) == -1 );
+    check( netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, &client_address[1], time ) != -1 );
+    check( netcode_encryption_manager_find_encryption_mapping( &server->encryption_manager, &client_address[2], time ) != -1 );
+
+    server_config.max_pending_connections = NETCODE_MAX_ENCRYPTION_MAPPINGS + 1;
+
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_ERROR );
+
+    netcode_server_destroy( server );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_alternate_version_info()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // start a server that also accepts an older version info during a migration window
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.alternate_version_info = "NETCODE 1.00";
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    // make the client look like an older build by switching its connect token over to the alternate version info
+
+    uint8_t * alternate_version_info = (uint8_t*) "NETCODE 1.00";
+
+    check( netcode_decrypt_connect_token_private( client->connect_token.private_data, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  NETCODE_VERSION_INFO, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  client->connect_token.expire_timestamp, 
+                                                  client->connect_token.nonce, 
+                                                  private_key ) == NETCODE_OK );
+
+    check( netcode_encrypt_connect_token_private( client->connect_token.private_data, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  alternate_version_info, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  client->connect_token.expire_timestamp, 
+                                                  client->connect_token.nonce, 
+                                                  private_key ) == NETCODE_OK );
+
+    memcpy( client->connect_token.version_info, alternate_version_info, NETCODE_VERSION_INFO_BYTES );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_encryption_manager_get_version_index( &server->encryption_manager, server->client_encryption_index[0] ) == 1 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH] == 0 );
+
+    // packets in both directions must be written and read with the version info the client connected with
+
+    int server_num_packets_received = 0;
+    int client_num_packets_received = 0;
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
+        packet_data[i] = (uint8_t) i;
+
+    for ( i = 0; i < 100; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            check( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            check( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            check( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            check( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            server_num_packets_received++;
+            netcode_server_free_packet( server, packet );
+        }
+
+        if ( client_num_packets_received >= 10 && server_num_packets_received >= 10 )
+            break;
+
+        time += delta_time;
+    }
+
+    check( client_num_packets_received >= 10 && server_num_packets_received >= 10 );
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+
+    netcode_server_destroy( server );
+
+    // a server without the alternate version info configured must not let the older client in
+
+    server_config.alternate_version_info = NULL;
+
+    server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    netcode_client_disconnect( client );
+
+    netcode_client_connect( client, connect_token );
+
+    check( netcode_decrypt_connect_token_private( client->connect_token.private_data, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  NETCODE_VERSION_INFO, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  client->connect_token.expire_timestamp, 
+                                                  client->connect_token.nonce, 
+                                                  private_key ) == NETCODE_OK );
+
+    check( netcode_encrypt_connect_token_private( client->connect_token.private_data, 
+                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                  alternate_version_info, 
+                                                  TEST_PROTOCOL_ID, 
+                                                  client->connect_token.expire_timestamp, 
+                                                  client->connect_token.nonce, 
+                                                  private_key ) == NETCODE_OK );
+
+    memcpy( client->connect_token.version_info, alternate_version_info, NETCODE_VERSION_INFO_BYTES );
+
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_SENDING_CONNECTION_REQUEST );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH] > 0 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void * test_receive_packet_1_01( struct netcode_network_simulator_t * network_simulator, 
+                                 struct netcode_address_t * client_address, 
+                                 uint8_t * read_packet_key, 
+                                 int packet_type )
+{
+    // play the part of a 1.01 client: read packets sent to it with the 1.01 version info and keep the first of the given type
+
+    uint8_t * packet_data[NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS];
+    int packet_bytes[NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS];
+    struct netcode_address_t from[NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS];
+
+    int num_packets = netcode_network_simulator_receive_packets( network_simulator, client_address, NETCODE_NETWORK_SIMULATOR_NUM_PENDING_RECEIVE_PACKETS, packet_data, packet_bytes, from );
+
+    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packets, 0, sizeof( allowed_packets ) );
+    allowed_packets[packet_type] = 1;
+
+    void * result = NULL;
+
+    int i;
+    for ( i = 0; i < num_packets; ++i )
+    {
+        if ( !result )
+        {
+            uint64_t sequence;
+            result = netcode_read_packet( packet_data[i], packet_bytes[i], &sequence, read_packet_key, NETCODE_VERSION_INFO_1_01, TEST_PROTOCOL_ID, netcode_timestamp(), NULL, allowed_packets, NULL, NULL, NULL );
+        }
+
+        network_simulator->free_function( network_simulator->allocator_context, packet_data[i] );
+    }
+
+    return result;
+}
+
+void test_server_accept_version_1_01()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // a server accepting both specs takes a 1.01 client through the handshake and keeps talking to it in 1.01
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.accept_version_1_01 = 1;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    struct netcode_address_t server_address;
+    struct netcode_address_t client_address;
+    check( netcode_parse_address( "[::1]:40000", &server_address ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50000", &client_address ) == NETCODE_OK );
+
+    // build the connection request a 1.01 client sends, with a connect token from a 1.01 backend
+
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+
+    struct netcode_connect_token_private_t connect_token_private;
+    netcode_generate_connect_token_private( &connect_token_private, TEST_CLIENT_ID, TEST_TIMEOUT_SECONDS, 1, &server_address, user_data );
+
+    struct netcode_connection_request_packet_t request_packet;
+    memset( &request_packet, 0, sizeof( request_packet ) );
+    request_packet.packet_type = NETCODE_CONNECTION_REQUEST_PACKET;
+    memcpy( request_packet.version_info, NETCODE_VERSION_INFO_1_01, NETCODE_VERSION_INFO_BYTES );
+    request_packet.protocol_id = TEST_PROTOCOL_ID;
+    request_packet.connect_token_expire_timestamp = netcode_timestamp() + TEST_CONNECT_TOKEN_EXPIRY;
+    request_packet.connect_token_sequence = 1000;
+    netcode_write_connect_token_private( &connect_token_private, request_packet.connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    check( netcode_encrypt_connect_token_private_1_01( request_packet.connect_token_data, 
+                                                       NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
+                                                       NETCODE_VERSION_INFO_1_01, 
+                                                       TEST_PROTOCOL_ID, 
+                                                       request_packet.connect_token_expire_timestamp, 
+                                                       request_packet.connect_token_sequence, 
+                                                       private_key ) == NETCODE_OK );
+
+    uint64_t client_sequence = 0;
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
+
+    int packet_bytes = netcode_write_packet( &request_packet, packet_data, NETCODE_MAX_PACKET_BYTES, client_sequence++, connect_token_private.client_to_server_key, NETCODE_VERSION_INFO_1_01, TEST_PROTOCOL_ID );
+
+    check( packet_bytes == 1 + NETCODE_VERSION_INFO_BYTES + 8 + 8 + 8 + NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+
+    netcode_network_simulator_send_packet( network_simulator, &client_address, &server_address, packet_data, packet_bytes );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    // the challenge comes back encrypted with 1.01 in the additional data
+
+    struct netcode_connection_challenge_packet_t * challenge_packet = (struct netcode_connection_challenge_packet_t*) 
+        test_receive_packet_1_01( network_simulator, &client_address, connect_token_private.server_to_client_key, NETCODE_CONNECTION_CHALLENGE_PACKET );
+
+    check( challenge_packet );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH] == 0 );
+
+    struct netcode_connection_response_packet_t response_packet;
+    response_packet.packet_type = NETCODE_CONNECTION_RESPONSE_PACKET;
+    response_packet.challenge_token_sequence = challenge_packet->challenge_token_sequence;
+    memcpy( response_packet.challenge_token_data, challenge_packet->challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+
+    free( challenge_packet );
+
+    packet_bytes = netcode_write_packet( &response_packet, packet_data, NETCODE_MAX_PACKET_BYTES, client_sequence++, connect_token_private.client_to_server_key, NETCODE_VERSION_INFO_1_01, TEST_PROTOCOL_ID );
+
+    check( packet_bytes > 0 );
+
+    netcode_network_simulator_send_packet( network_simulator, &client_address, &server_address, packet_data, packet_bytes );
+
+    time += delta_time;
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    // the client is tagged with 1.01 and keep alives to it are written with 1.01
+
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_client_id( server, 0 ) == TEST_CLIENT_ID );
+    check( strcmp( netcode_server_client_version_info( server, 0 ), "NETCODE 1.01" ) == 0 );
+
+    struct netcode_connection_keep_alive_packet_t * keep_alive_packet = (struct netcode_connection_keep_alive_packet_t*) 
+        test_receive_packet_1_01( network_simulator, &client_address, connect_token_private.server_to_client_key, NETCODE_CONNECTION_KEEP_ALIVE_PACKET );
+
+    check( keep_alive_packet );
+    check( keep_alive_packet->client_index == 0 );
+    check( keep_alive_packet->max_clients == 1 );
+
+    free( keep_alive_packet );
+
+    netcode_server_destroy( server );
+
+    // without accept_version_1_01 the same request is a version mismatch
+
+    server_config.accept_version_1_01 = 0;
+
+    server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    packet_bytes = netcode_write_packet( &request_packet, packet_data, NETCODE_MAX_PACKET_BYTES, client_sequence++, connect_token_private.client_to_server_key, NETCODE_VERSION_INFO_1_01, TEST_PROTOCOL_ID );
+
+    netcode_server_process_packet( server, &client_address, packet_data, packet_bytes );
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH] == 1 );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+
+    netcode_server_destroy( server );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_ipv4_socket_connect()
+{
+    {
+        double time = 0.0;
+        double delta_time = 1.0 / 10.0;
+
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create( "0.0.0.0:50000", &client_config, time );
+
+        check( client );
+
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+        server_config.protocol_id = TEST_PROTOCOL_ID;
+        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+        struct netcode_server_t * server = netcode_server_create( "127.0.0.1:40000", &server_config, time );
+
+        check( server );
+
+        netcode_server_start( server, 1 );
+
+        NETCODE_CONST char * server_address = "127.0.0.1:40000";
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client, connect_token );
+
+        while ( 1 )
+        {
+            netcode_client_update( client, time );
+
+            netcode_server_update( server, time );
+
+            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                break;
+
+            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+                break;
+
+            time += delta_time;
+        }
+
+        netcode_server_destroy( server );
+
+        netcode_client_destroy( client );
+    }
+
+    {
+        double time = 0.0;
+        double delta_time = 1.0 / 10.0;
+
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create( "0.0.0.0:50000", &client_config, time );
+
+        check( client );
+
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+        server_config.protocol_id = TEST_PROTOCOL_ID;
+        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:40000", &server_config, time );
+
+        check( server );
+
+        netcode_server_start( server, 1 );
+
+        NETCODE_CONST char * server_address = "127.0.0.1:40000";
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client, connect_token );
+
+        while ( 1 )
+        {
+            netcode_client_update( client, time );
+
+            netcode_server_update( server, time );
+
+            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                break;
+
+            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+                break;
+
+            time += delta_time;
+        }
+
+        netcode_server_destroy( server );
+
+        netcode_client_destroy( client );
+    }
+
+    {
+        double time = 0.0;
+        double delta_time = 1.0 / 10.0;
+
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create_overload( "0.0.0.0:50000", "[::]:50000", &client_config, time );
+
+        check( client );
+
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+        server_config.protocol_id = TEST_PROTOCOL_ID;
+        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+        struct netcode_server_t * server = netcode_server_create( "127.0.0.1:40000", &server_config, time );
+
+        check( server );
+
+        netcode_server_start( server, 1 );
+
+        NETCODE_CONST char * server_address = "127.0.0.1:40000";
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client, connect_token );
+
+        while ( 1 )
+        {
+            netcode_client_update( client, time );
+
+            netcode_server_update( server, time );
+
+            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                break;
+
+            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+                break;
+
+            time += delta_time;
+        }
+
+        netcode_server_destroy( server );
+
+        netcode_client_destroy( client );
+    }
+
+    {
+        double time = 0.0;
+        double delta_time = 1.0 / 10.0;
+
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create_overload( "0.0.0.0:50000", "[::]:50000", &client_config, time );
+
+        check( client );
+
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+        server_config.protocol_id = TEST_PROTOCOL_ID;
+        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:40000", &server_config, time );
+
+        check( server );
+
+        netcode_server_start( server, 1 );
+
+        NETCODE_CONST char * server_address = "127.0.0.1:40000";
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client, connect_token );
+
+        while ( 1 )
+        {
+            netcode_client_update( client, time );
+
+            netcode_server_update( server, time );
+
+            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                break;
+
+            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+                break;
+
+            time += delta_time;
+        }
+
+        netcode_server_destroy( server );
+
+        netcode_client_destroy( client );
+    }
+}
+
+void test_client_server_ipv6_socket_connect()
+{
+    {
+        double time = 0.0;
+        double delta_time = 1.0 / 10.0;
+
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+        check( client );
+
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+        server_config.protocol_id = TEST_PROTOCOL_ID;
+        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+        struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+        check( server );
+
+        netcode_server_start( server, 1 );
+
+        NETCODE_CONST char * server_address = "[::1]:40000";
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client, connect_token );
+
+        while ( 1 )
+        {
+            netcode_client_update( client, time );
+
+            netcode_server_update( server, time );
+
+            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                break;
+
+            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+                break;
+
+            time += delta_time;
+        }
+
+        netcode_server_destroy( server );
+
+        netcode_client_destroy( client );
+    }
+    
+    {
+        double time = 0.0;
+        double delta_time = 1.0 / 10.0;
+
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+        check( client );
+
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+        server_config.protocol_id = TEST_PROTOCOL_ID;
+        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:40000", &server_config, time );
+
+        check( server );
+
+        netcode_server_start( server, 1 );
+
+        NETCODE_CONST char * server_address = "[::1]:40000";
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client, connect_token );
+
+        while ( 1 )
+        {
+            netcode_client_update( client, time );
+
+            netcode_server_update( server, time );
+
+            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                break;
+
+            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+                break;
+
+            time += delta_time;
+        }
+
+        netcode_server_destroy( server );
+
+        netcode_client_destroy( client );
+    }
+    
+    {
+        double time = 0.0;
+        double delta_time = 1.0 / 10.0;
+
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create_overload( "0.0.0.0:50000", "[::]:50000", &client_config, time );
+
+        check( client );
+
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+        server_config.protocol_id = TEST_PROTOCOL_ID;
+        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+        struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+        check( server );
+
+        netcode_server_start( server, 1 );
+
+        NETCODE_CONST char * server_address = "[::1]:40000";
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client, connect_token );
+
+        while ( 1 )
+        {
+            netcode_client_update( client, time );
+
+            netcode_server_update( server, time );
+
+            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                break;
+
+            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+                break;
+
+            time += delta_time;
+        }
+
+        netcode_server_destroy( server );
+
+        netcode_client_destroy( client );
+    }
+    
+    {
+        double time = 0.0;
+        double delta_time = 1.0 / 10.0;
+
+        struct netcode_client_config_t client_config;
+        netcode_default_client_config( &client_config );
+
+        struct netcode_client_t * client = netcode_client_create_overload( "0.0.0.0:50000", "[::]:50000", &client_config, time );
+
+        check( client );
+
+        struct netcode_server_config_t server_config;
+        netcode_default_server_config( &server_config );
+        server_config.protocol_id = TEST_PROTOCOL_ID;
+        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:40000", &server_config, time );
+
+        check( server );
+
+        netcode_server_start( server, 1 );
+
+        NETCODE_CONST char * server_address = "[::1]:40000";
+
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+        uint64_t client_id = 0;
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+        netcode_client_connect( client, connect_token );
+
+        while ( 1 )
+        {
+            netcode_client_update( client, time );
+
+            netcode_server_update( server, time );
+
+            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                break;
+
+            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+                break;
+
+            time += delta_time;
+        }
+
+        netcode_server_destroy( server );
+
+        netcode_client_destroy( client );
+    }
+}
+
+void test_client_server_keep_alive()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    // connect client to server
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // pump the client and server long enough that they would timeout without keep alive packets
+
+    int num_iterations = (int) ceil( 1.25f * TEST_TIMEOUT_SECONDS / delta_time );
+
+    int i;
+    for ( i = 0; i < num_iterations; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_time_sync()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // the server clock runs 100 seconds ahead of the client clock
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+    double server_time_offset = 100.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+    client_config.time_sync = 1;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time + server_time_offset );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time + server_time_offset );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+
+    // a server without time sync drops the client's time sync packets, so the client stays on its own clock
+
+    int i;
+    for ( i = 0; i < 30; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time + server_time_offset );
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_server_time( client ) == client->time );
+
+    // once the server answers, the client converges on the server clock
+
+    server_config.time_sync = 1;
+
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
+
+    for ( i = 0; i < 30; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time + server_time_offset );
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( fabs( netcode_client_server_time( client ) - ( client->time + server_time_offset ) ) < delta_time );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_packet_send_rate()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // start a server and connect one client
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+    client_config.packet_send_rate = 20.0;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    check( server->client_packet_send_rate[0] == NETCODE_PACKET_SEND_RATE );
+
+    // drop the server send rate for this client to one packet per second and verify both sides send at their own rate
+
+    netcode_server_set_client_packet_send_rate( server, 0, 1.0 );
+
+    int num_server_sends = 0;
+    int num_client_sends = 0;
+
+    int i;
+    for ( i = 0; i < 100; ++i )
+    {
+        time += 0.01;
+
+        double client_last_send_time = client->last_packet_send_time;
+        double server_last_send_time = server->client_last_packet_send_time[0];
+
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( client->last_packet_send_time != client_last_send_time )
+            num_client_sends++;
+
+        if ( server->client_last_packet_send_time[0] != server_last_send_time )
+            num_server_sends++;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( num_server_sends >= 1 );
+    check( num_server_sends <= 2 );
+    check( num_client_sends >= 10 );
+
+    // the per-client rate resets to the configured rate when the slot is freed
+
+    netcode_server_disconnect_client( server, 0 );
+
+    check( server->client_packet_send_rate[0] == NETCODE_PACKET_SEND_RATE );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_multiple_clients()
+{
+    #define NUM_START_STOP_ITERATIONS 3
+
+    int max_clients[NUM_START_STOP_ITERATIONS] = { 2, 32, 5 };
+
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    int i;
+    for ( i = 0; i < NUM_START_STOP_ITERATIONS; ++i )
+    {
+        // start the server with max # of clients for this iteration
+
+        netcode_server_start( server, max_clients[i] );
+
+        // create # of client objects for this iteration and connect to server
+
+        struct netcode_client_t ** client = (struct netcode_client_t **) malloc( sizeof( struct netcode_client_t* ) * max_clients[i] );
+
+        check( client );
+
+        int j;
+        for ( j = 0; j < max_clients[i]; ++j )
+        {
+            char client_address[NETCODE_MAX_ADDRESS_STRING_LENGTH];
+            sprintf( client_address, "[::]:%d", 50000 + j );
+
+            struct netcode_client_config_t client_config;
+            netcode_default_client_config( &client_config );
+            client_config.network_simulator = network_simulator;
+
+            client[j] = netcode_client_create( client_address, &client_config, time );
+
+            check( client[j] );
+
+            uint64_t client_id = j;
+            netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+            NETCODE_CONST char * server_address = "[::1]:40000";
+
+            uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+            check( netcode_generate_connect_token( 1, 
+                                                   &server_address, 
+                                                   &server_address, 
+                                                   TEST_CONNECT_TOKEN_EXPIRY, 
+                                                   TEST_TIMEOUT_SECONDS,
+                                                   client_id, 
+                                                   TEST_PROTOCOL_ID, 
+                                                   private_key, 
+                                                   NULL, 
+                                                   connect_token ) );
+
+            netcode_client_connect( client[j], connect_token );
+        }
+
+        // make sure all clients can connect
+
+        while ( 1 )
+        {
+            netcode_network_simulator_update( network_simulator, time );
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                netcode_client_update( client[j], time );
+            }
+
+            netcode_server_update( server, time );
+
+            int num_connected_clients = 0;
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                if ( netcode_client_state( client[j] ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                    break;
+
+                if ( netcode_client_state( client[j] ) == NETCODE_CLIENT_STATE_CONNECTED )
+                    num_connected_clients++;
+            }
+
+            if ( num_connected_clients == max_clients[i] )
+                break;
+
+            time += delta_time;
+        }
+
+        check( netcode_server_num_connected_clients( server ) == max_clients[i] );
+
+        for ( j = 0; j < max_clients[i]; ++j )
+        {
+            check( netcode_client_state( client[j] ) == NETCODE_CLIENT_STATE_CONNECTED );
+            check( netcode_server_client_connected( server, j ) == 1 );
+        }
+
+        // make sure all clients can exchange packets with the server
+
+        int * server_num_packets_received = (int*) malloc( sizeof(int) * max_clients[i] );
+        int * client_num_packets_received = (int*) malloc( sizeof(int) * max_clients[i] );
+
+        memset( server_num_packets_received, 0, sizeof(int) * max_clients[i] );
+        memset( client_num_packets_received, 0, sizeof(int) * max_clients[i] );
+
+        uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+        for ( j = 0; j < NETCODE_MAX_PACKET_SIZE; ++j )
+            packet_data[j] = (uint8_t) j;
+
+        while ( 1 )
+        {
+            netcode_network_simulator_update( network_simulator, time );
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                netcode_client_update( client[j], time );
+            }
+
+            netcode_server_update( server, time );
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                netcode_client_send_packet( client[j], packet_data, NETCODE_MAX_PACKET_SIZE );
+            }
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                netcode_server_send_packet( server, j, packet_data, NETCODE_MAX_PACKET_SIZE );
+            }
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                while ( 1 )
+                {
+                    int packet_bytes;
+                    uint64_t packet_sequence;
+                    uint8_t * packet = netcode_client_receive_packet( client[j], &packet_bytes, &packet_sequence );
+                    if ( !packet )
+                        break;
+                    (void) packet_sequence;
+                    netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+                    netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+                    client_num_packets_received[j]++;
+                    netcode_client_free_packet( client[j], packet );
+                }
+            }
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                while ( 1 )
+                {
+                    int packet_bytes;
+                    uint64_t packet_sequence;
+                    void * packet = netcode_server_receive_packet( server, j, &packet_bytes, &packet_sequence );
+                    if ( !packet )
+                        break;
+                    (void) packet_sequence;
+                    netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+                    netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+                    server_num_packets_received[j]++;
+                    netcode_server_free_packet( server, packet );
+                }
+            }
+
+            int num_clients_ready = 0;
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                if ( client_num_packets_received[j] >= 1 && server_num_packets_received[j] >= 1 )
+                {
+                    num_clients_ready++;
+                }
+            }
+
+            if ( num_clients_ready == max_clients[i] )
+                break;
+
+            for ( j = 0; j < max_clients[i]; ++j )
+            {
+                if ( netcode_client_state( client[j] ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+                    break;
+            }
+
+            time += delta_time;
+        }
+
+        int num_clients_ready = 0;
+
+        for ( j = 0; j < max_clients[i]; ++j )
+        {
+            if ( client_num_packets_received[j] >= 1 && server_num_packets_received[j] >= 1 )
+            {
+                num_clients_ready++;
+            }
+        }
+
+        check( num_clients_ready == max_clients[i] );
+
+        free( server_num_packets_received );
+        free( client_num_packets_received );
+        
+        netcode_network_simulator_reset( network_simulator );
+
+        for ( j = 0; j < max_clients[i]; ++j )
+        {
+            netcode_client_destroy( client[j] );
+        }
+
+        free( client );
+
+        netcode_server_stop( server );
+    }
+
+    netcode_server_destroy( server );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_multiple_servers()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address[] = { "10.10.10.10:1000", "100.100.100.100:50000", "[::1]:40000" };
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 3, server_address, server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    int server_num_packets_received = 0;
+    int client_num_packets_received = 0;
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
+        packet_data[i] = (uint8_t) i;
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            (void) packet_sequence;
+            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            server_num_packets_received++;
+            netcode_server_free_packet( server, packet );
+        }
+
+        if ( client_num_packets_received >= 10 && server_num_packets_received >= 10 )
+        {
+            if ( netcode_server_client_connected( server, 0 ) )
+            {
+                netcode_server_disconnect_client( server, 0 );
+            }
+        }
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( client_num_packets_received >= 10 && server_num_packets_received >= 10 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_error_connect_token_expired()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, 0, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    netcode_client_update( client, time );
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECT_TOKEN_EXPIRED );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_error_invalid_connect_token()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    netcode_random_bytes( connect_token, NETCODE_CONNECT_TOKEN_BYTES );
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    netcode_client_connect( client, connect_token );
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_INVALID_CONNECT_TOKEN );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_error_connection_timed_out()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    // connect a client to the server
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // now disable updating the server and verify that the client times out
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_TIMED_OUT );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_error_connection_response_timeout()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    server->flags = NETCODE_SERVER_FLAG_IGNORE_CONNECTION_RESPONSE_PACKETS;
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED  )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_RESPONSE_TIMED_OUT );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_error_connection_request_timeout()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    double time = 0.0;
+    double delta_time = 1.0 / 60.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    server->flags = NETCODE_SERVER_FLAG_IGNORE_CONNECTION_REQUEST_PACKETS;
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED  )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_REQUEST_TIMED_OUT );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_connect_retry_schedule()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 60.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+    client_config.connection_request_send_rate = 2.0;
+    client_config.connect_timeout = 2.0;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    // invalid retry schedules are rejected
+
+    client_config.connection_response_send_rate = 0.0;
+    check( netcode_client_create( "[::]:50001", &client_config, time ) == NULL );
+    client_config.connection_response_send_rate = NETCODE_PACKET_SEND_RATE;
+
+    client_config.connect_timeout = -1.0;
+    check( netcode_client_create( "[::]:50001", &client_config, time ) == NULL );
+    client_config.connect_timeout = 2.0;
+
+    // nobody is listening, so the client resends connection requests at its configured rate
+    // and gives up after its connect timeout, well before the connect token timeout
+
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
+
+    struct netcode_address_t server_address;
+    check( netcode_parse_address( server_address_string, &server_address ) == NETCODE_OK );
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    int num_requests = 0;
+
+    while ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_SENDING_CONNECTION_REQUEST )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        num_requests += test_count_received_packets( network_simulator, &server_address );
+
+        time += delta_time;
+
+        check( time < TEST_TIMEOUT_SECONDS );
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_REQUEST_TIMED_OUT );
+    check( time >= 2.0 && time < 3.0 );
+    check( num_requests >= 4 && num_requests <= 6 );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_error_connection_denied()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    network_simulator->latency_milliseconds = 250;
+    network_simulator->jitter_milliseconds = 250;
+    network_simulator->packet_loss_percent = 5;
+    network_simulator->duplicate_packet_percent = 10;
+
+    // start a server and connect one client
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // now attempt to connect a second client. the connection should be denied.
+
+    struct netcode_client_t * client2 = netcode_client_create( "[::]:50001", &client_config, time );
+
+    check( client2 );
+
+    uint8_t connect_token2[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id2 = 0;
+    netcode_random_bytes( (uint8_t*) &client_id2, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id2, TEST_PROTOCOL_ID, private_key, NULL, connect_token2 ) );
+
+    netcode_client_connect( client2, connect_token2 );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_client_update( client2, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client2 ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_state( client2 ) == NETCODE_CLIENT_STATE_CONNECTION_DENIED );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+    
+    netcode_client_destroy( client2 );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_side_disconnect()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // start a server and connect one client
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // disconnect client side and verify that the server sees that client disconnect cleanly, rather than timing out.
+
+    netcode_client_disconnect( client );
+
+    int i;
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_server_client_connected( server, 0 ) == 0 )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_server_client_connected( server, 0 ) == 0 );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_side_disconnect()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // start a server and connect one client
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // disconnect server side and verify that the client disconnects cleanly, rather than timing out.
+
+    netcode_server_disconnect_client( server, 0 );
+
+    int i;
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_DISCONNECTED );
+    check( netcode_server_client_connected( server, 0 ) == 0 );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_side_disconnect_by_id()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // start a server and connect one client
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // disconnecting an unknown client id should fail and leave the connected client alone
+
+    check( netcode_server_disconnect_client_by_id( server, client_id + 1 ) == NETCODE_ERROR );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+
+    // disconnect server side by client id and verify that the client disconnects cleanly, rather than timing out.
+
+    check( netcode_server_disconnect_client_by_id( server, client_id ) == NETCODE_OK );
+
+    int i;
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_DISCONNECTED );
+    check( netcode_server_client_connected( server, 0 ) == 0 );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+struct test_disconnect_reason_context_t
+{
+    struct netcode_server_t * server;
+    int server_disconnect_reason;
+};
+
+void test_disconnect_reason_callback( void * _context, int client_index, int connected )
+{
+    struct test_disconnect_reason_context_t * context = (struct test_disconnect_reason_context_t*) _context;
+    if ( !connected )
+    {
+        context->server_disconnect_reason = netcode_server_client_disconnect_reason( context->server, client_index );
+    }
+}
+
+int test_update_until_client_state( struct netcode_network_simulator_t * network_simulator, 
+                                    struct netcode_client_t * client, 
+                                    struct netcode_server_t * server, 
+                                    double * time, 
+                                    int client_state, 
+                                    int num_iterations )
+{
+    int i;
+    for ( i = 0; i < num_iterations; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, *time );
+
+        netcode_client_update( client, *time );
+
+        netcode_server_update( server, *time );
+
+        if ( netcode_client_state( client ) == client_state )
+            return 1;
+
+        *time += 0.1;
+    }
+
+    return 0;
+}
+
+void test_disconnect_reason()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct test_disconnect_reason_context_t context;
+    memset( &context, 0, sizeof( context ) );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &context;
+    server_config.connect_disconnect_callback = test_disconnect_reason_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    context.server = server;
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    // kicked by the server
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_NONE );
+    check( netcode_server_client_disconnect_reason( server, 0 ) == NETCODE_DISCONNECT_REASON_NONE );
+
+    netcode_server_disconnect_client( server, 0 );
+    check( context.server_disconnect_reason == NETCODE_DISCONNECT_REASON_KICKED );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 10 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_SERVER_DISCONNECTED );
+
+    // disconnected by the client
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_NONE );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+    check( netcode_server_client_disconnect_reason( server, 0 ) == NETCODE_DISCONNECT_REASON_NONE );
+
+    netcode_client_disconnect( client );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_CLIENT_DISCONNECTED );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 10 ) );
+    netcode_server_update( server, time );
+    check( netcode_server_client_connected( server, 0 ) == 0 );
+    check( context.server_disconnect_reason == NETCODE_DISCONNECT_REASON_CLIENT_DISCONNECTED );
+
+    // server shutdown
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+
+    netcode_server_stop( server );
+    check( context.server_disconnect_reason == NETCODE_DISCONNECT_REASON_SERVER_SHUTDOWN );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 10 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_SERVER_DISCONNECTED );
+
+    // timed out on both sides
+
+    netcode_server_start( server, 1 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+
+    int i;
+    for ( i = 0; i < ( TEST_TIMEOUT_SECONDS + 1 ) * 10; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+        netcode_server_update( server, time );
+        time += 0.1;
+    }
+
+    check( netcode_server_client_connected( server, 0 ) == 0 );
+    check( context.server_disconnect_reason == NETCODE_DISCONNECT_REASON_TIMED_OUT );
+
+    netcode_client_update( client, time );
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_TIMED_OUT );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_TIMED_OUT );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_disconnect_reason_extension()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.send_disconnect_reason = 1;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    // the client learns that it was kicked, rather than just that the server disconnected it
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+
+    netcode_server_disconnect_client( server, 0 );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 10 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_KICKED );
+
+    // and that the server is shutting down
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+
+    netcode_server_stop( server );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 10 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_SERVER_SHUTDOWN );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_kick_client()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.send_disconnect_reason = 1;
+    server_config.send_pacing_rate = 1.0;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+
+    // queue up more packets than the pacing rate lets out before the disconnect, then kick the client
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    memset( packet_data, 0, sizeof( packet_data ) );
+
+    int i;
+    for ( i = 0; i < 3; ++i )
+    {
+        netcode_server_send_packet( server, 0, packet_data, 100 );
+    }
+
+    int kick_reason = NETCODE_DISCONNECT_REASON_USER + 1;
+
+    netcode_server_kick_client( server, 0, kick_reason );
+
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+
+    // the client receives every queued packet before it is told why it was disconnected
+
+    int num_packets_received = 0;
+
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( num_packets_received == 3 );
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_DISCONNECTED );
+    check( netcode_client_disconnect_reason( client ) == kick_reason );
+    check( netcode_server_client_connected( server, 0 ) == 0 );
+    check( netcode_server_client_disconnect_reason( server, 0 ) == kick_reason );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+struct test_proxy_context_t
+{
+    struct netcode_network_simulator_t * network_simulator;
+    struct netcode_address_t client_address;
+    struct netcode_address_t proxy_public_address;
+    struct netcode_address_t proxy_backend_address;
+    int num_packets_sent;
+    int num_packets_sent_to_proxy;
+};
+
+static uint8_t test_proxy_header_signature[12] = { 0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A };
+
+int test_proxy_receive_packet( void * _context, struct netcode_address_t * from, uint8_t * packet_data, int packet_bytes )
+{
+    struct test_proxy_context_t * context = (struct test_proxy_context_t*) _context;
+
+    uint8_t * proxied_packet_data = NULL;
+    int proxied_packet_bytes = 0;
+    struct netcode_address_t client_address;
+
+    if ( netcode_network_simulator_receive_packets( context->network_simulator, &context->proxy_public_address, 1, &proxied_packet_data, &proxied_packet_bytes, &client_address ) == 0 )
+        return 0;
+
+    // prepend a PROXY v2 header carrying the real client address, as a UDP load balancer would
+
+    check( client_address.type == NETCODE_ADDRESS_IPV6 );
+    check( 52 + proxied_packet_bytes <= packet_bytes );
+
+    memset( packet_data, 0, 52 );
+    memcpy( packet_data, test_proxy_header_signature, 12 );
+    packet_data[12] = 0x21;
+    packet_data[13] = 0x22;
+    packet_data[15] = 36;
+    int i;
+    for ( i = 0; i < 8; ++i )
+    {
+        packet_data[16+i*2] = (uint8_t) ( client_address.data.ipv6[i] >> 8 );
+        packet_data[16+i*2+1] = (uint8_t) ( client_address.data.ipv6[i] & 0xFF );
+    }
+    packet_data[48] = (uint8_t) ( client_address.port >> 8 );
+    packet_data[49] = (uint8_t) ( client_address.port & 0xFF );
+    memcpy( packet_data + 52, proxied_packet_data, proxied_packet_bytes );
+
+    context->network_simulator->free_function( context->network_simulator->allocator_context, proxied_packet_data );
+
+    context->client_address = client_address;
+
+    *from = context->proxy_backend_address;
+
+    return 52 + proxied_packet_bytes;
+}
+
+void test_proxy_send_packet( void * _context, struct netcode_address_t * to, NETCODE_CONST uint8_t * packet_data, int packet_bytes )
+{
+    struct test_proxy_context_t * context = (struct test_proxy_context_t*) _context;
+
+    context->num_packets_sent++;
+
+    if ( !netcode_address_equal( to, &context->proxy_backend_address ) )
+        return;
+
+    context->num_packets_sent_to_proxy++;
+
+    netcode_network_simulator_send_packet( context->network_simulator, &context->proxy_public_address, &context->client_address, (uint8_t*) packet_data, packet_bytes );
+}
+
+void test_client_server_proxy_protocol()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // the client talks to the proxy through the network simulator. the server only sees packets relayed by the proxy.
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct test_proxy_context_t context;
+    memset( &context, 0, sizeof( context ) );
+    context.network_simulator = network_simulator;
+    check( netcode_parse_address( "[::1]:40001", &context.proxy_public_address ) );
+    check( netcode_parse_address( "[::1]:45000", &context.proxy_backend_address ) );
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.callback_context = &context;
+    server_config.override_send_and_receive = 1;
+    server_config.send_packet_override = test_proxy_send_packet;
+    server_config.receive_packet_override = test_proxy_receive_packet;
+    server_config.proxy_protocol = 1;
+    server_config.num_trusted_proxies = 1;
+    server_config.trusted_proxy_address[0] = "[::1]:45000";
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * public_server_address = "[::1]:40001";
+    NETCODE_CONST char * internal_server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &public_server_address, &internal_server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+
+    // the server identifies the client by its real address, but replies through the proxy
+
+    struct netcode_address_t client_address;
+    check( netcode_parse_address( "[::]:50000", &client_address ) );
+    check( netcode_address_equal( &server->client_address[0], &client_address ) );
+    check( context.num_packets_sent > 0 );
+    check( context.num_packets_sent_to_proxy == context.num_packets_sent );
+
+    // exchange payloads through the proxy
+
+    int server_num_packets_received = 0;
+    int client_num_packets_received = 0;
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
+        packet_data[i] = (uint8_t) i;
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            (void) packet_sequence;
+            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            (void) packet_sequence;
+            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            server_num_packets_received++;
+            netcode_server_free_packet( server, packet );
+        }
+
+        if ( client_num_packets_received >= 10 && server_num_packets_received >= 10 )
+            break;
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( client_num_packets_received >= 10 && server_num_packets_received >= 10 );
+    check( context.num_packets_sent_to_proxy == context.num_packets_sent );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_challenge_rate_limit_proxy()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+
+    struct test_proxy_context_t context;
+    memset( &context, 0, sizeof( context ) );
+    context.network_simulator = network_simulator;
+    check( netcode_parse_address( "[::1]:40001", &context.proxy_public_address ) );
+    check( netcode_parse_address( "[::1]:45000", &context.proxy_backend_address ) );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.callback_context = &context;
+    server_config.override_send_and_receive = 1;
+    server_config.send_packet_override = test_proxy_send_packet;
+    server_config.receive_packet_override = test_proxy_receive_packet;
+    server_config.proxy_protocol = 1;
+    server_config.num_trusted_proxies = 1;
+    server_config.trusted_proxy_address[0] = "[::1]:45000";
+    server_config.max_challenges_per_address_per_second = 1;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 2 );
+
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
+
+    struct netcode_address_t client_address[2];
+    check( netcode_parse_address( "[::1]:50000", &client_address[0] ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50001", &client_address[1] ) == NETCODE_OK );
+
+    // two clients behind the same proxy each get their own challenge. the per address limit goes by their real addresses, not the proxy's
+
+    int i;
+    for ( i = 0; i < 2; ++i )
+    {
+        uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
+        check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID + i, TEST_PROTOCOL_ID, private_key, NULL, connect_token_data ) );
+
+        struct netcode_connect_token_t connect_token;
+        check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token ) );
+
+        test_send_connection_request( network_simulator, &client_address[i], &context.proxy_public_address, &connect_token );
+    }
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    check( context.num_packets_sent_to_proxy == 2 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_CHALLENGES_RATE_LIMITED] == 0 );
+
+    netcode_server_destroy( server );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+int test_source_address_callback_none( void * context, struct netcode_address_t * source_address, NETCODE_CONST uint8_t * packet_data, int packet_bytes )
+{
+    (void) context;
+    (void) source_address;
+    (void) packet_data;
+    (void) packet_bytes;
+    return 0;
+}
+
+void test_server_untrusted_proxy_header()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+
+    // neither proxy protocol nor a source address callback can be turned on without saying which proxies to believe
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.proxy_protocol = 1;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+
+    server_config.proxy_protocol = 0;
+    server_config.source_address_callback = test_source_address_callback_none;
+
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+
+    server_config.proxy_protocol = 1;
+    server_config.source_address_callback = NULL;
+    server_config.num_trusted_proxies = 1;
+    server_config.trusted_proxy_address[0] = "not an address";
+
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+
+    // the proxy relays from an address that isn't on the trusted list, so its headers must not be believed
+
+    struct test_proxy_context_t context;
+    memset( &context, 0, sizeof( context ) );
+    context.network_simulator = network_simulator;
+    check( netcode_parse_address( "[::1]:40001", &context.proxy_public_address ) );
+    check( netcode_parse_address( "[::1]:45001", &context.proxy_backend_address ) );
+
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.callback_context = &context;
+    server_config.override_send_and_receive = 1;
+    server_config.send_packet_override = test_proxy_send_packet;
+    server_config.receive_packet_override = test_proxy_receive_packet;
+    server_config.proxy_protocol = 1;
+    server_config.num_trusted_proxies = 1;
+    server_config.trusted_proxy_address[0] = "[::1]:45000";
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
+
+    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
+    check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token_data ) );
+
+    struct netcode_connect_token_t connect_token;
+    check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token ) );
+
+    struct netcode_address_t client_address;
+    check( netcode_parse_address( "[::1]:50000", &client_address ) == NETCODE_OK );
+
+    test_send_connection_request( network_simulator, &client_address, &context.proxy_public_address, &connect_token );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    check( context.num_packets_sent == 0 );
+
+    // once the proxy's address is trusted, the same request gets a challenge back through it
+
+    netcode_server_destroy( server );
+
+    server_config.trusted_proxy_address[0] = "[::1]:45001";
+
+    server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    test_send_connection_request( network_simulator, &client_address, &context.proxy_public_address, &connect_token );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    check( context.num_packets_sent_to_proxy == 1 );
+
+    // the trusted proxy list can't change while the server exists. the same addresses from a different string are no change
+
+    char trusted_proxy_string[32];
+    strcpy( trusted_proxy_string, "[::1]:45001" );
+
+    struct netcode_server_config_t new_config = server_config;
+    new_config.trusted_proxy_address[0] = trusted_proxy_string;
+    check( netcode_server_update_config( server, &new_config ) == NETCODE_OK );
+
+    new_config.trusted_proxy_address[0] = "[::1]:45002";
+    check( netcode_server_update_config( server, &new_config ) == NETCODE_ERROR );
+
+    netcode_server_destroy( server );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_address_migration()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // start a server and connect one client
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.client_address_migration = 1;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // simulate a NAT rebinding by moving the client to a new port. the server should follow it without a reconnect
+
+    struct netcode_address_t old_client_address = server->client_address[0];
+
+    check( netcode_parse_address( "[::]:50001", &client->address ) );
+
+    int server_num_packets_received = 0;
+    int client_num_packets_received = 0;
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
+        packet_data[i] = (uint8_t) i;
+
+    for ( i = 0; i < 100; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            (void) packet_sequence;
+            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
+
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            (void) packet_sequence;
+            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            server_num_packets_received++;
+            netcode_server_free_packet( server, packet );
+
+            // nothing sent from the new address is delivered before the client has answered the challenge from there
+
+            check( netcode_address_equal( &server->client_address[0], &client->address ) );
+        }
+
+        if ( client_num_packets_received >= 10 && server_num_packets_received >= 10 )
+            break;
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( client_num_packets_received >= 10 && server_num_packets_received >= 10 );
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( !netcode_address_equal( &server->client_address[0], &old_client_address ) );
+    check( netcode_address_equal( &server->client_address[0], &client->address ) );
+
+    // packets under the client's keys from an address the client isn't at, eg. captured and sent on from elsewhere, don't move the
+    // session or get delivered. the challenge goes to that address, and only an echo of it from there counts
+
+    struct netcode_address_t client_address = client->address;
+
+    struct netcode_address_t other_address;
+    check( netcode_parse_address( "[::]:50002", &other_address ) == NETCODE_OK );
+
+    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
+    memset( allowed_packets, 0, sizeof( allowed_packets ) );
+    allowed_packets[NETCODE_CONNECTION_KEEP_ALIVE_PACKET] = 1;
+    allowed_packets[NETCODE_CONNECTION_PAYLOAD_PACKET] = 1;
+
+    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+    int buffer_bytes;
+
+    struct netcode_connection_payload_packet_t * payload_packet = netcode_create_payload_packet( NETCODE_MAX_PACKET_SIZE, NULL, NULL );
+    check( payload_packet );
+    memcpy( payload_packet->payload_data, packet_data, NETCODE_MAX_PACKET_SIZE );
+
+    struct netcode_connection_keep_alive_packet_t keep_alive_packet;
+    keep_alive_packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
+    keep_alive_packet.client_index = 0;
+    keep_alive_packet.max_clients = 0;
+
+    for ( i = 0; i < 2; ++i )
+    {
+        buffer_bytes = netcode_write_packet( payload_packet, buffer, NETCODE_MAX_PACKET_BYTES, client->sequence++, client->context.write_packet_key, client->connect_token.version_info, client->connect_token.protocol_id );
+        netcode_server_read_and_process_packet( server, &other_address, buffer, buffer_bytes, netcode_timestamp(), allowed_packets );
+
+        buffer_bytes = netcode_write_packet( &keep_alive_packet, buffer, NETCODE_MAX_PACKET_BYTES, client->sequence++, client->context.write_packet_key, client->connect_token.version_info, client->connect_token.protocol_id );
+        netcode_server_read_and_process_packet( server, &other_address, buffer, buffer_bytes, netcode_timestamp(), allowed_packets );
+    }
+
+    check( netcode_address_equal( &server->client_address[0], &client_address ) );
+    check( netcode_address_equal( &server->client_migration_address[0], &other_address ) );
+
+    int packet_bytes;
+    uint64_t packet_sequence;
+    check( netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence ) == NULL );
+
+    // a wrong echo doesn't count either, and the right one moves the session. wait out the per address migration limit first
+
+    time += 1.0;
+    netcode_server_update( server, time );
+
+    keep_alive_packet.client_index = (int) (uint32_t) ( server->client_migration_challenge[0] + 1 );
+    keep_alive_packet.max_clients = (int) (uint32_t) ( server->client_migration_challenge[0] >> 32 );
+    buffer_bytes = netcode_write_packet( &keep_alive_packet, buffer, NETCODE_MAX_PACKET_BYTES, client->sequence++, client->context.write_packet_key, client->connect_token.version_info, client->connect_token.protocol_id );
+    netcode_server_read_and_process_packet( server, &other_address, buffer, buffer_bytes, netcode_timestamp(), allowed_packets );
+
+    check( netcode_address_equal( &server->client_address[0], &client_address ) );
+
+    keep_alive_packet.client_index = (int) (uint32_t) server->client_migration_challenge[0];
+    buffer_bytes = netcode_write_packet( &keep_alive_packet, buffer, NETCODE_MAX_PACKET_BYTES, client->sequence++, client->context.write_packet_key, client->connect_token.version_info, client->connect_token.protocol_id );
+    netcode_server_read_and_process_packet( server, &other_address, buffer, buffer_bytes, netcode_timestamp(), allowed_packets );
+
+    check( netcode_address_equal( &server->client_address[0], &other_address ) );
+
+    netcode_default_free_function( NULL, payload_packet );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+static uint64_t test_timestamp_value = 0;
+
+static uint64_t test_timestamp_function()
+{
+    return test_timestamp_value;
+}
+
+void test_server_migration_flood()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client[2];
+    client[0] = netcode_client_create( "[::]:50000", &client_config, time );
+    client[1] = netcode_client_create( "[::]:50001", &client_config, time );
+
+    check( client[0] );
+    check( client[1] );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.client_address_migration = 1;
+    server_config.max_migration_attempts_per_second = 8;
+    server_config.max_migration_attempts_per_address_per_second = 2;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 2 );
+
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
+
+    struct netcode_address_t server_address;
+    check( netcode_parse_address( server_address_string, &server_address ) == NETCODE_OK );
+
+    int i;
+    for ( i = 0; i < 2; ++i )
+    {
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+        check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID + i, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+        netcode_client_connect( client[i], connect_token );
+        check( test_update_until_client_state( network_simulator, client[i], server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+    }
+
+    // garbage from lots of unknown addresses, and lots of garbage from one of them, only gets tried against the clients' keys as often as the limits allow
+
+    uint8_t packet_data[100];
+    memset( packet_data, 0x11, sizeof( packet_data ) );
+
+    for ( i = 0; i < 64; ++i )
+    {
+        struct netcode_address_t from;
+        check( netcode_parse_address( "[::1]:60000", &from ) == NETCODE_OK );
+        from.port = (uint16_t) ( 60000 + ( i % 32 ) );
+        netcode_network_simulator_send_packet( network_simulator, &from, &server_address, packet_data, sizeof( packet_data ) );
+    }
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_MIGRATION_DECRYPTS] <= 8 * 2 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_MIGRATIONS_RATE_LIMITED] == 64 - 8 );
+    check( netcode_server_num_connected_clients( server ) == 2 );
+
+    // one address gets no more than its own share, even with the overall budget to spare
+
+    server_config.max_migration_attempts_per_second = 0;
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
+
+    time += 1.0;
+
+    for ( i = 0; i < 16; ++i )
+    {
+        struct netcode_address_t from;
+        check( netcode_parse_address( "[::1]:60000", &from ) == NETCODE_OK );
+        netcode_network_simulator_send_packet( network_simulator, &from, &server_address, packet_data, sizeof( packet_data ) );
+    }
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_MIGRATION_DECRYPTS] <= ( 8 + 2 ) * 2 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_MIGRATIONS_RATE_LIMITED] == ( 64 - 8 ) + ( 16 - 2 ) );
+
+    // a packet from an unknown address with a sequence the clients have already seen isn't counted as a replay against them
+
+    uint64_t num_replayed_packets = netcode_server_counters( server )[NETCODE_SERVER_COUNTER_REPLAYED_PACKETS_DROPPED];
+
+    uint64_t replayed_sequence = server->client_replay_protection[0].most_recent_sequence;
+
+    packet_data[0] = (uint8_t) ( ( 8 << 4 ) | NETCODE_CONNECTION_PAYLOAD_PACKET );
+    for ( i = 0; i < 8; ++i )
+    {
+        packet_data[1+i] = (uint8_t) ( replayed_sequence >> ( 8 * i ) );
+    }
+
+    struct netcode_address_t replay_from;
+    check( netcode_parse_address( "[::1]:61000", &replay_from ) == NETCODE_OK );
+    netcode_network_simulator_send_packet( network_simulator, &replay_from, &server_address, packet_data, sizeof( packet_data ) );
+
+    netcode_network_simulator_update( network_simulator, time );
+
+    netcode_server_update( server, time );
+
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_MIGRATION_DECRYPTS] <= ( 8 + 2 + 1 ) * 2 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_REPLAYED_PACKETS_DROPPED] == num_replayed_packets );
+
+    server_config.max_migration_attempts_per_address_per_second = -1;
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_ERROR );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client[0] );
+    netcode_client_destroy( client[1] );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_server_timestamp_function()
+{
+    // drive token timestamps from a fake clock, so token expiry can be tested without waiting for it
+
+    test_timestamp_value = 1000000;
+
+    netcode_set_timestamp_function( test_timestamp_function );
+
+    check( netcode_timestamp() == 1000000 );
+
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    struct netcode_connect_token_t token;
+    check( netcode_read_connect_token( connect_token, NETCODE_CONNECT_TOKEN_BYTES, &token ) == NETCODE_OK );
+    check( token.create_timestamp == 1000000 );
+    check( token.expire_timestamp == 1000000 + TEST_CONNECT_TOKEN_EXPIRY );
+
+    // move the fake clock past the token expiry. the server must ignore the connection request
+
+    test_timestamp_value += TEST_CONNECT_TOKEN_EXPIRY + 1;
+
+    netcode_client_connect( client, connect_token );
+
+    int i;
+    for ( i = 0; i < 1000; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_REQUEST_TIMED_OUT );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+
+    netcode_set_timestamp_function( NULL );
+
+    check( netcode_timestamp() != 1000000 + TEST_CONNECT_TOKEN_EXPIRY + 1 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_client_replay_protection()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    // start a server and connect one client
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    netcode_client_connect( client, connect_token );
+
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+
+        netcode_client_update( client, time );
+
+        netcode_server_update( server, time );
+
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
+
+        time += delta_time;
+    }
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // packets from the server are replay protected on the client too. write payload packets as the server would, 
+    // well ahead of the server's own sequence numbers, and feed them to the client directly
+
+    check( netcode_client_counters( client )[NETCODE_CLIENT_COUNTER_REPLAYED_PACKETS_DROPPED] == 0 );
+
+    struct netcode_address_t server_address_parsed;
+    check( netcode_parse_address( server_address, &server_address_parsed ) );
+
+    uint8_t payload[16];
+    netcode_random_bytes( payload, sizeof( payload ) );
+
+    struct netcode_connection_payload_packet_t * payload_packet = netcode_create_payload_packet( sizeof( payload ), NULL, NULL );
+    memcpy( payload_packet->payload_data, payload, sizeof( payload ) );
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
+    uint8_t packet_copy[NETCODE_MAX_PACKET_BYTES];
+
+    int packet_bytes = netcode_write_packet( payload_packet, packet_data, NETCODE_MAX_PACKET_BYTES, 1000000, client->context.read_packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+    check( packet_bytes > 0 );
+    memcpy( packet_copy, packet_data, packet_bytes );
+
+    // a forged packet with a higher sequence must not move the replay window
+
+    uint8_t forged_packet_data[NETCODE_MAX_PACKET_BYTES];
+    int forged_packet_bytes = netcode_write_packet( payload_packet, forged_packet_data, NETCODE_MAX_PACKET_BYTES, 2000000, client->context.read_packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+    forged_packet_data[forged_packet_bytes-1] ^= 1;
+    netcode_client_process_packet( client, &server_address_parsed, forged_packet_data, forged_packet_bytes );
+
+    netcode_client_process_packet( client, &server_address_parsed, packet_data, packet_bytes );
+
+    int received_packet_bytes;
+    uint64_t received_packet_sequence;
+    void * received_packet = netcode_client_receive_packet( client, &received_packet_bytes, &received_packet_sequence );
+    check( received_packet );
+    check( received_packet_sequence == 1000000 );
+    check( received_packet_bytes == (int) sizeof( payload ) );
+    check( memcmp( received_packet, payload, sizeof( payload ) ) == 0 );
+    netcode_client_free_packet( client, received_packet );
+
+    // replaying the same packet is dropped and counted
+
+    netcode_client_process_packet( client, &server_address_parsed, packet_copy, packet_bytes );
+
+    check( netcode_client_receive_packet( client, &received_packet_bytes, &received_packet_sequence ) == NULL );
+    check( netcode_client_counters( client )[NETCODE_CLIENT_COUNTER_REPLAYED_PACKETS_DROPPED] == 1 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_REPLAYED_PACKETS_DROPPED] == 0 );
+
+    free( payload_packet );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+struct test_used_token_store_t
+{
+    int num_entries;
+    uint8_t mac[16][NETCODE_MAC_BYTES];
+    struct netcode_address_t address[16];
+    int num_rejected;
+};
+
+int test_used_token_store_callback( void * context, NETCODE_CONST uint8_t * mac, struct netcode_address_t * address, uint64_t expire_timestamp )
+{
+    struct test_used_token_store_t * store = (struct test_used_token_store_t*) context;
+
+    check( expire_timestamp > netcode_timestamp() );
+
+    int i;
+    for ( i = 0; i < store->num_entries; ++i )
+    {
+        if ( memcmp( store->mac[i], mac, NETCODE_MAC_BYTES ) == 0 )
+        {
+            if ( netcode_address_equal( &store->address[i], address ) )
+                return 1;
+            store->num_rejected++;
+            return 0;
+        }
+    }
+
+    check( store->num_entries < 16 );
+    memcpy( store->mac[store->num_entries], mac, NETCODE_MAC_BYTES );
+    store->address[store->num_entries] = *address;
+    store->num_entries++;
+    return 1;
 }
 
-static void test_challenge_token()
+void test_connect_token_used_callback()
 {
-    // generate a challenge token
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    struct netcode_challenge_token_t input_token;
+    // two servers share one used token store, so a token used on one server can't be reused on the other
 
-    input_token.client_id = TEST_CLIENT_ID;
-    netcode_random_bytes( input_token.user_data, NETCODE_USER_DATA_BYTES );
+    struct test_used_token_store_t store;
+    memset( &store, 0, sizeof( store ) );
 
-    // write it to a buffer
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
-    uint8_t buffer[NETCODE_CHALLENGE_TOKEN_BYTES];
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-    netcode_write_challenge_token( &input_token, buffer, NETCODE_CHALLENGE_TOKEN_BYTES );
+    struct netcode_client_t * client1 = netcode_client_create( "[::]:50000", &client_config, time );
+    struct netcode_client_t * client2 = netcode_client_create( "[::]:50001", &client_config, time );
 
-    // encrypt the buffer
+    check( client1 );
+    check( client2 );
 
-    uint64_t sequence = 1000;
-    uint8_t key[NETCODE_KEY_BYTES]; 
-    netcode_generate_key( key );    
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &store;
+    server_config.connect_token_used_callback = test_used_token_store_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-    check( netcode_encrypt_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, sequence, key ) == NETCODE_OK );
+    struct netcode_server_t * server1 = netcode_server_create( "[::1]:40000", &server_config, time );
+    struct netcode_server_t * server2 = netcode_server_create( "[::1]:40001", &server_config, time );
 
-    // decrypt the buffer
+    check( server1 );
+    check( server2 );
 
-    check( netcode_decrypt_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, sequence, key ) == NETCODE_OK );
+    netcode_server_start( server1, 1 );
+    netcode_server_start( server2, 1 );
 
-    // read the challenge token back in
+    NETCODE_CONST char * server_addresses[] = { "[::1]:40000", "[::1]:40001" };
 
-    struct netcode_challenge_token_t output_token;
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-    check( netcode_read_challenge_token( buffer, NETCODE_CHALLENGE_TOKEN_BYTES, &output_token ) == NETCODE_OK );
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
 
-    // make sure that everything matches the original challenge token
+    check( netcode_generate_connect_token( 2, server_addresses, server_addresses, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
 
-    check( output_token.client_id == input_token.client_id );
-    check( memcmp( output_token.user_data, input_token.user_data, NETCODE_USER_DATA_BYTES ) == 0 );
-}
+    netcode_client_connect( client1, connect_token );
 
-static void test_connection_request_packet()
-{
-    // generate a connect token
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
 
-    struct netcode_address_t server_address;
-    server_address.type = NETCODE_ADDRESS_IPV4;
-    server_address.data.ipv4[0] = 127;
-    server_address.data.ipv4[1] = 0;
-    server_address.data.ipv4[2] = 0;
-    server_address.data.ipv4[3] = 1;
-    server_address.port = TEST_SERVER_PORT;
+        netcode_client_update( client1, time );
 
-    uint8_t user_data[NETCODE_USER_DATA_BYTES];
-    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+        netcode_server_update( server1, time );
 
-    struct netcode_connect_token_private_t input_token;
+        netcode_server_update( server2, time );
 
-    netcode_generate_connect_token_private( &input_token, TEST_CLIENT_ID, TEST_TIMEOUT_SECONDS, 1, &server_address, user_data );
+        if ( netcode_client_state( client1 ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
 
-    check( input_token.client_id == TEST_CLIENT_ID );
-    check( input_token.num_server_addresses == 1 );
-    check( memcmp( input_token.user_data, user_data, NETCODE_USER_DATA_BYTES ) == 0 );
-    check( netcode_address_equal( &input_token.server_addresses[0], &server_address ) );
+        if ( netcode_client_state( client1 ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
 
-    // write the conect token to a buffer (non-encrypted)
+        time += delta_time;
+    }
 
-    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    check( netcode_client_state( client1 ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_num_connected_clients( server1 ) == 1 );
+    check( store.num_entries == 1 );
+    check( store.num_rejected == 0 );
 
-    netcode_write_connect_token_private( &input_token, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+    // a second client with the same token is rejected by the first server's own cache, then by the shared store on the second server
 
-    // copy to a second buffer then encrypt it in place (we need the unencrypted token for verification later on)
+    netcode_client_connect( client2, connect_token );
 
-    uint8_t encrypted_connect_token_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    int i;
+    for ( i = 0; i < 1000; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
 
-    memcpy( encrypted_connect_token_data, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+        netcode_client_update( client1, time );
 
-    uint64_t connect_token_sequence = 1000;
-    uint64_t connect_token_expire_timestamp = time( NULL ) + 30;
-    uint8_t connect_token_key[NETCODE_KEY_BYTES];
-    netcode_generate_key( connect_token_key );
+        netcode_client_update( client2, time );
 
-    check( netcode_encrypt_connect_token_private( encrypted_connect_token_data, 
-                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
-                                                  NETCODE_VERSION_INFO, 
-                                                  TEST_PROTOCOL_ID, 
-                                                  connect_token_expire_timestamp, 
-                                                  connect_token_sequence, 
-                                                  connect_token_key ) == NETCODE_OK );
+        netcode_server_update( server1, time );
 
-    // setup a connection request packet wrapping the encrypted connect token
+        netcode_server_update( server2, time );
 
-    struct netcode_connection_request_packet_t input_packet;
+        if ( netcode_client_state( client2 ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
 
-    input_packet.packet_type = NETCODE_CONNECTION_REQUEST_PACKET;
-    memcpy( input_packet.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
-    input_packet.protocol_id = TEST_PROTOCOL_ID;
-    input_packet.connect_token_expire_timestamp = connect_token_expire_timestamp;
-    input_packet.connect_token_sequence = connect_token_sequence;
-    memcpy( input_packet.connect_token_data, encrypted_connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+        time += delta_time;
+    }
 
-    // write the connection request packet to a buffer
+    check( netcode_client_state( client2 ) == NETCODE_CLIENT_STATE_CONNECTION_REQUEST_TIMED_OUT );
+    check( netcode_server_num_connected_clients( server2 ) == 0 );
+    check( store.num_entries == 1 );
+    check( store.num_rejected > 0 );
 
-    uint8_t buffer[2048];
+    netcode_server_destroy( server1 );
+    netcode_server_destroy( server2 );
 
-    uint8_t packet_key[NETCODE_KEY_BYTES];
+    netcode_client_destroy( client1 );
+    netcode_client_destroy( client2 );
 
-    netcode_generate_key( packet_key );
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, TEST_PROTOCOL_ID );
+void test_server_update_config()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    check( bytes_written > 0 );
+    // start a server and connect one client
 
-    // read the connection request packet back in from the buffer (the connect token data is decrypted as part of the read packet validation)
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
-    uint64_t sequence = 1000;
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-    uint8_t allowed_packets[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packets, 1, sizeof( allowed_packets ) );
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
 
-    struct netcode_connection_request_packet_t * output_packet = (struct netcode_connection_request_packet_t*) 
-        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, TEST_PROTOCOL_ID, time( NULL ), connect_token_key, allowed_packets, NULL, NULL, NULL );
+    check( client );
 
-    check( output_packet );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-    // make sure the read packet matches what was written
-    
-    check( output_packet->packet_type == NETCODE_CONNECTION_REQUEST_PACKET );
-    check( memcmp( output_packet->version_info, input_packet.version_info, NETCODE_VERSION_INFO_BYTES ) == 0 );
-    check( output_packet->protocol_id == input_packet.protocol_id );
-    check( output_packet->connect_token_expire_timestamp == input_packet.connect_token_expire_timestamp );
-    check( output_packet->connect_token_sequence == input_packet.connect_token_sequence );
-    check( memcmp( output_packet->connect_token_data, connect_token_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES - NETCODE_MAC_BYTES ) == 0 );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    free( output_packet );
-}
+    check( server );
 
-void test_connection_denied_packet()
-{
-    // setup a connection denied packet
+    netcode_server_start( server, 1 );
 
-    struct netcode_connection_denied_packet_t input_packet;
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-    input_packet.packet_type = NETCODE_CONNECTION_DENIED_PACKET;
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-    // write the packet to a buffer
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
 
-    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
 
-    uint8_t packet_key[NETCODE_KEY_BYTES];
+    netcode_client_connect( client, connect_token );
 
-    netcode_generate_key( packet_key );
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
 
-    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, TEST_PROTOCOL_ID );
+        netcode_client_update( client, time );
 
-    check( bytes_written > 0 );
+        netcode_server_update( server, time );
 
-    // read the packet back in from the buffer
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
 
-    uint64_t sequence;
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
 
-    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+        time += delta_time;
+    }
 
-    struct netcode_connection_denied_packet_t * output_packet = (struct netcode_connection_denied_packet_t*) 
-        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
 
-    check( output_packet );
+    // fields that can't change on a running server are rejected and leave the config untouched
 
-    // make sure the read packet matches what was written
-    
-    check( output_packet->packet_type == NETCODE_CONNECTION_DENIED_PACKET );
+    struct netcode_server_config_t new_config = server_config;
+    new_config.packet_queue_size = server_config.packet_queue_size / 2;
+    check( netcode_server_update_config( server, &new_config ) == NETCODE_ERROR );
+    check( server->config.packet_queue_size == server_config.packet_queue_size );
 
-    free( output_packet );
-}
+    // reload with a new keep-alive rate and a rotated private key. the connected client stays connected
 
-void test_connection_challenge_packet()
-{
-    // setup a connection challenge packet
+    uint8_t new_private_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( new_private_key );
 
-    struct netcode_connection_challenge_packet_t input_packet;
+    new_config = server_config;
+    new_config.packet_send_rate = server_config.packet_send_rate * 2.0;
+    memcpy( new_config.private_key, new_private_key, NETCODE_KEY_BYTES );
+    check( netcode_server_update_config( server, &new_config ) == NETCODE_OK );
+    check( server->client_packet_send_rate[0] == new_config.packet_send_rate );
 
-    input_packet.packet_type = NETCODE_CONNECTION_CHALLENGE_PACKET;
-    input_packet.challenge_token_sequence = 0;
-    netcode_random_bytes( input_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+    int i;
+    for ( i = 0; i < 100; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
 
-    // write the packet to a buffer
+        netcode_client_update( client, time );
 
-    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+        netcode_server_update( server, time );
 
-    uint8_t packet_key[NETCODE_KEY_BYTES];
+        time += delta_time;
+    }
 
-    netcode_generate_key( packet_key );
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
 
-    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, TEST_PROTOCOL_ID );
+    // new connections must use tokens generated with the new private key
 
-    check( bytes_written > 0 );
+    netcode_server_disconnect_client( server, 0 );
+    netcode_client_disconnect( client );
 
-    // read the packet back in from the buffer
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, new_private_key, NULL, connect_token ) );
 
-    uint64_t sequence;
+    netcode_client_connect( client, connect_token );
 
-    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+    for ( i = 0; i < 1000; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
 
-    struct netcode_connection_challenge_packet_t * output_packet = (struct netcode_connection_challenge_packet_t*) 
-        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+        netcode_client_update( client, time );
 
-    check( output_packet );
+        netcode_server_update( server, time );
 
-    // make sure the read packet packet matches what was written
-    
-    check( output_packet->packet_type == NETCODE_CONNECTION_CHALLENGE_PACKET );
-    check( output_packet->challenge_token_sequence == input_packet.challenge_token_sequence );
-    check( memcmp( output_packet->challenge_token_data, input_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES ) == 0 );
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
 
-    free( output_packet );
-}
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
 
-void test_connection_response_packet()
-{
-    // setup a connection response packet
+        time += delta_time;
+    }
 
-    struct netcode_connection_response_packet_t input_packet;
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_num_connected_clients( server ) == 1 );
 
-    input_packet.packet_type = NETCODE_CONNECTION_RESPONSE_PACKET;
-    input_packet.challenge_token_sequence = 0;
-    netcode_random_bytes( input_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES );
+    netcode_server_destroy( server );
 
-    // write the packet to a buffer
+    netcode_client_destroy( client );
 
-    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+struct test_server_events_t
+{
+    int num_events;
+    struct netcode_server_event_t events[64];
+};
+
+void test_server_event_callback( void * context, NETCODE_CONST struct netcode_server_event_t * event )
+{
+    struct test_server_events_t * events = (struct test_server_events_t*) context;
+    if ( events->num_events < 64 )
+    {
+        events->events[events->num_events++] = *event;
+    }
+}
+
+int test_server_events_find( struct test_server_events_t * events, int type, int reason )
+{
+    int i;
+    for ( i = 0; i < events->num_events; ++i )
+    {
+        if ( events->events[i].type == type && events->events[i].reason == reason )
+            return i;
+    }
+    return -1;
+}
 
-    uint8_t packet_key[NETCODE_KEY_BYTES];
+void test_server_events()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    netcode_generate_key( packet_key );
-    
-    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, TEST_PROTOCOL_ID );
+    struct test_server_events_t events;
+    memset( &events, 0, sizeof( events ) );
 
-    check( bytes_written > 0 );
+    // start a server and connect one client
 
-    // read the packet back in from the buffer
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
-    uint64_t sequence;
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
 
-    struct netcode_connection_response_packet_t * output_packet = (struct netcode_connection_response_packet_t*) 
-        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+    check( client );
 
-    check( output_packet );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &events;
+    server_config.event_callback = test_server_event_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-    // make sure the read packet matches what was written
-    
-    check( output_packet->packet_type == NETCODE_CONNECTION_RESPONSE_PACKET );
-    check( output_packet->challenge_token_sequence == input_packet.challenge_token_sequence );
-    check( memcmp( output_packet->challenge_token_data, input_packet.challenge_token_data, NETCODE_CHALLENGE_TOKEN_BYTES ) == 0 );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    free( output_packet );
-}
+    check( server );
 
-void test_connection_keep_alive_packet()
-{
-    // setup a connection keep alive packet
+    netcode_server_start( server, 1 );
 
-    struct netcode_connection_keep_alive_packet_t input_packet;
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-    input_packet.packet_type = NETCODE_CONNECTION_KEEP_ALIVE_PACKET;
-    input_packet.client_index = 10;
-    input_packet.max_clients = 16;
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-    // write the packet to a buffer
+    uint64_t client_id = 0;
+    netcode_random_bytes( (uint8_t*) &client_id, 8 );
 
-    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
 
-    uint8_t packet_key[NETCODE_KEY_BYTES];
+    netcode_client_connect( client, connect_token );
 
-    netcode_generate_key( packet_key );
+    while ( 1 )
+    {
+        netcode_network_simulator_update( network_simulator, time );
 
-    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, TEST_PROTOCOL_ID );
+        netcode_client_update( client, time );
 
-    check( bytes_written > 0 );
+        netcode_server_update( server, time );
 
-    // read the packet back in from the buffer
+        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
 
-    uint64_t sequence;
+        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
 
-    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
-    
-    struct netcode_connection_keep_alive_packet_t * output_packet = (struct netcode_connection_keep_alive_packet_t*) 
-        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+        time += delta_time;
+    }
 
-    check( output_packet );
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_index( client ) == 0 );
+    check( netcode_server_client_connected( server, 0 ) == 1 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
 
-    // make sure the read packet matches what was written
-    
-    check( output_packet->packet_type == NETCODE_CONNECTION_KEEP_ALIVE_PACKET );
-    check( output_packet->client_index == input_packet.client_index );
-    check( output_packet->max_clients == input_packet.max_clients );
+    // the handshake so far is reported in order, with the client id attached
 
-    free( output_packet );
-}
+    int request_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_CONNECTION_REQUEST, NETCODE_SERVER_EVENT_REASON_NONE );
+    int challenge_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_CHALLENGE_SENT, NETCODE_SERVER_EVENT_REASON_NONE );
+    int connected_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_CLIENT_CONNECTED, NETCODE_SERVER_EVENT_REASON_NONE );
+    check( request_event != -1 );
+    check( challenge_event > request_event );
+    check( connected_event > challenge_event );
+    check( events.events[request_event].client_id == client_id );
+    check( events.events[connected_event].client_index == 0 );
+    check( events.events[connected_event].client_id == client_id );
+    check( netcode_address_equal( &events.events[connected_event].address, &server->client_address[0] ) );
 
-void test_connection_payload_packet()
-{
-    // setup a connection payload packet
+    // a second client reusing the same connect token is rejected, because that client id is already connected
 
-    struct netcode_connection_payload_packet_t * input_packet = netcode_create_payload_packet( NETCODE_MAX_PAYLOAD_BYTES, NULL, NULL );
+    struct netcode_client_t * client2 = netcode_client_create( "[::]:50001", &client_config, time );
 
-    check( input_packet->packet_type == NETCODE_CONNECTION_PAYLOAD_PACKET );
-    check( input_packet->payload_bytes == NETCODE_MAX_PAYLOAD_BYTES );
+    check( client2 );
 
-    netcode_random_bytes( input_packet->payload_data, NETCODE_MAX_PAYLOAD_BYTES );
-    
-    // write the packet to a buffer
+    netcode_client_connect( client2, connect_token );
 
-    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+    int i;
+    for ( i = 0; i < 10; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
 
-    uint8_t packet_key[NETCODE_KEY_BYTES];
+        netcode_client_update( client, time );
 
-    netcode_generate_key( packet_key );
+        netcode_client_update( client2, time );
 
-    int bytes_written = netcode_write_packet( input_packet, buffer, sizeof( buffer ), 1000, packet_key, TEST_PROTOCOL_ID );
+        netcode_server_update( server, time );
 
-    check( bytes_written > 0 );
+        time += delta_time;
+    }
 
-    // read the packet back in from the buffer
+    int rejected_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CLIENT_ID_ALREADY_CONNECTED );
 
-    uint64_t sequence;
+    check( rejected_event != -1 );
+    check( events.events[rejected_event].client_index == -1 );
+    check( events.events[rejected_event].client_id == client_id );
 
-    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+    // by now the client has sent packets of its own, which confirms the connection
 
-    struct netcode_connection_payload_packet_t * output_packet = (struct netcode_connection_payload_packet_t*) 
-        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+    int confirmed_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_CLIENT_CONFIRMED, NETCODE_SERVER_EVENT_REASON_NONE );
 
-    check( output_packet );
+    check( confirmed_event > connected_event );
+    check( events.events[confirmed_event].client_index == 0 );
 
-    // make sure the read packet matches what was written
-    
-    check( output_packet->packet_type == NETCODE_CONNECTION_PAYLOAD_PACKET );
-    check( output_packet->payload_bytes == input_packet->payload_bytes );
-    check( memcmp( output_packet->payload_data, input_packet->payload_data, NETCODE_MAX_PAYLOAD_BYTES ) == 0 );
+    netcode_client_destroy( client2 );
 
-    free( input_packet );
-    free( output_packet );
-}
+    // stop updating the client and the server times it out
 
-void test_connection_disconnect_packet()
-{
-    // setup a connection disconnect packet
+    for ( i = 0; i < ( TEST_TIMEOUT_SECONDS + 1 ) * 10; ++i )
+    {
+        netcode_network_simulator_update( network_simulator, time );
 
-    struct netcode_connection_disconnect_packet_t input_packet;
+        netcode_server_update( server, time );
 
-    input_packet.packet_type = NETCODE_CONNECTION_DISCONNECT_PACKET;
+        time += delta_time;
+    }
 
-    // write the packet to a buffer
+    check( netcode_server_num_connected_clients( server ) == 0 );
 
-    uint8_t buffer[NETCODE_MAX_PACKET_BYTES];
+    int timed_out_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_CLIENT_TIMED_OUT, NETCODE_SERVER_EVENT_REASON_NONE );
 
-    uint8_t packet_key[NETCODE_KEY_BYTES];
+    check( timed_out_event != -1 );
+    check( events.events[timed_out_event].client_index == 0 );
+    check( events.events[timed_out_event].client_id == client_id );
 
-    netcode_generate_key( packet_key );
+    netcode_server_destroy( server );
 
-    int bytes_written = netcode_write_packet( &input_packet, buffer, sizeof( buffer ), 1000, packet_key, TEST_PROTOCOL_ID );
+    netcode_client_destroy( client );
 
-    check( bytes_written > 0 );
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-    // read the packet back in from the buffer
+void test_server_abandoned_handshake()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    uint64_t sequence;
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
-    uint8_t allowed_packet_types[NETCODE_CONNECTION_NUM_PACKETS];
-    memset( allowed_packet_types, 1, sizeof( allowed_packet_types ) );
+    struct test_server_events_t events;
+    memset( &events, 0, sizeof( events ) );
 
-    struct netcode_connection_disconnect_packet_t * output_packet = (struct netcode_connection_disconnect_packet_t*) 
-        netcode_read_packet( buffer, bytes_written, &sequence, packet_key, TEST_PROTOCOL_ID, time( NULL ), NULL, allowed_packet_types, NULL, NULL, NULL );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &events;
+    server_config.event_callback = test_server_event_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-    check( output_packet );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    // make sure the read packet matches what was written
-    
-    check( output_packet->packet_type == NETCODE_CONNECTION_DISCONNECT_PACKET );
+    check( server );
 
-    free( output_packet );
-}
+    netcode_server_start( server, 1 );
 
-void test_connect_token_public()
-{
-    // generate a private connect token
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
 
     struct netcode_address_t server_address;
-    server_address.type = NETCODE_ADDRESS_IPV4;
-    server_address.data.ipv4[0] = 127;
-    server_address.data.ipv4[1] = 0;
-    server_address.data.ipv4[2] = 0;
-    server_address.data.ipv4[3] = 1;
-    server_address.port = TEST_SERVER_PORT;
+    struct netcode_address_t client_address;
+    check( netcode_parse_address( server_address_string, &server_address ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50000", &client_address ) == NETCODE_OK );
 
-    uint8_t user_data[NETCODE_USER_DATA_BYTES];
-    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+    uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
 
-    struct netcode_connect_token_private_t connect_token_private;
+    check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token_data ) );
 
-    netcode_generate_connect_token_private( &connect_token_private, TEST_CLIENT_ID, TEST_TIMEOUT_SECONDS, 1, &server_address, user_data );
+    struct netcode_connect_token_t connect_token;
+    check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token ) );
 
-    check( connect_token_private.client_id == TEST_CLIENT_ID );
-    check( connect_token_private.num_server_addresses == 1 );
-    check( memcmp( connect_token_private.user_data, user_data, NETCODE_USER_DATA_BYTES ) == 0 );
-    check( netcode_address_equal( &connect_token_private.server_addresses[0], &server_address ) );
+    // start a handshake and never answer the challenge
 
-    // write it to a buffer
+    test_send_connection_request( network_simulator, &client_address, &server_address, &connect_token );
 
-    uint8_t connect_token_private_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
-    netcode_write_connect_token_private( &connect_token_private, connect_token_private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
+    netcode_network_simulator_update( network_simulator, time );
 
-    // encrypt the buffer
+    netcode_server_update( server, time );
 
-    uint64_t sequence = 1000;
-    uint64_t create_timestamp = time( NULL );
-    uint64_t expire_timestamp = create_timestamp + 30;
-    uint8_t key[NETCODE_KEY_BYTES];
-    netcode_generate_key( key );    
-    check( netcode_encrypt_connect_token_private( connect_token_private_data, 
-                                                  NETCODE_CONNECT_TOKEN_PRIVATE_BYTES, 
-                                                  NETCODE_VERSION_INFO, 
-                                                  TEST_PROTOCOL_ID, 
-                                                  expire_timestamp, 
-                                                  sequence, 
-                                                  key ) == 1 );
+    check( test_server_events_find( &events, NETCODE_SERVER_EVENT_CHALLENGE_SENT, NETCODE_SERVER_EVENT_REASON_NONE ) != -1 );
+    check( netcode_encryption_manager_num_pending( &server->encryption_manager, time ) == 1 );
 
-    // wrap a public connect token around the private connect token data
+    // the mapping stays while the handshake could still finish
 
-    struct netcode_connect_token_t input_connect_token;
-    memset( &input_connect_token, 0, sizeof( struct netcode_connect_token_t ) );
-    memcpy( input_connect_token.version_info, NETCODE_VERSION_INFO, NETCODE_VERSION_INFO_BYTES );
-    input_connect_token.protocol_id = TEST_PROTOCOL_ID;
-    input_connect_token.create_timestamp = create_timestamp;
-    input_connect_token.expire_timestamp = expire_timestamp;
-    input_connect_token.sequence = sequence;
-    memcpy( input_connect_token.private_data, connect_token_private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES );
-    input_connect_token.num_server_addresses = 1;
-    input_connect_token.server_addresses[0] = server_address;
-    memcpy( input_connect_token.client_to_server_key, connect_token_private.client_to_server_key, NETCODE_KEY_BYTES );
-    memcpy( input_connect_token.server_to_client_key, connect_token_private.server_to_client_key, NETCODE_KEY_BYTES );
-    input_connect_token.timeout_seconds = (int) TEST_TIMEOUT_SECONDS;
+    int i;
+    for ( i = 0; i < TEST_TIMEOUT_SECONDS * 10; ++i )
+    {
+        time += delta_time;
+        netcode_server_update( server, time );
+    }
 
-    // write the connect token to a buffer
+    check( test_server_events_find( &events, NETCODE_SERVER_EVENT_HANDSHAKE_ABANDONED, NETCODE_SERVER_EVENT_REASON_NONE ) == -1 );
 
-    uint8_t buffer[NETCODE_CONNECT_TOKEN_BYTES];
-    netcode_write_connect_token( &input_connect_token, buffer, NETCODE_CONNECT_TOKEN_BYTES );
+    // once it times out, the next sweep removes it and reports the address
 
-    // read the buffer back in
+    for ( i = 0; i < 20; ++i )
+    {
+        time += delta_time;
+        netcode_server_update( server, time );
+    }
 
-    struct netcode_connect_token_t output_connect_token;
-    memset( &output_connect_token, 0, sizeof( struct netcode_connect_token_t ) );
-    check( netcode_read_connect_token( buffer, NETCODE_CONNECT_TOKEN_BYTES, &output_connect_token ) == 1 );
+    int abandoned_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_HANDSHAKE_ABANDONED, NETCODE_SERVER_EVENT_REASON_NONE );
 
-    // make sure the public connect token matches what was written
+    check( abandoned_event != -1 );
+    check( events.events[abandoned_event].client_index == -1 );
+    check( netcode_address_equal( &events.events[abandoned_event].address, &client_address ) );
+    check( server->encryption_manager.num_encryption_mappings == 0 );
 
-    check( memcmp( output_connect_token.version_info, input_connect_token.version_info, NETCODE_VERSION_INFO_BYTES ) == 0 );
-    check( output_connect_token.protocol_id == input_connect_token.protocol_id );
-    check( output_connect_token.create_timestamp == input_connect_token.create_timestamp );
-    check( output_connect_token.expire_timestamp == input_connect_token.expire_timestamp );
-    check( output_connect_token.sequence == input_connect_token.sequence );
-    check( memcmp( output_connect_token.private_data, input_connect_token.private_data, NETCODE_CONNECT_TOKEN_PRIVATE_BYTES ) == 0 );
-    check( output_connect_token.num_server_addresses == input_connect_token.num_server_addresses );
-    check( netcode_address_equal( &output_connect_token.server_addresses[0], &input_connect_token.server_addresses[0] ) );
-    check( memcmp( output_connect_token.client_to_server_key, input_connect_token.client_to_server_key, NETCODE_KEY_BYTES ) == 0 );
-    check( memcmp( output_connect_token.server_to_client_key, input_connect_token.server_to_client_key, NETCODE_KEY_BYTES ) == 0 );
-    check( output_connect_token.timeout_seconds == input_connect_token.timeout_seconds );
+    netcode_server_destroy( server );
+
+    netcode_network_simulator_destroy( network_simulator );
 }
 
-void test_encryption_manager()
+void test_server_wait_list()
 {
-    struct netcode_encryption_manager_t encryption_manager;
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+
+    struct test_server_events_t events;
+    memset( &events, 0, sizeof( events ) );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &events;
+    server_config.event_callback = test_server_event_callback;
+    server_config.wait_list_size = NETCODE_MAX_CLIENTS + 1;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
-    netcode_encryption_manager_reset( &encryption_manager );
+    server_config.wait_list_size = 1;
 
-    double time = 100.0;
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    // generate some test encryption mappings
+    check( server );
 
-    struct encryption_mapping_t
-    {
-        struct netcode_address_t address;
-        uint8_t send_key[NETCODE_KEY_BYTES];
-        uint8_t receive_key[NETCODE_KEY_BYTES];
-    };
+    netcode_server_start( server, 1 );
 
-    #define NUM_ENCRYPTION_MAPPINGS 5
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client[3];
+    client[0] = netcode_client_create( "[::]:50000", &client_config, time );
+    client[1] = netcode_client_create( "[::]:50001", &client_config, time );
+    client[2] = netcode_client_create( "[::]:50002", &client_config, time );
 
-    struct encryption_mapping_t encryption_mapping[NUM_ENCRYPTION_MAPPINGS];
-    memset( encryption_mapping, 0, sizeof( encryption_mapping ) );
     int i;
-    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    for ( i = 0; i < 3; ++i )
     {
-        encryption_mapping[i].address.type = NETCODE_ADDRESS_IPV6;
-        encryption_mapping[i].address.data.ipv6[7] = 1;
-        encryption_mapping[i].address.port = ( uint16_t) ( 20000 + i );
-        netcode_generate_key( encryption_mapping[i].send_key );
-        netcode_generate_key( encryption_mapping[i].receive_key );
+        check( client[i] );
     }
 
-    // add the encryption mappings to the manager and make sure they can be looked up by address
+    // the first client takes the only slot. the second waits for it, and the third finds the wait list full and is denied
 
-    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    for ( i = 0; i < 3; ++i )
     {
-        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+        uint64_t client_id = i + 1;
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+        netcode_client_connect( client[i], connect_token );
 
-        check( encryption_index == -1 );
+        int j;
+        for ( j = 0; j < 20; ++j )
+        {
+            netcode_network_simulator_update( network_simulator, time );
 
-        check( netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index ) == NULL );
-        check( netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index ) == NULL );
+            int k;
+            for ( k = 0; k <= i; ++k )
+            {
+                netcode_client_update( client[k], time );
+            }
 
-        check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
-                                                                  &encryption_mapping[i].address, 
-                                                                  encryption_mapping[i].send_key, 
-                                                                  encryption_mapping[i].receive_key, 
-                                                                  time, 
-                                                                  -1.0,
-                                                                  TEST_TIMEOUT_SECONDS ) );
+            netcode_server_update( server, time );
 
-        encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+            time += delta_time;
+        }
+    }
 
-        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
-        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+    check( netcode_client_state( client[0] ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_state( client[1] ) == NETCODE_CLIENT_STATE_SENDING_CONNECTION_REQUEST );
+    check( netcode_client_state( client[2] ) == NETCODE_CLIENT_STATE_CONNECTION_DENIED );
+    check( netcode_server_num_waiting_clients( server ) == 1 );
+    check( test_server_events_find( &events, NETCODE_SERVER_EVENT_CLIENT_WAITING, NETCODE_SERVER_EVENT_REASON_NONE ) != -1 );
 
-        check( send_key );
-        check( receive_key );
+    // when the first client leaves, the waiting client gets its slot
 
-        check( memcmp( send_key, encryption_mapping[i].send_key, NETCODE_KEY_BYTES ) == 0 );
-        check( memcmp( receive_key, encryption_mapping[i].receive_key, NETCODE_KEY_BYTES ) == 0 );
-    }
+    netcode_client_disconnect( client[0] );
 
-    // removing an encryption mapping that doesn't exist should return 0
+    for ( i = 0; i < 20; ++i )
     {
-        struct netcode_address_t address;
-        address.type = NETCODE_ADDRESS_IPV6;
-        address.data.ipv6[7] = 1;
-        address.port = 50000;
+        netcode_network_simulator_update( network_simulator, time );
 
-        check( netcode_encryption_manager_remove_encryption_mapping( &encryption_manager, &address, time ) == 0 );
-    }
+        netcode_client_update( client[1], time );
 
-    // remove the first and last encryption mappings
+        netcode_server_update( server, time );
 
-    check( netcode_encryption_manager_remove_encryption_mapping( &encryption_manager, &encryption_mapping[0].address, time ) == 1 );
+        if ( netcode_client_state( client[1] ) == NETCODE_CLIENT_STATE_CONNECTED )
+            break;
 
-    check( netcode_encryption_manager_remove_encryption_mapping( &encryption_manager, &encryption_mapping[NUM_ENCRYPTION_MAPPINGS-1].address, time ) == 1 );
+        time += delta_time;
+    }
 
-    // make sure the encryption mappings that were removed can no longer be looked up by address
+    check( netcode_client_state( client[1] ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_client_id( server, 0 ) == 2 );
+    check( netcode_server_num_waiting_clients( server ) == 0 );
 
-    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
-    {
-        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+    netcode_server_destroy( server );
 
-        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
-        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+    for ( i = 0; i < 3; ++i )
+    {
+        netcode_client_destroy( client[i] );
+    }
 
-        if ( i != 0 && i != NUM_ENCRYPTION_MAPPINGS - 1 )
-        {
-            check( send_key );
-            check( receive_key );
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-            check( memcmp( send_key, encryption_mapping[i].send_key, NETCODE_KEY_BYTES ) == 0 );
-            check( memcmp( receive_key, encryption_mapping[i].receive_key, NETCODE_KEY_BYTES ) == 0 );
-        }
-        else
-        {
-            check( !send_key );
-            check( !receive_key );
-        }
-    }
+void test_server_reserved_slots()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    // add the encryption mappings back in
-    
-    check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
-                                                              &encryption_mapping[0].address, 
-                                                              encryption_mapping[0].send_key, 
-                                                              encryption_mapping[0].receive_key, 
-                                                              time, 
-                                                              -1.0,
-                                                              TEST_TIMEOUT_SECONDS ) );
-    
-    check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
-                                                              &encryption_mapping[NUM_ENCRYPTION_MAPPINGS-1].address, 
-                                                              encryption_mapping[NUM_ENCRYPTION_MAPPINGS-1].send_key, 
-                                                              encryption_mapping[NUM_ENCRYPTION_MAPPINGS-1].receive_key, 
-                                                              time, 
-                                                              -1.0,
-                                                              TEST_TIMEOUT_SECONDS ) );
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
-    // all encryption mappings should be able to be looked up by address again
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.reserved_slots = NETCODE_MAX_CLIENTS + 1;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
-    {
-        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
-        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
-        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+    server_config.reserved_slots = 1;
 
-        check( send_key );
-        check( receive_key );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        check( memcmp( send_key, encryption_mapping[i].send_key, NETCODE_KEY_BYTES ) == 0 );
-        check( memcmp( receive_key, encryption_mapping[i].receive_key, NETCODE_KEY_BYTES ) == 0 );
-    }
+    check( server );
 
-    // check that encryption mappings time out properly
+    netcode_server_start( server, 2 );
 
-    time += TEST_TIMEOUT_SECONDS * 2;
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
-    {
-        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
-        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+    struct netcode_client_t * client[3];
+    client[0] = netcode_client_create( "[::]:50000", &client_config, time );
+    client[1] = netcode_client_create( "[::]:50001", &client_config, time );
+    client[2] = netcode_client_create( "[::]:50002", &client_config, time );
 
-        check( !send_key );
-        check( !receive_key );
+    int i;
+    for ( i = 0; i < 3; ++i )
+    {
+        check( client[i] );
     }
 
-    // add the same encryption mappings after timeout
+    // the first client takes the only unreserved slot and the second is denied. the third claims the reserved slot permission and gets in
 
-    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    for ( i = 0; i < 3; ++i )
     {
-        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
-
-        check( encryption_index == -1 );
+        uint8_t user_data[NETCODE_USER_DATA_BYTES];
+        memset( user_data, 0, sizeof( user_data ) );
 
-        check( netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index ) == NULL );
-        check( netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index ) == NULL );
+        if ( i == 2 )
+        {
+            struct netcode_user_data_claims_t claims;
+            memset( &claims, 0, sizeof( claims ) );
+            claims.player_id = i + 1;
+            claims.permissions = NETCODE_PERMISSION_RESERVED_SLOT;
+            netcode_write_user_data_claims( &claims, user_data );
+        }
 
-        check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
-                                                                  &encryption_mapping[i].address, 
-                                                                  encryption_mapping[i].send_key, 
-                                                                  encryption_mapping[i].receive_key, 
-                                                                  time, 
-                                                                  -1.0,
-                                                                  TEST_TIMEOUT_SECONDS ) );
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+        uint64_t client_id = i + 1;
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, user_data, connect_token ) );
+        netcode_client_connect( client[i], connect_token );
 
-        encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+        int j;
+        for ( j = 0; j < 20; ++j )
+        {
+            netcode_network_simulator_update( network_simulator, time );
 
-        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
-        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+            int k;
+            for ( k = 0; k <= i; ++k )
+            {
+                netcode_client_update( client[k], time );
+            }
 
-        check( send_key );
-        check( receive_key );
+            netcode_server_update( server, time );
 
-        check( memcmp( send_key, encryption_mapping[i].send_key, NETCODE_KEY_BYTES ) == 0 );
-        check( memcmp( receive_key, encryption_mapping[i].receive_key, NETCODE_KEY_BYTES ) == 0 );
+            time += delta_time;
+        }
     }
 
-    // reset the encryption mapping and verify that all encryption mappings have been removed
+    check( netcode_client_state( client[0] ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_state( client[1] ) == NETCODE_CLIENT_STATE_CONNECTION_DENIED );
+    check( netcode_client_state( client[2] ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_num_connected_clients( server ) == 2 );
 
-    netcode_encryption_manager_reset( &encryption_manager );
+    netcode_server_destroy( server );
 
-    for ( i = 0; i < NUM_ENCRYPTION_MAPPINGS; ++i )
+    for ( i = 0; i < 3; ++i )
     {
-        int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[i].address, time );
+        netcode_client_destroy( client[i] );
+    }
 
-        uint8_t * send_key = netcode_encryption_manager_get_send_key( &encryption_manager, encryption_index );
-        uint8_t * receive_key = netcode_encryption_manager_get_receive_key( &encryption_manager, encryption_index );
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-        check( !send_key );
-        check( !receive_key );
-    }
+int test_assign_slot_callback( void * context, uint64_t client_id, NETCODE_CONST uint8_t * user_data )
+{
+    (void) client_id;
+    (void) user_data;
+    return *( (int*) context );
+}
 
-    // test the expire time for encryption mapping works as expected
+void test_server_assign_slot_callback()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    check( netcode_encryption_manager_add_encryption_mapping( &encryption_manager, 
-                                                              &encryption_mapping[0].address, 
-                                                              encryption_mapping[0].send_key, 
-                                                              encryption_mapping[0].receive_key, 
-                                                              time, 
-                                                              time + 1.0,
-                                                              TEST_TIMEOUT_SECONDS ) );
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
-    int encryption_index = netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[0].address, time );
+    int assigned_slot = 3;
 
-    check( encryption_index != -1 );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &assigned_slot;
+    server_config.assign_slot_callback = test_assign_slot_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-    check( netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[0].address, time + 1.1f ) == -1 );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    netcode_encryption_manager_set_expire_time( &encryption_manager, encryption_index, -1.0 );
+    check( server );
 
-    check( netcode_encryption_manager_find_encryption_mapping( &encryption_manager, &encryption_mapping[0].address, time ) == encryption_index );
-}
+    netcode_server_start( server, 4 );
 
-void test_replay_protection()
-{
-    struct netcode_replay_protection_t replay_protection;
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client[2];
+    client[0] = netcode_client_create( "[::]:50000", &client_config, time );
+    client[1] = netcode_client_create( "[::]:50001", &client_config, time );
+
+    check( client[0] );
+    check( client[1] );
+
+    // both clients ask for the last slot. the first gets it and the second falls back to the first free slot
 
     int i;
     for ( i = 0; i < 2; ++i )
     {
-        netcode_replay_protection_reset( &replay_protection );
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+        uint64_t client_id = i + 1;
+        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+        netcode_client_connect( client[i], connect_token );
 
-        check( replay_protection.most_recent_sequence == 0 );
+        int j;
+        for ( j = 0; j < 20; ++j )
+        {
+            netcode_network_simulator_update( network_simulator, time );
 
-        // the first time we receive packets, they should not be already received
+            int k;
+            for ( k = 0; k <= i; ++k )
+            {
+                netcode_client_update( client[k], time );
+            }
 
-        #define MAX_SEQUENCE ( NETCODE_REPLAY_PROTECTION_BUFFER_SIZE * 4 )
+            netcode_server_update( server, time );
 
-        uint64_t sequence;
-        for ( sequence = 0; sequence < MAX_SEQUENCE; ++sequence )
-        {
-            check( netcode_replay_protection_packet_already_received( &replay_protection, sequence ) == 0 );
+            time += delta_time;
         }
 
-        // old packets outside buffer should be considered already received
-
-        check( netcode_replay_protection_packet_already_received( &replay_protection, 0 ) == 1 );
-
-        // packets received a second time should be flagged already received
+        check( netcode_client_state( client[i] ) == NETCODE_CLIENT_STATE_CONNECTED );
+    }
 
-        for ( sequence = MAX_SEQUENCE - 10; sequence < MAX_SEQUENCE; ++sequence )
-        {
-            check( netcode_replay_protection_packet_already_received( &replay_protection, sequence ) == 1 );
-        }
+    check( netcode_client_index( client[0] ) == 3 );
+    check( netcode_server_client_id( server, 3 ) == 1 );
+    check( netcode_client_index( client[1] ) == 0 );
+    check( netcode_server_client_id( server, 0 ) == 2 );
 
-        // jumping ahead to a much higher sequence should be considered not already received
+    netcode_server_destroy( server );
 
-        check( netcode_replay_protection_packet_already_received( &replay_protection, MAX_SEQUENCE + NETCODE_REPLAY_PROTECTION_BUFFER_SIZE ) == 0 );
+    netcode_client_destroy( client[0] );
+    netcode_client_destroy( client[1] );
 
-        // old packets should be considered already received
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-        for ( sequence = 0; sequence < MAX_SEQUENCE; ++sequence )
-        {
-            check( netcode_replay_protection_packet_already_received( &replay_protection, sequence ) == 1 );
-        }
+struct test_client_tag_context_t
+{
+    struct netcode_server_t * server;
+    void * disconnected_tag;
+};
+
+void test_client_tag_callback( void * _context, int client_index, int connected )
+{
+    struct test_client_tag_context_t * context = (struct test_client_tag_context_t*) _context;
+    if ( !connected )
+    {
+        context->disconnected_tag = netcode_server_client_tag( context->server, client_index );
     }
 }
 
-void test_client_create()
+void test_server_client_tag()
 {
-    {
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    struct test_client_tag_context_t context;
+    memset( &context, 0, sizeof( context ) );
 
-        struct netcode_client_t * client = netcode_client_create( "127.0.0.1:40000", &client_config, 0.0 );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.callback_context = &context;
+    server_config.connect_disconnect_callback = test_client_tag_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-        struct netcode_address_t test_address;
-        netcode_parse_address( "127.0.0.1:40000", &test_address );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, 0.0 );
 
-        check( client );
-        check( client->socket_holder.ipv4.handle != 0 );
-        check( client->socket_holder.ipv6.handle == 0 );
-        check( netcode_address_equal( &client->address, &test_address ) );
+    check( server );
 
-        netcode_client_destroy( client );
-    }
+    context.server = server;
 
-    {
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    netcode_server_start( server, 2 );
 
-        struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, 0.0 );
+    netcode_server_connect_loopback_client( server, 1, TEST_CLIENT_ID, NULL );
 
-        struct netcode_address_t test_address;
-        netcode_parse_address( "[::]:50000", &test_address );
+    check( netcode_server_client_tag( server, 1 ) == NULL );
 
-        check( client );
-        check( client->socket_holder.ipv4.handle == 0 );
-        check( client->socket_holder.ipv6.handle != 0 );
-        check( netcode_address_equal( &client->address, &test_address ) );
+    // the tag stays with the slot until the client disconnects, and is still there for the disconnect callback
 
-        netcode_client_destroy( client );
-    }
+    int player = 0;
+    netcode_server_set_client_tag( server, 1, &player );
+    check( netcode_server_client_tag( server, 1 ) == &player );
+    check( netcode_server_client_tag( server, 0 ) == NULL );
 
-    {
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    netcode_server_disconnect_loopback_client( server, 1 );
 
-        struct netcode_client_t * client = netcode_client_create_overload( "127.0.0.1:40000", "[::]:50000", &client_config, 0.0 );
+    check( context.disconnected_tag == &player );
+    check( netcode_server_client_tag( server, 1 ) == NULL );
 
-        struct netcode_address_t test_address;
-        netcode_parse_address( "127.0.0.1:40000", &test_address );
+    netcode_server_destroy( server );
+}
 
-        check( client );
-        check( client->socket_holder.ipv4.handle != 0 );
-        check( client->socket_holder.ipv6.handle != 0 );
-        check( netcode_address_equal( &client->address, &test_address ) );
+void test_server_alternate_protocols()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-        netcode_client_destroy( client );
-    }
+    double time = 0.0;
 
-    {
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    uint8_t alternate_private_key[NETCODE_KEY_BYTES];
+    netcode_generate_key( alternate_private_key );
 
-        struct netcode_client_t * client = netcode_client_create_overload( "[::]:50000", "127.0.0.1:40000", &client_config, 0.0 );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-        struct netcode_address_t test_address;
-        netcode_parse_address( "[::]:50000", &test_address );
+    // alternate protocol ids must differ from the primary and from each other
 
-        check( client );
-        check( client->socket_holder.ipv4.handle != 0 );
-        check( client->socket_holder.ipv6.handle != 0 );
-        check( netcode_address_equal( &client->address, &test_address ) );
+    server_config.num_alternate_protocols = 1;
+    server_config.alternate_protocol_id[0] = TEST_PROTOCOL_ID;
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
-        netcode_client_destroy( client );
-    }
-}
+    server_config.alternate_protocol_id[0] = TEST_PROTOCOL_ID + 1;
+    memcpy( server_config.alternate_private_key[0], alternate_private_key, NETCODE_KEY_BYTES );
 
-void test_server_create()
-{
-    {
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        struct netcode_server_t * server = netcode_server_create( "127.0.0.1:40000", &server_config, 0.0 );
+    check( server );
 
-        struct netcode_address_t test_address;
-        netcode_parse_address( "127.0.0.1:40000", &test_address );
+    netcode_server_start( server, 2 );
 
-        check( server );
-        check( server->socket_holder.ipv4.handle != 0 );
-        check( server->socket_holder.ipv6.handle == 0 );
-        check( netcode_address_equal( &server->address, &test_address ) );
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-        netcode_server_destroy( server );
-    }
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-    {
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+    struct netcode_client_t * alternate_client = netcode_client_create( "[::]:50001", &client_config, time );
 
-        struct netcode_server_t * server = netcode_server_create( "[::1]:50000", &server_config, 0.0 );
+    check( client );
+    check( alternate_client );
 
-        struct netcode_address_t test_address;
-        netcode_parse_address( "[::1]:50000", &test_address );
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-        check( server );
-        check( server->socket_holder.ipv4.handle == 0 );
-        check( server->socket_holder.ipv6.handle != 0 );
-        check( netcode_address_equal( &server->address, &test_address ) );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, 1000, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-        netcode_server_destroy( server );
-    }
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, 1001, TEST_PROTOCOL_ID + 1, alternate_private_key, NULL, connect_token ) );
+    netcode_client_connect( alternate_client, connect_token );
+    check( test_update_until_client_state( network_simulator, alternate_client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-    {
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
+    check( netcode_server_num_connected_clients( server ) == 2 );
+    check( netcode_server_client_protocol_id( server, 0 ) == TEST_PROTOCOL_ID );
+    check( netcode_server_client_protocol_id( server, 1 ) == TEST_PROTOCOL_ID + 1 );
 
-        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:50000", &server_config, 0.0 );
+    // payloads to and from the alternate client are sealed with its protocol id
 
-        struct netcode_address_t test_address;
-        netcode_parse_address( "127.0.0.1:40000", &test_address );
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    memset( packet_data, 0x42, sizeof( packet_data ) );
 
-        check( server );
-        check( server->socket_holder.ipv4.handle != 0 );
-        check( server->socket_holder.ipv6.handle != 0 );
-        check( netcode_address_equal( &server->address, &test_address ) );
+    netcode_server_send_packet( server, 1, packet_data, NETCODE_MAX_PACKET_SIZE );
+    netcode_client_send_packet( alternate_client, packet_data, NETCODE_MAX_PACKET_SIZE );
 
-        netcode_server_destroy( server );
-    }
+    int client_num_packets_received = 0;
+    int server_num_packets_received = 0;
 
+    int i;
+    for ( i = 0; i < 10; ++i )
     {
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
+        netcode_network_simulator_update( network_simulator, time );
 
-        struct netcode_server_t * server = netcode_server_create_overload( "[::1]:50000", "127.0.0.1:40000", &server_config, 0.0 );
+        netcode_client_update( alternate_client, time );
 
-        struct netcode_address_t test_address;
-        netcode_parse_address( "[::1]:50000", &test_address );
+        netcode_server_update( server, time );
 
-        check( server );
-        check( server->socket_holder.ipv4.handle != 0 );
-        check( server->socket_holder.ipv6.handle != 0 );
-        check( netcode_address_equal( &server->address, &test_address ) );
+        int packet_bytes;
+        uint64_t packet_sequence;
+        void * packet = netcode_client_receive_packet( alternate_client, &packet_bytes, &packet_sequence );
+        if ( packet )
+        {
+            client_num_packets_received++;
+            netcode_client_free_packet( alternate_client, packet );
+        }
 
-        netcode_server_destroy( server );
+        packet = netcode_server_receive_packet( server, 1, &packet_bytes, &packet_sequence );
+        if ( packet )
+        {
+            server_num_packets_received++;
+            netcode_server_free_packet( server, packet );
+        }
+
+        time += 0.1;
     }
-}
 
-static uint8_t private_key[NETCODE_KEY_BYTES] = { 0x60, 0x6a, 0xbe, 0x6e, 0xc9, 0x19, 0x10, 0xea, 
-                                                  0x9a, 0x65, 0x62, 0xf6, 0x6f, 0x2b, 0x30, 0xe4, 
-                                                  0x43, 0x71, 0xd6, 0x2c, 0xd1, 0x99, 0x27, 0x26,
-                                                  0x6b, 0x3c, 0x60, 0xf4, 0xb7, 0x15, 0xab, 0xa1 };
+    check( client_num_packets_received == 1 );
+    check( server_num_packets_received == 1 );
 
-void test_client_server_connect()
+    // a protocol id the server wasn't configured with is not accepted, even with a known private key
+
+    netcode_client_disconnect( alternate_client );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, 1001, TEST_PROTOCOL_ID + 2, alternate_private_key, NULL, connect_token ) );
+    netcode_client_connect( alternate_client, connect_token );
+    check( !test_update_until_client_state( network_simulator, alternate_client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    netcode_server_destroy( server );
+
+    netcode_client_destroy( client );
+    netcode_client_destroy( alternate_client );
+
+    netcode_network_simulator_destroy( network_simulator );
+}
+
+void test_server_public_address()
 {
     struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
-
     double time = 0.0;
-    double delta_time = 1.0 / 10.0;
 
     struct netcode_client_config_t client_config;
     netcode_default_client_config( &client_config );
@@ -6337,108 +17831,51 @@ void test_client_server_connect()
     server_config.network_simulator = network_simulator;
     memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
+    server_config.public_address = "not an address";
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+
+    server_config.public_address = NULL;
+
     struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
     check( server );
 
     netcode_server_start( server, 1 );
 
-    NETCODE_CONST char * server_address = "[::1]:40000";
-
-    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    // the token whitelists the address the server is reached on from outside, not the address it binds
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    NETCODE_CONST char * connect_address = "[::1]:40000";
+    NETCODE_CONST char * public_address = "203.0.113.10:50000";
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
+    check( netcode_generate_connect_token( 1, &connect_address, &public_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
     netcode_client_connect( client, connect_token );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( netcode_server_num_connected_clients( server ) == 0 );
 
-    while ( 1 )
-    {
-        netcode_network_simulator_update( network_simulator, time );
-
-        netcode_client_update( client, time );
-
-        netcode_server_update( server, time );
-
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
-
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-            break;
-
-        time += delta_time;
-    }
-
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_index( client ) == 0 );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
-
-    int server_num_packets_received = 0;
-    int client_num_packets_received = 0;
-
-    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
-    int i;
-    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
-        packet_data[i] = (uint8_t) i;
-
-    while ( 1 )
-    {
-        netcode_network_simulator_update( network_simulator, time );
-
-        netcode_client_update( client, time );
-
-        netcode_server_update( server, time );
-
-        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PACKET_SIZE );
+    netcode_server_destroy( server );
 
-        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+    server_config.public_address = public_address;
 
-        while ( 1 )             
-        {
-            int packet_bytes;
-            uint64_t packet_sequence;
-            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
-            if ( !packet )
-                break;
-            (void) packet_sequence;
-            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
-            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
-            client_num_packets_received++;
-            netcode_client_free_packet( client, packet );
-        }
+    server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        while ( 1 )             
-        {
-            int packet_bytes;
-            uint64_t packet_sequence;
-            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
-            if ( !packet )
-                break;
-            (void) packet_sequence;
-            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
-            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
-            server_num_packets_received++;
-            netcode_server_free_packet( server, packet );
-        }
+    check( server );
 
-        if ( client_num_packets_received >= 10 && server_num_packets_received >= 10 )
-        {
-            if ( netcode_server_client_connected( server, 0 ) )
-            {
-                netcode_server_disconnect_client( server, 0 );
-            }
-        }
+    netcode_server_start( server, 1 );
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    check( netcode_generate_connect_token( 1, &connect_address, &public_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+    check( netcode_server_client_connected( server, 0 ) );
 
-        time += delta_time;
-    }
+    // tokens that name the bind address still work
 
-    check( client_num_packets_received >= 10 && server_num_packets_received >= 10 );
+    netcode_client_disconnect( client );
+
+    check( netcode_generate_connect_token( 1, &connect_address, &connect_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
     netcode_server_destroy( server );
 
@@ -6447,449 +17884,532 @@ void test_client_server_connect()
     netcode_network_simulator_destroy( network_simulator );
 }
 
-void test_client_server_ipv4_socket_connect()
+struct test_server_address_match_context_t
 {
-    {
-        double time = 0.0;
-        double delta_time = 1.0 / 10.0;
-
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    struct netcode_address_t accepted_address;
+    int num_calls;
+};
 
-        struct netcode_client_t * client = netcode_client_create( "0.0.0.0:50000", &client_config, time );
+int test_match_server_address_callback( void * _context, struct netcode_address_t * address )
+{
+    struct test_server_address_match_context_t * context = (struct test_server_address_match_context_t*) _context;
+    context->num_calls++;
+    return netcode_address_equal( &context->accepted_address, address );
+}
 
-        check( client );
+void test_server_address_match_callback()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
-        server_config.protocol_id = TEST_PROTOCOL_ID;
-        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    double time = 0.0;
 
-        struct netcode_server_t * server = netcode_server_create( "127.0.0.1:40000", &server_config, time );
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-        check( server );
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
 
-        netcode_server_start( server, 1 );
+    check( client );
 
-        NETCODE_CONST char * server_address = "127.0.0.1:40000";
+    struct test_server_address_match_context_t context;
+    memset( &context, 0, sizeof( context ) );
+    netcode_parse_address( "10.0.0.5:40000", &context.accepted_address );
 
-        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &context;
+    server_config.server_address_match_callback = test_match_server_address_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-        uint64_t client_id = 0;
-        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( server );
 
-        netcode_client_connect( client, connect_token );
+    netcode_server_start( server, 1 );
 
-        while ( 1 )
-        {
-            netcode_client_update( client, time );
+    // the callback replaces the built-in comparison, so the bind address alone no longer matches
 
-            netcode_server_update( server, time );
+    NETCODE_CONST char * connect_addresses[] = { "[::1]:40000", "[::1]:40000" };
+    NETCODE_CONST char * bind_address = "[::1]:40000";
 
-            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                break;
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-                break;
+    check( netcode_generate_connect_token( 1, connect_addresses, &bind_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( context.num_calls > 0 );
 
-            time += delta_time;
-        }
+    // any one address matching is enough
 
-        netcode_server_destroy( server );
+    NETCODE_CONST char * internal_addresses[] = { "10.0.0.4:40000", "10.0.0.5:40000" };
 
-        netcode_client_destroy( client );
-    }
+    check( netcode_generate_connect_token( 2, connect_addresses, internal_addresses, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+    check( netcode_server_client_connected( server, 0 ) );
 
-    {
-        double time = 0.0;
-        double delta_time = 1.0 / 10.0;
+    netcode_server_destroy( server );
 
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    netcode_client_destroy( client );
 
-        struct netcode_client_t * client = netcode_client_create( "0.0.0.0:50000", &client_config, time );
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-        check( client );
+void test_server_send_priority()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
-        server_config.protocol_id = TEST_PROTOCOL_ID;
-        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
-        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:40000", &server_config, time );
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-        check( server );
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
 
-        netcode_server_start( server, 1 );
+    check( client );
 
-        NETCODE_CONST char * server_address = "127.0.0.1:40000";
+    // pace sends at one packet per update so queued packets go out one at a time
 
-        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.send_pacing_rate = 1.0 / delta_time;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-        uint64_t client_id = 0;
-        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( server );
 
-        netcode_client_connect( client, connect_token );
+    netcode_server_start( server, 1 );
 
-        while ( 1 )
-        {
-            netcode_client_update( client, time );
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-            netcode_server_update( server, time );
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                break;
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-                break;
+    // each payload is tagged with its priority. urgent skips the queue, and low waits for everything at normal priority
 
-            time += delta_time;
-        }
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    memset( packet_data, 0, sizeof( packet_data ) );
 
-        netcode_server_destroy( server );
+    int i;
+    for ( i = 0; i < 3; ++i )
+    {
+        packet_data[0] = NETCODE_PACKET_PRIORITY_LOW;
+        netcode_server_send_packet_with_priority( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE, NETCODE_PACKET_PRIORITY_LOW );
+    }
 
-        netcode_client_destroy( client );
+    for ( i = 0; i < 3; ++i )
+    {
+        packet_data[0] = NETCODE_PACKET_PRIORITY_NORMAL;
+        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
     }
 
+    packet_data[0] = NETCODE_PACKET_PRIORITY_URGENT;
+    netcode_server_send_packet_with_priority( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE, NETCODE_PACKET_PRIORITY_URGENT );
+
+    int expected_priority[] = { NETCODE_PACKET_PRIORITY_URGENT, 
+                                NETCODE_PACKET_PRIORITY_NORMAL, 
+                                NETCODE_PACKET_PRIORITY_NORMAL, 
+                                NETCODE_PACKET_PRIORITY_NORMAL, 
+                                NETCODE_PACKET_PRIORITY_LOW, 
+                                NETCODE_PACKET_PRIORITY_LOW, 
+                                NETCODE_PACKET_PRIORITY_LOW };
+
+    int client_num_packets_received = 0;
+
+    for ( i = 0; i < 20; ++i )
     {
-        double time = 0.0;
-        double delta_time = 1.0 / 10.0;
+        netcode_network_simulator_update( network_simulator, time );
 
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+        netcode_client_update( client, time );
 
-        struct netcode_client_t * client = netcode_client_create_overload( "0.0.0.0:50000", "[::]:50000", &client_config, time );
+        netcode_server_update( server, time );
 
-        check( client );
+        while ( 1 )
+        {
+            int packet_bytes;
+            uint64_t packet_sequence;
+            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            if ( !packet )
+                break;
+            check( client_num_packets_received < 7 );
+            check( packet[0] == expected_priority[client_num_packets_received] );
+            client_num_packets_received++;
+            netcode_client_free_packet( client, packet );
+        }
 
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
-        server_config.protocol_id = TEST_PROTOCOL_ID;
-        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+        time += delta_time;
+    }
 
-        struct netcode_server_t * server = netcode_server_create( "127.0.0.1:40000", &server_config, time );
+    check( client_num_packets_received == 7 );
 
-        check( server );
+    netcode_server_destroy( server );
 
-        netcode_server_start( server, 1 );
+    netcode_client_destroy( client );
 
-        NETCODE_CONST char * server_address = "127.0.0.1:40000";
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+int test_admin_socket_command( struct netcode_server_t * server, struct netcode_socket_t * tool_socket, NETCODE_CONST char * command, double time, char * response, int response_size )
+{
+    netcode_socket_send_packet( tool_socket, &server->admin_socket.address, (void*) command, (int) strlen( command ) );
 
-        uint64_t client_id = 0;
-        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    int response_bytes = 0;
+    int i;
+    for ( i = 0; i < 100 && response_bytes == 0; ++i )
+    {
+        netcode_server_update( server, time );
+        struct netcode_address_t from;
+        response_bytes = netcode_socket_receive_packet( tool_socket, &from, response, response_size - 1 );
+        if ( response_bytes == 0 )
+            netcode_sleep( 0.001 );
+    }
 
-        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    response[response_bytes] = '\0';
 
-        netcode_client_connect( client, connect_token );
+    return response_bytes;
+}
 
-        while ( 1 )
-        {
-            netcode_client_update( client, time );
+void test_server_admin()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-            netcode_server_update( server, time );
+    double time = 0.0;
 
-            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                break;
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-                break;
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
 
-            time += delta_time;
-        }
+    check( client );
 
-        netcode_server_destroy( server );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-        netcode_client_destroy( client );
-    }
+    server_config.send_disconnect_reason = 1;
 
-    {
-        double time = 0.0;
-        double delta_time = 1.0 / 10.0;
+    // the admin interface must not be reachable from other machines
 
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    server_config.admin_address = "not an address";
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
-        struct netcode_client_t * client = netcode_client_create_overload( "0.0.0.0:50000", "[::]:50000", &client_config, time );
+    server_config.admin_address = "203.0.113.10:40001";
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
-        check( client );
+    server_config.admin_address = "127.0.0.1:0";
 
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
-        server_config.protocol_id = TEST_PROTOCOL_ID;
-        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:40000", &server_config, time );
+    check( server );
+    check( server->admin_socket.address.port != 0 );
 
-        check( server );
+    netcode_server_start( server, 2 );
 
-        netcode_server_start( server, 1 );
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-        NETCODE_CONST char * server_address = "127.0.0.1:40000";
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-        uint64_t client_id = 0;
-        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    char client_id_string[32];
+    snprintf( client_id_string, sizeof( client_id_string ), "%.16" PRIx64, (uint64_t) TEST_CLIENT_ID );
 
-        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    char response[4*1024];
 
-        netcode_client_connect( client, connect_token );
+    check( netcode_server_admin_command( server, "help", response, sizeof( response ) ) == NETCODE_OK );
+    check( strstr( response, "kick" ) != NULL );
 
-        while ( 1 )
-        {
-            netcode_client_update( client, time );
+    check( netcode_server_admin_command( server, "clients", response, sizeof( response ) ) == NETCODE_OK );
+    check( strstr( response, "1/2 clients connected" ) != NULL );
+    check( strstr( response, client_id_string ) != NULL );
 
-            netcode_server_update( server, time );
+    check( netcode_server_admin_command( server, "stats", response, sizeof( response ) ) == NETCODE_OK );
+    check( strstr( response, "challenges rate limited" ) != NULL );
 
-            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                break;
+    check( netcode_server_admin_command( server, "health", response, sizeof( response ) ) == NETCODE_OK );
+    check( strstr( response, "ok" ) == response );
 
-            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-                break;
+    check( netcode_server_admin_command( server, "frobnicate", response, sizeof( response ) ) == NETCODE_ERROR );
+    check( strstr( response, "error: unknown command" ) == response );
 
-            time += delta_time;
-        }
+    check( netcode_server_admin_command( server, "kick 1", response, sizeof( response ) ) == NETCODE_ERROR );
+    check( netcode_server_admin_command( server, "kick banana", response, sizeof( response ) ) == NETCODE_ERROR );
+    check( netcode_server_admin_command( server, "ban", response, sizeof( response ) ) == NETCODE_ERROR );
+    check( netcode_server_admin_command( server, "unban 1234", response, sizeof( response ) ) == NETCODE_ERROR );
 
-        netcode_server_destroy( server );
+    int previous_log_level = log_level;
+    check( netcode_server_admin_command( server, "log debug", response, sizeof( response ) ) == NETCODE_OK );
+    check( log_level == NETCODE_LOG_LEVEL_DEBUG );
+    check( netcode_server_admin_command( server, "log 0", response, sizeof( response ) ) == NETCODE_OK );
+    check( log_level == NETCODE_LOG_LEVEL_NONE );
+    check( netcode_server_admin_command( server, "log loud", response, sizeof( response ) ) == NETCODE_ERROR );
+    netcode_log_level( previous_log_level );
 
-        netcode_client_destroy( client );
-    }
-}
+    // kicking goes through the normal kick path, so the client hears about it
 
-void test_client_server_ipv6_socket_connect()
-{
-    {
-        double time = 0.0;
-        double delta_time = 1.0 / 10.0;
+    check( netcode_server_admin_command( server, "kick 0", response, sizeof( response ) ) == NETCODE_OK );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 100 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_KICKED );
 
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-        struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+    // banning kicks the client and refuses its fresh connect tokens until the ban is lifted
 
-        check( client );
+    char command[64];
+    snprintf( command, sizeof( command ), "ban %s", client_id_string );
+    check( netcode_server_admin_command( server, command, response, sizeof( response ) ) == NETCODE_OK );
+    check( netcode_server_client_id_banned( server, TEST_CLIENT_ID ) );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 100 ) );
 
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
-        server_config.protocol_id = TEST_PROTOCOL_ID;
-        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    check( netcode_server_admin_command( server, "bans", response, sizeof( response ) ) == NETCODE_OK );
+    check( strstr( response, client_id_string ) != NULL );
 
-        struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( netcode_server_num_connected_clients( server ) == 0 );
 
-        check( server );
+    snprintf( command, sizeof( command ), "unban 0x%s", client_id_string );
+    check( netcode_server_admin_command( server, command, response, sizeof( response ) ) == NETCODE_OK );
+    check( !netcode_server_client_id_banned( server, TEST_CLIENT_ID ) );
 
-        netcode_server_start( server, 1 );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-        NETCODE_CONST char * server_address = "[::1]:40000";
+    // the same commands work over the admin socket, one datagram each way
 
-        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    struct netcode_address_t tool_address;
+    check( netcode_parse_address( "127.0.0.1:0", &tool_address ) == NETCODE_OK );
 
-        uint64_t client_id = 0;
-        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    struct netcode_socket_t tool_socket;
+    check( netcode_socket_create( &tool_socket, &tool_address, 64 * 1024, 64 * 1024, 0, 0, 0 ) == NETCODE_SOCKET_ERROR_NONE );
 
-        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( test_admin_socket_command( server, &tool_socket, "clients\n", time, response, sizeof( response ) ) > 0 );
+    check( strstr( response, client_id_string ) != NULL );
 
-        netcode_client_connect( client, connect_token );
+    netcode_socket_destroy( &tool_socket );
 
-        while ( 1 )
-        {
-            netcode_client_update( client, time );
+    netcode_server_stop( server );
 
-            netcode_server_update( server, time );
+    check( netcode_server_admin_command( server, "health", response, sizeof( response ) ) == NETCODE_ERROR );
 
-            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                break;
+    netcode_server_destroy( server );
 
-            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-                break;
+    netcode_client_destroy( client );
 
-            time += delta_time;
-        }
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-        netcode_server_destroy( server );
+void test_server_admin_secret()
+{
+    double time = 0.0;
 
-        netcode_client_destroy( client );
-    }
-    
-    {
-        double time = 0.0;
-        double delta_time = 1.0 / 10.0;
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    server_config.admin_address = "127.0.0.1:0";
 
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    server_config.admin_secret = "";
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
-        struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+    server_config.admin_secret = "two words";
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
-        check( client );
+    // the server keeps its own copy of the secret, so the caller's string doesn't have to outlive create
 
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
-        server_config.protocol_id = TEST_PROTOCOL_ID;
-        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    char admin_secret[16];
+    strcpy( admin_secret, "hunter2" );
+    server_config.admin_secret = admin_secret;
 
-        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:40000", &server_config, time );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        check( server );
+    check( server );
 
-        netcode_server_start( server, 1 );
+    memset( admin_secret, 0, sizeof( admin_secret ) );
 
-        NETCODE_CONST char * server_address = "[::1]:40000";
+    netcode_server_start( server, 1 );
 
-        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    struct netcode_address_t tool_address;
+    check( netcode_parse_address( "127.0.0.1:0", &tool_address ) == NETCODE_OK );
 
-        uint64_t client_id = 0;
-        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    struct netcode_socket_t tool_socket;
+    check( netcode_socket_create( &tool_socket, &tool_address, 64 * 1024, 64 * 1024, 0, 0, 0 ) == NETCODE_SOCKET_ERROR_NONE );
 
-        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    // commands without the secret, or with the wrong one, get no reply
 
-        netcode_client_connect( client, connect_token );
+    char response[4*1024];
 
-        while ( 1 )
-        {
-            netcode_client_update( client, time );
+    check( test_admin_socket_command( server, &tool_socket, "health\n", time, response, sizeof( response ) ) == 0 );
+    check( test_admin_socket_command( server, &tool_socket, "hunter3 health\n", time, response, sizeof( response ) ) == 0 );
+    check( test_admin_socket_command( server, &tool_socket, "hunter2\n", time, response, sizeof( response ) ) == 0 );
+    check( test_admin_socket_command( server, &tool_socket, "hunter22 health\n", time, response, sizeof( response ) ) == 0 );
 
-            netcode_server_update( server, time );
+    check( test_admin_socket_command( server, &tool_socket, "hunter2 health\n", time, response, sizeof( response ) ) > 0 );
+    check( strstr( response, "ok" ) == response );
 
-            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                break;
+    // calls made in process don't carry the secret
 
-            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-                break;
+    check( netcode_server_admin_command( server, "health", response, sizeof( response ) ) == NETCODE_OK );
 
-            time += delta_time;
-        }
+    netcode_socket_destroy( &tool_socket );
 
-        netcode_server_destroy( server );
+    netcode_server_destroy( server );
+}
 
-        netcode_client_destroy( client );
-    }
-    
-    {
-        double time = 0.0;
-        double delta_time = 1.0 / 10.0;
+void test_server_security_events()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    struct test_server_events_t events;
+    memset( &events, 0, sizeof( events ) );
 
-        struct netcode_client_t * client = netcode_client_create_overload( "0.0.0.0:50000", "[::]:50000", &client_config, time );
+    double time = 0.0;
 
-        check( client );
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
-        server_config.protocol_id = TEST_PROTOCOL_ID;
-        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
 
-        struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+    check( client );
 
-        check( server );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &events;
+    server_config.security_event_callback = test_server_event_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-        netcode_server_start( server, 1 );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        NETCODE_CONST char * server_address = "[::1]:40000";
+    check( server );
 
-        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    netcode_server_start( server, 2 );
 
-        uint64_t client_id = 0;
-        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-        netcode_client_connect( client, connect_token );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-        while ( 1 )
-        {
-            netcode_client_update( client, time );
+    // a normal handshake is not a security event
 
-            netcode_server_update( server, time );
+    check( events.num_events == 0 );
 
-            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                break;
+    // a forged packet from the client's address fails to decrypt
 
-            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-                break;
+    struct netcode_connection_payload_packet_t * payload_packet = netcode_create_payload_packet( 16, NULL, NULL );
+    netcode_random_bytes( payload_packet->payload_data, 16 );
 
-            time += delta_time;
-        }
+    uint8_t packet_data[NETCODE_MAX_PACKET_BYTES];
+    uint8_t packet_copy[NETCODE_MAX_PACKET_BYTES];
 
-        netcode_server_destroy( server );
+    int packet_bytes = netcode_write_packet( payload_packet, packet_data, NETCODE_MAX_PACKET_BYTES, 1000000, client->context.write_packet_key, NETCODE_VERSION_INFO, TEST_PROTOCOL_ID );
+    check( packet_bytes > 0 );
+    memcpy( packet_copy, packet_data, packet_bytes );
 
-        netcode_client_destroy( client );
-    }
-    
-    {
-        double time = 0.0;
-        double delta_time = 1.0 / 10.0;
+    packet_copy[packet_bytes-1] ^= 1;
+    netcode_server_process_packet( server, &server->client_address[0], packet_copy, packet_bytes );
 
-        struct netcode_client_config_t client_config;
-        netcode_default_client_config( &client_config );
+    int invalid_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_PACKET_REJECTED, NETCODE_SERVER_EVENT_REASON_PACKET_INVALID );
+    check( invalid_event != -1 );
+    check( events.events[invalid_event].client_index == 0 );
+    check( events.events[invalid_event].client_id == TEST_CLIENT_ID );
 
-        struct netcode_client_t * client = netcode_client_create_overload( "0.0.0.0:50000", "[::]:50000", &client_config, time );
+    // a genuine packet is accepted once, then reported as a replay
 
-        check( client );
+    memcpy( packet_copy, packet_data, packet_bytes );
+    netcode_server_process_packet( server, &server->client_address[0], packet_copy, packet_bytes );
+    check( events.num_events == 1 );
 
-        struct netcode_server_config_t server_config;
-        netcode_default_server_config( &server_config );
-        server_config.protocol_id = TEST_PROTOCOL_ID;
-        memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    memcpy( packet_copy, packet_data, packet_bytes );
+    netcode_server_process_packet( server, &server->client_address[0], packet_copy, packet_bytes );
 
-        struct netcode_server_t * server = netcode_server_create_overload( "127.0.0.1:40000", "[::1]:40000", &server_config, time );
+    int replayed_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_PACKET_REJECTED, NETCODE_SERVER_EVENT_REASON_PACKET_REPLAYED );
+    check( replayed_event != -1 );
+    check( events.events[replayed_event].client_index == 0 );
 
-        check( server );
+    free( payload_packet );
 
-        netcode_server_start( server, 1 );
+    // connection requests from banned client ids are reported, ones refused for ordinary reasons are not
 
-        NETCODE_CONST char * server_address = "[::1]:40000";
+    struct netcode_client_t * client2 = netcode_client_create( "[::]:50001", &client_config, time );
 
-        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    check( client2 );
 
-        uint64_t client_id = 0;
-        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    netcode_client_connect( client2, connect_token );
+    check( !test_update_until_client_state( network_simulator, client2, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 10 ) );
+    check( test_server_events_find( &events, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CLIENT_ID_ALREADY_CONNECTED ) == -1 );
 
-        check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( netcode_server_ban_client_id( server, TEST_CLIENT_ID + 1 ) == NETCODE_OK );
 
-        netcode_client_connect( client, connect_token );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID + 1, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client2, connect_token );
+    check( !test_update_until_client_state( network_simulator, client2, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 10 ) );
 
-        while ( 1 )
-        {
-            netcode_client_update( client, time );
+    int banned_event = test_server_events_find( &events, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CLIENT_BANNED );
+    check( banned_event != -1 );
+    check( events.events[banned_event].client_id == TEST_CLIENT_ID + 1 );
 
-            netcode_server_update( server, time );
+    netcode_client_destroy( client2 );
 
-            if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                break;
+    netcode_server_destroy( server );
 
-            if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-                break;
+    netcode_client_destroy( client );
 
-            time += delta_time;
-        }
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-        netcode_server_destroy( server );
+struct test_connection_request_inspector_t
+{
+    int allow;
+    int num_calls;
+    int max_requests_per_second;
+    struct netcode_connection_request_info_t last_info;
+    uint8_t last_user_data[NETCODE_USER_DATA_BYTES];
+};
 
-        netcode_client_destroy( client );
-    }
+int test_connection_request_callback( void * context, NETCODE_CONST struct netcode_connection_request_info_t * info )
+{
+    struct test_connection_request_inspector_t * inspector = (struct test_connection_request_inspector_t*) context;
+    inspector->num_calls++;
+    inspector->last_info = *info;
+    memcpy( inspector->last_user_data, info->user_data, NETCODE_USER_DATA_BYTES );
+    if ( info->requests_per_second > inspector->max_requests_per_second )
+        inspector->max_requests_per_second = info->requests_per_second;
+    return inspector->allow;
 }
 
-void test_client_server_keep_alive()
+void test_server_connection_request_callback()
 {
     struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
+    struct test_connection_request_inspector_t inspector;
+    memset( &inspector, 0, sizeof( inspector ) );
 
     double time = 0.0;
-    double delta_time = 1.0 / 10.0;
-
-    // connect client to server
 
     struct netcode_client_config_t client_config;
     netcode_default_client_config( &client_config );
@@ -6903,6 +18423,8 @@ void test_client_server_keep_alive()
     netcode_default_server_config( &server_config );
     server_config.protocol_id = TEST_PROTOCOL_ID;
     server_config.network_simulator = network_simulator;
+    server_config.callback_context = &inspector;
+    server_config.connection_request_callback = test_connection_request_callback;
     memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
     struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
@@ -6913,60 +18435,122 @@ void test_client_server_keep_alive()
 
     NETCODE_CONST char * server_address = "[::1]:40000";
 
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+
     uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, user_data, connect_token ) );
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    struct netcode_connect_token_t connect_token_public;
+    check( netcode_read_connect_token( connect_token, NETCODE_CONNECT_TOKEN_BYTES, &connect_token_public ) == NETCODE_OK );
+
+    // a vetoed request is dropped, and the client keeps asking until it gives up
 
     netcode_client_connect( client, connect_token );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( netcode_server_num_connected_clients( server ) == 0 );
 
-    while ( 1 )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+    check( inspector.num_calls > 1 );
+    check( inspector.max_requests_per_second > 1 );
+    check( inspector.last_info.client_id == TEST_CLIENT_ID );
+    check( inspector.last_info.protocol_id == TEST_PROTOCOL_ID );
+    check( inspector.last_info.expire_timestamp == connect_token_public.expire_timestamp );
+    check( inspector.last_info.address.port == 50000 );
+    check( memcmp( inspector.last_user_data, user_data, NETCODE_USER_DATA_BYTES ) == 0 );
 
-        netcode_client_update( client, time );
+    // the token was not spent by the vetoed requests, so it still works once the callback allows it
 
-        netcode_server_update( server, time );
+    inspector.allow = 1;
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-            break;
+    netcode_server_destroy( server );
 
-        time += delta_time;
-    }
+    netcode_client_destroy( client );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_index( client ) == 0 );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-    // pump the client and server long enough that they would timeout without keep alive packets
+struct test_source_filter_t
+{
+    int allow;
+    int num_calls;
+    struct netcode_address_t last_address;
+    struct test_server_events_t events;
+};
 
-    int num_iterations = (int) ceil( 1.25f * TEST_TIMEOUT_SECONDS / delta_time );
+int test_source_filter_callback( void * context, NETCODE_CONST struct netcode_address_t * address )
+{
+    struct test_source_filter_t * filter = (struct test_source_filter_t*) context;
+    filter->num_calls++;
+    filter->last_address = *address;
+    return filter->allow;
+}
 
-    int i;
-    for ( i = 0; i < num_iterations; ++i )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+void test_source_filter_event_callback( void * context, NETCODE_CONST struct netcode_server_event_t * event )
+{
+    struct test_source_filter_t * filter = (struct test_source_filter_t*) context;
+    test_server_event_callback( &filter->events, event );
+}
 
-        netcode_client_update( client, time );
+void test_server_source_filter()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-        netcode_server_update( server, time );
+    struct test_source_filter_t filter;
+    memset( &filter, 0, sizeof( filter ) );
+
+    double time = 0.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.callback_context = &filter;
+    server_config.source_filter_callback = test_source_filter_callback;
+    server_config.event_callback = test_source_filter_event_callback;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+
+    check( server );
+
+    netcode_server_start( server, 1 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+
+    // requests from a filtered source are dropped before the connect token is looked at
+
+    netcode_client_connect( client, connect_token );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+
+    check( filter.num_calls > 1 );
+    check( filter.last_address.type == NETCODE_ADDRESS_IPV6 );
+    check( filter.last_address.port == 50000 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_SOURCE_FILTERED] == (uint64_t) filter.num_calls );
+    check( test_server_events_find( &filter.events, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_SOURCE_FILTERED ) >= 0 );
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    // once the source is allowed the same token connects
 
-        time += delta_time;
-    }
+    filter.allow = 1;
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_index( client ) == 0 );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
     netcode_server_destroy( server );
 
@@ -6975,250 +18559,205 @@ void test_client_server_keep_alive()
     netcode_network_simulator_destroy( network_simulator );
 }
 
-void test_client_server_multiple_clients()
+void test_server_allow_list()
 {
-    #define NUM_START_STOP_ITERATIONS 3
-
-    int max_clients[NUM_START_STOP_ITERATIONS] = { 2, 32, 5 };
-
     struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
+    struct test_server_events_t events;
+    memset( &events, 0, sizeof( events ) );
 
     double time = 0.0;
-    double delta_time = 1.0 / 10.0;
+
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
+
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+
+    check( client );
 
     struct netcode_server_config_t server_config;
     netcode_default_server_config( &server_config );
     server_config.protocol_id = TEST_PROTOCOL_ID;
     server_config.network_simulator = network_simulator;
+    server_config.callback_context = &events;
+    server_config.event_callback = test_server_event_callback;
+    server_config.send_disconnect_reason = 1;
+    server_config.allow_list_only = 1;
     memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
     struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
     check( server );
 
-    uint64_t token_sequence = 0;
-
-    int i;
-    for ( i = 0; i < NUM_START_STOP_ITERATIONS; ++i )
-    {
-        // start the server with max # of clients for this iteration
-
-        netcode_server_start( server, max_clients[i] );
-
-        // create # of client objects for this iteration and connect to server
-
-        struct netcode_client_t ** client = (struct netcode_client_t **) malloc( sizeof( struct netcode_client_t* ) * max_clients[i] );
-
-        check( client );
+    netcode_server_start( server, 1 );
 
-        int j;
-        for ( j = 0; j < max_clients[i]; ++j )
-        {
-            char client_address[NETCODE_MAX_ADDRESS_STRING_LENGTH];
-            sprintf( client_address, "[::]:%d", 50000 + j );
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-            struct netcode_client_config_t client_config;
-            netcode_default_client_config( &client_config );
-            client_config.network_simulator = network_simulator;
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-            client[j] = netcode_client_create( client_address, &client_config, time );
+    // a valid connect token is not enough when the client id is not on the allow list
 
-            check( client[j] );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+    check( test_server_events_find( &events, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CLIENT_NOT_ALLOWED ) >= 0 );
 
-            uint64_t client_id = j;
-            netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    check( netcode_server_disallow_client_id( server, TEST_CLIENT_ID ) == NETCODE_ERROR );
+    check( netcode_server_allow_client_id( server, TEST_CLIENT_ID ) == NETCODE_OK );
+    check( netcode_server_allow_client_id( server, TEST_CLIENT_ID ) == NETCODE_OK );
+    check( netcode_server_client_id_allowed( server, TEST_CLIENT_ID ) );
 
-            NETCODE_CONST char * server_address = "[::1]:40000";
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-            uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    // removing a connected client from the allow list kicks it
 
-            check( netcode_generate_connect_token( 1, 
-                                                   &server_address, 
-                                                   &server_address, 
-                                                   TEST_CONNECT_TOKEN_EXPIRY, 
-                                                   TEST_TIMEOUT_SECONDS,
-                                                   client_id, 
-                                                   TEST_PROTOCOL_ID, 
-                                                   token_sequence++, 
-                                                   private_key, 
-                                                   connect_token ) );
+    check( netcode_server_disallow_client_id( server, TEST_CLIENT_ID ) == NETCODE_OK );
+    check( !netcode_server_client_id_allowed( server, TEST_CLIENT_ID ) );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 100 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_KICKED );
 
-            netcode_client_connect( client[j], connect_token );
-        }
+    // bans win over the allow list
 
-        // make sure all clients can connect
+    check( netcode_server_allow_client_id( server, TEST_CLIENT_ID ) == NETCODE_OK );
+    check( netcode_server_ban_client_id( server, TEST_CLIENT_ID ) == NETCODE_OK );
 
-        while ( 1 )
-        {
-            netcode_network_simulator_update( network_simulator, time );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( netcode_server_num_connected_clients( server ) == 0 );
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                netcode_client_update( client[j], time );
-            }
+    check( netcode_server_unban_client_id( server, TEST_CLIENT_ID ) == NETCODE_OK );
 
-            netcode_server_update( server, time );
+    // the allow list is kept but not enforced once allow list only is turned off
 
-            int num_connected_clients = 0;
+    char response[1024];
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                if ( netcode_client_state( client[j] ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                    break;
+    check( netcode_server_admin_command( server, "allowed", response, sizeof( response ) ) == NETCODE_OK );
+    check( strstr( response, "1/" ) == response );
 
-                if ( netcode_client_state( client[j] ) == NETCODE_CLIENT_STATE_CONNECTED )
-                    num_connected_clients++;
-            }
+    check( netcode_server_admin_command( server, "disallow 0x1234", response, sizeof( response ) ) == NETCODE_ERROR );
+    check( netcode_server_admin_command( server, "allow banana", response, sizeof( response ) ) == NETCODE_ERROR );
 
-            if ( num_connected_clients == max_clients[i] )
-                break;
+    check( netcode_server_disallow_client_id( server, TEST_CLIENT_ID ) == NETCODE_OK );
 
-            time += delta_time;
-        }
+    server_config.allow_list_only = 0;
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
 
-        check( netcode_server_num_connected_clients( server ) == max_clients[i] );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-        for ( j = 0; j < max_clients[i]; ++j )
-        {
-            check( netcode_client_state( client[j] ) == NETCODE_CLIENT_STATE_CONNECTED );
-            check( netcode_server_client_connected( server, j ) == 1 );
-        }
+    netcode_server_destroy( server );
 
-        // make sure all clients can exchange packets with the server
+    netcode_client_destroy( client );
 
-        int * server_num_packets_received = (int*) malloc( sizeof(int) * max_clients[i] );
-        int * client_num_packets_received = (int*) malloc( sizeof(int) * max_clients[i] );
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-        memset( server_num_packets_received, 0, sizeof(int) * max_clients[i] );
-        memset( client_num_packets_received, 0, sizeof(int) * max_clients[i] );
+void test_server_duplicate_client_id()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-        uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
-        for ( j = 0; j < NETCODE_MAX_PACKET_SIZE; ++j )
-            packet_data[j] = (uint8_t) j;
+    double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
-        while ( 1 )
-        {
-            netcode_network_simulator_update( network_simulator, time );
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                netcode_client_update( client[j], time );
-            }
+    struct netcode_client_t * old_client = netcode_client_create( "[::]:50000", &client_config, time );
+    struct netcode_client_t * new_client = netcode_client_create( "[::]:50001", &client_config, time );
 
-            netcode_server_update( server, time );
+    check( old_client );
+    check( new_client );
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                netcode_client_send_packet( client[j], packet_data, NETCODE_MAX_PACKET_SIZE );
-            }
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    server_config.send_disconnect_reason = 1;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                netcode_server_send_packet( server, j, packet_data, NETCODE_MAX_PACKET_SIZE );
-            }
+    server_config.duplicate_client_id_policy = 2;
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+    server_config.duplicate_client_id_policy = NETCODE_DUPLICATE_CLIENT_ID_DENY;
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                while ( 1 )             
-                {
-                    int packet_bytes;
-                    uint64_t packet_sequence;
-                    uint8_t * packet = netcode_client_receive_packet( client[j], &packet_bytes, &packet_sequence );
-                    if ( !packet )
-                        break;
-                    (void) packet_sequence;
-                    netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
-                    netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
-                    client_num_packets_received[j]++;
-                    netcode_client_free_packet( client[j], packet );
-                }
-            }
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                while ( 1 )             
-                {
-                    int packet_bytes;
-                    uint64_t packet_sequence;
-                    void * packet = netcode_server_receive_packet( server, j, &packet_bytes, &packet_sequence );
-                    if ( !packet )
-                        break;
-                    (void) packet_sequence;
-                    netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
-                    netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
-                    server_num_packets_received[j]++;
-                    netcode_server_free_packet( server, packet );
-                }
-            }
+    check( server );
 
-            int num_clients_ready = 0;
+    netcode_server_start( server, 2 );
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                if ( client_num_packets_received[j] >= 1 && server_num_packets_received[j] >= 1 )
-                {
-                    num_clients_ready++;
-                }
-            }
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-            if ( num_clients_ready == max_clients[i] )
-                break;
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-            for ( j = 0; j < max_clients[i]; ++j )
-            {
-                if ( netcode_client_state( client[j] ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-                    break;
-            }
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( old_client, connect_token );
+    check( test_update_until_client_state( network_simulator, old_client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-            time += delta_time;
-        }
+    // by default a second session for a connected client id is refused and the first keeps its slot
 
-        int num_clients_ready = 0;
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( new_client, connect_token );
 
-        for ( j = 0; j < max_clients[i]; ++j )
-        {
-            if ( client_num_packets_received[j] >= 1 && server_num_packets_received[j] >= 1 )
-            {
-                num_clients_ready++;
-            }
-        }
+    int iteration;
+    for ( iteration = 0; iteration < 20; ++iteration )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+        netcode_client_update( old_client, time );
+        netcode_client_update( new_client, time );
+        netcode_server_update( server, time );
+        time += delta_time;
+    }
 
-        check( num_clients_ready == max_clients[i] );
+    check( netcode_client_state( new_client ) != NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_state( old_client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_server_num_connected_clients( server ) == 1 );
 
-        free( server_num_packets_received );
-        free( client_num_packets_received );
-        
-        netcode_network_simulator_reset( network_simulator );
+    // with the replace policy the new session takes over and the old one is told why it was dropped
 
-        for ( j = 0; j < max_clients[i]; ++j )
-        {
-            netcode_client_destroy( client[j] );
-        }
+    server_config.duplicate_client_id_policy = 2;
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_ERROR );
+    server_config.duplicate_client_id_policy = NETCODE_DUPLICATE_CLIENT_ID_REPLACE;
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
 
-        free( client );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( new_client, connect_token );
 
-        netcode_server_stop( server );
+    for ( iteration = 0; iteration < 100; ++iteration )
+    {
+        netcode_network_simulator_update( network_simulator, time );
+        netcode_client_update( old_client, time );
+        netcode_client_update( new_client, time );
+        netcode_server_update( server, time );
+        if ( netcode_client_state( new_client ) == NETCODE_CLIENT_STATE_CONNECTED && netcode_client_state( old_client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
+            break;
+        time += delta_time;
     }
 
+    check( netcode_client_state( new_client ) == NETCODE_CLIENT_STATE_CONNECTED );
+    check( netcode_client_state( old_client ) == NETCODE_CLIENT_STATE_DISCONNECTED );
+    check( netcode_client_disconnect_reason( old_client ) == NETCODE_DISCONNECT_REASON_REPLACED );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+    check( netcode_server_client_id( server, netcode_client_index( new_client ) ) == TEST_CLIENT_ID );
+
     netcode_server_destroy( server );
 
+    netcode_client_destroy( old_client );
+    netcode_client_destroy( new_client );
+
     netcode_network_simulator_destroy( network_simulator );
 }
 
-void test_client_server_multiple_servers()
+void test_server_session_snapshot()
 {
     struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
-
     double time = 0.0;
     double delta_time = 1.0 / 10.0;
 
@@ -7240,160 +18779,197 @@ void test_client_server_multiple_servers()
 
     check( server );
 
-    netcode_server_start( server, 1 );
+    netcode_server_start( server, 4 );
+
+    NETCODE_CONST char * server_address = "[::1]:40000";
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, user_data, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+
+    int client_index = netcode_client_index( client );
+
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
+        packet_data[i] = (uint8_t) i;
+
+    // exchange some packets first, so there are sequence numbers and replay protection state worth keeping
+
+    int iteration;
+    for ( iteration = 0; iteration < 10; ++iteration )
+    {
+        netcode_client_send_packet( client, packet_data, NETCODE_MAX_PACKET_SIZE );
+        netcode_server_send_packet( server, client_index, packet_data, NETCODE_MAX_PACKET_SIZE );
+        netcode_network_simulator_update( network_simulator, time );
+        netcode_client_update( client, time );
+        netcode_server_update( server, time );
+        time += delta_time;
+    }
 
-    NETCODE_CONST char * server_address[] = { "10.10.10.10:1000", "100.100.100.100:50000", "[::1]:40000" };
+    int snapshot_bytes = netcode_server_session_snapshot_bytes( server );
 
-    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    uint8_t * snapshot = (uint8_t*) malloc( snapshot_bytes );
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    check( netcode_server_write_session_snapshot( server, snapshot, snapshot_bytes - 1 ) == 0 );
+    check( netcode_server_write_session_snapshot( server, snapshot, snapshot_bytes ) == snapshot_bytes );
 
-    check( netcode_generate_connect_token( 3, server_address, server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    // once the snapshot is written the old server sends nothing more, so it can't use sequence numbers the restored sessions will
 
-    netcode_client_connect( client, connect_token );
+    uint64_t snapshot_sequence = server->client_sequence[client_index];
 
-    while ( 1 )
+    for ( iteration = 0; iteration < 10; ++iteration )
     {
+        netcode_server_send_packet( server, client_index, packet_data, NETCODE_MAX_PACKET_SIZE );
         netcode_network_simulator_update( network_simulator, time );
-
         netcode_client_update( client, time );
-
         netcode_server_update( server, time );
+        time += delta_time;
+    }
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    check( server->client_sequence[client_index] == snapshot_sequence );
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
+    while ( 1 )
+    {
+        int packet_bytes;
+        uint64_t packet_sequence;
+        void * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+        if ( !packet )
             break;
-
-        time += delta_time;
+        check( packet_sequence < snapshot_sequence );
+        netcode_client_free_packet( client, packet );
     }
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_index( client ) == 0 );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
+    // the old server goes away without telling the client, and a new one comes up on the same address
 
-    int server_num_packets_received = 0;
-    int client_num_packets_received = 0;
+    netcode_server_stop_for_restart( server );
+    netcode_server_destroy( server );
 
-    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
-    int i;
-    for ( i = 0; i < NETCODE_MAX_PACKET_SIZE; ++i )
-        packet_data[i] = (uint8_t) i;
+    server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    while ( 1 )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+    check( server );
 
-        netcode_client_update( client, time );
+    // snapshots must be read into a running server, and are only good for the key and protocol they were written with
 
-        netcode_server_update( server, time );
+    check( netcode_server_read_session_snapshot( server, snapshot, snapshot_bytes ) == NETCODE_ERROR );
+
+    netcode_server_start( server, 4 );
+
+    snapshot[snapshot_bytes - 1] ^= 1;
+    check( netcode_server_read_session_snapshot( server, snapshot, snapshot_bytes ) == NETCODE_ERROR );
+    snapshot[snapshot_bytes - 1] ^= 1;
+
+    check( netcode_server_read_session_snapshot( server, snapshot, snapshot_bytes - 1 ) == NETCODE_ERROR );
+    check( netcode_server_num_connected_clients( server ) == 0 );
+
+    check( netcode_server_read_session_snapshot( server, snapshot, snapshot_bytes ) == NETCODE_OK );
+
+    check( netcode_server_num_connected_clients( server ) == 1 );
+    check( netcode_server_client_connected( server, client_index ) );
+    check( netcode_server_client_id( server, client_index ) == TEST_CLIENT_ID );
+    check( memcmp( netcode_server_client_user_data( server, client_index ), user_data, NETCODE_USER_DATA_BYTES ) == 0 );
+
+    // reading it again is refused, and does not duplicate the session
+
+    check( netcode_server_read_session_snapshot( server, snapshot, snapshot_bytes ) == NETCODE_ERROR );
+    check( netcode_server_num_connected_clients( server ) == 1 );
+
+    // the client never noticed the restart, and packets keep flowing both ways
+
+    int client_num_packets_received = 0;
+    int server_num_packets_received = 0;
 
+    for ( iteration = 0; iteration < 50; ++iteration )
+    {
         netcode_client_send_packet( client, packet_data, NETCODE_MAX_PACKET_SIZE );
+        netcode_server_send_packet( server, client_index, packet_data, NETCODE_MAX_PACKET_SIZE );
 
-        netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
+        netcode_network_simulator_update( network_simulator, time );
+        netcode_client_update( client, time );
+        netcode_server_update( server, time );
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
-            uint8_t * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
+            void * packet = netcode_client_receive_packet( client, &packet_bytes, &packet_sequence );
             if ( !packet )
                 break;
-            (void) packet_sequence;
-            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
-            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            check( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            check( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );
             client_num_packets_received++;
             netcode_client_free_packet( client, packet );
         }
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
-            void * packet = netcode_server_receive_packet( server, 0, &packet_bytes, &packet_sequence );
+            void * packet = netcode_server_receive_packet( server, client_index, &packet_bytes, &packet_sequence );
             if ( !packet )
                 break;
-            netcode_assert( packet_bytes == NETCODE_MAX_PACKET_SIZE );
-            netcode_assert( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );            
+            check( packet_bytes == NETCODE_MAX_PACKET_SIZE );
+            check( memcmp( packet, packet_data, NETCODE_MAX_PACKET_SIZE ) == 0 );
             server_num_packets_received++;
             netcode_server_free_packet( server, packet );
         }
 
-        if ( client_num_packets_received >= 10 && server_num_packets_received >= 10 )
-        {
-            if ( netcode_server_client_connected( server, 0 ) )
-            {
-                netcode_server_disconnect_client( server, 0 );
-            }
-        }
-
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+        check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
 
         time += delta_time;
     }
 
-    check( client_num_packets_received >= 10 && server_num_packets_received >= 10 );
-
-    netcode_server_destroy( server );
-
-    netcode_client_destroy( client );
-
-    netcode_network_simulator_destroy( network_simulator );
-}
-
-void test_client_error_connect_token_expired()
-{
-    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
-
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
-
-    double time = 0.0;
+    check( client_num_packets_received >= 10 );
+    check( server_num_packets_received >= 10 );
+    check( netcode_server_client_connected( server, client_index ) );
 
-    struct netcode_client_config_t client_config;
-    netcode_default_client_config( &client_config );
-    client_config.network_simulator = network_simulator;
+    // the used token set came across too, so the token the client connected with can't be spent again from somewhere else
 
-    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+    netcode_client_disconnect( client );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 10 ) );
+    check( netcode_server_num_connected_clients( server ) == 0 );
 
-    check( client );
+    struct test_server_events_t events;
+    memset( &events, 0, sizeof( events ) );
 
-    NETCODE_CONST char * server_address = "[::1]:40000";
+    server_config.callback_context = &events;
+    server_config.event_callback = test_server_event_callback;
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
 
-    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    struct netcode_client_t * other_client = netcode_client_create( "[::]:50001", &client_config, time );
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    check( other_client );
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, 0, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    netcode_client_connect( other_client, connect_token );
+    check( !test_update_until_client_state( network_simulator, other_client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( test_server_events_find( &events, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_CONNECT_TOKEN_ALREADY_USED ) >= 0 );
 
-    netcode_client_connect( client, connect_token );
+    netcode_client_destroy( other_client );
 
-    netcode_client_update( client, time );
+    free( snapshot );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECT_TOKEN_EXPIRED );
+    netcode_server_destroy( server );
 
     netcode_client_destroy( client );
 
     netcode_network_simulator_destroy( network_simulator );
 }
 
-void test_client_error_invalid_connect_token()
+void test_server_session_snapshot_restore_twice()
 {
-    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+    test_timestamp_value = (uint64_t) time( NULL );
 
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
+    netcode_set_timestamp_function( test_timestamp_function );
+
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
     double time = 0.0;
+    double delta_time = 1.0 / 10.0;
 
     struct netcode_client_config_t client_config;
     netcode_default_client_config( &client_config );
@@ -7403,274 +18979,339 @@ void test_client_error_invalid_connect_token()
 
     check( client );
 
-    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
-    netcode_random_bytes( connect_token, NETCODE_CONNECT_TOKEN_BYTES );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    netcode_client_connect( client, connect_token );
+    check( server );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_INVALID_CONNECT_TOKEN );
+    netcode_server_start( server, 4 );
 
-    netcode_client_destroy( client );
+    NETCODE_CONST char * server_address = "[::1]:40000";
 
-    netcode_network_simulator_destroy( network_simulator );
-}
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-void test_client_error_connection_timed_out()
-{
-    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
+    uint8_t user_data[NETCODE_USER_DATA_BYTES];
+    netcode_random_bytes( user_data, NETCODE_USER_DATA_BYTES );
 
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, user_data, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-    double time = 0.0;
-    double delta_time = 1.0 / 10.0;
+    int client_index = netcode_client_index( client );
 
-    // connect a client to the server
+    uint64_t snapshot_sequence = server->client_sequence[client_index];
 
-    struct netcode_client_config_t client_config;
-    netcode_default_client_config( &client_config );
-    client_config.network_simulator = network_simulator;
+    int snapshot_bytes = netcode_server_session_snapshot_bytes( server );
 
-    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+    uint8_t * snapshot = (uint8_t*) malloc( snapshot_bytes );
 
-    check( client );
+    check( netcode_server_write_session_snapshot( server, snapshot, snapshot_bytes ) == snapshot_bytes );
 
-    struct netcode_server_config_t server_config;
-    netcode_default_server_config( &server_config );
-    server_config.protocol_id = TEST_PROTOCOL_ID;
-    server_config.network_simulator = network_simulator;
-    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+    netcode_server_stop_for_restart( server );
+    netcode_server_destroy( server );
 
-    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+    // the first restore sends a while and then dies, eg. it crashed during the handover
 
-    check( server );
+    server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    netcode_server_start( server, 1 );
+    check( server );
 
-    NETCODE_CONST char * server_address = "[::1]:40000";
+    netcode_server_start( server, 4 );
 
-    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    check( netcode_server_read_session_snapshot( server, snapshot, snapshot_bytes ) == NETCODE_OK );
+    check( netcode_server_client_connected( server, client_index ) );
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    uint64_t first_restore_sequence = server->client_sequence[client_index];
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( first_restore_sequence > snapshot_sequence );
 
-    netcode_client_connect( client, connect_token );
+    uint8_t packet_data[NETCODE_MAX_PACKET_SIZE];
+    memset( packet_data, 0, NETCODE_MAX_PACKET_SIZE );
 
-    while ( 1 )
+    int iteration;
+    for ( iteration = 0; iteration < 10; ++iteration )
     {
+        netcode_server_send_packet( server, client_index, packet_data, NETCODE_MAX_PACKET_SIZE );
         netcode_network_simulator_update( network_simulator, time );
-
         netcode_client_update( client, time );
-
         netcode_server_update( server, time );
+        time += delta_time;
+    }
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    uint64_t first_restore_last_sequence = server->client_sequence[client_index];
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-            break;
+    check( first_restore_last_sequence > first_restore_sequence );
 
-        time += delta_time;
-    }
+    netcode_server_stop_for_restart( server );
+    netcode_server_destroy( server );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_index( client ) == 0 );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
+    // the same snapshot is restored again a second later, and must start past everything the first restore sent
 
-    // now disable updating the server and verify that the client times out
+    test_timestamp_value++;
 
-    while ( 1 )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+    server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-        netcode_client_update( client, time );
+    check( server );
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    netcode_server_start( server, 4 );
 
-        time += delta_time;
-    }
+    check( netcode_server_read_session_snapshot( server, snapshot, snapshot_bytes ) == NETCODE_OK );
+    check( netcode_server_client_connected( server, client_index ) );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_TIMED_OUT );
+    check( server->client_sequence[client_index] >= first_restore_last_sequence );
+
+    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
+
+    free( snapshot );
 
     netcode_server_destroy( server );
 
     netcode_client_destroy( client );
 
     netcode_network_simulator_destroy( network_simulator );
+
+    netcode_set_timestamp_function( NULL );
 }
 
-void test_client_error_connection_response_timeout()
+void test_server_pause()
 {
     struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
+    struct test_server_events_t events;
+    memset( &events, 0, sizeof( events ) );
 
     double time = 0.0;
-    double delta_time = 1.0 / 10.0;
 
     struct netcode_client_config_t client_config;
     netcode_default_client_config( &client_config );
     client_config.network_simulator = network_simulator;
 
     struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+    struct netcode_client_t * late_client = netcode_client_create( "[::]:50001", &client_config, time );
 
     check( client );
+    check( late_client );
 
     struct netcode_server_config_t server_config;
     netcode_default_server_config( &server_config );
     server_config.protocol_id = TEST_PROTOCOL_ID;
     server_config.network_simulator = network_simulator;
+    server_config.callback_context = &events;
+    server_config.event_callback = test_server_event_callback;
     memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
     struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
     check( server );
 
-    server->flags = NETCODE_SERVER_FLAG_IGNORE_CONNECTION_RESPONSE_PACKETS;
-
-    netcode_server_start( server, 1 );
+    netcode_server_start( server, 2 );
 
     NETCODE_CONST char * server_address = "[::1]:40000";
 
     uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    int client_index = netcode_client_index( client );
 
-    netcode_client_connect( client, connect_token );
+    // a paused server turns new connections away
 
-    while ( 1 )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+    netcode_server_pause( server, 1 );
+    check( netcode_server_paused( server ) );
 
-        netcode_client_update( client, time );
+    uint8_t late_connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-        netcode_server_update( server, time );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID + 1, TEST_PROTOCOL_ID, private_key, NULL, late_connect_token ) );
+    netcode_client_connect( late_client, late_connect_token );
+    check( !test_update_until_client_state( network_simulator, late_client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
+    check( test_server_events_find( &events, NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED, NETCODE_SERVER_EVENT_REASON_SERVER_PAUSED ) >= 0 );
+    check( netcode_server_num_connected_clients( server ) == 1 );
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    // with timeouts frozen, a client that goes quiet for longer than its timeout keeps its slot, including right after resume
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED  )
-            break;
+    time += TEST_TIMEOUT_SECONDS + 1;
+    netcode_server_update( server, time );
+    check( netcode_server_client_connected( server, client_index ) );
 
-        time += delta_time;
-    }
+    netcode_server_resume( server );
+    check( !netcode_server_paused( server ) );
+    netcode_server_update( server, time );
+    check( netcode_server_client_connected( server, client_index ) );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_RESPONSE_TIMED_OUT );
+    netcode_client_update( late_client, time );
+    netcode_client_connect( late_client, late_connect_token );
+    check( test_update_until_client_state( network_simulator, late_client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+
+    // without freezing, timeouts keep counting while paused
+
+    netcode_server_pause( server, 0 );
+
+    time += TEST_TIMEOUT_SECONDS + 1;
+    netcode_server_update( server, time );
+    netcode_server_update( server, time );
+    check( !netcode_server_client_connected( server, client_index ) );
+
+    // pause and resume are also admin commands
+
+    netcode_server_resume( server );
+
+    char response[1024];
+
+    check( netcode_server_admin_command( server, "pause banana", response, sizeof( response ) ) == NETCODE_ERROR );
+    check( !netcode_server_paused( server ) );
+    check( netcode_server_admin_command( server, "pause freeze", response, sizeof( response ) ) == NETCODE_OK );
+    check( netcode_server_paused( server ) );
+    check( netcode_server_admin_command( server, "stats", response, sizeof( response ) ) == NETCODE_OK );
+    check( strstr( response, "timeouts frozen" ) != NULL );
+    check( netcode_server_admin_command( server, "resume", response, sizeof( response ) ) == NETCODE_OK );
+    check( !netcode_server_paused( server ) );
 
     netcode_server_destroy( server );
 
     netcode_client_destroy( client );
+    netcode_client_destroy( late_client );
 
     netcode_network_simulator_destroy( network_simulator );
 }
 
-void test_client_error_connection_request_timeout()
+void test_server_keep_alive_jitter()
 {
-    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
-
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
-
     double time = 0.0;
-    double delta_time = 1.0 / 60.0;
-
-    struct netcode_client_config_t client_config;
-    netcode_default_client_config( &client_config );
-    client_config.network_simulator = network_simulator;
-
-    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
-
-    check( client );
 
     struct netcode_server_config_t server_config;
     netcode_default_server_config( &server_config );
     server_config.protocol_id = TEST_PROTOCOL_ID;
-    server_config.network_simulator = network_simulator;
     memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
+    server_config.keep_alive_jitter = 1.5;
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+
+    server_config.keep_alive_jitter = 0.5;
+
     struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
     check( server );
 
-    server->flags = NETCODE_SERVER_FLAG_IGNORE_CONNECTION_REQUEST_PACKETS;
+    netcode_server_start( server, NETCODE_MAX_CLIENTS );
 
-    netcode_server_start( server, 1 );
+    // offsets stay within half the jitter either side of the send interval and don't all land on the same value
 
-    NETCODE_CONST char * server_address = "[::1]:40000";
+    double interval = 1.0 / server_config.packet_send_rate;
+    double min_offset = interval;
+    double max_offset = -interval;
 
-    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    int i;
+    for ( i = 0; i < NETCODE_MAX_CLIENTS; ++i )
+    {
+        double offset = netcode_server_keep_alive_offset( server, i );
+        check( offset >= -interval * 0.25 - 0.000001 );
+        check( offset <= interval * 0.25 + 0.000001 );
+        if ( offset < min_offset ) min_offset = offset;
+        if ( offset > max_offset ) max_offset = offset;
+    }
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    check( max_offset - min_offset > interval * 0.1 );
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    // zero jitter turns it off
 
-    netcode_client_connect( client, connect_token );
+    struct netcode_server_config_t new_config = server_config;
+    new_config.keep_alive_jitter = -0.1;
+    check( netcode_server_update_config( server, &new_config ) == NETCODE_ERROR );
 
-    while ( 1 )
+    new_config.keep_alive_jitter = 0.0;
+    check( netcode_server_update_config( server, &new_config ) == NETCODE_OK );
+
+    for ( i = 0; i < NETCODE_MAX_CLIENTS; ++i )
     {
-        netcode_network_simulator_update( network_simulator, time );
+        check( netcode_server_keep_alive_offset( server, i ) == 0.0 );
+    }
 
-        netcode_client_update( client, time );
+    netcode_server_destroy( server );
+}
 
-        netcode_server_update( server, time );
+void test_send_wheel()
+{
+    struct netcode_send_wheel_t wheel;
+    netcode_send_wheel_reset( &wheel, 10.0 );
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    int due[NETCODE_MAX_CLIENTS];
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED  )
-            break;
+    // nothing is due until its time comes
 
-        time += delta_time;
-    }
+    netcode_send_wheel_insert( &wheel, 0, 10.1 );
+    netcode_send_wheel_insert( &wheel, 1, 10.5 );
+    netcode_send_wheel_insert( &wheel, 2, 9.0 );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTION_REQUEST_TIMED_OUT );
+    check( netcode_send_wheel_advance( &wheel, 10.0, due ) == 1 );
+    check( due[0] == 2 );
+    check( wheel.entry_slot[2] == -1 );
 
-    netcode_server_destroy( server );
+    check( netcode_send_wheel_advance( &wheel, 10.09, due ) == 0 );
+    check( netcode_send_wheel_advance( &wheel, 10.1, due ) == 1 );
+    check( due[0] == 0 );
 
-    netcode_client_destroy( client );
+    // removed entries never come due, and inserting again moves an entry rather than adding it twice
 
-    netcode_network_simulator_destroy( network_simulator );
+    netcode_send_wheel_remove( &wheel, 1 );
+    netcode_send_wheel_insert( &wheel, 3, 10.2 );
+    netcode_send_wheel_insert( &wheel, 3, 10.3 );
+    check( netcode_send_wheel_advance( &wheel, 10.25, due ) == 0 );
+    check( netcode_send_wheel_advance( &wheel, 10.6, due ) == 1 );
+    check( due[0] == 3 );
+
+    // entries more than a turn of the wheel away wait for their turn, and a big jump in time still finds everything due
+
+    double turn_seconds = NETCODE_SEND_WHEEL_SLOTS * NETCODE_SEND_WHEEL_SLOT_SECONDS;
+
+    netcode_send_wheel_insert( &wheel, 4, 10.7 + turn_seconds * 2.5 );
+    netcode_send_wheel_insert( &wheel, 5, 10.7 );
+
+    check( netcode_send_wheel_advance( &wheel, 10.7 + turn_seconds, due ) == 1 );
+    check( due[0] == 5 );
+    check( netcode_send_wheel_advance( &wheel, 10.7 + turn_seconds * 2, due ) == 0 );
+    check( netcode_send_wheel_advance( &wheel, 10.7 + turn_seconds * 10, due ) == 1 );
+    check( due[0] == 4 );
+
+    int i;
+    for ( i = 0; i < NETCODE_SEND_WHEEL_SLOTS; ++i )
+    {
+        check( wheel.slot_head[i] == -1 );
+    }
 }
 
-void test_client_error_connection_denied()
+void test_packet_queue_config()
 {
     struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    network_simulator->latency_milliseconds = 250;
-    network_simulator->jitter_milliseconds = 250;
-    network_simulator->packet_loss_percent = 5;
-    network_simulator->duplicate_packet_percent = 10;
-
-    // start a server and connect one client
-
     double time = 0.0;
-    double delta_time = 1.0 / 10.0;
+
+    // queues are fixed size rings, so a capacity past the end or an unknown policy is refused at create
 
     struct netcode_client_config_t client_config;
     netcode_default_client_config( &client_config );
     client_config.network_simulator = network_simulator;
 
-    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
+    client_config.packet_queue_size = 0;
+    check( netcode_client_create( "[::]:50000", &client_config, time ) == NULL );
+
+    client_config.packet_queue_size = NETCODE_PACKET_QUEUE_SIZE + 1;
+    check( netcode_client_create( "[::]:50000", &client_config, time ) == NULL );
+
+    client_config.packet_queue_size = NETCODE_PACKET_QUEUE_SIZE;
+    client_config.packet_queue_overflow_policy = NETCODE_PACKET_QUEUE_DROP_OLDEST + 1;
+    check( netcode_client_create( "[::]:50000", &client_config, time ) == NULL );
 
+    client_config.packet_queue_overflow_policy = NETCODE_PACKET_QUEUE_DROP_OLDEST;
+    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
     check( client );
+    netcode_client_destroy( client );
 
     struct netcode_server_config_t server_config;
     netcode_default_server_config( &server_config );
@@ -7678,109 +19319,122 @@ void test_client_error_connection_denied()
     server_config.network_simulator = network_simulator;
     memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
+    server_config.packet_queue_size = -1;
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+
+    server_config.packet_queue_size = NETCODE_PACKET_QUEUE_SIZE + 1;
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
+    server_config.packet_queue_size = NETCODE_PACKET_QUEUE_SIZE;
+    server_config.packet_queue_overflow_policy = -1;
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
+
+    server_config.packet_queue_overflow_policy = NETCODE_PACKET_QUEUE_DROP_NEWEST;
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
     check( server );
+    netcode_server_destroy( server );
 
-    netcode_server_start( server, 1 );
+    netcode_network_simulator_destroy( network_simulator );
+}
 
-    NETCODE_CONST char * server_address = "[::1]:40000";
+void test_disconnect_packet_redundancy()
+{
+    struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+    double time = 0.0;
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    struct netcode_client_config_t client_config;
+    netcode_default_client_config( &client_config );
+    client_config.network_simulator = network_simulator;
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    client_config.num_disconnect_packets = 0;
+    check( netcode_client_create( "[::]:50000", &client_config, time ) == NULL );
+    client_config.num_disconnect_packets = NETCODE_MAX_DISCONNECT_PACKETS + 1;
+    check( netcode_client_create( "[::]:50000", &client_config, time ) == NULL );
 
-    netcode_client_connect( client, connect_token );
+    client_config.num_disconnect_packets = 3;
 
-    while ( 1 )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+    struct netcode_client_t * client[2];
+    client[0] = netcode_client_create( "[::]:50000", &client_config, time );
+    client[1] = netcode_client_create( "[::]:50001", &client_config, time );
 
-        netcode_client_update( client, time );
+    check( client[0] );
+    check( client[1] );
 
-        netcode_server_update( server, time );
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.network_simulator = network_simulator;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    server_config.num_disconnect_packets = 0;
+    check( netcode_server_create( "[::1]:40000", &server_config, time ) == NULL );
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-            break;
+    server_config.num_disconnect_packets = 5;
 
-        time += delta_time;
-    }
+    struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_index( client ) == 0 );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
+    check( server );
 
-    // now attempt to connect a second client. the connection should be denied.
+    netcode_server_start( server, 2 );
 
-    struct netcode_client_t * client2 = netcode_client_create( "[::]:50001", &client_config, time );
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
 
-    check( client2 );
+    struct netcode_address_t server_address;
+    check( netcode_parse_address( server_address_string, &server_address ) == NETCODE_OK );
 
-    uint8_t connect_token2[NETCODE_CONNECT_TOKEN_BYTES];
+    int i;
+    for ( i = 0; i < 2; ++i )
+    {
+        uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+        check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID + i, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+        netcode_client_connect( client[i], connect_token );
+        check( test_update_until_client_state( network_simulator, client[i], server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+    }
 
-    uint64_t client_id2 = 0;
-    netcode_random_bytes( (uint8_t*) &client_id2, 8 );
+    // a client disconnecting sends the server as many disconnect packets as it was configured to
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id2, TEST_PROTOCOL_ID, 0, private_key, connect_token2 ) );
+    netcode_network_simulator_update( network_simulator, time );
+    test_count_received_packets( network_simulator, &server_address );
 
-    netcode_client_connect( client2, connect_token2 );
+    netcode_client_disconnect( client[0] );
 
-    while ( 1 )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+    netcode_network_simulator_update( network_simulator, time );
+    check( test_count_received_packets( network_simulator, &server_address ) == 3 );
 
-        netcode_client_update( client, time );
+    // and so does the server when it disconnects a client
 
-        netcode_client_update( client2, time );
+    int client_index = netcode_client_index( client[1] );
+    struct netcode_address_t client_address = server->client_address[client_index];
 
-        netcode_server_update( server, time );
+    netcode_network_simulator_update( network_simulator, time );
+    test_count_received_packets( network_simulator, &client_address );
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    netcode_server_disconnect_client( server, client_index );
 
-        if ( netcode_client_state( client2 ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    netcode_network_simulator_update( network_simulator, time );
+    check( test_count_received_packets( network_simulator, &client_address ) == 5 );
 
-        time += delta_time;
-    }
+    // it can be changed on a running server
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_state( client2 ) == NETCODE_CLIENT_STATE_CONNECTION_DENIED );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
+    server_config.num_disconnect_packets = NETCODE_MAX_DISCONNECT_PACKETS + 1;
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_ERROR );
+    server_config.num_disconnect_packets = 1;
+    check( netcode_server_update_config( server, &server_config ) == NETCODE_OK );
 
     netcode_server_destroy( server );
 
-    netcode_client_destroy( client );
-    
-    netcode_client_destroy( client2 );
+    netcode_client_destroy( client[0] );
+    netcode_client_destroy( client[1] );
 
     netcode_network_simulator_destroy( network_simulator );
 }
 
-void test_client_side_disconnect()
+void test_server_challenge_resend()
 {
     struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    // start a server and connect one client
-
     double time = 0.0;
-    double delta_time = 1.0 / 10.0;
-
-    struct netcode_client_config_t client_config;
-    netcode_default_client_config( &client_config );
-    client_config.network_simulator = network_simulator;
-
-    struct netcode_client_t * client = netcode_client_create( "[::]:50000", &client_config, time );
-
-    check( client );
 
     struct netcode_server_config_t server_config;
     netcode_default_server_config( &server_config );
@@ -7794,76 +19448,64 @@ void test_client_side_disconnect()
 
     netcode_server_start( server, 1 );
 
-    NETCODE_CONST char * server_address = "[::1]:40000";
-
-    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
-
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    NETCODE_CONST char * server_address_string = "[::1]:40000";
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    struct netcode_address_t server_address;
+    struct netcode_address_t client_address;
+    check( netcode_parse_address( server_address_string, &server_address ) == NETCODE_OK );
+    check( netcode_parse_address( "[::1]:50000", &client_address ) == NETCODE_OK );
 
-    netcode_client_connect( client, connect_token );
+    struct netcode_connect_token_t connect_token[2];
 
-    while ( 1 )
+    int i;
+    for ( i = 0; i < 2; ++i )
     {
-        netcode_network_simulator_update( network_simulator, time );
-
-        netcode_client_update( client, time );
-
-        netcode_server_update( server, time );
-
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+        uint8_t connect_token_data[NETCODE_CONNECT_TOKEN_BYTES];
+        check( netcode_generate_connect_token( 1, &server_address_string, &server_address_string, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token_data ) );
+        check( netcode_read_connect_token( connect_token_data, NETCODE_CONNECT_TOKEN_BYTES, &connect_token[i] ) );
+    }
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-            break;
+    // repeats of a request get the challenge sent for the first one, without using up challenge sequence numbers
 
-        time += delta_time;
+    for ( i = 0; i < 3; ++i )
+    {
+        test_send_connection_request( network_simulator, &client_address, &server_address, &connect_token[0] );
     }
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_index( client ) == 0 );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
+    netcode_network_simulator_update( network_simulator, time );
 
-    // disconnect client side and verify that the server sees that client disconnect cleanly, rather than timing out.
+    netcode_server_update( server, time );
 
-    netcode_client_disconnect( client );
+    netcode_network_simulator_update( network_simulator, time );
 
-    int i;
-    for ( i = 0; i < 10; ++i )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+    check( test_count_received_packets( network_simulator, &client_address ) == 3 );
+    check( server->challenge_sequence == 1 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_CHALLENGES_RESENT] == 2 );
 
-        netcode_client_update( client, time );
+    // a different connect token from the same address starts a new handshake with a new challenge
 
-        netcode_server_update( server, time );
+    test_send_connection_request( network_simulator, &client_address, &server_address, &connect_token[1] );
 
-        if ( netcode_server_client_connected( server, 0 ) == 0 )
-            break;
+    netcode_network_simulator_update( network_simulator, time );
 
-        time += delta_time;
-    }
+    netcode_server_update( server, time );
 
-    check( netcode_server_client_connected( server, 0 ) == 0 );
-    check( netcode_server_num_connected_clients( server ) == 0 );
+    netcode_network_simulator_update( network_simulator, time );
 
-    netcode_server_destroy( server );
+    check( test_count_received_packets( network_simulator, &client_address ) == 1 );
+    check( server->challenge_sequence == 2 );
+    check( netcode_server_counters( server )[NETCODE_SERVER_COUNTER_CHALLENGES_RESENT] == 2 );
 
-    netcode_client_destroy( client );
+    netcode_server_destroy( server );
 
     netcode_network_simulator_destroy( network_simulator );
 }
 
-void test_server_side_disconnect()
+void test_sequence_exhaustion()
 {
     struct netcode_network_simulator_t * network_simulator = netcode_network_simulator_create( NULL, NULL, NULL );
 
-    // start a server and connect one client
-
     double time = 0.0;
-    double delta_time = 1.0 / 10.0;
 
     struct netcode_client_config_t client_config;
     netcode_default_client_config( &client_config );
@@ -7877,6 +19519,7 @@ void test_server_side_disconnect()
     netcode_default_server_config( &server_config );
     server_config.protocol_id = TEST_PROTOCOL_ID;
     server_config.network_simulator = network_simulator;
+    server_config.send_disconnect_reason = 1;
     memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
 
     struct netcode_server_t * server = netcode_server_create( "[::1]:40000", &server_config, time );
@@ -7889,58 +19532,95 @@ void test_server_side_disconnect()
 
     uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
 
-    uint64_t client_id = 0;
-    netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+
+    // the server closes a connection before its sequence runs into the range used by global packets
+
+    server->client_sequence[netcode_client_index( client )] = NETCODE_CONNECTION_SEQUENCE_LIMIT - 1;
+
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 100 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_SEQUENCE_EXHAUSTED );
+    check( netcode_server_num_connected_clients( server ) == 0 );
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    // and so does the client
 
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
     netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-    while ( 1 )
+    client->sequence = NETCODE_CONNECTION_SEQUENCE_LIMIT;
+
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_DISCONNECTED, 100 ) );
+    check( netcode_client_disconnect_reason( client ) == NETCODE_DISCONNECT_REASON_SEQUENCE_EXHAUSTED );
+
+    int i;
+    for ( i = 0; i < 10 && netcode_server_num_connected_clients( server ) > 0; ++i )
     {
+        time += 0.1;
         netcode_network_simulator_update( network_simulator, time );
+        netcode_server_update( server, time );
+    }
 
-        netcode_client_update( client, time );
+    check( netcode_server_num_connected_clients( server ) == 0 );
 
-        netcode_server_update( server, time );
+    // the challenge key is replaced before the challenge sequence wraps, and clients still connect
 
-        if ( netcode_client_state( client ) <= NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    uint8_t challenge_key[NETCODE_KEY_BYTES];
+    memcpy( challenge_key, server->challenge_key, NETCODE_KEY_BYTES );
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED )
-            break;
+    server->challenge_sequence = NETCODE_GLOBAL_SEQUENCE_LIMIT;
 
-        time += delta_time;
-    }
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
+    check( server->challenge_sequence == 1 );
+    check( memcmp( challenge_key, server->challenge_key, NETCODE_KEY_BYTES ) != 0 );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_CONNECTED );
-    check( netcode_client_index( client ) == 0 );
-    check( netcode_server_client_connected( server, 0 ) == 1 );
-    check( netcode_server_num_connected_clients( server ) == 1 );
+    netcode_server_disconnect_client( server, netcode_client_index( client ) );
 
-    // disconnect server side and verify that the client disconnects cleanly, rather than timing out.
+    // a client already answering a challenge when the key changes doesn't ask again, so its response must still decrypt
 
-    netcode_server_disconnect_client( server, 0 );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_update( client, time );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_SENDING_CONNECTION_RESPONSE, 100 ) );
 
-    int i;
-    for ( i = 0; i < 10; ++i )
-    {
-        netcode_network_simulator_update( network_simulator, time );
+    netcode_server_rotate_challenge_key( server );
 
-        netcode_client_update( client, time );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 100 ) );
 
-        netcode_server_update( server, time );
+    // but only for one generation
 
-        if ( netcode_client_state( client ) == NETCODE_CLIENT_STATE_DISCONNECTED )
-            break;
+    netcode_server_disconnect_client( server, netcode_client_index( client ) );
 
-        time += delta_time;
-    }
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_update( client, time );
+    netcode_client_connect( client, connect_token );
+    check( test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_SENDING_CONNECTION_RESPONSE, 100 ) );
 
-    check( netcode_client_state( client ) == NETCODE_CLIENT_STATE_DISCONNECTED );
-    check( netcode_server_client_connected( server, 0 ) == 0 );
+    netcode_server_rotate_challenge_key( server );
+    netcode_server_rotate_challenge_key( server );
+
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_CONNECTED, 20 ) );
     check( netcode_server_num_connected_clients( server ) == 0 );
 
+    netcode_client_disconnect( client );
+
+    // once the global sequence runs out the server stops answering connection requests, until it is restarted
+
+    server->global_sequence = NETCODE_GLOBAL_SEQUENCE_LIMIT;
+
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_CLIENT_ID, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
+    netcode_client_update( client, time );
+    netcode_client_connect( client, connect_token );
+    check( !test_update_until_client_state( network_simulator, client, server, &time, NETCODE_CLIENT_STATE_SENDING_CONNECTION_RESPONSE, 20 ) );
+    check( server->global_sequence == NETCODE_GLOBAL_SEQUENCE_LIMIT );
+
+    netcode_server_stop( server );
+    check( server->global_sequence == NETCODE_GLOBAL_SEQUENCE_START );
+
     netcode_server_destroy( server );
 
     netcode_client_destroy( client );
@@ -7989,7 +19669,7 @@ void test_client_reconnect()
     uint64_t client_id = 0;
     netcode_random_bytes( (uint8_t*) &client_id, 8 );
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
 
     netcode_client_connect( client, connect_token );
 
@@ -8043,7 +19723,7 @@ void test_client_reconnect()
 
     netcode_network_simulator_reset( network_simulator );
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
 
     netcode_client_connect( client, connect_token );
 
@@ -8157,7 +19837,7 @@ void test_disable_timeout()
     uint64_t client_id = 0;
     netcode_random_bytes( (uint8_t*) &client_id, 8 );
 
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, -1, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, -1, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
 
     netcode_client_connect( client, connect_token );
 
@@ -8203,7 +19883,7 @@ void test_disable_timeout()
 
         netcode_server_send_packet( server, 0, packet_data, NETCODE_MAX_PACKET_SIZE );
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8217,7 +19897,7 @@ void test_disable_timeout()
             netcode_client_free_packet( client, packet );
         }
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8325,7 +20005,7 @@ void test_loopback()
 
     uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
     netcode_random_bytes( (uint8_t*) &client_id, 8 );
-    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, 0, private_key, connect_token ) );
+    check( netcode_generate_connect_token( 1, &server_address, &server_address, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, client_id, TEST_PROTOCOL_ID, private_key, NULL, connect_token ) );
 
     netcode_client_connect( regular_client, connect_token );
 
@@ -8382,7 +20062,7 @@ void test_loopback()
         
         netcode_server_send_packet( server, 1, packet_data, NETCODE_MAX_PACKET_SIZE );
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8396,7 +20076,7 @@ void test_loopback()
             netcode_client_free_packet( loopback_client, packet );
         }
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8410,7 +20090,7 @@ void test_loopback()
             netcode_client_free_packet( regular_client, packet );
         }
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8424,7 +20104,7 @@ void test_loopback()
             netcode_server_free_packet( server, packet );
         }
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8514,7 +20194,7 @@ void test_loopback()
         
         netcode_server_send_packet( server, 1, packet_data, NETCODE_MAX_PACKET_SIZE );
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8528,7 +20208,7 @@ void test_loopback()
             netcode_client_free_packet( loopback_client, packet );
         }
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8542,7 +20222,7 @@ void test_loopback()
             netcode_client_free_packet( regular_client, packet );
         }
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8556,7 +20236,7 @@ void test_loopback()
             netcode_server_free_packet( server, packet );
         }
 
-        while ( 1 )             
+        while ( 1 )
         {
             int packet_bytes;
             uint64_t packet_sequence;
@@ -8632,26 +20312,58 @@ void netcode_test()
     //while ( 1 )
     {
         RUN_TEST( test_queue );
+        RUN_TEST( test_queue_overflow_policy );
+        RUN_TEST( test_packet_queue_config );
         RUN_TEST( test_endian );
         RUN_TEST( test_address );
         RUN_TEST( test_sequence );
         RUN_TEST( test_connect_token );
+        RUN_TEST( test_aead_xchacha20poly1305 );
+        RUN_TEST( test_connect_token_known_answer );
+        RUN_TEST( test_aead_aes256gcm );
         RUN_TEST( test_challenge_token );
+        RUN_TEST( test_aead_functions );
         RUN_TEST( test_connection_request_packet );
+        RUN_TEST( test_connection_request_packet_1_01 );
         RUN_TEST( test_connection_denied_packet );
         RUN_TEST( test_connection_challenge_packet );
         RUN_TEST( test_connection_response_packet );
+        RUN_TEST( test_connection_keep_alive_packet );
+        RUN_TEST( test_connection_time_sync_packet );
+        RUN_TEST( test_connection_packet_sequence_encoding );
         RUN_TEST( test_connection_payload_packet );
         RUN_TEST( test_connection_disconnect_packet );
         RUN_TEST( test_connect_token_public );
+        RUN_TEST( test_connect_token_signature );
+        RUN_TEST( test_read_connect_token );
+        RUN_TEST( test_user_data_claims );
+        RUN_TEST( test_base64 );
+        RUN_TEST( test_select_servers );
+        RUN_TEST( test_random_bytes_function_override );
+        RUN_TEST( test_socket_options );
+        RUN_TEST( test_proxy_protocol_header );
         RUN_TEST( test_encryption_manager );
+        RUN_TEST( test_connect_token_entries );
         RUN_TEST( test_replay_protection );
+        RUN_TEST( test_network_simulator_bandwidth );
+        RUN_TEST( test_network_simulator_faults );
         RUN_TEST( test_client_create );
         RUN_TEST( test_server_create );
+        RUN_TEST( test_server_version_info_mismatch );
         RUN_TEST( test_client_server_connect );
+        RUN_TEST( test_client_server_max_packet_size );
+        RUN_TEST( test_server_send_pacing );
+        RUN_TEST( test_server_bandwidth_limit );
+        RUN_TEST( test_server_egress_limit );
+        RUN_TEST( test_server_challenge_rate_limit );
+        RUN_TEST( test_server_max_pending_connections );
+        RUN_TEST( test_client_server_alternate_version_info );
+        RUN_TEST( test_server_accept_version_1_01 );
         RUN_TEST( test_client_server_ipv4_socket_connect );
         RUN_TEST( test_client_server_ipv6_socket_connect );
         RUN_TEST( test_client_server_keep_alive );
+        RUN_TEST( test_client_server_time_sync );
+        RUN_TEST( test_client_server_packet_send_rate );
         RUN_TEST( test_client_server_multiple_clients );
         RUN_TEST( test_client_server_multiple_servers );
         RUN_TEST( test_client_error_connect_token_expired );
@@ -8659,9 +20371,48 @@ void netcode_test()
         RUN_TEST( test_client_error_connection_timed_out );
         RUN_TEST( test_client_error_connection_response_timeout );
         RUN_TEST( test_client_error_connection_request_timeout );
+        RUN_TEST( test_client_connect_retry_schedule );
         RUN_TEST( test_client_error_connection_denied );
         RUN_TEST( test_client_side_disconnect );
         RUN_TEST( test_server_side_disconnect );
+        RUN_TEST( test_server_side_disconnect_by_id );
+        RUN_TEST( test_disconnect_reason );
+        RUN_TEST( test_disconnect_reason_extension );
+        RUN_TEST( test_server_kick_client );
+        RUN_TEST( test_client_server_proxy_protocol );
+        RUN_TEST( test_server_challenge_rate_limit_proxy );
+        RUN_TEST( test_server_untrusted_proxy_header );
+        RUN_TEST( test_client_server_address_migration );
+        RUN_TEST( test_server_migration_flood );
+        RUN_TEST( test_client_server_timestamp_function );
+        RUN_TEST( test_client_replay_protection );
+        RUN_TEST( test_connect_token_used_callback );
+        RUN_TEST( test_server_update_config );
+        RUN_TEST( test_server_events );
+        RUN_TEST( test_server_abandoned_handshake );
+        RUN_TEST( test_server_wait_list );
+        RUN_TEST( test_server_reserved_slots );
+        RUN_TEST( test_server_assign_slot_callback );
+        RUN_TEST( test_server_client_tag );
+        RUN_TEST( test_server_alternate_protocols );
+        RUN_TEST( test_server_public_address );
+        RUN_TEST( test_server_address_match_callback );
+        RUN_TEST( test_server_send_priority );
+        RUN_TEST( test_server_admin );
+        RUN_TEST( test_server_admin_secret );
+        RUN_TEST( test_server_security_events );
+        RUN_TEST( test_server_connection_request_callback );
+        RUN_TEST( test_server_source_filter );
+        RUN_TEST( test_server_allow_list );
+        RUN_TEST( test_server_duplicate_client_id );
+        RUN_TEST( test_server_session_snapshot );
+        RUN_TEST( test_server_session_snapshot_restore_twice );
+        RUN_TEST( test_server_pause );
+        RUN_TEST( test_server_keep_alive_jitter );
+        RUN_TEST( test_send_wheel );
+        RUN_TEST( test_disconnect_packet_redundancy );
+        RUN_TEST( test_server_challenge_resend );
+        RUN_TEST( test_sequence_exhaustion );
         RUN_TEST( test_client_reconnect );
         RUN_TEST( test_disable_timeout );
         RUN_TEST( test_loopback );
@@ -54,10 +54,55 @@
 #endif
 
 #define NETCODE_CONNECT_TOKEN_BYTES 2048
+#define NETCODE_CONNECT_TOKEN_BASE64_BYTES 2733
+#define NETCODE_CONNECT_TOKEN_PRIVATE_BYTES 1024
+#define NETCODE_CONNECT_TOKEN_NONCE_BYTES 24
+#define NETCODE_CHALLENGE_TOKEN_BYTES 300
 #define NETCODE_KEY_BYTES 32
 #define NETCODE_MAC_BYTES 16
+#define NETCODE_USER_DATA_BYTES 256
 #define NETCODE_MAX_SERVERS_PER_CONNECT 32
 
+// connect tokens may carry an ed25519 signature in the last 64 bytes of the zero pad, so services without the private key can check where a token came from. it covers the first NETCODE_CONNECT_TOKEN_BYTES - 64 bytes, encrypted private data included
+
+#define NETCODE_SIGNING_PUBLIC_KEY_BYTES 32
+#define NETCODE_SIGNING_PRIVATE_KEY_BYTES 64
+#define NETCODE_CONNECT_TOKEN_SIGNATURE_BYTES 64
+
+// version info is the null terminated string "NETCODE 1.02" (13 bytes). it prefixes connect tokens and connection request packets, and is mixed into the additional data of every encrypted packet
+
+#define NETCODE_VERSION_INFO ( (uint8_t*) "NETCODE 1.02" )
+#define NETCODE_VERSION_INFO_BYTES 13
+
+// servers with accept_version_1_01 set also take connection requests from 1.01 clients, which carry a 64 bit connect token sequence in place of the 24 byte nonce
+
+#define NETCODE_VERSION_INFO_1_01 ( (uint8_t*) "NETCODE 1.01" )
+
+// max packet bytes is the largest packet netcode.io will put on the wire. max payload bytes is the largest payload that fits in a payload packet with header and mac.
+// both may be raised at compile time for LAN and tools builds that know their path MTU. internet builds should leave them alone, since packets above ~1200 bytes risk fragmentation
+
+#ifndef NETCODE_MAX_PACKET_BYTES
+#define NETCODE_MAX_PACKET_BYTES 1200
+#endif
+
+#ifndef NETCODE_MAX_PAYLOAD_BYTES
+#define NETCODE_MAX_PAYLOAD_BYTES 1100
+#endif
+
+#if NETCODE_MAX_PAYLOAD_BYTES + 1 + 8 + NETCODE_MAC_BYTES > NETCODE_MAX_PACKET_BYTES
+#error netcode.io - max payload bytes plus prefix byte, sequence and mac must fit in max packet bytes
+#endif
+
+#define NETCODE_CONNECTION_REQUEST_PACKET           0
+#define NETCODE_CONNECTION_DENIED_PACKET            1
+#define NETCODE_CONNECTION_CHALLENGE_PACKET         2
+#define NETCODE_CONNECTION_RESPONSE_PACKET          3
+#define NETCODE_CONNECTION_KEEP_ALIVE_PACKET        4
+#define NETCODE_CONNECTION_PAYLOAD_PACKET           5
+#define NETCODE_CONNECTION_DISCONNECT_PACKET        6
+#define NETCODE_CONNECTION_TIME_SYNC_PACKET         7
+#define NETCODE_CONNECTION_NUM_PACKETS              8
+
 #define NETCODE_CLIENT_STATE_CONNECT_TOKEN_EXPIRED              -6
 #define NETCODE_CLIENT_STATE_INVALID_CONNECT_TOKEN              -5
 #define NETCODE_CLIENT_STATE_CONNECTION_TIMED_OUT               -4
@@ -70,7 +115,108 @@
 #define NETCODE_CLIENT_STATE_CONNECTED                          3
 
 #define NETCODE_MAX_CLIENTS         256
+
+// alternate protocols let one server socket accept connect tokens for other protocol ids (eg. older game builds), each with its own private key
+
+#define NETCODE_MAX_ALTERNATE_PROTOCOLS 4
+
+// proxy_protocol and source_address_callback both need at least one trusted proxy address. source address headers are only read from packets sent by one of them. a trusted address with port 0 matches any port
+
+#define NETCODE_MAX_TRUSTED_PROXIES 16
+
+// banned client ids are refused at connect. the list lives as long as the server does
+
+#define NETCODE_MAX_BANNED_CLIENTS 256
+
+// when allow_list_only is set in server config, only client ids on the allow list may connect. bans still apply to allowed client ids
+
+#define NETCODE_MAX_ALLOWED_CLIENTS 1024
+
+// the admin socket only binds loopback, but anything on the same host can reach it. on hosts shared with other users or tenants admin_secret is required: every command datagram must then start with the secret and a space
+
+#define NETCODE_MAX_ADMIN_SECRET_BYTES 64
+
+// max packet size is the default for max_packet_size in client and server config: the largest packet you may pass to netcode_client_send_packet and netcode_server_send_packet. config may raise it as far as max payload bytes
+
+#ifndef NETCODE_MAX_PACKET_SIZE
 #define NETCODE_MAX_PACKET_SIZE     1024
+#endif
+
+#if NETCODE_MAX_PACKET_SIZE > NETCODE_MAX_PAYLOAD_BYTES
+#error netcode.io - max packet size must not exceed max payload bytes
+#endif
+
+#define NETCODE_PACKET_QUEUE_SIZE   256
+
+#define NETCODE_PACKET_QUEUE_DROP_NEWEST                        0
+#define NETCODE_PACKET_QUEUE_DROP_OLDEST                        1
+
+#define NETCODE_CLIENT_COUNTER_PAYLOAD_PACKETS_DROPPED          0
+#define NETCODE_CLIENT_COUNTER_REPLAYED_PACKETS_DROPPED         1
+#define NETCODE_CLIENT_NUM_COUNTERS                             2
+
+#define NETCODE_SERVER_COUNTER_VERSION_INFO_MISMATCH            0
+#define NETCODE_SERVER_COUNTER_PAYLOAD_PACKETS_DROPPED          1
+#define NETCODE_SERVER_COUNTER_REPLAYED_PACKETS_DROPPED         2
+#define NETCODE_SERVER_COUNTER_SEND_QUEUE_PACKETS_DROPPED       3
+#define NETCODE_SERVER_COUNTER_BANDWIDTH_PACKETS_DROPPED        4
+#define NETCODE_SERVER_COUNTER_BANDWIDTH_PACKETS_DELAYED        5
+#define NETCODE_SERVER_COUNTER_CHALLENGES_RATE_LIMITED          6
+#define NETCODE_SERVER_COUNTER_PENDING_CONNECTIONS_EVICTED      7
+#define NETCODE_SERVER_COUNTER_SOURCE_FILTERED                  8
+#define NETCODE_SERVER_COUNTER_CHALLENGES_RESENT                9
+#define NETCODE_SERVER_COUNTER_MIGRATION_DECRYPTS               10
+#define NETCODE_SERVER_COUNTER_MIGRATIONS_RATE_LIMITED          11
+#define NETCODE_SERVER_NUM_COUNTERS                             12
+
+#define NETCODE_BANDWIDTH_LIMIT_DROP                            0
+#define NETCODE_BANDWIDTH_LIMIT_DELAY                           1
+
+#define NETCODE_DUPLICATE_CLIENT_ID_DENY                        0
+#define NETCODE_DUPLICATE_CLIENT_ID_REPLACE                     1
+
+#define NETCODE_PACKET_PRIORITY_LOW                             0
+#define NETCODE_PACKET_PRIORITY_NORMAL                          1
+#define NETCODE_PACKET_PRIORITY_URGENT                          2
+
+#define NETCODE_SERVER_EVENT_CONNECTION_REQUEST                 0
+#define NETCODE_SERVER_EVENT_CONNECTION_REQUEST_REJECTED        1
+#define NETCODE_SERVER_EVENT_CHALLENGE_SENT                     2
+#define NETCODE_SERVER_EVENT_CLIENT_CONNECTED                   3
+#define NETCODE_SERVER_EVENT_CLIENT_CONFIRMED                   4
+#define NETCODE_SERVER_EVENT_CLIENT_TIMED_OUT                   5
+#define NETCODE_SERVER_EVENT_HANDSHAKE_ABANDONED                6
+#define NETCODE_SERVER_EVENT_CLIENT_WAITING                     7
+#define NETCODE_SERVER_EVENT_PACKET_REJECTED                    8
+
+#define NETCODE_SERVER_EVENT_REASON_NONE                        0
+#define NETCODE_SERVER_EVENT_REASON_INVALID_REQUEST             1
+#define NETCODE_SERVER_EVENT_REASON_INVALID_CONNECT_TOKEN       2
+#define NETCODE_SERVER_EVENT_REASON_SERVER_ADDRESS_NOT_IN_TOKEN 3
+#define NETCODE_SERVER_EVENT_REASON_ADDRESS_ALREADY_CONNECTED   4
+#define NETCODE_SERVER_EVENT_REASON_CLIENT_ID_ALREADY_CONNECTED 5
+#define NETCODE_SERVER_EVENT_REASON_CONNECT_TOKEN_ALREADY_USED  6
+#define NETCODE_SERVER_EVENT_REASON_SERVER_FULL                 7
+#define NETCODE_SERVER_EVENT_REASON_ENCRYPTION_MAPPING_FAILED   8
+#define NETCODE_SERVER_EVENT_REASON_CHALLENGE_RATE_LIMITED      9
+#define NETCODE_SERVER_EVENT_REASON_CLIENT_BANNED               10
+#define NETCODE_SERVER_EVENT_REASON_PACKET_REPLAYED             11
+#define NETCODE_SERVER_EVENT_REASON_PACKET_INVALID              12
+#define NETCODE_SERVER_EVENT_REASON_CHALLENGE_TOKEN_INVALID     13
+#define NETCODE_SERVER_EVENT_REASON_REQUEST_VETOED              14
+#define NETCODE_SERVER_EVENT_REASON_SOURCE_FILTERED             15
+#define NETCODE_SERVER_EVENT_REASON_CLIENT_NOT_ALLOWED          16
+#define NETCODE_SERVER_EVENT_REASON_SERVER_PAUSED               17
+
+#define NETCODE_DISCONNECT_REASON_NONE                          0
+#define NETCODE_DISCONNECT_REASON_TIMED_OUT                     1
+#define NETCODE_DISCONNECT_REASON_CLIENT_DISCONNECTED           2
+#define NETCODE_DISCONNECT_REASON_SERVER_DISCONNECTED           3
+#define NETCODE_DISCONNECT_REASON_KICKED                        4
+#define NETCODE_DISCONNECT_REASON_SERVER_SHUTDOWN               5
+#define NETCODE_DISCONNECT_REASON_REPLACED                      6
+#define NETCODE_DISCONNECT_REASON_SEQUENCE_EXHAUSTED            7
+#define NETCODE_DISCONNECT_REASON_USER                          128         // reasons from here up to 255 are free for the application to use when kicking clients
 
 #define NETCODE_LOG_LEVEL_NONE      0
 #define NETCODE_LOG_LEVEL_ERROR     1
@@ -124,6 +270,19 @@ struct netcode_client_config_t
     int override_send_and_receive;
     void (*send_packet_override)(void*,struct netcode_address_t*,NETCODE_CONST uint8_t*,int);
     int (*receive_packet_override)(void*,struct netcode_address_t*,uint8_t*,int);
+    double packet_send_rate;
+    int packet_queue_size;
+    int packet_queue_overflow_policy;
+    int socket_send_buffer_size;
+    int socket_receive_buffer_size;
+    int socket_tos;
+    int socket_dont_fragment;
+    int time_sync;
+    int max_packet_size;
+    double connection_request_send_rate;
+    double connection_response_send_rate;
+    double connect_timeout;
+    int num_disconnect_packets;
 };
 
 void netcode_default_client_config( struct netcode_client_config_t * config );
@@ -148,10 +307,14 @@ void netcode_client_disconnect( struct netcode_client_t * client );
 
 int netcode_client_state( struct netcode_client_t * client );
 
+int netcode_client_disconnect_reason( struct netcode_client_t * client );
+
 int netcode_client_index( struct netcode_client_t * client );
 
 int netcode_client_max_clients( struct netcode_client_t * client );
 
+double netcode_client_server_time( struct netcode_client_t * client );
+
 void netcode_client_connect_loopback( struct netcode_client_t * client, int client_index, int max_clients );
 
 void netcode_client_disconnect_loopback( struct netcode_client_t * client );
@@ -166,6 +329,8 @@ uint16_t netcode_client_get_port( struct netcode_client_t * client );
 
 struct netcode_address_t * netcode_client_server_address( struct netcode_client_t * client );
 
+NETCODE_CONST uint64_t * netcode_client_counters( struct netcode_client_t * client );
+
 int netcode_generate_connect_token( int num_server_addresses, 
                                     NETCODE_CONST char ** public_server_addresses, 
                                     NETCODE_CONST char ** internal_server_addresses, 
@@ -173,10 +338,81 @@ int netcode_generate_connect_token( int num_server_addresses,
                                     int timeout_seconds, 
                                     uint64_t client_id, 
                                     uint64_t protocol_id, 
-                                    uint64_t sequence, 
                                     NETCODE_CONST uint8_t * private_key, 
+                                    NETCODE_CONST uint8_t * user_data, 
                                     uint8_t * connect_token );
 
+int netcode_select_servers( int num_servers, 
+                            NETCODE_CONST char ** server_addresses, 
+                            uint64_t client_id, 
+                            int max_selected, 
+                            int * selected_indices );
+
+struct netcode_connect_token_t
+{
+    uint8_t version_info[NETCODE_VERSION_INFO_BYTES];
+    uint64_t protocol_id;
+    uint64_t create_timestamp;
+    uint64_t expire_timestamp;
+    uint8_t nonce[NETCODE_CONNECT_TOKEN_NONCE_BYTES];
+    uint8_t private_data[NETCODE_CONNECT_TOKEN_PRIVATE_BYTES];
+    int timeout_seconds;
+    int num_server_addresses;
+    struct netcode_address_t server_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
+    uint8_t client_to_server_key[NETCODE_KEY_BYTES];
+    uint8_t server_to_client_key[NETCODE_KEY_BYTES];
+};
+
+int netcode_read_connect_token( uint8_t * buffer, int buffer_length, struct netcode_connect_token_t * connect_token );
+
+void netcode_generate_signing_keys( uint8_t * signing_public_key, uint8_t * signing_private_key );
+
+void netcode_sign_connect_token( uint8_t * connect_token, NETCODE_CONST uint8_t * signing_private_key );
+
+int netcode_verify_connect_token( NETCODE_CONST uint8_t * connect_token, NETCODE_CONST uint8_t * signing_public_key );
+
+int netcode_base64_encode_data( NETCODE_CONST uint8_t * input, int input_size, char * output, int output_size );
+
+int netcode_base64_decode_data( NETCODE_CONST char * input, uint8_t * output, int output_size );
+
+#define NETCODE_USER_DATA_CLAIMS_VERSION 1
+#define NETCODE_USER_DATA_CLAIMS_EXTRA_BYTES 228
+
+#define NETCODE_PERMISSION_RESERVED_SLOT ( 1ULL << 0 )
+
+struct netcode_user_data_claims_t
+{
+    uint64_t player_id;
+    uint32_t team;
+    uint32_t region;
+    uint64_t permissions;
+    uint8_t extra_data[NETCODE_USER_DATA_CLAIMS_EXTRA_BYTES];
+};
+
+void netcode_write_user_data_claims( struct netcode_user_data_claims_t * claims, uint8_t * user_data );
+
+int netcode_read_user_data_claims( uint8_t * user_data, struct netcode_user_data_claims_t * claims );
+
+struct netcode_server_event_t
+{
+    int type;
+    int reason;
+    int client_index;
+    uint64_t client_id;
+    struct netcode_address_t address;
+    double time;
+};
+
+struct netcode_connection_request_info_t
+{
+    struct netcode_address_t address;
+    uint64_t client_id;
+    uint64_t protocol_id;
+    uint64_t expire_timestamp;
+    int requests_per_second;                // connection requests seen from this address in the current one second window, this one included
+    NETCODE_CONST uint8_t * user_data;
+};
+
 struct netcode_server_config_t
 {
     uint64_t protocol_id;
@@ -191,6 +427,52 @@ struct netcode_server_config_t
     int override_send_and_receive;
     void (*send_packet_override)(void*,struct netcode_address_t*,NETCODE_CONST uint8_t*,int);
     int (*receive_packet_override)(void*,struct netcode_address_t*,uint8_t*,int);
+    double packet_send_rate;
+    NETCODE_CONST char * alternate_version_info;
+    int accept_version_1_01;
+    int proxy_protocol;
+    int (*source_address_callback)(void*,struct netcode_address_t*,NETCODE_CONST uint8_t*,int);
+    int num_trusted_proxies;
+    NETCODE_CONST char * trusted_proxy_address[NETCODE_MAX_TRUSTED_PROXIES];
+    int client_address_migration;
+    int max_migration_attempts_per_second;
+    int max_migration_attempts_per_address_per_second;
+    int (*connect_token_used_callback)(void*,NETCODE_CONST uint8_t*,struct netcode_address_t*,uint64_t);
+    int packet_queue_size;
+    int packet_queue_overflow_policy;
+    int socket_send_buffer_size;
+    int socket_receive_buffer_size;
+    int socket_tos;
+    int socket_dont_fragment;
+    void (*event_callback)(void*,NETCODE_CONST struct netcode_server_event_t*);
+    int time_sync;
+    int max_packet_size;
+    double send_pacing_rate;
+    double bandwidth_limit;
+    int bandwidth_limit_policy;
+    double egress_limit;
+    int max_challenges_per_second;
+    int max_challenges_per_address_per_second;
+    int max_pending_connections;
+    int send_disconnect_reason;
+    int wait_list_size;
+    int reserved_slots;
+    int (*assign_slot_callback)(void*,uint64_t,NETCODE_CONST uint8_t*);
+    int num_alternate_protocols;
+    uint64_t alternate_protocol_id[NETCODE_MAX_ALTERNATE_PROTOCOLS];
+    uint8_t alternate_private_key[NETCODE_MAX_ALTERNATE_PROTOCOLS][NETCODE_KEY_BYTES];
+    NETCODE_CONST char * public_address;
+    int (*server_address_match_callback)(void*,struct netcode_address_t*);
+    NETCODE_CONST char * admin_address;
+    NETCODE_CONST char * admin_secret;
+    void (*security_event_callback)(void*,NETCODE_CONST struct netcode_server_event_t*);
+    int (*connection_request_callback)(void*,NETCODE_CONST struct netcode_connection_request_info_t*);
+    int (*source_filter_callback)(void*,NETCODE_CONST struct netcode_address_t*);
+    int allow_list_only;
+    int duplicate_client_id_policy;
+    int socket_reuse_port;
+    double keep_alive_jitter;
+    int num_disconnect_packets;
 };
 
 void netcode_default_server_config( struct netcode_server_config_t * config );
@@ -203,6 +485,14 @@ void netcode_server_start( struct netcode_server_t * server, int max_clients );
 
 void netcode_server_stop( struct netcode_server_t * server );
 
+void netcode_server_stop_for_restart( struct netcode_server_t * server );
+
+void netcode_server_pause( struct netcode_server_t * server, int freeze_timeouts );
+
+void netcode_server_resume( struct netcode_server_t * server );
+
+int netcode_server_paused( struct netcode_server_t * server );
+
 int netcode_server_running( struct netcode_server_t * server );
 
 int netcode_server_max_clients( struct netcode_server_t * server );
@@ -215,20 +505,42 @@ uint64_t netcode_server_client_id( struct netcode_server_t * server, int client_
 
 void netcode_server_disconnect_client( struct netcode_server_t * server, int client_index );
 
+int netcode_server_disconnect_client_by_id( struct netcode_server_t * server, uint64_t client_id );
+
+int netcode_server_client_disconnect_reason( struct netcode_server_t * server, int client_index );
+
+void netcode_server_kick_client( struct netcode_server_t * server, int client_index, int disconnect_reason );
+
+void netcode_server_set_client_packet_send_rate( struct netcode_server_t * server, int client_index, double packet_send_rate );
+
+void netcode_server_set_client_bandwidth_limit( struct netcode_server_t * server, int client_index, double bandwidth_limit );
+
+int netcode_server_update_config( struct netcode_server_t * server, NETCODE_CONST struct netcode_server_config_t * config );
+
 void netcode_server_disconnect_all_clients( struct netcode_server_t * server );
 
 uint64_t netcode_server_next_packet_sequence( struct netcode_server_t * server, int client_index );
 
 void netcode_server_send_packet( struct netcode_server_t * server, int client_index, NETCODE_CONST uint8_t * packet_data, int packet_bytes );
 
+void netcode_server_send_packet_with_priority( struct netcode_server_t * server, int client_index, NETCODE_CONST uint8_t * packet_data, int packet_bytes, int priority );
+
 uint8_t * netcode_server_receive_packet( struct netcode_server_t * server, int client_index, int * packet_bytes, uint64_t * packet_sequence );
 
 void netcode_server_free_packet( struct netcode_server_t * server, void * packet );
 
 int netcode_server_num_connected_clients( struct netcode_server_t * server );
 
+int netcode_server_num_waiting_clients( struct netcode_server_t * server );
+
 void * netcode_server_client_user_data( struct netcode_server_t * server, int client_index );
 
+void netcode_server_set_client_tag( struct netcode_server_t * server, int client_index, void * tag );
+
+void * netcode_server_client_tag( struct netcode_server_t * server, int client_index );
+
+uint64_t netcode_server_client_protocol_id( struct netcode_server_t * server, int client_index );
+
 void netcode_server_process_packet( struct netcode_server_t * server, struct netcode_address_t * from, uint8_t * packet_data, int packet_bytes );
 
 void netcode_server_connect_loopback_client( struct netcode_server_t * server, int client_index, uint64_t client_id, NETCODE_CONST uint8_t * user_data );
@@ -237,10 +549,38 @@ void netcode_server_disconnect_loopback_client( struct netcode_server_t * server
 
 int netcode_server_client_loopback( struct netcode_server_t * server, int client_index );
 
+NETCODE_CONST char * netcode_server_client_version_info( struct netcode_server_t * server, int client_index );
+
 void netcode_server_process_loopback_packet( struct netcode_server_t * server, int client_index, NETCODE_CONST uint8_t * packet_data, int packet_bytes, uint64_t packet_sequence );
 
 uint16_t netcode_server_get_port( struct netcode_server_t * server );
 
+NETCODE_CONST uint64_t * netcode_server_counters( struct netcode_server_t * server );
+
+int netcode_server_ban_client_id( struct netcode_server_t * server, uint64_t client_id );
+
+int netcode_server_unban_client_id( struct netcode_server_t * server, uint64_t client_id );
+
+int netcode_server_client_id_banned( struct netcode_server_t * server, uint64_t client_id );
+
+int netcode_server_allow_client_id( struct netcode_server_t * server, uint64_t client_id );
+
+int netcode_server_disallow_client_id( struct netcode_server_t * server, uint64_t client_id );
+
+int netcode_server_client_id_allowed( struct netcode_server_t * server, uint64_t client_id );
+
+int netcode_server_admin_command( struct netcode_server_t * server, NETCODE_CONST char * command, char * response, int response_size );
+
+// session snapshots move connected sessions to a new server process, eg. a blue-green handover on a SO_REUSEPORT socket. writing a snapshot
+// hands the sessions over: the old server sends nothing more to its clients from then on, since every packet it sent would spend a sequence
+// number the new process uses too. write it last, read it in the new process, then call netcode_server_stop_for_restart on the old one
+
+int netcode_server_session_snapshot_bytes( struct netcode_server_t * server );
+
+int netcode_server_write_session_snapshot( struct netcode_server_t * server, uint8_t * buffer, int buffer_size );
+
+int netcode_server_read_session_snapshot( struct netcode_server_t * server, NETCODE_CONST uint8_t * buffer, int buffer_bytes );
+
 void netcode_log_level( int level );
 
 void netcode_set_printf_function( int (*function)( NETCODE_CONST char *, ... ) );
@@ -266,6 +606,25 @@ void netcode_set_assert_function( void (*function)( NETCODE_CONST char * /*condi
                                   NETCODE_CONST char * /*file*/, 
                                   int /*line*/ ) );
 
+void netcode_set_timestamp_function( uint64_t (*function)() );
+
+uint64_t netcode_timestamp();
+
+int netcode_encrypt_aead_chacha20poly1305( uint8_t * message, uint64_t message_length, uint8_t * additional, uint64_t additional_length, uint8_t * nonce, NETCODE_CONST uint8_t * key );
+
+int netcode_decrypt_aead_chacha20poly1305( uint8_t * message, uint64_t message_length, uint8_t * additional, uint64_t additional_length, uint8_t * nonce, NETCODE_CONST uint8_t * key );
+
+int netcode_aes256gcm_available();
+
+int netcode_encrypt_aead_aes256gcm( uint8_t * message, uint64_t message_length, uint8_t * additional, uint64_t additional_length, uint8_t * nonce, NETCODE_CONST uint8_t * key );
+
+int netcode_decrypt_aead_aes256gcm( uint8_t * message, uint64_t message_length, uint8_t * additional, uint64_t additional_length, uint8_t * nonce, NETCODE_CONST uint8_t * key );
+
+void netcode_set_aead_functions( int (*encrypt_function)( uint8_t * /*message*/, uint64_t /*message_length*/, uint8_t * /*additional*/, uint64_t /*additional_length*/, uint8_t * /*nonce*/, NETCODE_CONST uint8_t * /*key*/ ), 
+                                 int (*decrypt_function)( uint8_t * /*message*/, uint64_t /*message_length*/, uint8_t * /*additional*/, uint64_t /*additional_length*/, uint8_t * /*nonce*/, NETCODE_CONST uint8_t * /*key*/ ) );
+
+void netcode_set_random_bytes_function( void (*function)( uint8_t * /*data*/, int /*bytes*/ ) );
+
 void netcode_random_bytes( uint8_t * data, int bytes );
 
 void netcode_sleep( double seconds );
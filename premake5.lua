@@ -41,6 +41,9 @@ project "soak"
 project "profile"
     files { "profile.c", "netcode.c" }
 
+project "bench"
+    files { "bench.cpp" }
+
 project "client"
     files { "client.c", "netcode.c" }
 
@@ -50,6 +53,12 @@ project "server"
 project "client_server"
     files { "client_server.c", "netcode.c" }
 
+project "token"
+    files { "token.c", "netcode.c" }
+
+project "inspect"
+    files { "inspect.cpp" }
+
 if os.is "windows" then
 
     -- Windows
@@ -106,6 +115,18 @@ else
         end
     }
 
+    newaction
+    {
+        trigger     = "bench",
+        description = "Build and run benchmarks",
+        execute = function ()
+            os.execute "test ! -e Makefile && premake5 gmake"
+            if os.execute "make -j32 bench config=release_x64" == 0 then
+                os.execute "./bin/bench"
+            end
+        end
+    }
+
     newaction
     {
         trigger     = "client",
@@ -220,7 +220,7 @@ void profile_iteration( double time )
                     }
                 }
 
-                if ( num_server_addresses > 0 && netcode_generate_connect_token( num_server_addresses, (NETCODE_CONST char**) server_address, (NETCODE_CONST char**) server_address, CONNECT_TOKEN_EXPIRY, CONNECT_TOKEN_TIMEOUT, client_id, PROTOCOL_ID, 0, private_key, connect_token ) )
+                if ( num_server_addresses > 0 && netcode_generate_connect_token( num_server_addresses, (NETCODE_CONST char**) server_address, (NETCODE_CONST char**) server_address, CONNECT_TOKEN_EXPIRY, CONNECT_TOKEN_TIMEOUT, client_id, PROTOCOL_ID, private_key, NULL, connect_token ) )
                 {
                     netcode_client_connect( client[i], connect_token );
                 }
@@ -253,6 +253,41 @@ void profile_iteration( double time )
     }
 }
 
+#define AEAD_BENCHMARK_ITERATIONS 100000
+
+void profile_aead( NETCODE_CONST char * name, 
+                   int (*encrypt_function)( uint8_t*, uint64_t, uint8_t*, uint64_t, uint8_t*, NETCODE_CONST uint8_t* ), 
+                   int (*decrypt_function)( uint8_t*, uint64_t, uint8_t*, uint64_t, uint8_t*, NETCODE_CONST uint8_t* ) )
+{
+    uint8_t key[NETCODE_KEY_BYTES];
+    netcode_random_bytes( key, NETCODE_KEY_BYTES );
+
+    uint8_t nonce[12];
+    memset( nonce, 0, sizeof( nonce ) );
+
+    uint8_t additional[NETCODE_VERSION_INFO_BYTES+8+1];
+    memset( additional, 0, sizeof( additional ) );
+
+    uint8_t buffer[NETCODE_MAX_PAYLOAD_BYTES+NETCODE_MAC_BYTES];
+    memset( buffer, 0, sizeof( buffer ) );
+
+    double start_time = netcode_time();
+
+    int i;
+    for ( i = 0; i < AEAD_BENCHMARK_ITERATIONS; ++i )
+    {
+        nonce[0] = (uint8_t) i;
+        encrypt_function( buffer, NETCODE_MAX_PAYLOAD_BYTES, additional, sizeof( additional ), nonce, key );
+        int result = decrypt_function( buffer, sizeof( buffer ), additional, sizeof( additional ), nonce, key );
+        (void) result;
+        assert( result == NETCODE_OK );
+    }
+
+    double elapsed = netcode_time() - start_time;
+
+    printf( "%s: %.2f us per %d byte packet (encrypt + decrypt)\n", name, elapsed * 1000000.0 / AEAD_BENCHMARK_ITERATIONS, NETCODE_MAX_PAYLOAD_BYTES );
+}
+
 int main( int argc, char ** argv )
 {
     int num_iterations = 100;
@@ -262,6 +297,13 @@ int main( int argc, char ** argv )
 
     profile_initialize();
 
+    profile_aead( "chacha20poly1305", netcode_encrypt_aead_chacha20poly1305, netcode_decrypt_aead_chacha20poly1305 );
+
+    if ( netcode_aes256gcm_available() )
+    {
+        profile_aead( "aes256gcm", netcode_encrypt_aead_aes256gcm, netcode_decrypt_aead_aes256gcm );
+    }
+
     printf( "profiling" );
 
     signal( SIGINT, interrupt_handler );
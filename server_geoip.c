@@ -0,0 +1,227 @@
+/*
+    netcode.io reference implementation
+
+    Copyright © 2017, The Network Protocol Company, Inc.
+
+    Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+        1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+        2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer 
+           in the documentation and/or other materials provided with the distribution.
+
+        3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived 
+           from this software without specific prior written permission.
+
+    THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, 
+    INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE 
+    DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, 
+    SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR 
+    SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, 
+    WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+    USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+    Example of region locking a server with a MaxMind GeoIP2/GeoLite2 country database.
+
+    Connection requests are checked against the database by source address before the server 
+    decrypts the connect token, so requests from outside the allowed countries cost almost nothing.
+
+    This example needs libmaxminddb (https://github.com/maxmind/libmaxminddb), so it is not part of the 
+    default build. Build it by hand against netcode.c, eg:
+
+        cc -std=c99 -I. server_geoip.c netcode.c -lsodium -lmaxminddb -o server_geoip
+
+    Usage: server_geoip <GeoLite2-Country.mmdb> <allowed country codes, eg. US,CA> [server address]
+*/
+
+#include "netcode.h"
+#include <maxminddb.h>
+#include <stdio.h>
+#include <string.h>
+#include <signal.h>
+#include <inttypes.h>
+
+static volatile int quit = 0;
+
+void interrupt_handler( int signal )
+{
+    (void) signal;
+    quit = 1;
+}
+
+static uint8_t private_key[NETCODE_KEY_BYTES] = { 0x60, 0x6a, 0xbe, 0x6e, 0xc9, 0x19, 0x10, 0xea, 
+                                                  0x9a, 0x65, 0x62, 0xf6, 0x6f, 0x2b, 0x30, 0xe4, 
+                                                  0x43, 0x71, 0xd6, 0x2c, 0xd1, 0x99, 0x27, 0x26,
+                                                  0x6b, 0x3c, 0x60, 0xf4, 0xb7, 0x15, 0xab, 0xa1 };
+
+struct geoip_filter_t
+{
+    MMDB_s mmdb;
+    NETCODE_CONST char * allowed_countries;
+};
+
+static void geoip_address_to_ip_string( NETCODE_CONST struct netcode_address_t * address, char * buffer, int buffer_size )
+{
+    if ( address->type == NETCODE_ADDRESS_IPV4 )
+    {
+        snprintf( buffer, buffer_size, "%d.%d.%d.%d", address->data.ipv4[0], address->data.ipv4[1], address->data.ipv4[2], address->data.ipv4[3] );
+    }
+    else
+    {
+        snprintf( buffer, buffer_size, "%x:%x:%x:%x:%x:%x:%x:%x", 
+            address->data.ipv6[0], address->data.ipv6[1], address->data.ipv6[2], address->data.ipv6[3], 
+            address->data.ipv6[4], address->data.ipv6[5], address->data.ipv6[6], address->data.ipv6[7] );
+    }
+}
+
+static int geoip_country_allowed( NETCODE_CONST char * allowed_countries, NETCODE_CONST char * country, int country_length )
+{
+    NETCODE_CONST char * p = allowed_countries;
+    while ( *p )
+    {
+        NETCODE_CONST char * end = strchr( p, ',' );
+        int length = end ? (int) ( end - p ) : (int) strlen( p );
+        if ( length == country_length && strncmp( p, country, length ) == 0 )
+            return 1;
+        if ( !end )
+            break;
+        p = end + 1;
+    }
+    return 0;
+}
+
+int geoip_source_filter( void * context, NETCODE_CONST struct netcode_address_t * address )
+{
+    struct geoip_filter_t * filter = (struct geoip_filter_t*) context;
+
+    char ip_string[64];
+    geoip_address_to_ip_string( address, ip_string, sizeof( ip_string ) );
+
+    int gai_error = 0;
+    int mmdb_error = MMDB_SUCCESS;
+    MMDB_lookup_result_s result = MMDB_lookup_string( &filter->mmdb, ip_string, &gai_error, &mmdb_error );
+    if ( gai_error != 0 || mmdb_error != MMDB_SUCCESS )
+    {
+        printf( "geoip lookup failed for %s\n", ip_string );
+        return 0;
+    }
+
+    // addresses not in the database (loopback, LAN) are allowed so local testing still works
+
+    if ( !result.found_entry )
+        return 1;
+
+    MMDB_entry_data_s data;
+    if ( MMDB_get_value( &result.entry, &data, "country", "iso_code", NULL ) != MMDB_SUCCESS || !data.has_data || data.type != MMDB_DATA_TYPE_UTF8_STRING )
+        return 0;
+
+    if ( !geoip_country_allowed( filter->allowed_countries, data.utf8_string, (int) data.data_size ) )
+    {
+        printf( "rejected connection request from %s (%.*s)\n", ip_string, (int) data.data_size, data.utf8_string );
+        return 0;
+    }
+
+    return 1;
+}
+
+int main( int argc, char ** argv )
+{
+    if ( argc < 3 )
+    {
+        printf( "usage: server_geoip <mmdb file> <allowed country codes, eg. US,CA> [server address]\n" );
+        return 1;
+    }
+
+    struct geoip_filter_t filter;
+    memset( &filter, 0, sizeof( filter ) );
+    filter.allowed_countries = argv[2];
+
+    int mmdb_status = MMDB_open( argv[1], MMDB_MODE_MMAP, &filter.mmdb );
+    if ( mmdb_status != MMDB_SUCCESS )
+    {
+        printf( "error: failed to open %s: %s\n", argv[1], MMDB_strerror( mmdb_status ) );
+        return 1;
+    }
+
+    if ( netcode_init() != NETCODE_OK )
+    {
+        printf( "error: failed to initialize netcode.io\n" );
+        MMDB_close( &filter.mmdb );
+        return 1;
+    }
+
+    netcode_log_level( NETCODE_LOG_LEVEL_INFO );
+
+    double time = 0.0;
+    double delta_time = 1.0 / 60.0;
+
+    printf( "[server geoip]\n" );
+
+    #define TEST_PROTOCOL_ID 0x1122334455667788
+
+    char * server_address = "127.0.0.1:40000";
+    if ( argc == 4 )
+        server_address = argv[3];
+
+    struct netcode_server_config_t server_config;
+    netcode_default_server_config( &server_config );
+    server_config.protocol_id = TEST_PROTOCOL_ID;
+    server_config.callback_context = &filter;
+    server_config.source_filter_callback = geoip_source_filter;
+    memcpy( &server_config.private_key, private_key, NETCODE_KEY_BYTES );
+
+    struct netcode_server_t * server = netcode_server_create( server_address, &server_config, time );
+
+    if ( !server )
+    {
+        printf( "error: failed to create server\n" );
+        MMDB_close( &filter.mmdb );
+        return 1;
+    }
+
+    netcode_server_start( server, NETCODE_MAX_CLIENTS );
+
+    signal( SIGINT, interrupt_handler );
+
+    while ( !quit )
+    {
+        netcode_server_update( server, time );
+
+        int client_index;
+        for ( client_index = 0; client_index < NETCODE_MAX_CLIENTS; ++client_index )
+        {
+            while ( 1 )             
+            {
+                int packet_bytes;
+                uint64_t packet_sequence;
+                void * packet = netcode_server_receive_packet( server, client_index, &packet_bytes, &packet_sequence );
+                if ( !packet )
+                    break;
+                (void) packet_bytes;
+                (void) packet_sequence;
+                netcode_server_free_packet( server, packet );
+            }
+        }
+
+        netcode_sleep( delta_time );
+
+        time += delta_time;
+    }
+
+    if ( quit )
+    {
+        printf( "\nshutting down\n" );
+    }
+
+    printf( "%" PRIu64 " connection requests source filtered\n", netcode_server_counters( server )[NETCODE_SERVER_COUNTER_SOURCE_FILTERED] );
+
+    netcode_server_destroy( server );
+
+    netcode_term();
+
+    MMDB_close( &filter.mmdb );
+    
+    return 0;
+}
@@ -0,0 +1,259 @@
+
+/*
+    netcode.io reference implementation
+
+    Copyright © 2017, The Network Protocol Company, Inc.
+
+    Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+        1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+        2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer 
+           in the documentation and/or other materials provided with the distribution.
+
+        3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived 
+           from this software without specific prior written permission.
+
+    THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, 
+    INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE 
+    DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, 
+    SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR 
+    SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, 
+    WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE
+    USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+#include "netcode.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <inttypes.h>
+
+#define CONNECT_TOKEN_EXPIRY 30
+#define CONNECT_TOKEN_TIMEOUT 5
+#define PROTOCOL_ID 0x1122334455667788
+
+// the same key as the client and server examples, so a token minted with no key file connects to ./bin/server
+
+static uint8_t private_key[NETCODE_KEY_BYTES] = { 0x60, 0x6a, 0xbe, 0x6e, 0xc9, 0x19, 0x10, 0xea, 
+                                                  0x9a, 0x65, 0x62, 0xf6, 0x6f, 0x2b, 0x30, 0xe4, 
+                                                  0x43, 0x71, 0xd6, 0x2c, 0xd1, 0x99, 0x27, 0x26,
+                                                  0x6b, 0x3c, 0x60, 0xf4, 0xb7, 0x15, 0xab, 0xa1 };
+
+void usage()
+{
+    printf( "usage: token [options]\n\n" );
+    printf( "mints a connect token and prints it as base64\n\n" );
+    printf( "    -client-id <id>        client id, decimal or 0x hex (default: random)\n" );
+    printf( "    -server <address>      server address. repeat for up to %d servers (default: 127.0.0.1:40000)\n", NETCODE_MAX_SERVERS_PER_CONNECT );
+    printf( "    -internal <address>    address the server checks against, if it differs from the address clients connect to. one per -server\n" );
+    printf( "    -protocol-id <id>      protocol id, decimal or 0x hex (default: 0x%" PRIx64 ")\n", (uint64_t) PROTOCOL_ID );
+    printf( "    -expire <seconds>      seconds until the token expires (default: %d)\n", CONNECT_TOKEN_EXPIRY );
+    printf( "    -timeout <seconds>     connection timeout in seconds. negative disables timeouts (default: %d)\n", CONNECT_TOKEN_TIMEOUT );
+    printf( "    -key-file <path>       private key, as %d raw bytes or base64 (default: the example key)\n", NETCODE_KEY_BYTES );
+}
+
+int parse_uint64( NETCODE_CONST char * string, uint64_t * value )
+{
+    char * end = NULL;
+    *value = (uint64_t) strtoull( string, &end, 0 );
+    return end != string && *end == '\0';
+}
+
+int parse_int( NETCODE_CONST char * string, int * value )
+{
+    char * end = NULL;
+    *value = (int) strtol( string, &end, 10 );
+    return end != string && *end == '\0';
+}
+
+int read_key_file( NETCODE_CONST char * path, uint8_t * key )
+{
+    FILE * file = fopen( path, "rb" );
+    if ( !file )
+        return 0;
+
+    char buffer[256];
+    int bytes_read = (int) fread( buffer, 1, sizeof( buffer ) - 1, file );
+    fclose( file );
+
+    if ( bytes_read == NETCODE_KEY_BYTES )
+    {
+        memcpy( key, buffer, NETCODE_KEY_BYTES );
+        return 1;
+    }
+
+    // anything else must be the base64 encoded key, maybe with a trailing newline
+
+    while ( bytes_read > 0 && ( buffer[bytes_read-1] == '\n' || buffer[bytes_read-1] == '\r' || buffer[bytes_read-1] == ' ' ) )
+        bytes_read--;
+
+    buffer[bytes_read] = '\0';
+
+    uint8_t decoded[NETCODE_KEY_BYTES+2];
+
+    if ( netcode_base64_decode_data( buffer, decoded, sizeof( decoded ) ) != NETCODE_KEY_BYTES )
+        return 0;
+
+    memcpy( key, decoded, NETCODE_KEY_BYTES );
+
+    return 1;
+}
+
+int main( int argc, char ** argv )
+{
+    uint64_t client_id = 0;
+    int random_client_id = 1;
+    uint64_t protocol_id = PROTOCOL_ID;
+    int expire_seconds = CONNECT_TOKEN_EXPIRY;
+    int timeout_seconds = CONNECT_TOKEN_TIMEOUT;
+    int num_server_addresses = 0;
+    int num_internal_addresses = 0;
+    NETCODE_CONST char * server_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
+    NETCODE_CONST char * internal_addresses[NETCODE_MAX_SERVERS_PER_CONNECT];
+
+    int i;
+    for ( i = 1; i < argc; ++i )
+    {
+        NETCODE_CONST char * option = argv[i];
+
+        if ( strcmp( option, "-h" ) == 0 || strcmp( option, "-help" ) == 0 )
+        {
+            usage();
+            return 0;
+        }
+
+        if ( i + 1 >= argc )
+        {
+            fprintf( stderr, "error: missing value for %s\n", option );
+            return 1;
+        }
+
+        NETCODE_CONST char * value = argv[++i];
+
+        if ( strcmp( option, "-client-id" ) == 0 )
+        {
+            if ( !parse_uint64( value, &client_id ) )
+            {
+                fprintf( stderr, "error: bad client id '%s'\n", value );
+                return 1;
+            }
+            random_client_id = 0;
+        }
+        else if ( strcmp( option, "-server" ) == 0 || strcmp( option, "-internal" ) == 0 )
+        {
+            int internal = strcmp( option, "-internal" ) == 0;
+            int * num_addresses = internal ? &num_internal_addresses : &num_server_addresses;
+            if ( *num_addresses == NETCODE_MAX_SERVERS_PER_CONNECT )
+            {
+                fprintf( stderr, "error: too many server addresses. the limit is %d\n", NETCODE_MAX_SERVERS_PER_CONNECT );
+                return 1;
+            }
+            struct netcode_address_t address;
+            if ( netcode_parse_address( value, &address ) != NETCODE_OK )
+            {
+                fprintf( stderr, "error: bad server address '%s'\n", value );
+                return 1;
+            }
+            if ( internal )
+                internal_addresses[(*num_addresses)++] = value;
+            else
+                server_addresses[(*num_addresses)++] = value;
+        }
+        else if ( strcmp( option, "-protocol-id" ) == 0 )
+        {
+            if ( !parse_uint64( value, &protocol_id ) )
+            {
+                fprintf( stderr, "error: bad protocol id '%s'\n", value );
+                return 1;
+            }
+        }
+        else if ( strcmp( option, "-expire" ) == 0 )
+        {
+            if ( !parse_int( value, &expire_seconds ) || expire_seconds <= 0 )
+            {
+                fprintf( stderr, "error: bad expire seconds '%s'\n", value );
+                return 1;
+            }
+        }
+        else if ( strcmp( option, "-timeout" ) == 0 )
+        {
+            if ( !parse_int( value, &timeout_seconds ) || timeout_seconds == 0 )
+            {
+                fprintf( stderr, "error: bad timeout seconds '%s'\n", value );
+                return 1;
+            }
+        }
+        else if ( strcmp( option, "-key-file" ) == 0 )
+        {
+            if ( !read_key_file( value, private_key ) )
+            {
+                fprintf( stderr, "error: could not read a %d byte private key from '%s'\n", NETCODE_KEY_BYTES, value );
+                return 1;
+            }
+        }
+        else
+        {
+            fprintf( stderr, "error: unknown option %s\n\n", option );
+            usage();
+            return 1;
+        }
+    }
+
+    if ( num_server_addresses == 0 )
+    {
+        server_addresses[num_server_addresses++] = "127.0.0.1:40000";
+    }
+
+    if ( num_internal_addresses != 0 && num_internal_addresses != num_server_addresses )
+    {
+        fprintf( stderr, "error: need one -internal address per -server address\n" );
+        return 1;
+    }
+
+    if ( netcode_init() != NETCODE_OK )
+    {
+        fprintf( stderr, "error: failed to initialize netcode.io\n" );
+        return 1;
+    }
+
+    netcode_log_level( NETCODE_LOG_LEVEL_ERROR );
+
+    if ( random_client_id )
+    {
+        netcode_random_bytes( (uint8_t*) &client_id, 8 );
+    }
+
+    uint8_t connect_token[NETCODE_CONNECT_TOKEN_BYTES];
+
+    if ( netcode_generate_connect_token( num_server_addresses, 
+                                         server_addresses, 
+                                         num_internal_addresses ? internal_addresses : server_addresses, 
+                                         expire_seconds, 
+                                         timeout_seconds, 
+                                         client_id, 
+                                         protocol_id, 
+                                         private_key, 
+                                         NULL, 
+                                         connect_token ) != NETCODE_OK )
+    {
+        fprintf( stderr, "error: failed to generate connect token\n" );
+        netcode_term();
+        return 1;
+    }
+
+    char connect_token_base64[NETCODE_CONNECT_TOKEN_BASE64_BYTES];
+
+    if ( netcode_base64_encode_data( connect_token, NETCODE_CONNECT_TOKEN_BYTES, connect_token_base64, sizeof( connect_token_base64 ) ) < 0 )
+    {
+        fprintf( stderr, "error: failed to encode connect token\n" );
+        netcode_term();
+        return 1;
+    }
+
+    printf( "%s\n", connect_token_base64 );
+
+    netcode_term();
+
+    return 0;
+}